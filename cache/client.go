@@ -0,0 +1,316 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	defaultSize = 10000
+	defaultTTL  = 5 * time.Minute
+)
+
+// Backend represents the eth client to be cached. Both ethclient.Client and
+// multiclient.Client implement it.
+type Backend interface {
+	BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error)
+	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+	HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error)
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+	StorageAt(ctx context.Context, account common.Address, key common.Hash, blockNumber *big.Int) ([]byte, error)
+	CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+	CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error
+}
+
+// Client caches the immutable results of the backend. The calls to the latest or
+// pending state are always passed through to the backend.
+type Client struct {
+	Backend
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	size  int
+	ttl   time.Duration
+	store *store
+	heads *headTracker
+}
+
+// New creates a caching client on top of the given backend.
+func New(backend Backend, opts ...Option) (*Client, error) {
+	// create client own context to control the internal go routines
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{
+		Backend: backend,
+		ctx:     ctx,
+		cancel:  cancel,
+		size:    defaultSize,
+		ttl:     defaultTTL,
+	}
+
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	c.store, err = newStore(c.size, c.ttl)
+	if err != nil {
+		return nil, err
+	}
+	if c.heads != nil {
+		c.wg.Add(1)
+		go c.watchReorg()
+	}
+	return c, nil
+}
+
+// Close stops watching the chain reorganizations.
+func (c *Client) Close() {
+	c.cancel()
+	c.wg.Wait()
+}
+
+// Purge removes all cached results.
+func (c *Client) Purge() {
+	c.store.purge()
+}
+
+// BlockByHash returns the given full block.
+func (c *Client) BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
+	key := "blockByHash:" + hash.Hex()
+	if v, ok := c.store.get(key); ok {
+		return copyBlock(v.(*types.Block)), nil
+	}
+	block, err := c.Backend.BlockByHash(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	c.store.addImmutable(key, block)
+	return copyBlock(block), nil
+}
+
+// BlockByNumber returns a block from the current canonical chain. If number is nil, the
+// latest known block is returned and it's not cached.
+func (c *Client) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	if number == nil {
+		return c.Backend.BlockByNumber(ctx, number)
+	}
+	key := "blockByNumber:" + number.String()
+	if v, ok := c.store.get(key); ok {
+		return copyBlock(v.(*types.Block)), nil
+	}
+	block, err := c.Backend.BlockByNumber(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	c.store.addNumberSensitive(key, block, number.Uint64())
+	return copyBlock(block), nil
+}
+
+// HeaderByHash returns the block header with the given hash.
+func (c *Client) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	key := "headerByHash:" + hash.Hex()
+	if v, ok := c.store.get(key); ok {
+		return types.CopyHeader(v.(*types.Header)), nil
+	}
+	header, err := c.Backend.HeaderByHash(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	c.store.addImmutable(key, header)
+	return types.CopyHeader(header), nil
+}
+
+// HeaderByNumber returns a block header from the current canonical chain. If number is
+// nil, the latest known header is returned and it's not cached.
+func (c *Client) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if number == nil {
+		return c.Backend.HeaderByNumber(ctx, number)
+	}
+	key := "headerByNumber:" + number.String()
+	if v, ok := c.store.get(key); ok {
+		return types.CopyHeader(v.(*types.Header)), nil
+	}
+	header, err := c.Backend.HeaderByNumber(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	c.store.addNumberSensitive(key, header, number.Uint64())
+	return types.CopyHeader(header), nil
+}
+
+// TransactionByHash returns the transaction with the given hash. Only the mined
+// transactions are cached, and they are invalidated if their blocks are reorganized.
+func (c *Client) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	// The transaction doesn't contain the block number, so get it through the generic
+	// call which caches the mined transaction with the block number in the raw result.
+	var raw json.RawMessage
+	if err := c.CallContext(ctx, &raw, "eth_getTransactionByHash", hash); err != nil {
+		return nil, false, err
+	}
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, false, ethereum.NotFound
+	}
+	tx := new(types.Transaction)
+	if err := json.Unmarshal(raw, tx); err != nil {
+		return nil, false, err
+	}
+	if _, r, _ := tx.RawSignatureValues(); r == nil {
+		return nil, false, errors.New("server returned transaction without signature")
+	}
+	_, mined := minedBlockNumber(raw)
+	return tx, !mined, nil
+}
+
+// TransactionReceipt returns the receipt of a transaction by transaction hash. The
+// receipt is invalidated if its block is reorganized.
+func (c *Client) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	// The receipt doesn't contain the block number, so get it through the generic
+	// call which caches the receipt with the block number in the raw result.
+	var r *types.Receipt
+	err := c.CallContext(ctx, &r, "eth_getTransactionReceipt", txHash)
+	if err == nil && r == nil {
+		return nil, ethereum.NotFound
+	}
+	return r, err
+}
+
+// BalanceAt returns the wei balance of the given account.
+// The block number can be nil, in which case the balance is taken from the latest known block.
+func (c *Client) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	if blockNumber == nil {
+		return c.Backend.BalanceAt(ctx, account, blockNumber)
+	}
+	key := fmt.Sprintf("balanceAt:%s:%s", account.Hex(), blockNumber)
+	if v, ok := c.store.get(key); ok {
+		return new(big.Int).Set(v.(*big.Int)), nil
+	}
+	balance, err := c.Backend.BalanceAt(ctx, account, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	c.store.addNumberSensitive(key, new(big.Int).Set(balance), blockNumber.Uint64())
+	return balance, nil
+}
+
+// StorageAt returns the value of key in the contract storage of the given account.
+// The block number can be nil, in which case the value is taken from the latest known block.
+func (c *Client) StorageAt(ctx context.Context, account common.Address, key common.Hash, blockNumber *big.Int) ([]byte, error) {
+	if blockNumber == nil {
+		return c.Backend.StorageAt(ctx, account, key, blockNumber)
+	}
+	cacheKey := fmt.Sprintf("storageAt:%s:%s:%s", account.Hex(), key.Hex(), blockNumber)
+	if v, ok := c.store.get(cacheKey); ok {
+		return common.CopyBytes(v.([]byte)), nil
+	}
+	value, err := c.Backend.StorageAt(ctx, account, key, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	c.store.addNumberSensitive(cacheKey, common.CopyBytes(value), blockNumber.Uint64())
+	return value, nil
+}
+
+// CodeAt returns the contract code of the given account.
+// The block number can be nil, in which case the code is taken from the latest known block.
+func (c *Client) CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error) {
+	if blockNumber == nil {
+		return c.Backend.CodeAt(ctx, account, blockNumber)
+	}
+	key := fmt.Sprintf("codeAt:%s:%s", account.Hex(), blockNumber)
+	if v, ok := c.store.get(key); ok {
+		return common.CopyBytes(v.([]byte)), nil
+	}
+	code, err := c.Backend.CodeAt(ctx, account, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	c.store.addNumberSensitive(key, common.CopyBytes(code), blockNumber.Uint64())
+	return code, nil
+}
+
+// NonceAt returns the account nonce of the given account.
+// The block number can be nil, in which case the nonce is taken from the latest known block.
+func (c *Client) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	if blockNumber == nil {
+		return c.Backend.NonceAt(ctx, account, blockNumber)
+	}
+	key := fmt.Sprintf("nonceAt:%s:%s", account.Hex(), blockNumber)
+	if v, ok := c.store.get(key); ok {
+		return v.(uint64), nil
+	}
+	nonce, err := c.Backend.NonceAt(ctx, account, blockNumber)
+	if err != nil {
+		return 0, err
+	}
+	c.store.addNumberSensitive(key, nonce, blockNumber.Uint64())
+	return nonce, nil
+}
+
+// CallContract executes a message call transaction, which is directly executed in the VM
+// of the node, but never mined into the blockchain.
+//
+// The block number can be nil, in which case the call runs at the latest known block
+// and it's not cached.
+func (c *Client) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	if blockNumber == nil {
+		return c.Backend.CallContract(ctx, msg, blockNumber)
+	}
+	key := fmt.Sprintf("callContract:%s:%s", callMsgKey(msg), blockNumber)
+	if v, ok := c.store.get(key); ok {
+		return common.CopyBytes(v.([]byte)), nil
+	}
+	result, err := c.Backend.CallContract(ctx, msg, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	c.store.addNumberSensitive(key, common.CopyBytes(result), blockNumber.Uint64())
+	return result, nil
+}
+
+func callMsgKey(msg ethereum.CallMsg) string {
+	to := "nil"
+	if msg.To != nil {
+		to = msg.To.Hex()
+	}
+	return fmt.Sprintf("%s:%s:%d:%s:%s:%s", msg.From.Hex(), to, msg.Gas, msg.GasPrice, msg.Value, hexutil.Encode(msg.Data))
+}
+
+// copyBlock copies the block, so the callers cannot modify the cached block.
+func copyBlock(block *types.Block) *types.Block {
+	return block.WithBody(block.Transactions(), block.Uncles())
+}
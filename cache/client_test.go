@@ -0,0 +1,198 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// fakeBackend counts the calls and returns the given results.
+type fakeBackend struct {
+	Backend
+
+	blocks  map[common.Hash]*types.Block
+	balance *big.Int
+	// results are the raw results of CallContext keyed by method
+	results map[string]string
+
+	calls map[string]int
+	lock  sync.Mutex
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		blocks:  make(map[common.Hash]*types.Block),
+		balance: big.NewInt(100),
+		results: make(map[string]string),
+		calls:   make(map[string]int),
+	}
+}
+
+func (b *fakeBackend) called(method string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.calls[method]
+}
+
+func (b *fakeBackend) call(method string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.calls[method]++
+}
+
+func (b *fakeBackend) BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
+	b.call("BlockByHash")
+	return b.blocks[hash], nil
+}
+
+func (b *fakeBackend) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	b.call("HeaderByHash")
+	return b.blocks[hash].Header(), nil
+}
+
+func (b *fakeBackend) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	b.call("BalanceAt")
+	return new(big.Int).Set(b.balance), nil
+}
+
+func (b *fakeBackend) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	b.call(method)
+	raw, ok := b.results[method]
+	if !ok {
+		raw = "null"
+	}
+	return json.Unmarshal([]byte(raw), result)
+}
+
+func newTestBlock() *types.Block {
+	header := &types.Header{Number: big.NewInt(1), Extra: []byte("test")}
+	txs := []*types.Transaction{
+		types.NewTransaction(0, common.Address{1}, big.NewInt(1), 21000, big.NewInt(1), nil),
+		types.NewTransaction(1, common.Address{2}, big.NewInt(2), 21000, big.NewInt(1), nil),
+	}
+	return types.NewBlock(header, txs, nil, nil)
+}
+
+func TestCallContextPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		args   []interface{}
+		result string
+		calls  int
+	}{
+		{"immutable", "eth_getBlockByHash", []interface{}{common.Hash{1}, true}, `{"number":"0x1"}`, 1},
+		{"not found", "eth_getBlockByHash", []interface{}{common.Hash{2}, true}, `null`, 2},
+		{"unknown method", "eth_blockNumber", nil, `"0x1"`, 2},
+		{"write method", "eth_sendRawTransaction", []interface{}{"0x00"}, `"0x01"`, 2},
+		{"number", "eth_getBalance", []interface{}{common.Address{1}, "0x1"}, `"0x64"`, 1},
+		{"latest", "eth_getBalance", []interface{}{common.Address{1}, "latest"}, `"0x64"`, 2},
+		{"pending", "eth_call", []interface{}{map[string]interface{}{}, "pending"}, `"0x"`, 2},
+		{"mined", "eth_getTransactionReceipt", []interface{}{common.Hash{1}}, `{"blockNumber":"0x1"}`, 1},
+		{"not mined", "eth_getTransactionByHash", []interface{}{common.Hash{1}}, `{"blockNumber":null}`, 2},
+	}
+	for _, test := range tests {
+		backend := newFakeBackend()
+		backend.results[test.method] = test.result
+		c, err := New(backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			var raw json.RawMessage
+			if err := c.CallContext(context.Background(), &raw, test.method, test.args...); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if string(raw) != test.result {
+				t.Fatalf("%s: got result %s, want %s", test.name, raw, test.result)
+			}
+		}
+		if n := backend.called(test.method); n != test.calls {
+			t.Fatalf("%s: got %d backend calls, want %d", test.name, n, test.calls)
+		}
+		c.Close()
+	}
+}
+
+func TestCopyOnRead(t *testing.T) {
+	backend := newFakeBackend()
+	block := newTestBlock()
+	backend.blocks[block.Hash()] = block
+	c, err := New(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	// the callers modify the results of both the missed and the hit calls
+	for i := 0; i < 2; i++ {
+		b, err := c.BlockByHash(ctx, block.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs := b.Transactions()
+		txs[0], txs[1] = txs[1], txs[0]
+
+		h, err := c.HeaderByHash(ctx, block.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Number.SetUint64(100)
+		h.Extra[0] = 'x'
+
+		balance, err := c.BalanceAt(ctx, common.Address{1}, big.NewInt(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		balance.SetUint64(0)
+	}
+
+	b, err := c.BlockByHash(ctx, block.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.Transactions()[0].Hash(), block.Transactions()[0].Hash(); got != want {
+		t.Fatalf("got transaction %x, want %x", got, want)
+	}
+	h, err := c.HeaderByHash(ctx, block.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Hash() != block.Hash() {
+		t.Fatalf("got header %x, want %x", h.Hash(), block.Hash())
+	}
+	balance, err := c.BalanceAt(ctx, common.Address{1}, big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Cmp(backend.balance) != 0 {
+		t.Fatalf("got balance %v, want %v", balance, backend.balance)
+	}
+	for _, method := range []string{"BlockByHash", "HeaderByHash", "BalanceAt"} {
+		if n := backend.called(method); n != 1 {
+			t.Fatalf("%s: got %d backend calls, want 1", method, n)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"errors"
+	"time"
+
+	"github.com/getamis/sirius/log"
+
+	"github.com/getamis/hypereth/multiclient"
+)
+
+var (
+	ErrInvalidSize = errors.New("invalid cache size")
+	ErrInvalidTTL  = errors.New("invalid cache ttl")
+)
+
+// Option represents a Client option
+type Option func(*Client) error
+
+// Size sets the maximum number of cached results. Default is 10000.
+func Size(size int) Option {
+	return func(c *Client) error {
+		if size <= 0 {
+			return ErrInvalidSize
+		}
+		c.size = size
+		return nil
+	}
+}
+
+// TTL sets the lifetime of block-number-sensitive results, e.g. the balance at a
+// given block number. Default is 5 minutes.
+func TTL(ttl time.Duration) Option {
+	return func(c *Client) error {
+		if ttl <= 0 {
+			return ErrInvalidTTL
+		}
+		c.ttl = ttl
+		return nil
+	}
+}
+
+// InvalidateOnReorg watches the new heads of the given multiclient and invalidates the
+// block-number-sensitive results if the blocks are reorganized.
+func InvalidateOnReorg(mc *multiclient.Client) Option {
+	return func(c *Client) error {
+		log.Info("Invalidate cache on chain reorganization")
+		c.heads = newHeadTracker(mc)
+		return nil
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"context"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/getamis/sirius/log"
+
+	"github.com/getamis/hypereth/multiclient"
+)
+
+const (
+	// maxReorgDepth is the number of recent canonical blocks to track.
+	maxReorgDepth = 64
+	retryPeriod   = 10 * time.Second
+)
+
+// headReader is the source of the new heads, e.g. multiclient.Client.
+type headReader interface {
+	HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error)
+	SubscribeNewHead(ctx context.Context, ch chan<- *multiclient.Header) (ethereum.Subscription, error)
+}
+
+// headTracker tracks the recent canonical blocks to detect chain reorganizations.
+type headTracker struct {
+	client    headReader
+	canonical map[uint64]common.Hash
+	highest   uint64
+}
+
+func newHeadTracker(client headReader) *headTracker {
+	return &headTracker{
+		client:    client,
+		canonical: make(map[uint64]common.Hash),
+	}
+}
+
+// update records the given head as canonical and returns the lowest block number
+// which is reorganized. The heads not above the highest one are ignored unless they
+// replace the known canonical blocks, e.g. the stale heads of a lagging eth client.
+func (t *headTracker) update(ctx context.Context, header *types.Header) (fork uint64, reorged bool) {
+	number := header.Number.Uint64()
+	known, ok := t.canonical[number]
+	if ok && known == header.Hash() {
+		// The head is already known, e.g. it's received from another eth client.
+		return 0, false
+	}
+	if !ok && number <= t.highest && len(t.canonical) > 0 {
+		// The head is too old to be tracked or it's behind the tracked chain.
+		return 0, false
+	}
+	if ok {
+		fork, reorged = number, true
+	}
+	t.canonical[number] = header.Hash()
+
+	// Walk back the new chain until it meets the known canonical chain.
+	parentHash := header.ParentHash
+	for n := number; n > 0 && number-n < maxReorgDepth; n-- {
+		known, ok := t.canonical[n-1]
+		if !ok || known == parentHash {
+			break
+		}
+		fork, reorged = n-1, true
+		t.canonical[n-1] = parentHash
+
+		parent, err := t.client.HeaderByHash(ctx, parentHash)
+		if err != nil {
+			log.Warn("Failed to get parent header, invalidate all tracked blocks", "hash", parentHash.Hex(), "err", err)
+			fork = t.lowest()
+			break
+		}
+		parentHash = parent.ParentHash
+	}
+
+	// The blocks above the new head are not canonical anymore.
+	for n := number + 1; n <= t.highest; n++ {
+		delete(t.canonical, n)
+	}
+	t.highest = number
+	for n := range t.canonical {
+		if n+maxReorgDepth < number {
+			delete(t.canonical, n)
+		}
+	}
+	return fork, reorged
+}
+
+func (t *headTracker) lowest() uint64 {
+	lowest := t.highest
+	for n := range t.canonical {
+		if n < lowest {
+			lowest = n
+		}
+	}
+	return lowest
+}
+
+func (c *Client) watchReorg() {
+	defer c.wg.Done()
+
+	retryTimer := time.NewTimer(0)
+	defer retryTimer.Stop()
+
+	for {
+		select {
+		case <-retryTimer.C:
+		case <-c.ctx.Done():
+			return
+		}
+
+		err := c.followHeads()
+		if err == nil {
+			return
+		}
+		log.Warn("Failed to subscribe new head for cache invalidation", "err", err)
+		retryTimer.Reset(retryPeriod)
+	}
+}
+
+func (c *Client) followHeads() error {
+	ch := make(chan *multiclient.Header)
+	sub, err := c.heads.client.SubscribeNewHead(c.ctx, ch)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case head := <-ch:
+			fork, reorged := c.heads.update(c.ctx, head.Header)
+			if reorged {
+				log.Info("Chain reorganization detected", "number", head.Number, "hash", head.Hash().Hex(), "fork", fork)
+				c.store.invalidateFrom(fork)
+			}
+		case err := <-sub.Err():
+			return err
+		case <-c.ctx.Done():
+			return nil
+		}
+	}
+}
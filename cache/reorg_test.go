@@ -0,0 +1,223 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+
+	"github.com/getamis/hypereth/multiclient"
+)
+
+// fakeHeads serves the headers of the test chains and feeds the new heads.
+type fakeHeads struct {
+	headers map[common.Hash]*types.Header
+	feed    event.Feed
+}
+
+func newFakeHeads() *fakeHeads {
+	return &fakeHeads{headers: make(map[common.Hash]*types.Header)}
+}
+
+func (f *fakeHeads) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	h, ok := f.headers[hash]
+	if !ok {
+		return nil, ethereum.NotFound
+	}
+	return h, nil
+}
+
+func (f *fakeHeads) SubscribeNewHead(ctx context.Context, ch chan<- *multiclient.Header) (ethereum.Subscription, error) {
+	return f.feed.Subscribe(ch), nil
+}
+
+// chain creates n headers on top of the given parent. The fork is the extra data
+// to tell the forks apart.
+func (f *fakeHeads) chain(parent *types.Header, n int, fork string) []*types.Header {
+	var headers []*types.Header
+	for i := 0; i < n; i++ {
+		h := &types.Header{
+			Number:     new(big.Int).Add(parent.Number, big.NewInt(1)),
+			ParentHash: parent.Hash(),
+			Extra:      []byte(fork),
+		}
+		f.headers[h.Hash()] = h
+		headers = append(headers, h)
+		parent = h
+	}
+	return headers
+}
+
+func TestHeadTrackerUpdate(t *testing.T) {
+	f := newFakeHeads()
+	genesis := &types.Header{Number: big.NewInt(0)}
+	f.headers[genesis.Hash()] = genesis
+	// main: 1 - 10, side: 8' - 11', tip: 10'', stale: 7''' - 9'''
+	main := append([]*types.Header{genesis}, f.chain(genesis, 10, "main")...)
+	side := f.chain(main[7], 4, "side")
+	tip := f.chain(main[9], 1, "tip")
+	stale := f.chain(main[6], 3, "stale")
+
+	type step struct {
+		head    *types.Header
+		fork    uint64
+		reorged bool
+		highest uint64
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			"extend",
+			[]step{{main[1], 0, false, 1}, {main[2], 0, false, 2}, {main[3], 0, false, 3}},
+		},
+		{
+			"duplicate",
+			[]step{{main[5], 0, false, 5}, {main[5], 0, false, 5}, {main[6], 0, false, 6}},
+		},
+		{
+			"lagging",
+			[]step{{main[8], 0, false, 8}, {main[9], 0, false, 9}, {main[10], 0, false, 10}, {main[8], 0, false, 10}, {main[9], 0, false, 10}},
+		},
+		{
+			"untracked",
+			[]step{{main[8], 0, false, 8}, {main[9], 0, false, 9}, {main[10], 0, false, 10}, {main[5], 0, false, 10}},
+		},
+		{
+			"same height",
+			[]step{{main[9], 0, false, 9}, {main[10], 0, false, 10}, {tip[0], 10, true, 10}},
+		},
+		{
+			"deeper",
+			[]step{{main[8], 0, false, 8}, {main[9], 0, false, 9}, {main[10], 0, false, 10}, {side[3], 8, true, 11}, {main[10], 8, true, 10}},
+		},
+		{
+			"shorter",
+			[]step{{main[7], 0, false, 7}, {main[8], 0, false, 8}, {main[9], 0, false, 9}, {main[10], 0, false, 10}, {stale[2], 7, true, 9}},
+		},
+	}
+	for _, test := range tests {
+		tracker := newHeadTracker(f)
+		for i, s := range test.steps {
+			fork, reorged := tracker.update(context.Background(), s.head)
+			if fork != s.fork || reorged != s.reorged {
+				t.Fatalf("%s: step %d: got fork %d and reorged %v, want %d and %v", test.name, i, fork, reorged, s.fork, s.reorged)
+			}
+			if tracker.highest != s.highest {
+				t.Fatalf("%s: step %d: got highest %d, want %d", test.name, i, tracker.highest, s.highest)
+			}
+			if h := tracker.canonical[tracker.highest]; reorged && h != s.head.Hash() {
+				t.Fatalf("%s: step %d: got canonical head %x, want %x", test.name, i, h, s.head.Hash())
+			}
+		}
+	}
+}
+
+func TestInvalidateOnReorg(t *testing.T) {
+	backend := newFakeBackend()
+	backend.results["eth_getBalance"] = `"0x64"`
+	backend.results["eth_getTransactionReceipt"] = `{"blockNumber":"0x2"}`
+	backend.results["eth_getBlockByHash"] = `{"number":"0x2"}`
+	c, err := New(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	f := newFakeHeads()
+	c.heads = newHeadTracker(f)
+	c.wg.Add(1)
+	go c.watchReorg()
+
+	genesis := &types.Header{Number: big.NewInt(0)}
+	main := f.chain(genesis, 3, "main")
+	side := f.chain(main[0], 3, "side")
+	// send waits for the subscription of the client. The head is received by the client
+	// once it's sent, and it's processed once the next one is sent.
+	send := func(h *types.Header) {
+		for f.feed.Send(&multiclient.Header{Header: h}) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for _, h := range main {
+		send(h)
+	}
+	send(main[2])
+
+	ctx := context.Background()
+	calls := []struct {
+		method string
+		args   []interface{}
+	}{
+		{"eth_getBalance", []interface{}{common.Address{1}, "0x1"}},
+		{"eth_getBalance", []interface{}{common.Address{1}, "0x2"}},
+		{"eth_getTransactionReceipt", []interface{}{common.Hash{1}}},
+		{"eth_getBlockByHash", []interface{}{main[1].Hash(), false}},
+	}
+	for _, call := range calls {
+		if err := c.CallContext(ctx, nil, call.method, call.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the reorg from block 2 is processed after the next head
+	send(side[2])
+	send(side[2])
+	for _, call := range calls {
+		if err := c.CallContext(ctx, nil, call.method, call.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		method string
+		calls  int
+	}{
+		// only the balance at block 2 is refetched
+		{"eth_getBalance", 3},
+		{"eth_getTransactionReceipt", 2},
+		{"eth_getBlockByHash", 1},
+	} {
+		if n := backend.called(test.method); n != test.calls {
+			t.Fatalf("%s: got %d backend calls, want %d", test.method, n, test.calls)
+		}
+	}
+}
+
+func TestHeadTrackerMissingParent(t *testing.T) {
+	f := newFakeHeads()
+	genesis := &types.Header{Number: big.NewInt(0)}
+	main := f.chain(genesis, 5, "main")
+	side := f.chain(main[0], 4, "side")
+	delete(f.headers, side[1].Hash())
+
+	tracker := newHeadTracker(f)
+	for _, h := range main {
+		tracker.update(context.Background(), h)
+	}
+	// the parent of block 3' is unknown, so all tracked blocks are invalidated
+	fork, reorged := tracker.update(context.Background(), side[3])
+	if !reorged || fork != 1 {
+		t.Fatalf("got fork %d and reorged %v, want %d and %v", fork, reorged, 1, true)
+	}
+}
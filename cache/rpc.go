@@ -0,0 +1,151 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+type cachePolicy int
+
+const (
+	// noCache means the result may change at any time, e.g. the latest block.
+	noCache cachePolicy = iota
+	// immutable means the result never changes once it's available, e.g. the block of a hash.
+	immutable
+	// mined means the result is immutable once it's mined in the block specified by
+	// the "blockNumber" field of the result, e.g. the receipt of a transaction.
+	mined
+	// numberSensitive means the result depends on the block number given in arguments.
+	numberSensitive
+)
+
+type methodPolicy struct {
+	policy cachePolicy
+	// numberArg is the index of the block number argument for the numberSensitive methods.
+	numberArg int
+}
+
+// methodPolicies defines how to cache the results of known JSON-RPC methods.
+var methodPolicies = map[string]methodPolicy{
+	"eth_getBlockByHash":                      {policy: immutable},
+	"eth_getBlockTransactionCountByHash":      {policy: immutable},
+	"eth_getTransactionByBlockHashAndIndex":   {policy: immutable},
+	"eth_getUncleByBlockHashAndIndex":         {policy: immutable},
+	"eth_getUncleCountByBlockHash":            {policy: immutable},
+	"eth_getTransactionByHash":                {policy: mined},
+	"eth_getTransactionReceipt":               {policy: mined},
+	"eth_getBlockByNumber":                    {policy: numberSensitive, numberArg: 0},
+	"eth_getBlockTransactionCountByNumber":    {policy: numberSensitive, numberArg: 0},
+	"eth_getTransactionByBlockNumberAndIndex": {policy: numberSensitive, numberArg: 0},
+	"eth_getUncleByBlockNumberAndIndex":       {policy: numberSensitive, numberArg: 0},
+	"eth_getUncleCountByBlockNumber":          {policy: numberSensitive, numberArg: 0},
+	"eth_getBalance":                          {policy: numberSensitive, numberArg: 1},
+	"eth_getCode":                             {policy: numberSensitive, numberArg: 1},
+	"eth_getTransactionCount":                 {policy: numberSensitive, numberArg: 1},
+	"eth_call":                                {policy: numberSensitive, numberArg: 1},
+	"eth_getStorageAt":                        {policy: numberSensitive, numberArg: 2},
+}
+
+// CallContext performs a JSON-RPC call with the given arguments. The results of the
+// known immutable methods are cached, and other calls are passed through to the backend.
+func (c *Client) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	mp, ok := methodPolicies[method]
+	if !ok {
+		return c.Backend.CallContext(ctx, result, method, args...)
+	}
+
+	var number uint64
+	if mp.policy == numberSensitive {
+		if number, ok = blockNumberArg(args, mp.numberArg); !ok {
+			return c.Backend.CallContext(ctx, result, method, args...)
+		}
+	}
+
+	rawArgs, err := json.Marshal(args)
+	if err != nil {
+		return c.Backend.CallContext(ctx, result, method, args...)
+	}
+	key := "rpc:" + method + ":" + string(rawArgs)
+	if v, ok := c.store.get(key); ok {
+		return unmarshalResult(v.(json.RawMessage), result)
+	}
+
+	var raw json.RawMessage
+	if err := c.Backend.CallContext(ctx, &raw, method, args...); err != nil {
+		return err
+	}
+	// The result may be available later, don't cache it.
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return unmarshalResult(raw, result)
+	}
+
+	switch mp.policy {
+	case immutable:
+		c.store.addImmutable(key, raw)
+	case mined:
+		if n, ok := minedBlockNumber(raw); ok {
+			c.store.addReorgable(key, raw, n)
+		}
+	case numberSensitive:
+		c.store.addNumberSensitive(key, raw, number)
+	}
+	return unmarshalResult(raw, result)
+}
+
+func unmarshalResult(raw json.RawMessage, result interface{}) error {
+	if result == nil || len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, result)
+}
+
+// blockNumberArg returns the explicit block number in arguments. The block tags,
+// e.g. "latest" and "pending", are not considered as block numbers.
+func blockNumberArg(args []interface{}, index int) (uint64, bool) {
+	if index >= len(args) {
+		return 0, false
+	}
+	raw, err := json.Marshal(args[index])
+	if err != nil {
+		return 0, false
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil || !strings.HasPrefix(s, "0x") {
+		return 0, false
+	}
+	n, err := hexutil.DecodeUint64(s)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+func minedBlockNumber(raw json.RawMessage) (uint64, bool) {
+	var r struct {
+		BlockNumber *hexutil.Uint64 `json:"blockNumber"`
+	}
+	if err := json.Unmarshal(raw, &r); err != nil || r.BlockNumber == nil {
+		return 0, false
+	}
+	return uint64(*r.BlockNumber), true
+}
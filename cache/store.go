@@ -0,0 +1,110 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"time"
+
+	"github.com/getamis/sirius/log"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+type entry struct {
+	value interface{}
+	// reorgable represents the value depends on the canonical chain at number, so
+	// it's invalidated when the block at number is reorganized.
+	reorgable bool
+	number    uint64
+	// expireAt is zero if the value never expires.
+	expireAt time.Time
+}
+
+// store is a size-bounded LRU cache. The block-number-sensitive entries expire after ttl.
+type store struct {
+	entries *lru.Cache
+	ttl     time.Duration
+}
+
+func newStore(size int, ttl time.Duration) (*store, error) {
+	entries, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &store{
+		entries: entries,
+		ttl:     ttl,
+	}, nil
+}
+
+func (s *store) get(key string) (interface{}, bool) {
+	v, ok := s.entries.Get(key)
+	if !ok {
+		return nil, false
+	}
+	e := v.(*entry)
+	if !e.expireAt.IsZero() && time.Now().After(e.expireAt) {
+		s.entries.Remove(key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+// addImmutable adds the value which never changes, e.g. the block of a given hash.
+func (s *store) addImmutable(key string, value interface{}) {
+	s.entries.Add(key, &entry{value: value})
+}
+
+// addReorgable adds the value which is immutable unless the block at number is
+// reorganized, e.g. the receipt of a mined transaction.
+func (s *store) addReorgable(key string, value interface{}, number uint64) {
+	s.entries.Add(key, &entry{
+		value:     value,
+		reorgable: true,
+		number:    number,
+	})
+}
+
+// addNumberSensitive adds the value which is queried by a block number, e.g. the
+// balance at a block number. It's invalidated when the block is reorganized or expired.
+func (s *store) addNumberSensitive(key string, value interface{}, number uint64) {
+	s.entries.Add(key, &entry{
+		value:     value,
+		reorgable: true,
+		number:    number,
+		expireAt:  time.Now().Add(s.ttl),
+	})
+}
+
+// invalidateFrom removes all reorgable entries at or above the given block number.
+func (s *store) invalidateFrom(number uint64) {
+	removed := 0
+	for _, key := range s.entries.Keys() {
+		v, ok := s.entries.Peek(key)
+		if !ok {
+			continue
+		}
+		if e := v.(*entry); e.reorgable && e.number >= number {
+			s.entries.Remove(key)
+			removed++
+		}
+	}
+	log.Debug("Cache entries invalidated", "from", number, "count", removed)
+}
+
+func (s *store) purge() {
+	s.entries.Purge()
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStoreEviction(t *testing.T) {
+	s, err := newStore(2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addImmutable("a", 1)
+	s.addImmutable("b", 2)
+	// a becomes the most recently used one
+	if _, ok := s.get("a"); !ok {
+		t.Fatal("a not found")
+	}
+	s.addImmutable("c", 3)
+
+	for _, test := range []struct {
+		key   string
+		found bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+	} {
+		if _, ok := s.get(test.key); ok != test.found {
+			t.Fatalf("%s: got found %v, want %v", test.key, ok, test.found)
+		}
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	s, err := newStore(10, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addImmutable("immutable", 1)
+	s.addReorgable("reorgable", 2, 1)
+	s.addNumberSensitive("numberSensitive", 3, 1)
+	if _, ok := s.get("numberSensitive"); !ok {
+		t.Fatal("number-sensitive entry expired too early")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	for _, test := range []struct {
+		key   string
+		found bool
+	}{
+		{"immutable", true},
+		{"reorgable", true},
+		{"numberSensitive", false},
+	} {
+		if _, ok := s.get(test.key); ok != test.found {
+			t.Fatalf("%s: got found %v, want %v", test.key, ok, test.found)
+		}
+	}
+	if s.entries.Contains("numberSensitive") {
+		t.Fatal("expired entry not removed")
+	}
+}
+
+func TestStoreInvalidateFrom(t *testing.T) {
+	s, err := newStore(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addImmutable("immutable", 1)
+	s.addReorgable("reorgable9", 2, 9)
+	s.addReorgable("reorgable10", 3, 10)
+	s.addNumberSensitive("numberSensitive9", 4, 9)
+	s.addNumberSensitive("numberSensitive11", 5, 11)
+
+	s.invalidateFrom(10)
+	for _, test := range []struct {
+		key   string
+		found bool
+	}{
+		{"immutable", true},
+		{"reorgable9", true},
+		{"reorgable10", false},
+		{"numberSensitive9", true},
+		{"numberSensitive11", false},
+	} {
+		if _, ok := s.get(test.key); ok != test.found {
+			t.Fatalf("%s: got found %v, want %v", test.key, ok, test.found)
+		}
+	}
+}
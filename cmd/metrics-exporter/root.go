@@ -129,7 +129,8 @@ func retryDialEthClient() (*ethclient.Client, error) {
 		client, err := ethclient.DialContext(ctx, ethEndpoint)
 		cancel()
 		if err == nil {
-			return client, nil
+			// Survive the restarts of the ethereum endpoint
+			return client.WithReconnect(ethclient.ReconnectConfig{}), nil
 		}
 		log.Warn("Failed to dial ethereum endpoint and retry", "err", err)
 		select {
@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -35,6 +37,23 @@ const (
 	monitorDurationFlag = "monitor.duration"
 	minPeerCountFlag    = "peercount.min"
 	maxPeerCountFlag    = "peercount.max"
+	staticNodesFlag     = "source.static"
+	nodeFilesFlag       = "source.files"
+	nodeURLsFlag        = "source.urls"
+	publicSourcesFlag   = "source.public"
+	discoveryFlag       = "source.discovery"
+	bootnodesFlag       = "discovery.bootnodes"
+	discoveryAddrFlag   = "discovery.addr"
+	dnsFlag             = "source.dns"
+	dnsTreesFlag        = "dns.trees"
+	verifyFlag          = "verify.handshake"
+	pruneThresholdFlag  = "prune.threshold"
+	pruneMaxFlag        = "prune.max"
+	pruneGraceFlag      = "prune.grace"
+	maxBlockLagFlag     = "score.lag.blocks"
+	lagPenaltyFlag      = "score.lag.penalty"
+	inboundPenaltyFlag  = "score.inbound.penalty"
+	clientPenaltiesFlag = "score.client.penalties"
 )
 
 var (
@@ -45,6 +64,21 @@ var (
 	monitorDuration time.Duration
 	minPeerCount    int
 	maxPeerCount    int
+	// flags for node sources
+	staticNodes   []string
+	nodeFiles     []string
+	nodeURLs      []string
+	publicSources bool
+	discovery     bool
+	bootnodes     []string
+	discoveryAddr string
+	dns           bool
+	dnsTrees      []string
+	// flags for verification
+	verifyHandshake bool
+	// flags for pruning
+	scoreConfig     peermonitor.ScoreConfig
+	clientPenalties []string
 )
 
 var ServerCmd = &cobra.Command{
@@ -52,7 +86,10 @@ var ServerCmd = &cobra.Command{
 	Short: "peer-monitor runs peer monitor",
 	Long:  `The Ethereum peer monitor. Need to open admin api for peer monitor`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		peerMonitor := peermonitor.NewPeerMonitor(ethURL, minPeerCount, maxPeerCount, chainNetwork)
+		peerMonitor, err := newPeerMonitor()
+		if err != nil {
+			return err
+		}
 
 		go func() {
 			sigs := make(chan os.Signal, 1)
@@ -63,7 +100,7 @@ var ServerCmd = &cobra.Command{
 		}()
 
 		log.Info("Ready to monitor")
-		err := peerMonitor.Run(monitorDuration)
+		err = peerMonitor.Run(monitorDuration)
 		if err != nil {
 			log.Error("Stopped unexpectedly", "err", err)
 		}
@@ -77,11 +114,72 @@ var onceCmd = &cobra.Command{
 	Short: "once runs peer monitor once",
 	Long:  `once runs peer monitor once`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		peerMonitor := peermonitor.NewPeerMonitor(ethURL, minPeerCount, maxPeerCount, chainNetwork)
+		peerMonitor, err := newPeerMonitor()
+		if err != nil {
+			return err
+		}
+		defer peerMonitor.Close()
 		return peerMonitor.RunOnce()
 	},
 }
 
+func newPeerMonitor() (*peermonitor.PeerMonitor, error) {
+	var sources []peermonitor.NodeSource
+	if len(staticNodes) > 0 {
+		s, err := peermonitor.NewStaticSource(staticNodes)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, s)
+	}
+	for _, f := range nodeFiles {
+		sources = append(sources, peermonitor.NewFileSource(f))
+	}
+	for _, u := range nodeURLs {
+		sources = append(sources, peermonitor.NewHTTPSource(u))
+	}
+	if discovery {
+		s, err := peermonitor.NewDiscoverySource(chainNetwork, peermonitor.DiscoveryConfig{
+			Bootnodes:  bootnodes,
+			ListenAddr: discoveryAddr,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, s)
+	}
+	if dns {
+		s, err := peermonitor.NewDNSSource(chainNetwork, peermonitor.DNSConfig{
+			Trees: dnsTrees,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, s)
+	}
+	// the public sources are the default if no other source is given
+	if publicSources && len(sources) > 0 {
+		sources = append(sources, peermonitor.NewGistSource(chainNetwork), peermonitor.NewEthernodesSource(chainNetwork))
+	}
+	scoreConfig.ClientPenalties = make(map[string]float64)
+	for _, p := range clientPenalties {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid client penalty %q", p)
+		}
+		penalty, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client penalty %q: %v", p, err)
+		}
+		scoreConfig.ClientPenalties[kv[0]] = penalty
+	}
+	return peermonitor.New(ethURL, minPeerCount, maxPeerCount, chainNetwork,
+		peermonitor.WithSources(sources...),
+		peermonitor.VerifyHandshake(verifyHandshake),
+		peermonitor.WithScoreConfig(scoreConfig),
+	)
+}
+
 func Execute() {
 	if err := ServerCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -100,6 +198,29 @@ func init() {
 	ServerCmd.PersistentFlags().Int(minPeerCountFlag, 5, "Minimum number of peer count")
 	ServerCmd.PersistentFlags().Int(maxPeerCountFlag, 15, "Maximum number of peer count")
 
+	// node source flags
+	ServerCmd.PersistentFlags().StringSlice(staticNodesFlag, []string{}, "The static enode URLs to add as peers")
+	ServerCmd.PersistentFlags().StringSlice(nodeFilesFlag, []string{}, "The files of enode URLs to add as peers, either a JSON array or one per line")
+	ServerCmd.PersistentFlags().StringSlice(nodeURLsFlag, []string{}, "The HTTP endpoints responding enode URLs to add as peers, either a JSON array or one per line")
+	ServerCmd.PersistentFlags().Bool(publicSourcesFlag, false, "Also fetch nodes from gist and ethernodes if other node sources are given")
+	ServerCmd.PersistentFlags().Bool(discoveryFlag, false, "Find nodes by the discovery v4 protocol")
+	ServerCmd.PersistentFlags().StringSlice(bootnodesFlag, []string{}, "The enode URLs to bootstrap the discovery (default: the bootnodes of the chain network)")
+	ServerCmd.PersistentFlags().String(discoveryAddrFlag, ":0", "The UDP address to listen for the discovery packets")
+	ServerCmd.PersistentFlags().Bool(dnsFlag, false, "Find nodes in the DNS discovery lists (EIP-1459)")
+	ServerCmd.PersistentFlags().StringSlice(dnsTreesFlag, []string{}, "The enrtree URLs of the DNS discovery lists, e.g. enrtree://<key>@nodes.example.org (default: the lists of the chain network)")
+
+	// verification flags
+	ServerCmd.PersistentFlags().Bool(verifyFlag, true, "Verify the network ID and genesis of the nodes by the handshakes before adding them as peers")
+
+	// pruning flags
+	ServerCmd.PersistentFlags().Float64(pruneThresholdFlag, 0, "The score between 0 and 100 to prune the peers below (default: no pruning)")
+	ServerCmd.PersistentFlags().Int(pruneMaxFlag, peermonitor.DefaultScoreConfig.MaxPrune, "Maximum number of peers pruned in each run")
+	ServerCmd.PersistentFlags().Duration(pruneGraceFlag, peermonitor.DefaultScoreConfig.GracePeriod, "The connection age before the peers could be pruned")
+	ServerCmd.PersistentFlags().Uint64(maxBlockLagFlag, peermonitor.DefaultScoreConfig.MaxBlockLag, "The head lag in blocks to get the full lag penalty")
+	ServerCmd.PersistentFlags().Float64(lagPenaltyFlag, peermonitor.DefaultScoreConfig.LagPenalty, "The score penalty of the lagging peers")
+	ServerCmd.PersistentFlags().Float64(inboundPenaltyFlag, peermonitor.DefaultScoreConfig.InboundPenalty, "The score penalty of the inbound peers")
+	ServerCmd.PersistentFlags().StringSlice(clientPenaltiesFlag, []string{}, "The score penalties by the prefixes of the client names, e.g. Parity=20")
+
 	ServerCmd.Flags().Duration(monitorDurationFlag, 1*time.Hour, "Monitor duration for eth peer set")
 
 }
@@ -119,4 +240,23 @@ func assignVarFromViper() {
 	monitorDuration = viper.GetDuration(monitorDurationFlag)
 	minPeerCount = viper.GetInt(minPeerCountFlag)
 	maxPeerCount = viper.GetInt(maxPeerCountFlag)
+	staticNodes = viper.GetStringSlice(staticNodesFlag)
+	nodeFiles = viper.GetStringSlice(nodeFilesFlag)
+	nodeURLs = viper.GetStringSlice(nodeURLsFlag)
+	publicSources = viper.GetBool(publicSourcesFlag)
+	discovery = viper.GetBool(discoveryFlag)
+	bootnodes = viper.GetStringSlice(bootnodesFlag)
+	discoveryAddr = viper.GetString(discoveryAddrFlag)
+	dns = viper.GetBool(dnsFlag)
+	dnsTrees = viper.GetStringSlice(dnsTreesFlag)
+	verifyHandshake = viper.GetBool(verifyFlag)
+	scoreConfig = peermonitor.ScoreConfig{
+		Threshold:      viper.GetFloat64(pruneThresholdFlag),
+		MaxPrune:       viper.GetInt(pruneMaxFlag),
+		GracePeriod:    viper.GetDuration(pruneGraceFlag),
+		MaxBlockLag:    uint64(viper.GetInt64(maxBlockLagFlag)),
+		LagPenalty:     viper.GetFloat64(lagPenaltyFlag),
+		InboundPenalty: viper.GetFloat64(inboundPenaltyFlag),
+	}
+	clientPenalties = viper.GetStringSlice(clientPenaltiesFlag)
 }
@@ -0,0 +1,293 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/getamis/sirius/log"
+
+	"github.com/getamis/hypereth/multiclient"
+)
+
+const (
+	jsonrpcVersion          = "2.0"
+	contentType             = "application/json"
+	maxRequestContentLength = 1024 * 1024 * 5
+
+	sendRawTransactionMethod = "eth_sendRawTransaction"
+	subscribeMethod          = "eth_subscribe"
+	unsubscribeMethod        = "eth_unsubscribe"
+)
+
+const (
+	errCodeParse          = -32700
+	errCodeInvalidRequest = -32600
+	errCodeMethodNotFound = -32601
+	errCodeInvalidParams  = -32602
+	errCodeServer         = -32000
+)
+
+type jsonError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type jsonrpcMessage struct {
+	Version string          `json:"jsonrpc,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Error   *jsonError      `json:"error,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+}
+
+func (msg *jsonrpcMessage) isNotification() bool {
+	return msg.ID == nil && msg.Method != ""
+}
+
+func newErrorResponse(id json.RawMessage, code int, err error) *jsonrpcMessage {
+	if rpcErr, ok := err.(rpc.Error); ok {
+		code = rpcErr.ErrorCode()
+	}
+	return &jsonrpcMessage{
+		Version: jsonrpcVersion,
+		ID:      id,
+		Error:   &jsonError{Code: code, Message: err.Error()},
+	}
+}
+
+func newResultResponse(id json.RawMessage, result interface{}) *jsonrpcMessage {
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return newErrorResponse(id, errCodeServer, err)
+	}
+	return &jsonrpcMessage{
+		Version: jsonrpcVersion,
+		ID:      id,
+		Result:  raw,
+	}
+}
+
+// methodFilter decides whether a method is allowed to pass through the proxy.
+// Patterns follow the syntax of path.Match, e.g. "eth_*" or "debug_traceTransaction".
+type methodFilter struct {
+	allow []string
+	deny  []string
+}
+
+func matchAny(patterns []string, method string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, method); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *methodFilter) permitted(method string) bool {
+	if matchAny(f.deny, method) {
+		return false
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	return matchAny(f.allow, method)
+}
+
+// Proxy forwards JSON-RPC requests to the eth clients managed by a multiclient.
+type Proxy struct {
+	client *multiclient.Client
+	filter *methodFilter
+}
+
+// NewProxy creates a JSON-RPC proxy on top of the given multiclient. Methods matching
+// the deny list are always rejected. If the allow list is not empty, only the matched
+// methods are served.
+func NewProxy(client *multiclient.Client, allow, deny []string) *Proxy {
+	return &Proxy{
+		client: client,
+		filter: &methodFilter{
+			allow: allow,
+			deny:  deny,
+		},
+	}
+}
+
+// ServeHTTP serves JSON-RPC requests over HTTP, and upgrades the connection to
+// websocket if it's requested.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		p.websocketHandler().ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.ContentLength > maxRequestContentLength {
+		http.Error(w, fmt.Sprintf("content length too large (%d>%d)", r.ContentLength, maxRequestContentLength), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestContentLength))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := p.handleRequest(r.Context(), body, nil)
+	w.Header().Set("Content-Type", contentType)
+	if resp == nil {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Debug("Failed to write response", "err", err)
+	}
+}
+
+// handleRequest handles a single or batch request and returns the response to be
+// written back. It returns nil if there is nothing to respond.
+func (p *Proxy) handleRequest(ctx context.Context, body []byte, subs *subscriptions) interface{} {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var msgs []*jsonrpcMessage
+		if err := json.Unmarshal(body, &msgs); err != nil {
+			return newErrorResponse(nil, errCodeParse, err)
+		}
+		if len(msgs) == 0 {
+			return newErrorResponse(nil, errCodeInvalidRequest, fmt.Errorf("empty batch"))
+		}
+		return p.handleBatch(ctx, msgs, subs)
+	}
+
+	var msg *jsonrpcMessage
+	if err := json.Unmarshal(body, &msg); err != nil || msg == nil {
+		if err == nil {
+			err = fmt.Errorf("invalid request")
+		}
+		return newErrorResponse(nil, errCodeParse, err)
+	}
+	resp := p.handleMessage(ctx, msg, subs)
+	if msg.isNotification() {
+		return nil
+	}
+	return resp
+}
+
+// handleBatch handles the batch messages concurrently and keeps the order of responses.
+func (p *Proxy) handleBatch(ctx context.Context, msgs []*jsonrpcMessage, subs *subscriptions) interface{} {
+	resps := make([]*jsonrpcMessage, len(msgs))
+
+	var wg sync.WaitGroup
+	for i, msg := range msgs {
+		wg.Add(1)
+		go func(i int, msg *jsonrpcMessage) {
+			defer wg.Done()
+			resps[i] = p.handleMessage(ctx, msg, subs)
+		}(i, msg)
+	}
+	wg.Wait()
+
+	results := make([]*jsonrpcMessage, 0, len(resps))
+	for i, resp := range resps {
+		if msgs[i] == nil || !msgs[i].isNotification() {
+			results = append(results, resp)
+		}
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	return results
+}
+
+func (p *Proxy) handleMessage(ctx context.Context, msg *jsonrpcMessage, subs *subscriptions) *jsonrpcMessage {
+	if msg == nil || msg.Method == "" {
+		return newErrorResponse(nil, errCodeInvalidRequest, fmt.Errorf("invalid request"))
+	}
+	if !p.filter.permitted(msg.Method) {
+		log.Debug("Method is not allowed", "method", msg.Method)
+		return newErrorResponse(msg.ID, errCodeMethodNotFound, fmt.Errorf("the method %s does not exist/is not available", msg.Method))
+	}
+
+	var params []json.RawMessage
+	if len(msg.Params) > 0 {
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return newErrorResponse(msg.ID, errCodeInvalidParams, fmt.Errorf("non-array args"))
+		}
+	}
+
+	switch msg.Method {
+	case sendRawTransactionMethod:
+		return p.sendRawTransaction(ctx, msg.ID, params)
+	case subscribeMethod, unsubscribeMethod:
+		if subs == nil {
+			return newErrorResponse(msg.ID, errCodeMethodNotFound, rpc.ErrNotificationsUnsupported)
+		}
+		if msg.Method == subscribeMethod {
+			return subs.subscribe(msg.ID, params)
+		}
+		return subs.unsubscribe(msg.ID, params)
+	}
+
+	args := make([]interface{}, len(params))
+	for i, param := range params {
+		args[i] = param
+	}
+	var result json.RawMessage
+	if err := p.client.CallContext(ctx, &result, msg.Method, args...); err != nil {
+		return newErrorResponse(msg.ID, errCodeServer, err)
+	}
+	return &jsonrpcMessage{
+		Version: jsonrpcVersion,
+		ID:      msg.ID,
+		Result:  result,
+	}
+}
+
+// sendRawTransaction broadcasts the signed transaction to all eth clients.
+func (p *Proxy) sendRawTransaction(ctx context.Context, id json.RawMessage, params []json.RawMessage) *jsonrpcMessage {
+	if len(params) != 1 {
+		return newErrorResponse(id, errCodeInvalidParams, fmt.Errorf("missing value for required argument 0"))
+	}
+	var raw hexutil.Bytes
+	if err := json.Unmarshal(params[0], &raw); err != nil {
+		return newErrorResponse(id, errCodeInvalidParams, err)
+	}
+	tx := new(types.Transaction)
+	if err := rlp.DecodeBytes(raw, tx); err != nil {
+		return newErrorResponse(id, errCodeInvalidParams, err)
+	}
+	if err := p.client.SendTransaction(ctx, tx); err != nil {
+		return newErrorResponse(id, errCodeServer, err)
+	}
+	return newResultResponse(id, tx.Hash())
+}
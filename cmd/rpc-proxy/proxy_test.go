@@ -0,0 +1,333 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/getamis/hypereth/multiclient"
+	"github.com/getamis/hypereth/testutil"
+)
+
+func startTestNode(t *testing.T, chain *testutil.Chain) *testutil.Node {
+	node, err := testutil.NewNode(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// startTestProxy starts the proxy of the eth clients of the urls.
+func startTestProxy(t *testing.T, urls []string, allow, deny []string) (*multiclient.Client, *httptest.Server) {
+	mc, err := multiclient.New(context.Background(), multiclient.EthURLs(urls))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mc, httptest.NewServer(NewProxy(mc, allow, deny))
+}
+
+// post posts the body to the proxy and decodes the response.
+func post(t *testing.T, url, body string, resp interface{}) {
+	r, err := http.Post(url, contentType, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("got status %s, want 200 OK", r.Status)
+	}
+	if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMethodFilter(t *testing.T) {
+	f := &methodFilter{
+		allow: []string{"eth_*", "net_version"},
+		deny:  []string{"eth_sign*"},
+	}
+	tests := []struct {
+		method string
+		want   bool
+	}{
+		{"eth_blockNumber", true},
+		{"net_version", true},
+		{"net_peerCount", false},
+		{"eth_sign", false},
+		{"eth_signTransaction", false},
+		{"admin_peers", false},
+	}
+	for _, test := range tests {
+		if got := f.permitted(test.method); got != test.want {
+			t.Fatalf("got permitted %v of %s, want %v", got, test.method, test.want)
+		}
+	}
+	if f := (&methodFilter{deny: []string{"admin_*"}}); !f.permitted("debug_metrics") || f.permitted("admin_peers") {
+		t.Fatal("got wrong permission with the deny list only")
+	}
+}
+
+func TestProxyHTTP(t *testing.T) {
+	chain := testutil.NewChain(testutil.ChainConfig{})
+	chain.AddBlocks(3)
+	n1, n2 := startTestNode(t, chain), startTestNode(t, chain)
+	defer n1.Close()
+	defer n2.Close()
+	mc, server := startTestProxy(t, []string{n1.HTTPURL(), n2.HTTPURL()}, []string{"eth_*", "net_version"}, []string{"eth_sign"})
+	defer mc.Close()
+	defer server.Close()
+
+	var single jsonrpcMessage
+	post(t, server.URL, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`, &single)
+	if single.Error != nil || string(single.ID) != "1" || string(single.Result) != `"0x3"` {
+		t.Fatalf("got response %+v, want block number 0x3", single)
+	}
+
+	// The responses of a batch are in the request order without the notifications
+	var batch []jsonrpcMessage
+	post(t, server.URL, `[
+		{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x1",false]},
+		{"jsonrpc":"2.0","method":"eth_blockNumber"},
+		{"jsonrpc":"2.0","id":2,"method":"net_version"},
+		{"jsonrpc":"2.0","id":3,"method":"eth_sign","params":[]},
+		{"jsonrpc":"2.0","id":4,"method":"admin_peers"},
+		{"jsonrpc":"2.0","id":5,"method":"eth_subscribe","params":["newHeads"]}
+	]`, &batch)
+	if len(batch) != 5 {
+		t.Fatalf("got %d responses, want 5", len(batch))
+	}
+	var block struct {
+		Hash common.Hash `json:"hash"`
+	}
+	if err := json.Unmarshal(batch[0].Result, &block); err != nil || block.Hash != chain.BlockByNumber(1).Hash() {
+		t.Fatalf("got block %s, want %x", batch[0].Result, chain.BlockByNumber(1).Hash())
+	}
+	if string(batch[1].ID) != "2" || batch[1].Error != nil {
+		t.Fatalf("got response %+v of net_version", batch[1])
+	}
+	// The denied and not allowed methods, and the subscriptions over HTTP are not found
+	for _, resp := range batch[2:] {
+		if resp.Error == nil || resp.Error.Code != errCodeMethodNotFound {
+			t.Fatalf("got response %+v of id %s, want method not found", resp, resp.ID)
+		}
+	}
+
+	var invalid jsonrpcMessage
+	post(t, server.URL, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"`, &invalid)
+	if invalid.Error == nil || invalid.Error.Code != errCodeParse {
+		t.Fatalf("got response %+v, want parse error", invalid)
+	}
+}
+
+func TestProxySendRawTransaction(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc := map[common.Address]*big.Int{
+		crypto.PubkeyToAddress(key.PublicKey): big.NewInt(1e18),
+	}
+	// The nodes of different chains to see the broadcast in both
+	chains := []*testutil.Chain{
+		testutil.NewChain(testutil.ChainConfig{Alloc: alloc}),
+		testutil.NewChain(testutil.ChainConfig{Alloc: alloc}),
+	}
+	var urls []string
+	for _, c := range chains {
+		n := startTestNode(t, c)
+		defer n.Close()
+		urls = append(urls, n.HTTPURL())
+	}
+	mc, server := startTestProxy(t, urls, nil, nil)
+	defer mc.Close()
+	defer server.Close()
+
+	tx, err := types.SignTx(types.NewTransaction(0, common.Address{1}, big.NewInt(1), 21000, big.NewInt(1), nil), types.NewEIP155Signer(chains[0].ChainID()), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  sendRawTransactionMethod,
+		"params":  []interface{}{hexutil.Bytes(raw)},
+	})
+	var resp jsonrpcMessage
+	post(t, server.URL, string(req), &resp)
+	var hash common.Hash
+	if err := json.Unmarshal(resp.Result, &hash); err != nil || hash != tx.Hash() {
+		t.Fatalf("got response %+v, want hash %x", resp, tx.Hash())
+	}
+	for i, c := range chains {
+		if pending := c.Pending(); len(pending) != 1 || pending[0].Hash() != tx.Hash() {
+			t.Fatalf("got %d pending transactions in node %d, want the sent one", len(pending), i)
+		}
+	}
+
+	post(t, server.URL, `{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["0x01"]}`, &resp)
+	if resp.Error == nil || resp.Error.Code != errCodeInvalidParams {
+		t.Fatalf("got response %+v, want invalid params", resp)
+	}
+}
+
+func TestProxyNewHeads(t *testing.T) {
+	chain := testutil.NewChain(testutil.ChainConfig{})
+	n1, n2 := startTestNode(t, chain), startTestNode(t, chain)
+	defer n1.Close()
+	defer n2.Close()
+	mc, server := startTestProxy(t, []string{n1.WSURL(), n2.WSURL()}, nil, nil)
+	defer mc.Close()
+	defer server.Close()
+
+	client, err := rpc.Dial("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ch := make(chan *types.Header, 16)
+	sub, err := client.EthSubscribe(context.Background(), ch, "newHeads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	// Mine until the subscriptions to the nodes are made
+	seen := make(map[common.Hash]bool)
+	deadline := time.After(5 * time.Second)
+	for subscribed := false; !subscribed; {
+		chain.AddBlock()
+		select {
+		case h := <-ch:
+			seen[h.Hash()] = true
+			subscribed = true
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("no head received")
+		}
+	}
+
+	// Every head is sent once although both nodes send it
+	for i := 0; i < 5; i++ {
+		block := chain.AddBlock()
+		timeout := time.After(5 * time.Second)
+	receive:
+		for {
+			select {
+			case h := <-ch:
+				if seen[h.Hash()] {
+					t.Fatalf("got duplicate head %d", h.Number)
+				}
+				seen[h.Hash()] = true
+				if h.Hash() == block.Hash() {
+					break receive
+				}
+			case err := <-sub.Err():
+				t.Fatal(err)
+			case <-timeout:
+				t.Fatalf("no head %d received", block.NumberU64())
+			}
+		}
+	}
+	select {
+	case h := <-ch:
+		if seen[h.Hash()] {
+			t.Fatalf("got duplicate head %d", h.Number)
+		}
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestProxySubscriptionMigration(t *testing.T) {
+	chain := testutil.NewChain(testutil.ChainConfig{})
+	n1, n2 := startTestNode(t, chain), startTestNode(t, chain)
+	defer n1.Close()
+	defer n2.Close()
+	mc, server := startTestProxy(t, []string{n1.WSURL(), n2.WSURL()}, nil, nil)
+	defer mc.Close()
+	defer server.Close()
+
+	client, err := rpc.Dial("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// The subscription is made on n1 since n2 fails
+	n2.SetFault("eth_subscribe", testutil.Fault{Err: context.DeadlineExceeded})
+	ch := make(chan types.Log, 16)
+	sub, err := client.EthSubscribe(context.Background(), ch, "logs", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	n2.ClearFaults()
+
+	receiveLog := func(data []byte) {
+		chain.AddBlock(types.Log{Address: common.Address{1}, Topics: []common.Hash{{1}}, Data: data})
+		select {
+		case l := <-ch:
+			if !bytes.Equal(l.Data, data) {
+				t.Fatalf("got log %x, want %x", l.Data, data)
+			}
+		case err := <-sub.Err():
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no log %x received", data)
+		}
+	}
+	receiveLog([]byte{1})
+
+	// The subscription is migrated to n2 when n1 is removed. The logs are sent until
+	// the migration is done, since n1 is closed right after removed.
+	mc.ClientMap().Delete(n1.WSURL())
+	deadline := time.After(5 * time.Second)
+	for migrated := false; !migrated; {
+		chain.AddBlock(types.Log{Address: common.Address{1}, Topics: []common.Hash{{1}}, Data: []byte{2}})
+		select {
+		case <-ch:
+			migrated = true
+		case err := <-sub.Err():
+			t.Fatal(err)
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("subscription is not migrated")
+		}
+	}
+	receiveLog([]byte{3})
+}
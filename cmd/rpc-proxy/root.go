@@ -0,0 +1,269 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/getamis/sirius/log"
+	"github.com/getamis/sirius/metrics"
+	"github.com/spf13/cobra"
+
+	"github.com/getamis/hypereth/ethclient"
+	"github.com/getamis/hypereth/multiclient"
+)
+
+var (
+	host string
+	port int
+	// flags for eth clients
+	ethURLs       []string
+	ethFile       string
+	consulURL     string
+	consulService string
+	consulScheme  string
+	consulTags    []string
+	consulDC      string
+	consulToken   string
+	dnsName       string
+	dnsService    string
+	dnsProto      string
+	dnsPort       int
+	dnsScheme     string
+	dnsInterval   time.Duration
+	dnsServers    []string
+	k8sNamespace  string
+	k8sEndpoints  string
+	k8sSelector   string
+	k8sPort       string
+	k8sNotReady   bool
+	k8sSlices     bool
+	k8sScheme     string
+	k8sConfigPath string
+	k8sAPIServer  string
+	// flags for dialing eth clients
+	dialHeaders       map[string]string
+	dialBearerToken   string
+	dialJWTSecretFile string
+	dialCAFile        string
+	dialCertFile      string
+	dialKeyFile       string
+	dialTimeout       time.Duration
+	recordFile        string
+	// flags for requests
+	zone           string
+	archiveRouting bool
+	historicalTags []string
+	retryLimit     int
+	retryTimeout   time.Duration
+	retryDelay     time.Duration
+	allowedMethods []string
+	deniedMethods  []string
+	statusPath     string
+	metricsPath    string
+)
+
+// Execute adds all child commands to the root command sets flags appropriately.
+// This is called by main.main(). It only needs to happen once to the rootCmd.
+func Execute() {
+	if err := RootCmd.Execute(); err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+}
+
+// RootCmd represents the JSON-RPC proxy
+var RootCmd = &cobra.Command{
+	Use:   "rpc-proxy",
+	Short: "The load-balancing JSON-RPC proxy for Ethereum clients",
+	Long:  `The load-balancing JSON-RPC proxy for Ethereum clients. It serves both HTTP and websocket requests on the same port.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := []multiclient.Option{
+			multiclient.WithRetryConfig(multiclient.RetryConfig{
+				Limit:   retryLimit,
+				Timeout: retryTimeout,
+				Delay:   retryDelay,
+			}),
+		}
+		if zone != "" {
+			opts = append(opts, multiclient.WithZone(zone))
+		}
+		if archiveRouting {
+			opts = append(opts, multiclient.WithArchiveRouting())
+		}
+		if len(historicalTags) > 0 {
+			opts = append(opts, multiclient.WithHistoricalTags(historicalTags...))
+		}
+		var recorder *ethclient.Recorder
+		if recordFile != "" {
+			f, err := os.OpenFile(recordFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				log.Error("Failed to open record file", "file", recordFile, "err", err)
+				return err
+			}
+			defer f.Close()
+			recorder = ethclient.NewRecorder(f)
+		}
+		if len(dialHeaders) > 0 || dialBearerToken != "" || dialJWTSecretFile != "" || dialCAFile != "" || dialCertFile != "" || dialKeyFile != "" || dialTimeout != 0 || recorder != nil {
+			opts = append(opts, multiclient.WithDialConfig(&ethclient.DialConfig{
+				Headers:       dialHeaders,
+				BearerToken:   dialBearerToken,
+				JWTSecretFile: dialJWTSecretFile,
+				CAFile:        dialCAFile,
+				CertFile:      dialCertFile,
+				KeyFile:       dialKeyFile,
+				Timeout:       dialTimeout,
+				Recorder:      recorder,
+			}))
+		}
+		if len(ethURLs) > 0 {
+			opts = append(opts, multiclient.EthURLs(ethURLs))
+		}
+		if ethFile != "" {
+			opts = append(opts, multiclient.FileDiscovery(ethFile))
+		}
+		if consulURL != "" {
+			opts = append(opts, multiclient.ConsulDiscoveryWithConfig(consulURL, consulService, consulScheme, &multiclient.ConsulConfig{
+				Tags:       consulTags,
+				Datacenter: consulDC,
+				Token:      consulToken,
+			}))
+		}
+		if dnsName != "" {
+			opts = append(opts, multiclient.DNSDiscovery(dnsName, dnsScheme, multiclient.DNSConfig{
+				Service:         dnsService,
+				Proto:           dnsProto,
+				Port:            dnsPort,
+				RefreshInterval: dnsInterval,
+				Servers:         dnsServers,
+			}))
+		}
+		if k8sEndpoints != "" || k8sSelector != "" {
+			var kubeconfig *multiclient.KubeConfig
+			if k8sConfigPath != "" || k8sAPIServer != "" {
+				kubeconfig = &multiclient.KubeConfig{
+					ConfigPath: k8sConfigPath,
+					APIServer:  k8sAPIServer,
+				}
+			}
+			opts = append(opts, multiclient.K8sDiscovery(k8sNamespace, k8sScheme, multiclient.K8sDiscoveryConfig{
+				Name:            k8sEndpoints,
+				LabelSelector:   k8sSelector,
+				PortName:        k8sPort,
+				IncludeNotReady: k8sNotReady,
+				EndpointSlices:  k8sSlices,
+			}, kubeconfig))
+		}
+
+		var metricsRegistry *metrics.PrometheusRegistry
+		if metricsPath != "" {
+			metricsRegistry = metrics.NewPrometheusRegistry()
+			opts = append(opts, multiclient.WithMetrics(metricsRegistry))
+		}
+
+		client, err := multiclient.New(context.Background(), opts...)
+		if err != nil {
+			log.Error("Failed to create multiclient", "err", err)
+			return err
+		}
+		defer client.Close()
+
+		mux := http.NewServeMux()
+		mux.Handle("/", NewProxy(client, allowedMethods, deniedMethods))
+		if statusPath != "" {
+			mux.Handle(statusPath, client.StatusHandler())
+		}
+		if metricsRegistry != nil {
+			mux.Handle(metricsPath, metricsRegistry)
+		}
+		srv := &http.Server{
+			Addr:    fmt.Sprintf("%s:%d", host, port),
+			Handler: mux,
+		}
+
+		go func() {
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+			defer signal.Stop(sigs)
+			log.Debug("Shutting down", "signal", <-sigs)
+			srv.Shutdown(context.Background())
+		}()
+
+		log.Info("Starting JSON-RPC proxy", "endpoint", fmt.Sprintf("%s:%d", host, port))
+
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			return err
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.Flags().StringVar(&host, "host", "localhost", "The HTTP and websocket server listening address")
+	RootCmd.Flags().IntVar(&port, "port", 8545, "The HTTP and websocket server listening port")
+
+	RootCmd.Flags().StringSliceVar(&ethURLs, "eth.urls", []string{}, "The static Ethereum endpoints to connect to")
+	RootCmd.Flags().StringVar(&ethFile, "eth.file", "", "The YAML or JSON file of Ethereum endpoints, reloaded on changes")
+	RootCmd.Flags().StringVar(&consulURL, "consul.url", "", "The consul server url to discover Ethereum endpoints")
+	RootCmd.Flags().StringVar(&consulService, "consul.service", "", "The consul service ID of Ethereum endpoints")
+	RootCmd.Flags().StringVar(&consulScheme, "consul.scheme", "ws", "The scheme of Ethereum endpoints discovered from consul")
+	RootCmd.Flags().StringSliceVar(&consulTags, "consul.tags", []string{}, "The consul service tags to filter Ethereum endpoints")
+	RootCmd.Flags().StringVar(&consulDC, "consul.datacenter", "", "The consul datacenter to query (default: the datacenter of the agent)")
+	RootCmd.Flags().StringVar(&consulToken, "consul.token", "", "The consul ACL token")
+	RootCmd.Flags().StringVar(&dnsName, "dns.name", "", "The domain name to discover Ethereum endpoints")
+	RootCmd.Flags().StringVar(&dnsService, "dns.service", "", "The service of SRV records, e.g. ethrpc (default: resolve A and AAAA records)")
+	RootCmd.Flags().StringVar(&dnsProto, "dns.proto", "tcp", "The protocol of SRV records")
+	RootCmd.Flags().IntVar(&dnsPort, "dns.port", 8546, "The port of Ethereum endpoints resolved from A and AAAA records")
+	RootCmd.Flags().StringVar(&dnsScheme, "dns.scheme", "ws", "The scheme of Ethereum endpoints discovered from DNS")
+	RootCmd.Flags().DurationVar(&dnsInterval, "dns.interval", 30*time.Second, "The interval to resolve DNS records again after failures, the resolved records are refreshed by their TTLs")
+	RootCmd.Flags().StringSliceVar(&dnsServers, "dns.servers", nil, "The name servers to resolve DNS records, e.g. 10.96.0.10:53 (default: the name servers in /etc/resolv.conf)")
+	RootCmd.Flags().StringVar(&k8sNamespace, "k8s.namespace", "default", "The k8s namespace of the Ethereum endpoints")
+	RootCmd.Flags().StringVar(&k8sEndpoints, "k8s.endpoints", "", "The k8s endpoints name to discover Ethereum endpoints")
+	RootCmd.Flags().StringVar(&k8sSelector, "k8s.selector", "", "The label selector of k8s endpoints to discover Ethereum endpoints, e.g. app=geth")
+	RootCmd.Flags().StringVar(&k8sPort, "k8s.port", "", "The port name of Ethereum endpoints discovered from k8s (default: all ports)")
+	RootCmd.Flags().BoolVar(&k8sNotReady, "k8s.not-ready", false, "Include the not-ready addresses discovered from k8s")
+	RootCmd.Flags().BoolVar(&k8sSlices, "k8s.endpointslices", false, "Discover from the k8s EndpointSlices of the service named by --k8s.endpoints instead of the endpoints objects")
+	RootCmd.Flags().StringVar(&k8sScheme, "k8s.scheme", "ws", "The scheme of Ethereum endpoints discovered from k8s")
+	RootCmd.Flags().StringVar(&k8sConfigPath, "k8s.kubeconfig", "", "The file path to KUBE-CONFIG file (default: in-cluster config)")
+	RootCmd.Flags().StringVar(&k8sAPIServer, "k8s.apiserver", "", "The url to override the apiserver address in KUBE-CONFIG file")
+
+	RootCmd.Flags().StringToStringVar(&dialHeaders, "dial.headers", map[string]string{}, "The HTTP headers sent to HTTP Ethereum endpoints. For example: k1=v1,k2=v2")
+	RootCmd.Flags().StringVar(&dialBearerToken, "dial.bearer-token", "", "The bearer token sent to HTTP Ethereum endpoints")
+	RootCmd.Flags().StringVar(&dialJWTSecretFile, "dial.jwt-secret", "", "The file path to the hex encoded secret to sign JWT tokens sent to HTTP Ethereum endpoints")
+	RootCmd.Flags().StringVar(&dialCAFile, "dial.tls.ca", "", "The file path to the CA certificates to verify HTTP Ethereum endpoints (default: system CAs)")
+	RootCmd.Flags().StringVar(&dialCertFile, "dial.tls.cert", "", "The file path to the client certificate for HTTP Ethereum endpoints")
+	RootCmd.Flags().StringVar(&dialKeyFile, "dial.tls.key", "", "The file path to the client key for HTTP Ethereum endpoints")
+	RootCmd.Flags().DurationVar(&dialTimeout, "dial.timeout", 0, "The timeout of HTTP requests to Ethereum endpoints (default: no timeout)")
+	RootCmd.Flags().StringVar(&recordFile, "record.file", "", "The file to append the JSON-RPC calls to HTTP Ethereum endpoints in JSON lines, e.g. to replay an incident (default: disabled)")
+	RootCmd.Flags().StringVar(&zone, "zone", "", "The zone to prefer Ethereum endpoints in (default: $MULTICLIENT_ZONE)")
+	RootCmd.Flags().BoolVar(&archiveRouting, "route.archive", false, "Route the historical state queries by the learned state retention of Ethereum endpoints")
+	RootCmd.Flags().StringSliceVar(&historicalTags, "route.historical-tags", []string{}, "The tags required by Ethereum endpoints to serve the historical state queries, e.g. archive")
+	RootCmd.Flags().IntVar(&retryLimit, "retry.limit", 0, "The total retry times of a request (default: the number of Ethereum endpoints)")
+	RootCmd.Flags().DurationVar(&retryTimeout, "retry.timeout", 5*time.Second, "The timeout for each retry")
+	RootCmd.Flags().DurationVar(&retryDelay, "retry.delay", 1*time.Second, "The delay duration for each retry")
+	RootCmd.Flags().StringSliceVar(&allowedMethods, "methods.allow", []string{}, "The allowed methods, e.g. eth_*,net_version (default: all methods)")
+	RootCmd.Flags().StringSliceVar(&deniedMethods, "methods.deny", []string{"admin_*", "debug_*", "miner_*", "personal_*"}, "The denied methods")
+	RootCmd.Flags().StringVar(&statusPath, "status.path", "", "The HTTP path to serve the status of Ethereum endpoints in JSON, e.g. /status (default: disabled)")
+	RootCmd.Flags().StringVar(&metricsPath, "metrics.path", "", "The HTTP path to serve the Prometheus metrics of Ethereum endpoints, e.g. /metrics (default: disabled)")
+}
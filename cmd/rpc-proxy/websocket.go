@@ -0,0 +1,331 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/getamis/sirius/log"
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/net/websocket"
+
+	"github.com/getamis/hypereth/multiclient"
+)
+
+const (
+	notificationMethod = "eth_subscription"
+	newHeadsKind       = "newHeads"
+
+	// recentHeadsSize is the number of recent head hashes to remember for
+	// deduplicating the heads received from multiple eth clients.
+	recentHeadsSize   = 128
+	resubscribePeriod = 1 * time.Second
+)
+
+type subscriptionNotification struct {
+	Subscription string          `json:"subscription"`
+	Result       json.RawMessage `json:"result"`
+}
+
+func (p *Proxy) websocketHandler() http.Handler {
+	// Don't check the origin, the proxy is expected to serve non-browser clients.
+	return websocket.Server{Handler: p.serveWebsocket}
+}
+
+func (p *Proxy) serveWebsocket(conn *websocket.Conn) {
+	conn.MaxPayloadBytes = maxRequestContentLength
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	session := &wsSession{
+		ctx:    ctx,
+		client: p.client,
+		conn:   conn,
+		subs:   make(map[string]context.CancelFunc),
+	}
+	for {
+		var body []byte
+		if err := websocket.Message.Receive(conn, &body); err != nil {
+			log.Trace("Websocket connection closed", "remote", conn.Request().RemoteAddr, "err", err)
+			return
+		}
+		go func() {
+			subs := &subscriptions{session: session}
+			resp := p.handleRequest(ctx, body, subs)
+			if resp != nil {
+				session.send(resp)
+			}
+			// Notifications can be sent only after the subscription ids are responded.
+			subs.activate()
+		}()
+	}
+}
+
+// wsSession represents a websocket connection and its active subscriptions.
+type wsSession struct {
+	ctx    context.Context
+	client *multiclient.Client
+	conn   *websocket.Conn
+
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	subs map[string]context.CancelFunc
+}
+
+func (s *wsSession) send(msg interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return websocket.JSON.Send(s.conn, msg)
+}
+
+func (s *wsSession) notify(id string, result interface{}) error {
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	params, err := json.Marshal(&subscriptionNotification{
+		Subscription: id,
+		Result:       raw,
+	})
+	if err != nil {
+		return err
+	}
+	return s.send(&jsonrpcMessage{
+		Version: jsonrpcVersion,
+		Method:  notificationMethod,
+		Params:  params,
+	})
+}
+
+// subscriptions handles the subscribe and unsubscribe requests in a single websocket
+// request. The created subscriptions are held until activate is called.
+type subscriptions struct {
+	session *wsSession
+
+	mu    sync.Mutex
+	ready []chan struct{}
+}
+
+func (subs *subscriptions) activate() {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	for _, r := range subs.ready {
+		close(r)
+	}
+	subs.ready = nil
+}
+
+func (subs *subscriptions) subscribe(id json.RawMessage, params []json.RawMessage) *jsonrpcMessage {
+	if len(params) == 0 {
+		return newErrorResponse(id, errCodeInvalidParams, fmt.Errorf("expected subscription name as first argument"))
+	}
+	var kind string
+	if err := json.Unmarshal(params[0], &kind); err != nil {
+		return newErrorResponse(id, errCodeInvalidParams, fmt.Errorf("expected subscription name as first argument"))
+	}
+
+	s := subs.session
+	subID := newSubscriptionID()
+	ctx, cancel := context.WithCancel(s.ctx)
+	ready := make(chan struct{})
+
+	var err error
+	if kind == newHeadsKind {
+		err = s.forwardNewHeads(ctx, subID, ready)
+	} else {
+		args := make([]interface{}, len(params))
+		for i, param := range params {
+			args[i] = param
+		}
+		err = s.forwardSubscription(ctx, subID, ready, args)
+	}
+	if err != nil {
+		cancel()
+		return newErrorResponse(id, errCodeServer, err)
+	}
+
+	s.mu.Lock()
+	s.subs[subID] = cancel
+	s.mu.Unlock()
+
+	subs.mu.Lock()
+	subs.ready = append(subs.ready, ready)
+	subs.mu.Unlock()
+
+	log.Trace("Subscription created", "id", subID, "kind", kind)
+	return newResultResponse(id, subID)
+}
+
+func (subs *subscriptions) unsubscribe(id json.RawMessage, params []json.RawMessage) *jsonrpcMessage {
+	if len(params) != 1 {
+		return newErrorResponse(id, errCodeInvalidParams, fmt.Errorf("expected subscription id as argument"))
+	}
+	var subID string
+	if err := json.Unmarshal(params[0], &subID); err != nil {
+		return newErrorResponse(id, errCodeInvalidParams, fmt.Errorf("expected subscription id as argument"))
+	}
+
+	s := subs.session
+	s.mu.Lock()
+	cancel, ok := s.subs[subID]
+	delete(s.subs, subID)
+	s.mu.Unlock()
+
+	if !ok {
+		return newErrorResponse(id, errCodeServer, fmt.Errorf("subscription not found"))
+	}
+	cancel()
+	return newResultResponse(id, true)
+}
+
+// forwardNewHeads subscribes new heads from all eth clients, and forwards the
+// deduplicated heads to the websocket connection.
+func (s *wsSession) forwardNewHeads(ctx context.Context, subID string, ready <-chan struct{}) error {
+	ch := make(chan *multiclient.Header)
+	sub, err := s.client.SubscribeNewHead(ctx, ch)
+	if err != nil {
+		return err
+	}
+	recentHeads, err := lru.New(recentHeadsSize)
+	if err != nil {
+		sub.Unsubscribe()
+		return err
+	}
+
+	go func() {
+		defer sub.Unsubscribe()
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return
+		}
+		for {
+			select {
+			case head := <-ch:
+				if ok, _ := recentHeads.ContainsOrAdd(head.Hash(), struct{}{}); ok {
+					continue
+				}
+				if err := s.notify(subID, head.Header); err != nil {
+					log.Debug("Failed to send notification", "id", subID, "err", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// forwardSubscription subscribes to one of the eth clients and forwards the notifications
+// to the websocket connection. If the subscription fails, it resubscribes to another
+// eth client. If the eth client is removed, the subscription is migrated to another eth
+// client before the eth client is closed.
+func (s *wsSession) forwardSubscription(ctx context.Context, subID string, ready <-chan struct{}, args []interface{}) error {
+	ch := make(chan json.RawMessage)
+	sub, rc, err := s.subscribeAny(ctx, ch, args)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer func() {
+			if sub != nil {
+				sub.Unsubscribe()
+			}
+		}()
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return
+		}
+
+		var retryCh <-chan time.Time
+		for {
+			var errCh <-chan error
+			var drainCh <-chan struct{}
+			if sub != nil {
+				errCh = sub.Err()
+				drainCh = s.client.ClientMap().Draining(rc)
+			}
+			select {
+			case result := <-ch:
+				if err := s.notify(subID, result); err != nil {
+					log.Debug("Failed to send notification", "id", subID, "err", err)
+				}
+			case err := <-errCh:
+				log.Warn("Failed during subscription, resubscribe", "id", subID, "err", err)
+				sub = nil
+				retryCh = time.After(0)
+			case <-drainCh:
+				// Subscribe to another eth client before unsubscribing, so no notification is missed
+				log.Debug("Eth client is draining, migrate subscription", "id", subID)
+				newSub, newRC, err := s.subscribeAny(ctx, ch, args)
+				if err != nil {
+					log.Warn("Failed to migrate subscription", "id", subID, "err", err)
+					retryCh = time.After(resubscribePeriod)
+				}
+				sub.Unsubscribe()
+				sub, rc = newSub, newRC
+			case <-retryCh:
+				var err error
+				sub, rc, err = s.subscribeAny(ctx, ch, args)
+				if err != nil {
+					retryCh = time.After(resubscribePeriod)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// subscribeAny subscribes to one of the eth clients, and returns the subscription and
+// the subscribed eth client.
+func (s *wsSession) subscribeAny(ctx context.Context, ch chan json.RawMessage, args []interface{}) (ethereum.Subscription, *rpc.Client, error) {
+	clients := s.client.RPCClients()
+	if len(clients) == 0 {
+		return nil, nil, multiclient.ErrNoEthClient
+	}
+
+	var errs []error
+	for _, c := range clients {
+		sub, err := c.EthSubscribe(ctx, ch, args...)
+		if err == nil {
+			return sub, c, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, nil, multiclient.NewMultipleError(errs)
+}
+
+func newSubscriptionID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hexutil.Encode(id)
+}
@@ -26,7 +26,13 @@ import (
 // AddPeer connects to the given nodeURL.
 func (ec *Client) AddPeer(ctx context.Context, nodeURL string) error {
 	var r bool
-	return ec.c.CallContext(ctx, &r, "admin_addPeer", nodeURL)
+	return ec.CallContext(ctx, &r, "admin_addPeer", nodeURL)
+}
+
+// RemovePeer disconnects from the given nodeURL.
+func (ec *Client) RemovePeer(ctx context.Context, nodeURL string) error {
+	var r bool
+	return ec.CallContext(ctx, &r, "admin_removePeer", nodeURL)
 }
 
 // BatchAddPeer performs batch add remote peers.
@@ -44,7 +50,7 @@ func (ec *Client) BatchAddPeer(ctx context.Context, urls []string) error {
 		}
 	}
 	// Batch calls
-	err := ec.c.BatchCallContext(ctx, reqs)
+	err := ec.batchCallContext(ctx, reqs)
 	if err != nil {
 		return err
 	}
@@ -60,7 +66,7 @@ func (ec *Client) BatchAddPeer(ctx context.Context, urls []string) error {
 // AdminPeers returns the number of connected peers.
 func (ec *Client) AdminPeers(ctx context.Context) ([]*p2p.PeerInfo, error) {
 	var r []*p2p.PeerInfo
-	err := ec.c.CallContext(ctx, &r, "admin_peers")
+	err := ec.CallContext(ctx, &r, "admin_peers")
 	if err != nil {
 		return nil, err
 	}
@@ -70,7 +76,7 @@ func (ec *Client) AdminPeers(ctx context.Context) ([]*p2p.PeerInfo, error) {
 // NodeInfo gathers and returns a collection of metadata known about the host.
 func (ec *Client) NodeInfo(ctx context.Context) (*p2p.PeerInfo, error) {
 	var r *p2p.PeerInfo
-	err := ec.c.CallContext(ctx, &r, "admin_nodeInfo")
+	err := ec.CallContext(ctx, &r, "admin_nodeInfo")
 	if err != nil {
 		return nil, err
 	}
@@ -19,13 +19,20 @@ package ethclient
 import (
 	"context"
 	"strings"
+	"time"
 
 	"github.com/ethereum/go-ethereum/rpc"
 )
 
 // Client defines typed wrappers for the Ethereum RPC API.
 type Client struct {
-	c *rpc.Client
+	c        *rpc.Client
+	endpoint string
+	hooks    Hooks
+	// reconnect is the options of the reconnecting mode, nil means disabled
+	reconnect *ReconnectConfig
+	// pollInterval is the interval to emulate the subscriptions over HTTP
+	pollInterval time.Duration
 }
 
 // Dial connects a client to the given URL.
@@ -45,15 +52,83 @@ func DialContext(ctx context.Context, endpoint string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(c), nil
+	ec := NewClient(c)
+	ec.endpoint = Endpoint(endpoint)
+	return ec, nil
 }
 
 // NewClient creates a client that uses the given RPC client.
 func NewClient(c *rpc.Client) *Client {
-	return &Client{c}
+	return &Client{c: c}
+}
+
+// WithHooks returns a copy of the client which invokes the given hooks before and
+// after each JSON-RPC call.
+func (ec *Client) WithHooks(hooks ...Hook) *Client {
+	c := *ec
+	c.hooks = append(append(Hooks{}, ec.hooks...), hooks...)
+	return &c
 }
 
 // Close closes an existing RPC connection.
 func (ec *Client) Close() {
 	ec.c.Close()
 }
+
+// CallContext performs a JSON-RPC call with the given arguments. If the context is
+// canceled before the call has successfully returned, CallContext returns immediately.
+//
+// The result must be a pointer so that package json can unmarshal into it. You
+// can also pass nil, in which case the result is ignored.
+func (ec *Client) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if len(ec.hooks) == 0 {
+		return ec.call(ctx, result, method, args...)
+	}
+	info := &CallInfo{
+		Method:     method,
+		ParamsSize: ParamsSize(args...),
+		Endpoint:   ec.endpoint,
+		Attempt:    1,
+	}
+	return ec.hooks.Call(ctx, info, func(ctx context.Context) error {
+		return ec.call(ctx, result, method, args...)
+	})
+}
+
+// batchCallContext sends all given requests as a single batch with the hooks.
+func (ec *Client) batchCallContext(ctx context.Context, b []rpc.BatchElem) error {
+	if len(ec.hooks) == 0 {
+		return ec.batchCall(ctx, b)
+	}
+	info := &CallInfo{
+		Method:   "batch",
+		Endpoint: ec.endpoint,
+		Attempt:  1,
+	}
+	for _, elem := range b {
+		info.ParamsSize += ParamsSize(elem.Args...)
+	}
+	return ec.hooks.Call(ctx, info, func(ctx context.Context) error {
+		return ec.batchCall(ctx, b)
+	})
+}
+
+// ethSubscribe registers a subscription under the "eth" namespace with the hooks.
+func (ec *Client) ethSubscribe(ctx context.Context, channel interface{}, args ...interface{}) (*rpc.ClientSubscription, error) {
+	if len(ec.hooks) == 0 {
+		return ec.c.EthSubscribe(ctx, channel, args...)
+	}
+	info := &CallInfo{
+		Method:     "eth_subscribe",
+		ParamsSize: ParamsSize(args...),
+		Endpoint:   ec.endpoint,
+		Attempt:    1,
+	}
+	var sub *rpc.ClientSubscription
+	err := ec.hooks.Call(ctx, info, func(ctx context.Context) error {
+		var err error
+		sub, err = ec.c.EthSubscribe(ctx, channel, args...)
+		return err
+	})
+	return sub, err
+}
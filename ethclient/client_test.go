@@ -0,0 +1,178 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethclient_test
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/getamis/hypereth/ethclient"
+	"github.com/getamis/hypereth/testutil"
+)
+
+func TestClient(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	chain := testutil.NewChain(testutil.ChainConfig{
+		NetworkID: 5,
+		Alloc:     map[common.Address]*big.Int{from: big.NewInt(1e18)},
+	})
+	node, err := testutil.NewNode(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	chain.AddBlocks(3)
+
+	for _, url := range []string{node.HTTPURL(), node.WSURL()} {
+		t.Run(url[:4], func(t *testing.T) {
+			ctx := context.Background()
+			ec, err := ethclient.Dial(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ec.Close()
+
+			if id, err := ec.NetworkID(ctx); err != nil || id.Uint64() != 5 {
+				t.Fatalf("got network id %v, err %v, want 5", id, err)
+			}
+			head := chain.Head()
+			if n, err := ec.BlockNumber(ctx); err != nil || n.Uint64() != head.NumberU64() {
+				t.Fatalf("got block number %v, err %v, want %d", n, err, head.NumberU64())
+			}
+			if b, err := ec.BlockByNumber(ctx, nil); err != nil || b.Hash() != head.Hash() {
+				t.Fatalf("got latest block err %v, want %x", err, head.Hash())
+			}
+			if h, err := ec.HeaderByHash(ctx, head.ParentHash()); err != nil || h.Number.Uint64() != head.NumberU64()-1 {
+				t.Fatalf("got parent header err %v, want number %d", err, head.NumberU64()-1)
+			}
+
+			// Send a transaction and mine it
+			nonce, err := ec.PendingNonceAt(ctx, from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			to := common.HexToAddress("0x01")
+			tx, err := types.SignTx(types.NewTransaction(nonce, to, big.NewInt(1), 21000, big.NewInt(1), nil), types.NewEIP155Signer(chain.ChainID()), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ec.SendTransaction(ctx, tx); err != nil {
+				t.Fatal(err)
+			}
+			if _, isPending, err := ec.TransactionByHash(ctx, tx.Hash()); err != nil || !isPending {
+				t.Fatalf("got pending %v, err %v, want a pending transaction", isPending, err)
+			}
+			block := chain.AddBlock()
+			receipt, err := ec.TransactionReceipt(ctx, tx.Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if receipt.Status != types.ReceiptStatusSuccessful {
+				t.Fatalf("got receipt status %d, want successful", receipt.Status)
+			}
+			if mined, err := ec.TransactionInBlock(ctx, block.Hash(), 0); err != nil || mined.Hash() != tx.Hash() {
+				t.Fatalf("got transaction err %v, want %x mined in %x", err, tx.Hash(), block.Hash())
+			}
+			if balance, err := ec.BalanceAt(ctx, to, nil); err != nil || balance.Sign() <= 0 {
+				t.Fatalf("got balance %v, err %v, want the transferred value", balance, err)
+			}
+
+			// The injected error is returned once
+			node.SetFault("eth_blockNumber", testutil.Fault{Err: errors.New("boom"), Count: 1})
+			if _, err := ec.BlockNumber(ctx); err == nil || err.Error() != "boom" {
+				t.Fatalf("got err %v, want the injected error", err)
+			}
+			if _, err := ec.BlockNumber(ctx); err != nil {
+				t.Fatalf("got err %v after the fault", err)
+			}
+		})
+	}
+}
+
+func TestClientSubscribeNewHead(t *testing.T) {
+	node := startNode(t)
+	defer node.Close()
+	chain := node.Chain()
+
+	for _, url := range []string{node.HTTPURL(), node.WSURL()} {
+		t.Run(url[:4], func(t *testing.T) {
+			ec, err := ethclient.Dial(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ec.Close()
+
+			ch := make(chan *types.Header, 16)
+			sub, err := ec.WithPollInterval(20*time.Millisecond).SubscribeNewHead(context.Background(), ch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Unsubscribe()
+
+			for _, b := range chain.AddBlocks(3) {
+				if h := receiveHead(t, ch); h.Hash() != b.Hash() {
+					t.Fatalf("got head %d %x, want %d %x", h.Number, h.Hash(), b.Number(), b.Hash())
+				}
+			}
+		})
+	}
+}
+
+func TestClientAdminPeers(t *testing.T) {
+	node := startNode(t)
+	defer node.Close()
+	peer := startNode(t)
+	defer peer.Close()
+
+	ec, err := ethclient.Dial(node.WSURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ec.Close()
+
+	ctx := context.Background()
+	if err := ec.AddPeer(ctx, peer.Enode().String()); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := ec.AdminPeers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].ID != peer.Enode().ID().String() {
+		t.Fatalf("got peers %+v, want %s", peers, peer.Enode().ID())
+	}
+	if err := ec.RemovePeer(ctx, peer.Enode().String()); err != nil {
+		t.Fatal(err)
+	}
+	if peers, err := ec.AdminPeers(ctx); err != nil || len(peers) != 0 {
+		t.Fatalf("got %d peers, err %v, want none", len(peers), err)
+	}
+}
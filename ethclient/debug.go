@@ -23,7 +23,7 @@ import (
 // Metrics gets the metrics.
 func (ec *Client) Metrics(ctx context.Context) (map[string]interface{}, error) {
 	r := make(map[string]interface{})
-	err := ec.c.CallContext(ctx, &r, "debug_metrics", true)
+	err := ec.CallContext(ctx, &r, "debug_metrics", true)
 	if err != nil {
 		return nil, err
 	}
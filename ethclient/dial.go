@@ -0,0 +1,304 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	netURL "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/getamis/sirius/log"
+)
+
+// defaultJWTRefresh is the default period to issue a new JWT token.
+const defaultJWTRefresh = 30 * time.Second
+
+var (
+	// ErrUnsupportedDialConfig is returned if the dial config is not supported by the
+	// scheme of the endpoint. The websocket endpoints only support basic auth, and the
+	// IPC endpoints support nothing. The recorder is ignored by both.
+	ErrUnsupportedDialConfig = errors.New("unsupported dial config")
+	// ErrInvalidJWTSecret is returned if the JWT secret is not a 32 bytes hex string.
+	ErrInvalidJWTSecret = errors.New("invalid JWT secret")
+)
+
+// DialConfig represents the authentication and transport options to dial an endpoint.
+// All options except basic auth are only supported by HTTP endpoints.
+type DialConfig struct {
+	// Headers are the HTTP headers sent with each request.
+	Headers map[string]string `yaml:"headers" json:"headers"`
+	// Username and Password are the credentials of HTTP basic auth.
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	// BearerToken is the static token sent in the Authorization header.
+	BearerToken string `yaml:"bearerToken" json:"bearerToken"`
+	// JWTSecret is the hex encoded 32 bytes secret to sign the JWT tokens sent in the
+	// Authorization header, e.g. the secret of the geth engine API. JWTSecretFile is the
+	// file containing the secret. A new token is issued every JWTRefresh, which is 30
+	// seconds if not set.
+	JWTSecret     string        `yaml:"jwtSecret" json:"jwtSecret"`
+	JWTSecretFile string        `yaml:"jwtSecretFile" json:"jwtSecretFile"`
+	JWTRefresh    time.Duration `yaml:"jwtRefresh" json:"jwtRefresh"`
+	// CAFile is the PEM encoded CA certificates to verify the server. Set to empty means
+	// the system CAs.
+	CAFile string `yaml:"caFile" json:"caFile"`
+	// CertFile and KeyFile are the PEM encoded client certificate and key for mutual TLS.
+	CertFile string `yaml:"certFile" json:"certFile"`
+	KeyFile  string `yaml:"keyFile" json:"keyFile"`
+	// ServerName overrides the server name to verify the server certificate.
+	ServerName         string `yaml:"serverName" json:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify" json:"insecureSkipVerify"`
+	// TLSConfig overrides the TLS options above if set.
+	TLSConfig *tls.Config `yaml:"-" json:"-"`
+	// Timeout is the timeout of each HTTP request. Set to 0 means no timeout.
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+	// Recorder records the JSON-RPC calls over HTTP if set. The calls over websocket
+	// and IPC are not recorded, and a warning is logged when they are dialed.
+	Recorder *Recorder `yaml:"-" json:"-"`
+}
+
+// DialWithConfig connects a client to the given URL with the dial config.
+func DialWithConfig(ctx context.Context, endpoint string, config *DialConfig) (*Client, error) {
+	c, err := DialRPC(ctx, endpoint, config)
+	if err != nil {
+		return nil, err
+	}
+	ec := NewClient(c)
+	ec.endpoint = Endpoint(endpoint)
+	return ec, nil
+}
+
+// DialRPC connects a RPC client to the given URL with the dial config. A nil config
+// means dialing with the URL only.
+func DialRPC(ctx context.Context, endpoint string, config *DialConfig) (*rpc.Client, error) {
+	if config == nil {
+		return rpc.DialContext(ctx, endpoint)
+	}
+	u, err := netURL.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if config.Recorder != nil && u.Scheme != "http" && u.Scheme != "https" {
+		log.Warn("Recording is only supported over HTTP, the calls are not recorded", "endpoint", Endpoint(endpoint))
+		cc := *config
+		cc.Recorder = nil
+		config = &cc
+	}
+	switch u.Scheme {
+	case "http", "https":
+		client, err := config.httpClient()
+		if err != nil {
+			return nil, err
+		}
+		return rpc.DialHTTPWithClient(endpoint, client)
+	case "ws", "wss":
+		if !config.basicAuthOnly() {
+			return nil, ErrUnsupportedDialConfig
+		}
+		// The websocket client only supports basic auth in the url
+		if config.Username != "" {
+			u.User = netURL.UserPassword(config.Username, config.Password)
+		}
+		return rpc.DialWebsocket(ctx, u.String(), "")
+	default:
+		if !config.empty() {
+			return nil, ErrUnsupportedDialConfig
+		}
+		return rpc.DialContext(ctx, endpoint)
+	}
+}
+
+// basicAuthOnly reports whether the config has no options other than basic auth.
+func (c *DialConfig) basicAuthOnly() bool {
+	cc := *c
+	cc.Username, cc.Password = "", ""
+	return cc.empty()
+}
+
+func (c *DialConfig) empty() bool {
+	return len(c.Headers) == 0 && c.Username == "" && c.Password == "" && c.BearerToken == "" &&
+		c.JWTSecret == "" && c.JWTSecretFile == "" && c.CAFile == "" && c.CertFile == "" &&
+		c.KeyFile == "" && c.ServerName == "" && !c.InsecureSkipVerify && c.TLSConfig == nil &&
+		c.Timeout == 0 && c.Recorder == nil
+}
+
+// httpClient creates the HTTP client sending the authentication headers.
+func (c *DialConfig) httpClient() (*http.Client, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	t := &authTransport{
+		base: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+		headers:  c.Headers,
+		username: c.Username,
+		password: c.Password,
+	}
+	if c.BearerToken != "" {
+		token := c.BearerToken
+		t.token = func() (string, error) {
+			return token, nil
+		}
+	}
+	if c.JWTSecret != "" || c.JWTSecretFile != "" {
+		secret, err := c.jwtSecret()
+		if err != nil {
+			return nil, err
+		}
+		refresh := c.JWTRefresh
+		if refresh <= 0 {
+			refresh = defaultJWTRefresh
+		}
+		t.token = newJWTSource(secret, refresh).token
+	}
+	var transport http.RoundTripper = t
+	if c.Recorder != nil {
+		transport = c.Recorder.transport(transport)
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   c.Timeout,
+	}, nil
+}
+
+func (c *DialConfig) tlsConfig() (*tls.Config, error) {
+	if c.TLSConfig != nil {
+		return c.TLSConfig, nil
+	}
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificate found in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func (c *DialConfig) jwtSecret() ([]byte, error) {
+	s := c.JWTSecret
+	if s == "" {
+		b, err := ioutil.ReadFile(c.JWTSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		s = string(b)
+	}
+	secret, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(s), "0x"))
+	if err != nil || len(secret) != 32 {
+		return nil, ErrInvalidJWTSecret
+	}
+	return secret, nil
+}
+
+// authTransport sends the headers and credentials with each request.
+type authTransport struct {
+	base     http.RoundTripper
+	headers  map[string]string
+	username string
+	password string
+	// token returns the bearer token, nil means no token
+	token func() (string, error)
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The request must not be modified, so clone it with the headers.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+len(t.headers)+1)
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	for k, v := range t.headers {
+		r.Header.Set(k, v)
+	}
+	if t.username != "" || t.password != "" {
+		r.SetBasicAuth(t.username, t.password)
+	}
+	if t.token != nil {
+		token, err := t.token()
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return t.base.RoundTrip(r)
+}
+
+// jwtSource issues the JWT tokens with the issued-at claim, and reuses a token until
+// the refresh period passes.
+type jwtSource struct {
+	secret  []byte
+	refresh time.Duration
+
+	lock     sync.Mutex
+	current  string
+	issuedAt time.Time
+}
+
+func newJWTSource(secret []byte, refresh time.Duration) *jwtSource {
+	return &jwtSource{
+		secret:  secret,
+		refresh: refresh,
+	}
+}
+
+func (s *jwtSource) token() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if s.current != "" && now.Sub(s.issuedAt) < s.refresh {
+		return s.current, nil
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iat": now.Unix(),
+	}).SignedString(s.secret)
+	if err != nil {
+		return "", err
+	}
+	s.current, s.issuedAt = token, now
+	return token, nil
+}
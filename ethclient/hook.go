@@ -0,0 +1,123 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethclient
+
+import (
+	"context"
+	"encoding/json"
+	netURL "net/url"
+	"time"
+
+	"github.com/getamis/sirius/log"
+)
+
+// CallInfo describes a JSON-RPC call passed to the hooks.
+type CallInfo struct {
+	// Method is the JSON-RPC method, or "batch" for batch calls.
+	Method string
+	// ParamsSize is the size of the JSON encoded params in bytes.
+	ParamsSize int
+	// Endpoint is the scheme and host of the eth client, the credentials and path are
+	// omitted. It's empty if unknown.
+	Endpoint string
+	// Attempt is the attempt number starting from 1. Set to 0 means the logical call
+	// spanning all attempts, e.g. the retries on multiple eth clients.
+	Attempt int
+}
+
+// Hook is invoked before and after each JSON-RPC call, e.g. to start and end tracing
+// spans or to write structured logs.
+type Hook interface {
+	// BeforeCall is called before the call. The returned context is used by the call
+	// and passed to AfterCall, so the attempts of a logical call are its children.
+	BeforeCall(ctx context.Context, info *CallInfo) context.Context
+	// AfterCall is called after the call with the error of the call.
+	AfterCall(ctx context.Context, info *CallInfo, err error)
+}
+
+// Hooks runs the hooks in order before the call and in reverse order after the call.
+type Hooks []Hook
+
+func (hs Hooks) BeforeCall(ctx context.Context, info *CallInfo) context.Context {
+	for _, h := range hs {
+		ctx = h.BeforeCall(ctx, info)
+	}
+	return ctx
+}
+
+func (hs Hooks) AfterCall(ctx context.Context, info *CallInfo, err error) {
+	for i := len(hs) - 1; i >= 0; i-- {
+		hs[i].AfterCall(ctx, info, err)
+	}
+}
+
+// Call runs the call with the hooks.
+func (hs Hooks) Call(ctx context.Context, info *CallInfo, call func(ctx context.Context) error) error {
+	if len(hs) == 0 {
+		return call(ctx)
+	}
+	ctx = hs.BeforeCall(ctx, info)
+	err := call(ctx)
+	hs.AfterCall(ctx, info, err)
+	return err
+}
+
+// ParamsSize returns the size of the JSON encoded params in bytes.
+func ParamsSize(params ...interface{}) int {
+	if len(params) == 0 {
+		return 0
+	}
+	b, err := json.Marshal(params)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+// Endpoint returns the scheme and host of the url, or the url itself if it has no
+// host, e.g. an IPC path.
+func Endpoint(rawURL string) string {
+	u, err := netURL.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// NewLogHook returns a hook which logs each call with the logger in debug level.
+func NewLogHook(logger log.Logger) Hook {
+	return &logHook{logger: logger}
+}
+
+type logHook struct {
+	logger log.Logger
+}
+
+// callStartKey is the context key of the start time of a call.
+type callStartKey struct{}
+
+func (h *logHook) BeforeCall(ctx context.Context, info *CallInfo) context.Context {
+	return context.WithValue(ctx, callStartKey{}, time.Now())
+}
+
+func (h *logHook) AfterCall(ctx context.Context, info *CallInfo, err error) {
+	var elapsed time.Duration
+	if start, ok := ctx.Value(callStartKey{}).(time.Time); ok {
+		elapsed = time.Since(start)
+	}
+	h.logger.Debug("JSON-RPC call", "method", info.Method, "paramsSize", info.ParamsSize, "endpoint", info.Endpoint, "attempt", info.Attempt, "elapsed", elapsed, "err", err)
+}
@@ -21,10 +21,10 @@ import "context"
 // StartMining starts mining operation.
 func (ec *Client) StartMining(ctx context.Context) error {
 	var r []byte
-	return ec.c.CallContext(ctx, &r, "miner_start", nil)
+	return ec.CallContext(ctx, &r, "miner_start", nil)
 }
 
 // StopMining stops mining.
 func (ec *Client) StopMining(ctx context.Context) error {
-	return ec.c.CallContext(ctx, nil, "miner_stop", nil)
+	return ec.CallContext(ctx, nil, "miner_stop", nil)
 }
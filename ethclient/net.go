@@ -28,7 +28,7 @@ import (
 func (ec *Client) NetworkID(ctx context.Context) (*big.Int, error) {
 	version := new(big.Int)
 	var ver string
-	if err := ec.c.CallContext(ctx, &ver, "net_version"); err != nil {
+	if err := ec.CallContext(ctx, &ver, "net_version"); err != nil {
 		return nil, err
 	}
 	if _, ok := version.SetString(ver, 10); !ok {
@@ -40,7 +40,7 @@ func (ec *Client) NetworkID(ctx context.Context) (*big.Int, error) {
 // PeerCount returns the number of peers.
 func (ec *Client) PeerCount(ctx context.Context) (uint64, error) {
 	var result hexutil.Uint64
-	if err := ec.c.CallContext(ctx, &result, "net_peerCount"); err != nil {
+	if err := ec.CallContext(ctx, &result, "net_peerCount"); err != nil {
 		return uint64(0), err
 	}
 	return uint64(result), nil
@@ -0,0 +1,66 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package oc provides the ethclient hooks of OpenCensus.
+package oc
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/getamis/hypereth/ethclient"
+	"go.opencensus.io/trace"
+)
+
+// hookCounter is the id of the last trace hook.
+var hookCounter uint64
+
+// NewTraceHook returns a hook which starts an OpenCensus span for each call.
+func NewTraceHook() ethclient.Hook {
+	return &traceHook{id: atomic.AddUint64(&hookCounter, 1)}
+}
+
+type traceHook struct {
+	id uint64
+}
+
+// spanKey is the context key of the span started by the trace hook of the id. Each hook
+// ends its own span even if the spans of other hooks are started after it.
+type spanKey uint64
+
+func (h *traceHook) BeforeCall(ctx context.Context, info *ethclient.CallInfo) context.Context {
+	ctx, span := trace.StartSpan(ctx, "ethclient."+info.Method, trace.WithSpanKind(trace.SpanKindClient))
+	span.AddAttributes(
+		trace.StringAttribute("rpc.method", info.Method),
+		trace.Int64Attribute("rpc.params_size", int64(info.ParamsSize)),
+		trace.Int64Attribute("rpc.attempt", int64(info.Attempt)),
+	)
+	if info.Endpoint != "" {
+		span.AddAttributes(trace.StringAttribute("rpc.endpoint", info.Endpoint))
+	}
+	return context.WithValue(ctx, spanKey(h.id), span)
+}
+
+func (h *traceHook) AfterCall(ctx context.Context, info *ethclient.CallInfo, err error) {
+	span, ok := ctx.Value(spanKey(h.id)).(*trace.Span)
+	if !ok {
+		return
+	}
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	span.End()
+}
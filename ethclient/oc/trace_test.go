@@ -0,0 +1,110 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package oc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/getamis/hypereth/ethclient"
+	"go.opencensus.io/trace"
+)
+
+// spanRecorder records the ended spans.
+type spanRecorder struct {
+	lock  sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func TestTraceHookNested(t *testing.T) {
+	r := &spanRecorder{}
+	trace.RegisterExporter(r)
+	defer trace.UnregisterExporter(r)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+
+	// the outer hook must end its own span, not the span of the inner hook
+	hooks := ethclient.Hooks{NewTraceHook(), NewTraceHook()}
+	wantErr := errors.New("call failed")
+	info := &ethclient.CallInfo{Method: "eth_blockNumber", Endpoint: "http://127.0.0.1:8545", Attempt: 1}
+	err := hooks.Call(context.Background(), info, func(ctx context.Context) error {
+		return wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("got error %v, want %v", err, wantErr)
+	}
+
+	if len(r.spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(r.spans))
+	}
+	inner, outer := r.spans[0], r.spans[1]
+	if inner.SpanID == outer.SpanID {
+		t.Fatalf("got the same span %v ended twice", inner.SpanID)
+	}
+	if inner.ParentSpanID != outer.SpanID {
+		t.Fatalf("got parent %v, want %v", inner.ParentSpanID, outer.SpanID)
+	}
+	for _, s := range r.spans {
+		if s.Name != "ethclient.eth_blockNumber" {
+			t.Fatalf("got span name %q, want %q", s.Name, "ethclient.eth_blockNumber")
+		}
+		if s.Status.Message != wantErr.Error() {
+			t.Fatalf("got status %q, want %q", s.Status.Message, wantErr.Error())
+		}
+		if s.Attributes["rpc.endpoint"] != info.Endpoint {
+			t.Fatalf("got endpoint %v, want %v", s.Attributes["rpc.endpoint"], info.Endpoint)
+		}
+	}
+}
+
+func TestTraceHookAttempts(t *testing.T) {
+	r := &spanRecorder{}
+	trace.RegisterExporter(r)
+	defer trace.UnregisterExporter(r)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+
+	// the attempts of a logical call are the children of its span
+	hook := NewTraceHook()
+	logical := &ethclient.CallInfo{Method: "eth_chainId"}
+	ctx := hook.BeforeCall(context.Background(), logical)
+	for i := 1; i <= 2; i++ {
+		attempt := &ethclient.CallInfo{Method: "eth_chainId", Attempt: i}
+		attemptCtx := hook.BeforeCall(ctx, attempt)
+		hook.AfterCall(attemptCtx, attempt, nil)
+	}
+	hook.AfterCall(ctx, logical, nil)
+
+	if len(r.spans) != 3 {
+		t.Fatalf("got %d spans, want 3", len(r.spans))
+	}
+	parent := r.spans[2]
+	for i, s := range r.spans[:2] {
+		if s.ParentSpanID != parent.SpanID {
+			t.Fatalf("attempt %d: got parent %v, want %v", i+1, s.ParentSpanID, parent.SpanID)
+		}
+		if s.Attributes["rpc.attempt"] != int64(i+1) {
+			t.Fatalf("attempt %d: got attempt attribute %v", i+1, s.Attributes["rpc.attempt"])
+		}
+	}
+}
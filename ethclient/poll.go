@@ -0,0 +1,169 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethclient
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/getamis/sirius/log"
+)
+
+const (
+	defaultPollInterval = 4 * time.Second
+	// maxPollBlocks is the maximum number of blocks to catch up in a poll.
+	maxPollBlocks = 128
+)
+
+// WithPollInterval returns a copy of the client which polls at the given interval to
+// emulate the subscriptions over HTTP. The default interval is 4 seconds.
+func (ec *Client) WithPollInterval(interval time.Duration) *Client {
+	c := *ec
+	c.pollInterval = interval
+	return &c
+}
+
+// The subscriptions over HTTP are emulated by polling the block number, instead of the
+// filters of eth_newFilter, since the filters are lost when the node restarts and are
+// not shared by the nodes behind a load balancer.
+func (ec *Client) poll(fn func(ctx context.Context, quit <-chan struct{}) bool) ethereum.Subscription {
+	interval := ec.pollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-quit:
+				return nil
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			ok := fn(ctx, quit)
+			cancel()
+			if !ok {
+				return nil
+			}
+		}
+	})
+}
+
+// pollNewHead emulates the new head subscription by polling the latest head. The heads
+// skipped between polls are fetched by number, and a different head of the same number
+// is sent on reorg. The lower heads are ignored, since they are served by the lagging
+// nodes behind a load balancer.
+func (ec *Client) pollNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	last, err := ec.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	logger := log.New("endpoint", ec.endpoint, "subscription", "newHeads")
+	logger.Debug("Notifications unsupported, polling new heads")
+
+	send := func(head *types.Header, quit <-chan struct{}) bool {
+		select {
+		case ch <- head:
+			last = head
+			return true
+		case <-quit:
+			return false
+		}
+	}
+	return ec.poll(func(ctx context.Context, quit <-chan struct{}) bool {
+		head, err := ec.HeaderByNumber(ctx, nil)
+		if err != nil {
+			logger.Debug("Failed to poll head", "err", err)
+			return true
+		}
+		switch head.Number.Cmp(last.Number) {
+		case -1:
+			return true
+		case 0:
+			if head.Hash() != last.Hash() {
+				return send(head, quit)
+			}
+			return true
+		}
+
+		from := new(big.Int).Add(last.Number, big.NewInt(1))
+		if min := new(big.Int).Sub(head.Number, big.NewInt(maxPollBlocks)); from.Cmp(min) < 0 {
+			from = min
+		}
+		for n := from; n.Cmp(head.Number) < 0; n = new(big.Int).Add(n, big.NewInt(1)) {
+			h, err := ec.HeaderByNumber(ctx, n)
+			if err != nil {
+				logger.Debug("Failed to poll head", "number", n, "err", err)
+				return true
+			}
+			if !send(h, quit) {
+				return false
+			}
+		}
+		return send(head, quit)
+	}), nil
+}
+
+// pollFilterLogs emulates the logs subscription by querying the logs of the new blocks
+// since the last poll. The removed logs on reorg are not sent.
+func (ec *Client) pollFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	head, err := ec.BlockNumber(ctx)
+	if err != nil {
+		return nil, err
+	}
+	last := head.Uint64()
+	logger := log.New("endpoint", ec.endpoint, "subscription", "logs")
+	logger.Debug("Notifications unsupported, polling logs")
+
+	return ec.poll(func(ctx context.Context, quit <-chan struct{}) bool {
+		head, err := ec.BlockNumber(ctx)
+		if err != nil {
+			logger.Debug("Failed to poll head", "err", err)
+			return true
+		}
+		to := head.Uint64()
+		if to <= last {
+			return true
+		}
+		from := last + 1
+		if to-from+1 > maxPollBlocks {
+			from = to - maxPollBlocks + 1
+		}
+		q.FromBlock = new(big.Int).SetUint64(from)
+		q.ToBlock = new(big.Int).SetUint64(to)
+		logs, err := ec.FilterLogs(ctx, q)
+		if err != nil {
+			logger.Debug("Failed to poll logs", "from", from, "to", to, "err", err)
+			return true
+		}
+		for _, l := range logs {
+			select {
+			case ch <- l:
+			case <-quit:
+				return false
+			}
+		}
+		last = to
+		return true
+	}), nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethclient_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/getamis/hypereth/ethclient"
+	"github.com/getamis/hypereth/testutil"
+)
+
+func TestPollNewHead(t *testing.T) {
+	node := startNode(t)
+	defer node.Close()
+	chain := node.Chain()
+	chain.AddBlocks(3)
+
+	ec, err := ethclient.Dial(node.HTTPURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ec.Close()
+	ch := make(chan *types.Header, 16)
+	sub, err := ec.WithPollInterval(20*time.Millisecond).SubscribeNewHead(context.Background(), ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	// The skipped heads are sent in order
+	blocks := chain.AddBlocks(2)
+	for _, b := range blocks {
+		if h := receiveHead(t, ch); h.Hash() != b.Hash() {
+			t.Fatalf("got head %d %x, want %d %x", h.Number, h.Hash(), b.Number(), b.Hash())
+		}
+	}
+
+	// The lower heads of a lagging node are ignored
+	node.SetLag(2)
+	select {
+	case h := <-ch:
+		t.Fatalf("got lower head %d", h.Number)
+	case <-time.After(200 * time.Millisecond):
+	}
+	node.SetLag(0)
+
+	// A different head of the same number is sent on reorg
+	reorged, err := chain.Reorg(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := receiveHead(t, ch); h.Hash() != reorged[0].Hash() || h.Number.Cmp(blocks[1].Number()) != 0 {
+		t.Fatalf("got head %d %x, want reorged head %d %x", h.Number, h.Hash(), reorged[0].Number(), reorged[0].Hash())
+	}
+}
+
+func startNode(t *testing.T) *testutil.Node {
+	node, err := testutil.NewNode(testutil.NewChain(testutil.ChainConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func receiveHead(t *testing.T, ch <-chan *types.Header) *types.Header {
+	select {
+	case h := <-ch:
+		return h
+	case <-time.After(5 * time.Second):
+		t.Fatal("no head received")
+		return nil
+	}
+}
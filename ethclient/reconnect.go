@@ -0,0 +1,332 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethclient
+
+import (
+	"context"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/getamis/sirius/log"
+)
+
+const (
+	defaultMinBackoff  = 1 * time.Second
+	defaultMaxBackoff  = 30 * time.Second
+	defaultMaxBackfill = 128
+	// resubscribeTimeout is the timeout to resubscribe and backfill after reconnecting.
+	resubscribeTimeout = 30 * time.Second
+	// maxRequestAttempts bounds the attempts of a request in the reconnecting mode,
+	// including the ones failing to be written to the lost connection.
+	maxRequestAttempts = 3
+)
+
+// ReconnectConfig represents the options of the reconnecting mode.
+type ReconnectConfig struct {
+	// MinBackoff and MaxBackoff bound the exponential backoff to resubscribe after the
+	// connection is lost. They are 1 and 30 seconds if not set.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxBackfill is the maximum number of blocks to backfill the missed heads and logs
+	// after resubscribing. It's 128 if not set.
+	MaxBackfill uint64
+}
+
+// WithReconnect returns a copy of the client in the reconnecting mode. The underlying
+// RPC client redials on the next request after the connection is lost, so the failed
+// requests on a lost connection are retried once, and the subscriptions resubscribe
+// with backoff and backfill the missed heads and logs by block range. The errors of
+// the subscriptions are never sent until they are unsubscribed.
+func (ec *Client) WithReconnect(config ReconnectConfig) *Client {
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = defaultMinBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = defaultMaxBackoff
+		if config.MaxBackoff < config.MinBackoff {
+			config.MaxBackoff = config.MinBackoff
+		}
+	}
+	if config.MaxBackfill == 0 {
+		config.MaxBackfill = defaultMaxBackfill
+	}
+	c := *ec
+	c.reconnect = &config
+	return &c
+}
+
+// isDisconnected reports whether the error is caused by the lost connection.
+func isDisconnected(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// resubscribe keeps the subscription alive until it's unsubscribed. The subscribe
+// function is called to resubscribe with backoff after the subscription fails, and
+// the forward function forwards the notifications until the subscription fails.
+func (ec *Client) resubscribe(logger log.Logger, sub ethereum.Subscription, subscribe func(ctx context.Context) (ethereum.Subscription, error), forward func(sub ethereum.Subscription, quit <-chan struct{}) error) ethereum.Subscription {
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		backoff := ec.reconnect.MinBackoff
+		for {
+			err := forward(sub, quit)
+			sub.Unsubscribe()
+			if err == nil {
+				return nil
+			}
+			logger.Warn("Subscription failed, resubscribing", "err", err)
+
+			for {
+				select {
+				case <-time.After(backoff):
+				case <-quit:
+					return nil
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), resubscribeTimeout)
+				sub, err = subscribe(ctx)
+				cancel()
+				if err == nil {
+					logger.Info("Resubscribed")
+					backoff = ec.reconnect.MinBackoff
+					break
+				}
+				logger.Debug("Failed to resubscribe", "backoff", backoff, "err", err)
+				if backoff *= 2; backoff > ec.reconnect.MaxBackoff {
+					backoff = ec.reconnect.MaxBackoff
+				}
+			}
+		}
+	})
+}
+
+// resubscribeNewHead subscribes new heads in the reconnecting mode. The missed heads
+// are backfilled before the first head after resubscribing.
+func (ec *Client) resubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	headCh := make(chan *types.Header)
+	subscribe := func(ctx context.Context) (ethereum.Subscription, error) {
+		return ec.ethSubscribe(ctx, headCh, "newHeads")
+	}
+	sub, err := subscribe(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := log.New("endpoint", ec.endpoint, "subscription", "newHeads")
+	// last is the number of the last forwarded head
+	var last *big.Int
+	backfill := false
+	forward := func(sub ethereum.Subscription, quit <-chan struct{}) error {
+		for {
+			select {
+			case head := <-headCh:
+				if backfill && last != nil {
+					if !ec.backfillHeads(logger, last, head.Number, ch, quit) {
+						return nil
+					}
+				}
+				backfill = false
+				select {
+				case ch <- head:
+				case <-quit:
+					return nil
+				}
+				last = head.Number
+			case err := <-sub.Err():
+				backfill = true
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}
+	return ec.resubscribe(logger, sub, subscribe, forward), nil
+}
+
+// backfillHeads sends the heads between last and next exclusively. It returns false if
+// the subscription is unsubscribed.
+func (ec *Client) backfillHeads(logger log.Logger, last, next *big.Int, ch chan<- *types.Header, quit <-chan struct{}) bool {
+	from := new(big.Int).Add(last, big.NewInt(1))
+	if min := new(big.Int).Sub(next, new(big.Int).SetUint64(ec.reconnect.MaxBackfill)); from.Cmp(min) < 0 {
+		logger.Warn("Too many missed heads, skip the older ones", "from", from, "to", min)
+		from = min
+	}
+	for n := from; n.Cmp(next) < 0; n = new(big.Int).Add(n, big.NewInt(1)) {
+		ctx, cancel := context.WithTimeout(context.Background(), resubscribeTimeout)
+		head, err := ec.HeaderByNumber(ctx, n)
+		cancel()
+		if err != nil {
+			logger.Warn("Failed to backfill head", "number", n, "err", err)
+			return true
+		}
+		select {
+		case ch <- head:
+		case <-quit:
+			return false
+		}
+	}
+	return true
+}
+
+// resubscribeFilterLogs subscribes logs in the reconnecting mode. The missed logs are
+// backfilled by a filter query from the last known block to the head after
+// resubscribing, and the duplicated logs of the subscription are dropped.
+func (ec *Client) resubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	logCh := make(chan types.Log)
+	subscribe := func(ctx context.Context) (ethereum.Subscription, error) {
+		return ec.ethSubscribe(ctx, logCh, "logs", toFilterArg(q))
+	}
+	sub, err := subscribe(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := log.New("endpoint", ec.endpoint, "subscription", "logs")
+	// last is the last block known to be covered, and the logs of the subscription
+	// until skip are dropped since they are backfilled.
+	var last, skip uint64
+	if head, err := ec.BlockNumber(ctx); err == nil {
+		last = head.Uint64()
+	} else {
+		logger.Warn("Failed to get head, missed logs before the first one are not backfilled", "err", err)
+	}
+	backfill := false
+	forward := func(sub ethereum.Subscription, quit <-chan struct{}) error {
+		if backfill {
+			backfill = false
+			if !ec.backfillLogs(logger, q, &last, &skip, ch, quit) {
+				return nil
+			}
+		}
+		for {
+			select {
+			case l := <-logCh:
+				if !l.Removed && l.BlockNumber <= skip {
+					continue
+				}
+				select {
+				case ch <- l:
+				case <-quit:
+					return nil
+				}
+				if l.BlockNumber > last {
+					last = l.BlockNumber
+				}
+			case err := <-sub.Err():
+				backfill = true
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}
+	return ec.resubscribe(logger, sub, subscribe, forward), nil
+}
+
+// backfillLogs sends the logs after the last known block until the head. It returns
+// false if the subscription is unsubscribed.
+func (ec *Client) backfillLogs(logger log.Logger, q ethereum.FilterQuery, last, skip *uint64, ch chan<- types.Log, quit <-chan struct{}) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), resubscribeTimeout)
+	defer cancel()
+
+	head, err := ec.BlockNumber(ctx)
+	if err != nil {
+		logger.Warn("Failed to get head to backfill logs", "err", err)
+		return true
+	}
+	to := head.Uint64()
+	if *last == 0 || to <= *last {
+		*last = to
+		return true
+	}
+	from := *last + 1
+	if to-from+1 > ec.reconnect.MaxBackfill {
+		logger.Warn("Too many missed blocks, skip the older logs", "from", from, "to", to-ec.reconnect.MaxBackfill)
+		from = to - ec.reconnect.MaxBackfill + 1
+	}
+	q.FromBlock = new(big.Int).SetUint64(from)
+	q.ToBlock = new(big.Int).SetUint64(to)
+	logs, err := ec.FilterLogs(ctx, q)
+	if err != nil {
+		logger.Warn("Failed to backfill logs", "from", from, "to", to, "err", err)
+		return true
+	}
+	for _, l := range logs {
+		select {
+		case ch <- l:
+		case <-quit:
+			return false
+		}
+	}
+	*last, *skip = to, to
+	return true
+}
+
+// call performs the call, and retries once on the lost connection in the reconnecting
+// mode since the RPC client redials on the next request.
+func (ec *Client) call(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	return ec.retry(ctx, method, func() error {
+		return ec.c.CallContext(ctx, result, method, args...)
+	})
+}
+
+// batchCall performs the batch call, and retries once on the lost connection in the
+// reconnecting mode.
+func (ec *Client) batchCall(ctx context.Context, b []rpc.BatchElem) error {
+	return ec.retry(ctx, "batch", func() error {
+		return ec.c.BatchCallContext(ctx, b)
+	})
+}
+
+// retry performs the request, and retries it once on the lost connection in the
+// reconnecting mode. The RPC client keeps writing to the lost connection until a write
+// fails, so the requests failing to be written are not counted since they never reach
+// the node, and the next request redials.
+func (ec *Client) retry(ctx context.Context, method string, request func() error) error {
+	err := request()
+	if ec.reconnect == nil {
+		return err
+	}
+	retried := false
+	for attempt := 1; attempt < maxRequestAttempts && isDisconnected(ctx, err); attempt++ {
+		if !isWriteFailed(err) {
+			if retried {
+				break
+			}
+			retried = true
+		}
+		log.Debug("Connection lost, retrying", "endpoint", ec.endpoint, "method", method, "err", err)
+		err = request()
+	}
+	return err
+}
+
+// isWriteFailed reports whether the request fails to be written to the connection.
+func isWriteFailed(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "write"
+}
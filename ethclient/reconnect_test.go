@@ -0,0 +1,246 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethclient_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/getamis/hypereth/ethclient"
+	"github.com/getamis/hypereth/testutil"
+)
+
+var testReconnectConfig = ethclient.ReconnectConfig{
+	MinBackoff: 10 * time.Millisecond,
+	MaxBackoff: 50 * time.Millisecond,
+}
+
+// keepMining mines a block with the logs every 20ms until the returned function is
+// called, so the subscriptions receive new blocks whenever they resubscribe.
+func keepMining(chain *testutil.Chain, logs ...types.Log) func() {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-time.After(20 * time.Millisecond):
+				chain.AddBlock(logs...)
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+func TestReconnectNewHead(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxBackfill uint64
+		// wantFirst is the first head after the restart
+		wantFirst uint64
+	}{
+		{"backfill all", 0, 3},
+		{"backfill at most 2", 2, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := startNode(t)
+			defer node.Close()
+			chain := node.Chain()
+
+			config := testReconnectConfig
+			config.MaxBackfill = test.maxBackfill
+			ec, err := ethclient.Dial(node.WSURL())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ec.Close()
+			ch := make(chan *types.Header, 64)
+			sub, err := ec.WithReconnect(config).SubscribeNewHead(context.Background(), ch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Unsubscribe()
+
+			for _, b := range chain.AddBlocks(2) {
+				if h := receiveHead(t, ch); h.Hash() != b.Hash() {
+					t.Fatalf("got head %d, want %d", h.Number, b.Number())
+				}
+			}
+
+			// The heads mined during the restart are missed by the subscription
+			node.Stop()
+			chain.AddBlocks(5)
+			if err := node.Start(); err != nil {
+				t.Fatal(err)
+			}
+			stop := keepMining(chain)
+			defer stop()
+
+			first := receiveHead(t, ch)
+			if test.wantFirst != 0 && first.Number.Uint64() != test.wantFirst {
+				t.Fatalf("got first head %d after restart, want %d", first.Number, test.wantFirst)
+			}
+			if test.wantFirst == 0 && first.Number.Uint64() <= 3 {
+				t.Fatalf("got first head %d after restart, want the older ones skipped", first.Number)
+			}
+			// The backfilled and new heads are in order without duplicates
+			last := first
+			for last.Number.Uint64() < 12 {
+				h := receiveHead(t, ch)
+				if h.Number.Uint64() != last.Number.Uint64()+1 || h.ParentHash != last.Hash() {
+					t.Fatalf("got head %d after %d", h.Number, last.Number)
+				}
+				if b := chain.BlockByNumber(h.Number.Uint64()); b.Hash() != h.Hash() {
+					t.Fatalf("got head %d %x, want %x", h.Number, h.Hash(), b.Hash())
+				}
+				last = h
+			}
+			select {
+			case err := <-sub.Err():
+				t.Fatalf("got subscription error %v, want none", err)
+			default:
+			}
+		})
+	}
+}
+
+func TestReconnectFilterLogs(t *testing.T) {
+	node := startNode(t)
+	defer node.Close()
+	chain := node.Chain()
+	addr := common.HexToAddress("0x01")
+	matched := types.Log{Address: addr, Topics: []common.Hash{common.HexToHash("0x02")}}
+	other := types.Log{Address: common.HexToAddress("0x03")}
+
+	ec, err := ethclient.Dial(node.WSURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ec.Close()
+	ch := make(chan types.Log, 64)
+	q := ethereum.FilterQuery{Addresses: []common.Address{addr}}
+	sub, err := ec.WithReconnect(testReconnectConfig).SubscribeFilterLogs(context.Background(), q, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	block := chain.AddBlock(matched, other)
+	if l := receiveLog(t, ch); l.BlockHash != block.Hash() || l.Address != addr {
+		t.Fatalf("got log of block %d %x, want %d", l.BlockNumber, l.Address, block.NumberU64())
+	}
+
+	// The logs mined during the restart are backfilled, and the logs sent by both the
+	// backfill and the new subscription are not duplicated
+	node.Stop()
+	for i := 0; i < 3; i++ {
+		chain.AddBlock(matched, other)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatal(err)
+	}
+	stop := keepMining(chain, matched, other)
+	defer stop()
+
+	for n := block.NumberU64() + 1; n <= block.NumberU64()+8; n++ {
+		l := receiveLog(t, ch)
+		if l.BlockNumber != n || l.Address != addr || l.Removed {
+			t.Fatalf("got log of block %d %x, want block %d", l.BlockNumber, l.Address, n)
+		}
+		if b := chain.BlockByNumber(n); l.BlockHash != b.Hash() {
+			t.Fatalf("got log of block %x, want %x", l.BlockHash, b.Hash())
+		}
+	}
+}
+
+func TestReconnectRetry(t *testing.T) {
+	node := startNode(t)
+	defer node.Close()
+	node.Chain().AddBlocks(3)
+
+	tests := []struct {
+		name      string
+		reconnect bool
+		// drops is the number of requests dropping the connections
+		drops int
+		// stale drops the connections before the request
+		stale   bool
+		wantErr bool
+	}{
+		{"dropped", false, 1, false, true},
+		{"retried", true, 1, false, false},
+		{"retried once", true, 2, false, true},
+		{"stale connection", true, 0, true, false},
+	}
+	for _, url := range []string{node.HTTPURL(), node.WSURL()} {
+		for _, test := range tests {
+			t.Run(url[:4]+"/"+test.name, func(t *testing.T) {
+				ec, err := ethclient.Dial(url)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer ec.Close()
+				if test.reconnect {
+					ec = ec.WithReconnect(testReconnectConfig)
+				}
+				ctx := context.Background()
+				if _, err := ec.BlockNumber(ctx); err != nil {
+					t.Fatal(err)
+				}
+
+				if test.stale {
+					node.DropConnections()
+				}
+				if test.drops > 0 {
+					node.SetFault("eth_blockNumber", testutil.Fault{Drop: true, Count: test.drops})
+					defer node.ClearFaults()
+				}
+				n, err := ec.BlockNumber(ctx)
+				if test.wantErr {
+					if err == nil {
+						t.Fatal("got no error on the dropped connection")
+					}
+					return
+				}
+				if err != nil || n.Uint64() != 3 {
+					t.Fatalf("got block number %v, err %v, want 3", n, err)
+				}
+			})
+		}
+	}
+}
+
+func receiveLog(t *testing.T, ch <-chan types.Log) types.Log {
+	select {
+	case l := <-ch:
+		return l
+	case <-time.After(5 * time.Second):
+		t.Fatal("no log received")
+		return types.Log{}
+	}
+}
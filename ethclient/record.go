@@ -0,0 +1,198 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RecordedCall is a JSON-RPC call recorded by a Recorder.
+type RecordedCall struct {
+	// Endpoint is the scheme and host of the endpoint, the path and credentials are
+	// not recorded.
+	Endpoint string `json:"endpoint"`
+	// Time is the time the request is sent, and Elapsed is the duration until the
+	// response is received.
+	Time    time.Time       `json:"time"`
+	Elapsed time.Duration   `json:"elapsed"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	// Result is the result of the response, or nil if the call failed.
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *RecordedError  `json:"error,omitempty"`
+}
+
+// RecordedError is the error of a recorded call. The code is 0 if the request failed
+// in the transport, e.g. connection refused or a non-JSON response.
+type RecordedError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// jsonrpcMessage is the fields of the JSON-RPC requests and responses to record.
+type jsonrpcMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *RecordedError  `json:"error"`
+}
+
+// Recorder records the JSON-RPC calls over HTTP to a writer in JSON lines, one call per
+// line. The calls of a batch request are recorded separately. Set it to DialConfig to
+// record the calls of the clients, and replay the recordings by testutil.Replayer.
+type Recorder struct {
+	enc  *json.Encoder
+	lock sync.Mutex
+}
+
+// NewRecorder creates a recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{
+		enc: json.NewEncoder(w),
+	}
+}
+
+// ReadRecording reads the calls written by a Recorder.
+func ReadRecording(r io.Reader) ([]RecordedCall, error) {
+	var calls []RecordedCall
+	dec := json.NewDecoder(r)
+	for {
+		var call RecordedCall
+		err := dec.Decode(&call)
+		if err == io.EOF {
+			return calls, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		calls = append(calls, call)
+	}
+}
+
+// transport returns the HTTP transport recording the calls sent through base.
+func (r *Recorder) transport(base http.RoundTripper) http.RoundTripper {
+	return &recordTransport{
+		base:     base,
+		recorder: r,
+	}
+}
+
+// record writes the calls of the request body with their results in the response
+// body, or the error if the request failed.
+func (r *Recorder) record(endpoint string, start time.Time, reqBody, respBody []byte, err error) {
+	reqs, batch := parseMessages(reqBody)
+	if len(reqs) == 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	resps := make(map[string]*jsonrpcMessage)
+	if err == nil {
+		msgs, _ := parseMessages(respBody)
+		for i := range msgs {
+			resps[string(msgs[i].ID)] = &msgs[i]
+		}
+		// The single request failed with an error response of a null ID, e.g. a
+		// parse error, or a non-JSON response, e.g. an HTTP error status.
+		if !batch && len(msgs) == 1 {
+			resps[string(reqs[0].ID)] = &msgs[0]
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, req := range reqs {
+		call := RecordedCall{
+			Endpoint: endpoint,
+			Time:     start,
+			Elapsed:  elapsed,
+			Method:   req.Method,
+			Params:   req.Params,
+		}
+		if resp, ok := resps[string(req.ID)]; ok {
+			call.Result, call.Error = resp.Result, resp.Error
+		} else if err != nil {
+			call.Error = &RecordedError{Message: err.Error()}
+		} else {
+			call.Error = &RecordedError{Message: fmt.Sprintf("no response: %s", bytes.TrimSpace(respBody))}
+		}
+		r.enc.Encode(call)
+	}
+}
+
+// parseMessages parses the single or batch JSON-RPC messages. It also reports whether
+// the messages are a batch.
+func parseMessages(body []byte) ([]jsonrpcMessage, bool) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var msgs []jsonrpcMessage
+		json.Unmarshal(body, &msgs)
+		return msgs, true
+	}
+	var msg jsonrpcMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, false
+	}
+	return []jsonrpcMessage{msg}, false
+}
+
+// recordTransport records the JSON-RPC calls sent through the base transport.
+type recordTransport struct {
+	base     http.RoundTripper
+	recorder *Recorder
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The request must not be modified, so clone it with the read body.
+	r := new(http.Request)
+	*r = *req
+	r.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+
+	endpoint := Endpoint(req.URL.String())
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		t.recorder.record(endpoint, start, reqBody, nil, err)
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+	t.recorder.record(endpoint, start, reqBody, respBody, err)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	return resp, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethclient_test
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/getamis/hypereth/ethclient"
+	"github.com/getamis/hypereth/testutil"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	node := startNode(t)
+	defer node.Close()
+	blocks := node.Chain().AddBlocks(2)
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	recorder := ethclient.NewRecorder(&buf)
+	ec, err := ethclient.DialWithConfig(ctx, node.HTTPURL(), &ethclient.DialConfig{Recorder: recorder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := ec.BlockNumber(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ec.BlockByNumber(ctx, big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec.Close()
+
+	calls, err := ethclient.ReadRecording(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("got %d recorded calls, want 2", len(calls))
+	}
+	replayer := testutil.NewReplayer(calls)
+	if err := replayer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer replayer.Close()
+
+	ec, err = ethclient.Dial(replayer.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ec.Close()
+	if got, err := ec.BlockNumber(ctx); err != nil || got.Cmp(n) != 0 || got.Uint64() != blocks[1].NumberU64() {
+		t.Fatalf("got block number %v, %v, want %v", got, err, n)
+	}
+	if got, err := ec.BlockByNumber(ctx, big.NewInt(1)); err != nil || got.Hash() != block.Hash() {
+		t.Fatalf("got block %v, want %x", err, block.Hash())
+	}
+	if _, err := ec.BlockByNumber(ctx, big.NewInt(2)); err == nil {
+		t.Fatal("got no error of an unrecorded call")
+	}
+	if unmatched := replayer.Unmatched(); len(unmatched) != 1 || unmatched[0] != "eth_getBlockByNumber" {
+		t.Fatalf("got unmatched %v, want [eth_getBlockByNumber]", unmatched)
+	}
+}
+
+func TestRecordWebsocket(t *testing.T) {
+	node := startNode(t)
+	defer node.Close()
+	ctx := context.Background()
+
+	// The calls over websocket are not recorded, but the dial does not fail
+	var buf bytes.Buffer
+	ec, err := ethclient.DialWithConfig(ctx, node.WSURL(), &ethclient.DialConfig{Recorder: ethclient.NewRecorder(&buf)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ec.Close()
+	if _, err := ec.BlockNumber(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("got recording %q, want nothing", buf.String())
+	}
+}
@@ -29,7 +29,7 @@ import (
 // }
 func (ec *Client) TxPoolStatus(ctx context.Context) (map[string]hexutil.Uint, error) {
 	r := make(map[string]hexutil.Uint)
-	err := ec.c.CallContext(ctx, &r, "txpool_status")
+	err := ec.CallContext(ctx, &r, "txpool_status")
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,313 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/getamis/sirius/log"
+)
+
+const (
+	// headRefreshPeriod is the period to refresh the chain head used to measure the
+	// state depth of requests.
+	headRefreshPeriod = 15 * time.Second
+	// maxProbeSteps bounds the binary search of the state retention probe.
+	maxProbeSteps = 32
+)
+
+// missingStateErrors are the error messages returned by the pruned nodes when the
+// requested state is unavailable.
+var missingStateErrors = []string{
+	"missing trie node",
+	"required historical state unavailable",
+	"state pruning",
+}
+
+// stateMethods are the state query methods and the index of their block parameters.
+var stateMethods = map[string]int{
+	"eth_getBalance":          1,
+	"eth_getCode":             1,
+	"eth_getTransactionCount": 1,
+	"eth_getStorageAt":        2,
+	"eth_call":                1,
+	"eth_getProof":            2,
+}
+
+// stateBlockNumber returns the block number of the state queried by the raw call, e.g.
+// the calls forwarded by rpc-proxy. It returns nil for the latest or pending state, the
+// block hashes and the non-state methods.
+func stateBlockNumber(method string, args []interface{}) *big.Int {
+	i, ok := stateMethods[method]
+	if !ok || i >= len(args) {
+		return nil
+	}
+	var raw []byte
+	switch arg := args[i].(type) {
+	case *big.Int:
+		return arg
+	case json.RawMessage:
+		raw = arg
+	default:
+		var err error
+		if raw, err = json.Marshal(arg); err != nil {
+			return nil
+		}
+	}
+	var tag string
+	if err := json.Unmarshal(raw, &tag); err == nil {
+		return parseBlockTag(tag)
+	}
+	// The block number object of EIP-1898
+	var obj struct {
+		BlockNumber *string `json:"blockNumber"`
+	}
+	if err := json.Unmarshal(raw, &obj); err == nil && obj.BlockNumber != nil {
+		return parseBlockTag(*obj.BlockNumber)
+	}
+	return nil
+}
+
+// parseBlockTag parses the block number or tag. It returns nil for the latest or
+// pending block and the invalid values.
+func parseBlockTag(tag string) *big.Int {
+	switch tag {
+	case "earliest":
+		return new(big.Int)
+	case "latest", "pending":
+		return nil
+	}
+	n, err := hexutil.DecodeBig(tag)
+	if err != nil {
+		return nil
+	}
+	return n
+}
+
+// isMissingStateError reports whether the error is caused by the pruned state.
+func isMissingStateError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, s := range missingStateErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retention represents the learned state retention window of an eth client. The depth
+// is the distance from the chain head to the block of the queried state.
+type Retention struct {
+	// Archive is true if the eth client serves the state since the first block.
+	Archive bool `json:"archive"`
+	// Served is the deepest state depth known to be served.
+	Served uint64 `json:"served"`
+	// Missing is the shallowest state depth known to be pruned. Set to 0 means unknown.
+	Missing uint64 `json:"missing"`
+}
+
+// canServe reports whether the state at the given depth is expected to be served.
+func (r Retention) canServe(depth uint64) bool {
+	return r.Archive || r.Missing == 0 || depth < r.Missing
+}
+
+// served records that the state at the given depth is served.
+func (r *Retention) served(depth uint64) {
+	if depth > r.Served {
+		r.Served = depth
+	}
+	// The retention window is larger than we knew
+	if r.Missing != 0 && depth >= r.Missing {
+		r.Missing = depth + 1
+	}
+}
+
+// missing records that the state at the given depth is pruned.
+func (r *Retention) missing(depth uint64) {
+	r.Archive = false
+	if r.Missing == 0 || depth < r.Missing {
+		r.Missing = depth
+	}
+	// The retention window is smaller than we knew
+	if depth > 0 && r.Served >= depth {
+		r.Served = depth - 1
+	}
+}
+
+// headNumber returns the known chain head. It returns 0 if the head is unknown.
+func (mc *Client) headNumber() uint64 {
+	return atomic.LoadUint64(&mc.head)
+}
+
+// updateHead raises the known chain head.
+func (mc *Client) updateHead(number uint64) {
+	for {
+		head := atomic.LoadUint64(&mc.head)
+		if number <= head || atomic.CompareAndSwapUint64(&mc.head, head, number) {
+			return
+		}
+	}
+}
+
+// stateDepth returns the depth of the state queried at the given block number. The
+// latest state, unknown head and future blocks are all considered as depth 0.
+func (mc *Client) stateDepth(blockNumber *big.Int) uint64 {
+	if !mc.archiveRouting || blockNumber == nil || !blockNumber.IsUint64() {
+		return 0
+	}
+	head, n := mc.headNumber(), blockNumber.Uint64()
+	if n >= head {
+		return 0
+	}
+	return head - n
+}
+
+// learnState wraps the RetryFunc of a state query to learn the state retention of the
+// rpc clients from their responses.
+func (mc *Client) learnState(blockNumber *big.Int, fn RetryFunc) RetryFunc {
+	if !mc.archiveRouting || blockNumber == nil {
+		return fn
+	}
+	return func(ctx context.Context, rc *rpc.Client) (bool, error) {
+		retry, err := fn(ctx, rc)
+		depth := mc.stateDepth(blockNumber)
+		if depth == 0 {
+			return retry, err
+		}
+		if err == nil {
+			mc.rpcClientMap.learnRetention(rc, depth, true)
+		} else if isMissingStateError(err) {
+			log.Debug("Eth client state is pruned", "number", blockNumber, "depth", depth, "err", err)
+			mc.rpcClientMap.learnRetention(rc, depth, false)
+		}
+		return retry, err
+	}
+}
+
+// watchHead refreshes the known chain head periodically.
+func (mc *Client) watchHead() {
+	defer mc.archiveWg.Done()
+
+	ticker := time.NewTicker(headRefreshPeriod)
+	defer ticker.Stop()
+
+	for {
+		header, err := mc.HeaderByNumber(mc.ctx, nil)
+		if err == nil {
+			mc.updateHead(header.Number.Uint64())
+		} else {
+			log.Debug("Failed to refresh chain head", "err", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-mc.ctx.Done():
+			return
+		}
+	}
+}
+
+// goProbeState starts probing the state retention of the eth client unless the
+// multiclient is closed, so the probe is never added after Close waits for them.
+func (mc *Client) goProbeState(key string, rc *rpc.Client) {
+	mc.closeLock.Lock()
+	defer mc.closeLock.Unlock()
+
+	if mc.ctx.Err() != nil {
+		return
+	}
+	mc.archiveWg.Add(1)
+	go mc.probeState(key, rc)
+}
+
+// probeState measures the state retention window of a newly dialed eth client by a
+// binary search of the oldest block whose state is served.
+func (mc *Client) probeState(key string, rc *rpc.Client) {
+	defer mc.archiveWg.Done()
+
+	logger := log.New("url", key)
+	call := func(result interface{}, method string, args ...interface{}) error {
+		ctx, cancel := context.WithTimeout(mc.ctx, dialTimeout)
+		defer cancel()
+		return rc.CallContext(ctx, result, method, args...)
+	}
+	// served reports whether the state at the given block is served.
+	served := func(number uint64) (bool, error) {
+		var balance hexutil.Big
+		err := call(&balance, "eth_getBalance", common.Address{}, hexutil.EncodeUint64(number))
+		if isMissingStateError(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	var head hexutil.Uint64
+	if err := call(&head, "eth_blockNumber"); err != nil {
+		logger.Warn("Failed to get head for state probe", "err", err)
+		return
+	}
+	mc.updateHead(uint64(head))
+	mc.rpcClientMap.observeHead(rc, uint64(head))
+	if head <= 1 {
+		return
+	}
+
+	// The genesis state is always kept, so probe from the first block.
+	ok, err := served(1)
+	if err != nil {
+		logger.Warn("Failed to probe state retention", "err", err)
+		return
+	}
+	if ok {
+		logger.Info("Eth client serves archive state", "head", uint64(head))
+		mc.rpcClientMap.setRetention(key, Retention{Archive: true, Served: uint64(head) - 1})
+		return
+	}
+
+	// The state of lo is pruned and the state of hi is served.
+	lo, hi := uint64(1), uint64(head)
+	for step := 0; hi-lo > 1 && step < maxProbeSteps; step++ {
+		mid := lo + (hi-lo)/2
+		ok, err := served(mid)
+		if err != nil {
+			logger.Warn("Failed to probe state retention", "number", mid, "err", err)
+			return
+		}
+		if ok {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	r := Retention{
+		Served:  uint64(head) - hi,
+		Missing: uint64(head) - lo,
+	}
+	logger.Info("Eth client state retention probed", "head", uint64(head), "served", r.Served, "missing", r.Missing)
+	mc.rpcClientMap.setRetention(key, r)
+}
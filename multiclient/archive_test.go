@@ -0,0 +1,211 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/getamis/hypereth/testutil"
+)
+
+func TestIsMissingStateError(t *testing.T) {
+	tests := []struct {
+		err     error
+		missing bool
+	}{
+		{nil, false},
+		{errors.New("missing trie node 0123 (path )"), true},
+		{errors.New("required historical state unavailable (reexec=128)"), true},
+		{errors.New("header not found, state pruning enabled"), true},
+		{errors.New("header not found"), false},
+		{context.DeadlineExceeded, false},
+	}
+	for _, test := range tests {
+		if missing := isMissingStateError(test.err); missing != test.missing {
+			t.Fatalf("%v: got missing %v, want %v", test.err, missing, test.missing)
+		}
+	}
+}
+
+func TestStateBlockNumber(t *testing.T) {
+	tests := []struct {
+		method string
+		args   []interface{}
+		number *big.Int
+	}{
+		{"eth_getBalance", []interface{}{common.Address{}, "0x10"}, big.NewInt(16)},
+		{"eth_getBalance", []interface{}{common.Address{}, "latest"}, nil},
+		{"eth_getBalance", []interface{}{common.Address{}, "earliest"}, big.NewInt(0)},
+		{"eth_getBalance", []interface{}{common.Address{}}, nil},
+		{"eth_getStorageAt", []interface{}{common.Address{}, "0x0", big.NewInt(3)}, big.NewInt(3)},
+		{"eth_call", []interface{}{map[string]interface{}{}, map[string]string{"blockNumber": "0x5"}}, big.NewInt(5)},
+		{"eth_call", []interface{}{map[string]interface{}{}, map[string]string{"blockHash": "0x01"}}, nil},
+		{"eth_getBlockByNumber", []interface{}{"0x10", false}, nil},
+	}
+	for _, test := range tests {
+		n := stateBlockNumber(test.method, test.args)
+		if (n == nil) != (test.number == nil) || (n != nil && n.Cmp(test.number) != 0) {
+			t.Fatalf("%s %v: got number %v, want %v", test.method, test.args, n, test.number)
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	type step struct {
+		depth  uint64
+		served bool
+	}
+	tests := []struct {
+		name  string
+		start Retention
+		steps []step
+		want  Retention
+	}{
+		{"served", Retention{}, []step{{10, true}, {5, true}}, Retention{Served: 10}},
+		{"missing", Retention{}, []step{{100, false}, {200, false}, {50, false}}, Retention{Missing: 50}},
+		{"window", Retention{}, []step{{10, true}, {100, false}}, Retention{Served: 10, Missing: 100}},
+		{"larger", Retention{Served: 10, Missing: 20}, []step{{30, true}}, Retention{Served: 30, Missing: 31}},
+		{"smaller", Retention{Served: 10, Missing: 20}, []step{{5, false}}, Retention{Served: 4, Missing: 5}},
+		{"archive pruned", Retention{Archive: true, Served: 100}, []step{{50, false}}, Retention{Served: 49, Missing: 50}},
+	}
+	for _, test := range tests {
+		r := test.start
+		for _, s := range test.steps {
+			if s.served {
+				r.served(s.depth)
+			} else {
+				r.missing(s.depth)
+			}
+		}
+		if r != test.want {
+			t.Fatalf("%s: got retention %+v, want %+v", test.name, r, test.want)
+		}
+	}
+
+	r := Retention{Served: 9, Missing: 10}
+	for depth, want := range map[uint64]bool{0: true, 9: true, 10: false, 11: false} {
+		if got := r.canServe(depth); got != want {
+			t.Fatalf("depth %d: got canServe %v, want %v", depth, got, want)
+		}
+	}
+	if !(Retention{}).canServe(1000) || !(Retention{Archive: true, Missing: 10}).canServe(1000) {
+		t.Fatal("unknown or archive retention cannot serve")
+	}
+}
+
+// waitRetention waits for the state retention of the eth client to be probed.
+func waitRetention(t *testing.T, mc *Client, key string) Retention {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if r, _ := mc.ClientMap().Retention(key); r.Archive || r.Missing != 0 {
+			return r
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s: state retention not probed", key)
+	return Retention{}
+}
+
+func TestProbeState(t *testing.T) {
+	var urls []string
+	tests := []struct {
+		retention uint64
+		want      Retention
+	}{
+		{0, Retention{Archive: true, Served: 99}},
+		{1, Retention{Served: 0, Missing: 1}},
+		{10, Retention{Served: 9, Missing: 10}},
+		{37, Retention{Served: 36, Missing: 37}},
+		{99, Retention{Served: 98, Missing: 99}},
+	}
+	for _, test := range tests {
+		chain := testutil.NewChain(testutil.ChainConfig{})
+		chain.AddBlocks(100)
+		chain.SetStateRetention(test.retention)
+		n := startTestNode(t, chain)
+		defer n.Close()
+		urls = append(urls, n.HTTPURL())
+	}
+
+	mc, err := New(context.Background(), EthURLs(urls), WithArchiveRouting())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	for i, test := range tests {
+		if r := waitRetention(t, mc, urls[i]); r != test.want {
+			t.Fatalf("retention %d: got %+v, want %+v", test.retention, r, test.want)
+		}
+		md, _ := mc.ClientMap().Metadata(urls[i])
+		if archive := md.HasTags([]string{TagArchive}); archive != test.want.Archive {
+			t.Fatalf("retention %d: got archive tag %v, want %v", test.retention, archive, test.want.Archive)
+		}
+	}
+	if head := mc.headNumber(); head != 100 {
+		t.Fatalf("got head %d, want %d", head, 100)
+	}
+}
+
+func TestLearnState(t *testing.T) {
+	chain := testutil.NewChain(testutil.ChainConfig{})
+	chain.AddBlocks(100)
+	chain.SetStateRetention(10)
+	n := startTestNode(t, chain)
+	defer n.Close()
+
+	ctx := context.Background()
+	mc, err := New(ctx, EthURLs([]string{n.HTTPURL()}), WithArchiveRouting(), WithRetryConfig(RetryConfig{
+		Timeout: time.Second,
+		Delay:   time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	waitRetention(t, mc, n.HTTPURL())
+
+	tests := []struct {
+		retention uint64
+		number    int64
+		missing   bool
+		want      Retention
+	}{
+		// the retention window is larger than probed
+		{30, 80, false, Retention{Served: 20, Missing: 21}},
+		// the latest state is not learned
+		{30, 100, false, Retention{Served: 20, Missing: 21}},
+		// the retention window is smaller than learned
+		{5, 90, true, Retention{Served: 9, Missing: 10}},
+		{5, 98, false, Retention{Served: 9, Missing: 10}},
+	}
+	for _, test := range tests {
+		chain.SetStateRetention(test.retention)
+		_, err := mc.BalanceAt(ctx, common.Address{}, big.NewInt(test.number))
+		if missing := isMissingStateError(err); missing != test.missing {
+			t.Fatalf("block %d: got error %v, want missing state %v", test.number, err, test.missing)
+		}
+		if r, _ := mc.ClientMap().Retention(n.HTTPURL()); r != test.want {
+			t.Fatalf("block %d: got retention %+v, want %+v", test.number, r, test.want)
+		}
+	}
+}
@@ -20,6 +20,9 @@ import (
 	"context"
 	"errors"
 	"math/big"
+	netURL "net/url"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -31,6 +34,9 @@ import (
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/getamis/sirius/log"
+	"github.com/getamis/sirius/metrics"
+
+	hethclient "github.com/getamis/hypereth/ethclient"
 )
 
 const (
@@ -41,34 +47,61 @@ const (
 	newAvailableClientTopic = "newAvailableClient"
 	// pubSubCapacity represents the channel size to received pubSub event.
 	pubSubCapacity = 10
+
+	// ZoneEnv is the environment variable of the zone where the client runs.
+	ZoneEnv = "MULTICLIENT_ZONE"
 )
 
 var (
-	ErrInvalidTypeCast = errors.New("invalid type cast")
-	ErrNoEthClient     = errors.New("no eth client")
+	ErrInvalidTypeCast  = errors.New("invalid type cast")
+	ErrNoEthClient      = errors.New("no eth client")
+	ErrThrottled        = errors.New("eth client throttled")
+	ErrNoTaggedClient   = errors.New("no eth client with required tags")
+	ErrInvalidDNSConfig = errors.New("either SRV service or port is required")
+	ErrInvalidK8sConfig = errors.New("either endpoints name or label selector is required")
 )
 
 type Client struct {
-	ctx              context.Context
-	cancel           context.CancelFunc
+	// head is the known chain head, it's accessed atomically
+	head uint64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// closeLock guards starting the go routines against Close
+	closeLock        sync.Mutex
 	rpcClientMap     *Map
+	methodTags       map[string][]string
+	historicalTags   []string
+	archiveRouting   bool
+	zone             string
+	archiveWg        sync.WaitGroup
+	discoverers      []Discoverer
+	reconciler       *reconciler
+	discoveryWg      sync.WaitGroup
 	newClientCh      chan string
 	pubSub           *pubsub.PubSub
 	retrydialWg      sync.WaitGroup
 	requestRetryFunc func(context.Context, []*rpc.Client, RetryFunc) error
+	metrics          *clientMetrics
+	hooks            hethclient.Hooks
+	dialConfig       *hethclient.DialConfig
 }
 
 func New(ctx context.Context, opts ...Option) (*Client, error) {
 	newClientCh := make(chan string)
 	// create client own context to control the internal go routines
 	myCtx, myCancel := context.WithCancel(context.Background())
+	rpcClientMap := NewMap(newClientCh)
 	mc := &Client{
 		ctx:              myCtx,
 		cancel:           myCancel,
-		rpcClientMap:     NewMap(newClientCh),
+		rpcClientMap:     rpcClientMap,
+		reconciler:       newReconciler(rpcClientMap),
 		newClientCh:      newClientCh,
 		pubSub:           pubsub.New(pubSubCapacity),
 		requestRetryFunc: NewRetry(0, defaultRetryTimeout, defaultRetryDelay),
+		metrics:          newClientMetrics(metrics.NewDummyRegistry()),
+		zone:             os.Getenv(ZoneEnv),
 	}
 
 	var newErr error
@@ -85,6 +118,11 @@ func New(ctx context.Context, opts ...Option) (*Client, error) {
 		}
 	}
 
+	// Wait for the initial discovery until ctx is done
+	if newErr = mc.reconciler.start(mc.ctx, ctx, mc.discoverers, &mc.discoveryWg); newErr != nil {
+		return nil, newErr
+	}
+
 	// Dial each eth client
 	mc.DialClients(ctx)
 
@@ -96,19 +134,29 @@ func New(ctx context.Context, opts ...Option) (*Client, error) {
 	mc.retrydialWg.Add(1)
 	go mc.retrydial()
 
+	if mc.archiveRouting {
+		mc.archiveWg.Add(1)
+		go mc.watchHead()
+	}
+
 	return mc, nil
 }
 
 // Close closes an existing RPC connection.
 func (mc *Client) Close() {
 	// stop go routines
+	mc.closeLock.Lock()
 	mc.cancel()
+	mc.closeLock.Unlock()
 	mc.retrydialWg.Wait()
+	mc.archiveWg.Wait()
+	mc.discoveryWg.Wait()
 	mc.pubSub.Shutdown()
 	clients := mc.rpcClientMap.List()
 	for _, c := range clients {
 		c.Close()
 	}
+	mc.rpcClientMap.closeDraining()
 }
 
 func (mc *Client) Context() context.Context {
@@ -139,15 +187,15 @@ func (mc *Client) RPCClients() []*rpc.Client {
 // Note that loading full blocks requires two requests. Use HeaderByHash
 // if you don't need all transactions or uncle headers.
 func (mc *Client) BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
-	clients := mc.rpcClientMap.List()
-	if len(clients) == 0 {
-		return nil, ErrNoEthClient
+	clients, err := mc.availableClients("eth_getBlockByHash", nil)
+	if err != nil {
+		return nil, err
 	}
 
 	var result *types.Block
 	var errs []error
 
-	finalErr := mc.requestRetryFunc(ctx, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+	finalErr := mc.retry(ctx, "eth_getBlockByHash", []interface{}{hash, true}, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
 		ec := ethclient.NewClient(rpcClient)
 		var err error
 		result, err = ec.BlockByHash(ctx, hash)
@@ -169,15 +217,15 @@ func (mc *Client) BlockByHash(ctx context.Context, hash common.Hash) (*types.Blo
 // Note that loading full blocks requires two requests. Use HeaderByNumber
 // if you don't need all transactions or uncle headers.
 func (mc *Client) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
-	clients := mc.rpcClientMap.List()
-	if len(clients) == 0 {
-		return nil, ErrNoEthClient
+	clients, err := mc.availableClients("eth_getBlockByNumber", nil)
+	if err != nil {
+		return nil, err
 	}
 
 	var result *types.Block
 	var errs []error
 
-	finalErr := mc.requestRetryFunc(ctx, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+	finalErr := mc.retry(ctx, "eth_getBlockByNumber", []interface{}{toBlockNumArg(number), true}, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
 		ec := ethclient.NewClient(rpcClient)
 		var err error
 		result, err = ec.BlockByNumber(ctx, number)
@@ -195,15 +243,15 @@ func (mc *Client) BlockByNumber(ctx context.Context, number *big.Int) (*types.Bl
 
 // HeaderByHash returns the block header with the given hash.
 func (mc *Client) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
-	clients := mc.rpcClientMap.List()
-	if len(clients) == 0 {
-		return nil, ErrNoEthClient
+	clients, err := mc.availableClients("eth_getBlockByHash", nil)
+	if err != nil {
+		return nil, err
 	}
 
 	var result *types.Header
 	var errs []error
 
-	finalErr := mc.requestRetryFunc(ctx, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+	finalErr := mc.retry(ctx, "eth_getBlockByHash", []interface{}{hash, false}, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
 		ec := ethclient.NewClient(rpcClient)
 		var err error
 		result, err = ec.HeaderByHash(ctx, hash)
@@ -222,15 +270,15 @@ func (mc *Client) HeaderByHash(ctx context.Context, hash common.Hash) (*types.He
 // HeaderByNumber returns a block header from the current canonical chain. If number is
 // nil, the latest known header is returned.
 func (mc *Client) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
-	clients := mc.rpcClientMap.List()
-	if len(clients) == 0 {
-		return nil, ErrNoEthClient
+	clients, err := mc.availableClients("eth_getBlockByNumber", nil)
+	if err != nil {
+		return nil, err
 	}
 
 	var result *types.Header
 	var errs []error
 
-	finalErr := mc.requestRetryFunc(ctx, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+	finalErr := mc.retry(ctx, "eth_getBlockByNumber", []interface{}{toBlockNumArg(number), false}, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
 		ec := ethclient.NewClient(rpcClient)
 		var err error
 		result, err = ec.HeaderByNumber(ctx, number)
@@ -248,16 +296,16 @@ func (mc *Client) HeaderByNumber(ctx context.Context, number *big.Int) (*types.H
 
 // TransactionByHash returns the transaction with the given hash.
 func (mc *Client) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
-	clients := mc.rpcClientMap.List()
-	if len(clients) == 0 {
-		return nil, false, ErrNoEthClient
+	clients, err := mc.availableClients("eth_getTransactionByHash", nil)
+	if err != nil {
+		return nil, false, err
 	}
 
 	var result *types.Transaction
 	var isPending bool
 	var errs []error
 
-	finalErr := mc.requestRetryFunc(ctx, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+	finalErr := mc.retry(ctx, "eth_getTransactionByHash", []interface{}{hash}, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
 		ec := ethclient.NewClient(rpcClient)
 		var err error
 		result, isPending, err = ec.TransactionByHash(ctx, hash)
@@ -273,20 +321,47 @@ func (mc *Client) TransactionByHash(ctx context.Context, hash common.Hash) (*typ
 	return result, isPending, nil
 }
 
+// TransactionReceipt returns the receipt of a transaction by transaction hash.
+// Note that the receipt is not available for pending transactions.
+func (mc *Client) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	clients, err := mc.availableClients("eth_getTransactionReceipt", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *types.Receipt
+	var errs []error
+
+	finalErr := mc.retry(ctx, "eth_getTransactionReceipt", []interface{}{txHash}, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+		ec := ethclient.NewClient(rpcClient)
+		var err error
+		result, err = ec.TransactionReceipt(ctx, txHash)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return true, err
+	})
+	if finalErr != nil {
+		log.Debug("Failed to get transaction receipt", "hash", txHash.Hex(), "finalErr", finalErr, "errs", errs)
+		return nil, finalErr
+	}
+	return result, nil
+}
+
 // State Access
 
 // BalanceAt returns the wei balance of the given account.
 // The block number can be nil, in which case the balance is taken from the latest known block.
 func (mc *Client) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
-	clients := mc.rpcClientMap.List()
-	if len(clients) == 0 {
-		return nil, ErrNoEthClient
+	clients, err := mc.availableClients("eth_getBalance", blockNumber)
+	if err != nil {
+		return nil, err
 	}
 
 	var result *big.Int
 	var errs []error
 
-	finalErr := mc.requestRetryFunc(ctx, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+	finalErr := mc.retry(ctx, "eth_getBalance", []interface{}{account, toBlockNumArg(blockNumber)}, clients, mc.learnState(blockNumber, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
 		ec := ethclient.NewClient(rpcClient)
 		var err error
 		result, err = ec.BalanceAt(ctx, account, blockNumber)
@@ -294,7 +369,7 @@ func (mc *Client) BalanceAt(ctx context.Context, account common.Address, blockNu
 			errs = append(errs, err)
 		}
 		return true, err
-	})
+	}))
 	if finalErr != nil {
 		log.Debug("Failed to get balance", "account", account.Hex(), "blockNumber", blockNumber.String(), "finalErr", finalErr, "errs", errs)
 		return nil, finalErr
@@ -302,18 +377,45 @@ func (mc *Client) BalanceAt(ctx context.Context, account common.Address, blockNu
 	return result, nil
 }
 
+// StorageAt returns the value of key in the contract storage of the given account.
+// The block number can be nil, in which case the value is taken from the latest known block.
+func (mc *Client) StorageAt(ctx context.Context, account common.Address, key common.Hash, blockNumber *big.Int) ([]byte, error) {
+	clients, err := mc.availableClients("eth_getStorageAt", blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []byte
+	var errs []error
+
+	finalErr := mc.retry(ctx, "eth_getStorageAt", []interface{}{account, key, toBlockNumArg(blockNumber)}, clients, mc.learnState(blockNumber, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+		ec := ethclient.NewClient(rpcClient)
+		var err error
+		result, err = ec.StorageAt(ctx, account, key, blockNumber)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return true, err
+	}))
+	if finalErr != nil {
+		log.Debug("Failed to get storage", "account", account.Hex(), "key", key.Hex(), "blockNumber", blockNumber.String(), "finalErr", finalErr, "errs", errs)
+		return nil, finalErr
+	}
+	return result, nil
+}
+
 // CodeAt returns the contract code of the given account.
 // The block number can be nil, in which case the code is taken from the latest known block.
 func (mc *Client) CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error) {
-	clients := mc.rpcClientMap.List()
-	if len(clients) == 0 {
-		return nil, ErrNoEthClient
+	clients, err := mc.availableClients("eth_getCode", blockNumber)
+	if err != nil {
+		return nil, err
 	}
 
 	var result []byte
 	var errs []error
 
-	finalErr := mc.requestRetryFunc(ctx, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+	finalErr := mc.retry(ctx, "eth_getCode", []interface{}{account, toBlockNumArg(blockNumber)}, clients, mc.learnState(blockNumber, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
 		ec := ethclient.NewClient(rpcClient)
 		var err error
 		result, err = ec.CodeAt(ctx, account, blockNumber)
@@ -321,7 +423,7 @@ func (mc *Client) CodeAt(ctx context.Context, account common.Address, blockNumbe
 			errs = append(errs, err)
 		}
 		return true, err
-	})
+	}))
 	if finalErr != nil {
 		log.Debug("Failed to get code", "account", account.Hex(), "blockNumber", blockNumber.String(), "finalErr", finalErr, "errs", errs)
 		return nil, finalErr
@@ -332,15 +434,15 @@ func (mc *Client) CodeAt(ctx context.Context, account common.Address, blockNumbe
 // NonceAt returns the account nonce of the given account.
 // The block number can be nil, in which case the nonce is taken from the latest known block.
 func (mc *Client) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
-	clients := mc.rpcClientMap.List()
-	if len(clients) == 0 {
-		return 0, ErrNoEthClient
+	clients, err := mc.availableClients("eth_getTransactionCount", blockNumber)
+	if err != nil {
+		return 0, err
 	}
 
 	var result uint64
 	var errs []error
 
-	finalErr := mc.requestRetryFunc(ctx, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+	finalErr := mc.retry(ctx, "eth_getTransactionCount", []interface{}{account, toBlockNumArg(blockNumber)}, clients, mc.learnState(blockNumber, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
 		ec := ethclient.NewClient(rpcClient)
 		var err error
 		result, err = ec.NonceAt(ctx, account, blockNumber)
@@ -348,7 +450,7 @@ func (mc *Client) NonceAt(ctx context.Context, account common.Address, blockNumb
 			errs = append(errs, err)
 		}
 		return true, err
-	})
+	}))
 	if finalErr != nil {
 		log.Debug("Failed to get nonce", "account", account.Hex(), "blockNumber", blockNumber.String(), "finalErr", finalErr, "errs", errs)
 		return uint64(0), finalErr
@@ -360,15 +462,15 @@ func (mc *Client) NonceAt(ctx context.Context, account common.Address, blockNumb
 
 // PendingBalanceAt returns the wei balance of the given account in the pending state.
 func (mc *Client) PendingBalanceAt(ctx context.Context, account common.Address) (*big.Int, error) {
-	clients := mc.rpcClientMap.List()
-	if len(clients) == 0 {
-		return nil, ErrNoEthClient
+	clients, err := mc.availableClients("eth_getBalance", nil)
+	if err != nil {
+		return nil, err
 	}
 
 	var result *big.Int
 	var errs []error
 
-	finalErr := mc.requestRetryFunc(ctx, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+	finalErr := mc.retry(ctx, "eth_getBalance", []interface{}{account, "pending"}, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
 		ec := ethclient.NewClient(rpcClient)
 		var err error
 		result, err = ec.PendingBalanceAt(ctx, account)
@@ -387,15 +489,15 @@ func (mc *Client) PendingBalanceAt(ctx context.Context, account common.Address)
 // PendingNonceAt returns the account nonce of the given account in the pending state.
 // This is the nonce that should be used for the next transaction.
 func (mc *Client) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
-	clients := mc.rpcClientMap.List()
-	if len(clients) == 0 {
-		return 0, ErrNoEthClient
+	clients, err := mc.availableClients("eth_getTransactionCount", nil)
+	if err != nil {
+		return 0, err
 	}
 
 	var result uint64
 	var errs []error
 
-	finalErr := mc.requestRetryFunc(ctx, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+	finalErr := mc.retry(ctx, "eth_getTransactionCount", []interface{}{account, "pending"}, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
 		ec := ethclient.NewClient(rpcClient)
 		var err error
 		result, err = ec.PendingNonceAt(ctx, account)
@@ -420,15 +522,15 @@ func (mc *Client) PendingNonceAt(ctx context.Context, account common.Address) (u
 // case the code is taken from the latest known block. Note that state from very old
 // blocks might not be available.
 func (mc *Client) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
-	clients := mc.rpcClientMap.List()
-	if len(clients) == 0 {
-		return nil, ErrNoEthClient
+	clients, err := mc.availableClients("eth_call", blockNumber)
+	if err != nil {
+		return nil, err
 	}
 
 	var result []byte
 	var errs []error
 
-	finalErr := mc.requestRetryFunc(ctx, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+	finalErr := mc.retry(ctx, "eth_call", []interface{}{msg, toBlockNumArg(blockNumber)}, clients, mc.learnState(blockNumber, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
 		ec := ethclient.NewClient(rpcClient)
 		var err error
 		result, err = ec.CallContract(ctx, msg, blockNumber)
@@ -436,7 +538,7 @@ func (mc *Client) CallContract(ctx context.Context, msg ethereum.CallMsg, blockN
 			errs = append(errs, err)
 		}
 		return true, err
-	})
+	}))
 	if finalErr != nil {
 		log.Debug("Failed to call contract", "from", msg.From.Hex(), "to", msg.To.Hex(), "blockNumber", blockNumber.String(), "finalErr", finalErr, "errs", errs)
 		return nil, finalErr
@@ -447,15 +549,15 @@ func (mc *Client) CallContract(ctx context.Context, msg ethereum.CallMsg, blockN
 // PendingCallContract executes a message call transaction using the EVM.
 // The state seen by the contract call is the pending state.
 func (mc *Client) PendingCallContract(ctx context.Context, msg ethereum.CallMsg) ([]byte, error) {
-	clients := mc.rpcClientMap.List()
-	if len(clients) == 0 {
-		return nil, ErrNoEthClient
+	clients, err := mc.availableClients("eth_call", nil)
+	if err != nil {
+		return nil, err
 	}
 
 	var result []byte
 	var errs []error
 
-	finalErr := mc.requestRetryFunc(ctx, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+	finalErr := mc.retry(ctx, "eth_call", []interface{}{msg, "pending"}, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
 		ec := ethclient.NewClient(rpcClient)
 		var err error
 		result, err = ec.PendingCallContract(ctx, msg)
@@ -482,34 +584,59 @@ func (mc *Client) SendTransaction(ctx context.Context, tx *types.Transaction) er
 		return ErrNoEthClient
 	}
 
-	respCh := make(chan error, len(clients))
+	info := &CallInfo{
+		Method:     "eth_sendRawTransaction",
+		ParamsSize: mc.txParamsSize(tx),
+	}
+	return mc.hooks.Call(ctx, info, func(ctx context.Context) error {
+		respCh := make(chan error, len(clients))
 
-	for url, c := range clients {
-		go func(url string, c *rpc.Client) {
-			ec := ethclient.NewClient(c)
-			err := ec.SendTransaction(ctx, tx)
-			var clientErr *ClientError
-			if err != nil {
-				clientErr = NewClientError(url, err)
+		attempt := 0
+		for url, c := range clients {
+			attempt++
+			attemptInfo := &CallInfo{
+				Method:     info.Method,
+				ParamsSize: info.ParamsSize,
+				Endpoint:   hethclient.Endpoint(url),
+				Attempt:    attempt,
 			}
-			respCh <- clientErr
-		}(url, c)
-	}
+			go func(url string, c *rpc.Client) {
+				release, ok := mc.rpcClientMap.acquire(c)
+				if !ok {
+					respCh <- NewClientError(url, ErrThrottled)
+					return
+				}
+				defer release()
+
+				ec := ethclient.NewClient(c)
+				start := time.Now()
+				err := mc.hooks.Call(ctx, attemptInfo, func(ctx context.Context) error {
+					return ec.SendTransaction(ctx, tx)
+				})
+				mc.metrics.observe(url, info.Method, time.Since(start), err)
+				if err != nil {
+					respCh <- NewClientError(url, err)
+					return
+				}
+				respCh <- nil
+			}(url, c)
+		}
 
-	var errs []error
-	for i := 0; i < len(clients); i++ {
-		respErr := <-respCh
-		if respErr != nil {
-			errs = append(errs, respErr)
+		var errs []error
+		for i := 0; i < len(clients); i++ {
+			respErr := <-respCh
+			if respErr != nil {
+				errs = append(errs, respErr)
+			}
 		}
-	}
 
-	if len(errs) == len(clients) {
-		log.Debug("Failed to send transaction", "txHash", tx.Hash().Hex(), "errs", errs)
-		return NewMultipleError(errs)
-	}
+		if len(errs) == len(clients) {
+			log.Debug("Failed to send transaction", "txHash", tx.Hash().Hex(), "errs", errs)
+			return NewMultipleError(errs)
+		}
 
-	return nil
+		return nil
+	})
 }
 
 // CallContext performs a JSON-RPC call with the given arguments. If the context is
@@ -517,21 +644,27 @@ func (mc *Client) SendTransaction(ctx context.Context, tx *types.Transaction) er
 //
 // The result must be a pointer so that package json can unmarshal into it. You
 // can also pass nil, in which case the result is ignored.
+//
+// The state queries, e.g. eth_getBalance and eth_call, are routed by their block
+// parameters as the typed methods, so the raw calls forwarded by rpc-proxy are served
+// by the eth clients with the historical tags or the state.
 func (mc *Client) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
-	clients := mc.rpcClientMap.List()
-	if len(clients) == 0 {
-		return ErrNoEthClient
+	// The state queries are routed by the block number as the typed methods
+	blockNumber := stateBlockNumber(method, args)
+	clients, err := mc.availableClients(method, blockNumber)
+	if err != nil {
+		return err
 	}
 
 	var errs []error
 
-	finalErr := mc.requestRetryFunc(ctx, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+	finalErr := mc.retry(ctx, method, args, clients, mc.learnState(blockNumber, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
 		err := rpcClient.CallContext(ctx, result, method, args...)
 		if err != nil {
 			errs = append(errs, err)
 		}
 		return true, err
-	})
+	}))
 	if finalErr != nil {
 		log.Debug("Failed to perform a JSON-RPC call", "finalErr", finalErr, "errs", errs)
 		return finalErr
@@ -549,14 +682,17 @@ func (mc *Client) CallContext(ctx context.Context, result interface{}, method st
 //
 // Note that batch calls may not be executed atomically on the server side.
 func (mc *Client) BatchCallContext(ctx context.Context, b []rpc.BatchElem) error {
-	clients := mc.rpcClientMap.List()
-	if len(clients) == 0 {
-		return ErrNoEthClient
+	clients, err := mc.selectClients(query{
+		tags: mc.batchTags(b),
+		zone: mc.zone,
+	})
+	if err != nil {
+		return err
 	}
 
 	var errs []error
 
-	finalErr := mc.requestRetryFunc(ctx, clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
+	finalErr := mc.retry(ctx, "batch", batchParams(b), clients, func(ctx context.Context, rpcClient *rpc.Client) (bool, error) {
 		err := rpcClient.BatchCallContext(ctx, b)
 		if err != nil {
 			errs = append(errs, err)
@@ -632,7 +768,7 @@ func (mc *Client) subscribeNewHead(ctx context.Context, wg *sync.WaitGroup, id u
 		}
 		subLogger := logger.New("url", url)
 		// If we have error, we need to retry
-		err := doSubscribe(ctx, subLogger, rc, ch)
+		err := doSubscribe(ctx, subLogger, rc, mc.rpcClientMap.Draining(rc), mc.rpcClientMap.observeHead, ch)
 		if err == nil {
 			return nil
 		}
@@ -645,12 +781,15 @@ func (mc *Client) subscribeNewHead(ctx context.Context, wg *sync.WaitGroup, id u
 			return nil
 		}
 		subLogger.Trace("Retry to subscribe new head")
+		mc.metrics.observeReconnect(url)
 	}
 }
 
-func doSubscribe(ctx context.Context, logger log.Logger, rc *rpc.Client, ch chan<- *Header) error {
+// doSubscribe subscribes new head until the context is done or the client starts draining.
+// The subscription is emulated by polling over HTTP endpoints.
+func doSubscribe(ctx context.Context, logger log.Logger, rc *rpc.Client, drainCh <-chan struct{}, observeHead func(*rpc.Client, uint64), ch chan<- *Header) error {
 	headerCh := make(chan *types.Header)
-	c := ethclient.NewClient(rc)
+	c := hethclient.NewClient(rc)
 	subCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -659,9 +798,11 @@ func doSubscribe(ctx context.Context, logger log.Logger, rc *rpc.Client, ch chan
 		logger.Warn("Failed to subscribe new head", "err", err)
 		return err
 	}
+	defer sub.Unsubscribe()
 	for {
 		select {
 		case header := <-headerCh:
+			observeHead(rc, header.Number.Uint64())
 			h := &Header{
 				Client: rc,
 				Header: header,
@@ -674,6 +815,9 @@ func doSubscribe(ctx context.Context, logger log.Logger, rc *rpc.Client, ch chan
 		case err := <-sub.Err():
 			logger.Warn("Failed during subscription", "err", err)
 			return err
+		case <-drainCh:
+			logger.Trace("Stop subscription of draining eth client")
+			return nil
 		case <-subCtx.Done():
 			return nil
 		}
@@ -683,6 +827,7 @@ func doSubscribe(ctx context.Context, logger log.Logger, rc *rpc.Client, ch chan
 type dialedClient struct {
 	url    string
 	client *rpc.Client
+	err    error
 }
 
 func (mc *Client) DialClients(ctx context.Context) {
@@ -692,23 +837,72 @@ func (mc *Client) DialClients(ctx context.Context) {
 		go func(rawURL string) {
 			dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
 			defer cancel()
-			c, err := rpc.DialContext(dialCtx, rawURL)
+			c, err := hethclient.DialRPC(dialCtx, rawURL, mc.dialConfigOf(rawURL))
 			if err == nil {
 				log.Info("Connect to eth client successfully", "url", rawURL)
 			} else {
 				log.Warn("Failed to dial eth client", "url", rawURL, "err", err)
 			}
-			dialCh <- &dialedClient{url: rawURL, client: c}
+			dialCh <- &dialedClient{url: rawURL, client: c, err: err}
 		}(rawURL)
 	}
 
 	for i := 0; i < len(urls); i++ {
 		dialed := <-dialCh
+		mc.rpcClientMap.observeDial(dialed.url, dialed.err)
+		if dialed.err != nil {
+			mc.metrics.observeDialFailure(dialed.url)
+		}
 		if dialed.client != nil {
 			id := mc.rpcClientMap.Replace(dialed.url, dialed.client)
+			if id == 0 {
+				// The eth client is removed during dialing
+				dialed.client.Close()
+				continue
+			}
 			mc.pubSub.Pub(id, newAvailableClientTopic)
+			if mc.archiveRouting {
+				mc.goProbeState(dialed.url, dialed.client)
+			}
+		}
+	}
+}
+
+// dialConfigOf returns the dial config of the eth client, which is the one in the
+// endpoint metadata or the default one. The default one applies to the HTTP endpoints
+// only, and the websocket endpoints get its basic auth only, because the other options
+// are not supported by them.
+func (mc *Client) dialConfigOf(key string) *hethclient.DialConfig {
+	if md, ok := mc.rpcClientMap.Metadata(key); ok && md.Dial != nil {
+		return md.Dial
+	}
+	if mc.dialConfig == nil {
+		return nil
+	}
+	switch scheme(key) {
+	case "http", "https":
+		return mc.dialConfig
+	case "ws", "wss":
+		if mc.dialConfig.Username == "" && mc.dialConfig.Password == "" && mc.dialConfig.Recorder == nil {
+			return nil
 		}
+		// The recorder is kept to warn that the calls are not recorded
+		return &hethclient.DialConfig{
+			Username: mc.dialConfig.Username,
+			Password: mc.dialConfig.Password,
+			Recorder: mc.dialConfig.Recorder,
+		}
+	}
+	return nil
+}
+
+// scheme returns the lower case scheme of the url, or empty if it's not a valid url.
+func scheme(rawURL string) string {
+	u, err := netURL.Parse(rawURL)
+	if err != nil {
+		return ""
 	}
+	return strings.ToLower(u.Scheme)
 }
 
 func (mc *Client) retrydial() {
@@ -0,0 +1,55 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"testing"
+
+	hethclient "github.com/getamis/hypereth/ethclient"
+)
+
+func TestDialConfigOf(t *testing.T) {
+	config := &hethclient.DialConfig{
+		Username:    "user",
+		Password:    "pass",
+		BearerToken: "token",
+	}
+	own := &hethclient.DialConfig{BearerToken: "own"}
+	mc := &Client{
+		rpcClientMap: NewMap(nil),
+		dialConfig:   config,
+	}
+	mc.rpcClientMap.AddWithMetadata("https://own.example.com", nil, Metadata{Dial: own})
+
+	if c := mc.dialConfigOf("https://own.example.com"); c != own {
+		t.Errorf("got %+v, want the config in metadata", c)
+	}
+	if c := mc.dialConfigOf("https://example.com"); c != config {
+		t.Errorf("got %+v, want the default config for http", c)
+	}
+	if c := mc.dialConfigOf("WSS://example.com"); c == nil || c.Username != "user" || c.Password != "pass" || c.BearerToken != "" {
+		t.Errorf("got %+v, want the basic auth only for websocket", c)
+	}
+	if c := mc.dialConfigOf("/var/run/geth.ipc"); c != nil {
+		t.Errorf("got %+v, want no config for ipc", c)
+	}
+
+	mc.dialConfig = &hethclient.DialConfig{BearerToken: "token"}
+	if c := mc.dialConfigOf("ws://example.com"); c != nil {
+		t.Errorf("got %+v, want no config for websocket without basic auth", c)
+	}
+}
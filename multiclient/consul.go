@@ -17,49 +17,167 @@
 package multiclient
 
 import (
+	"context"
 	"fmt"
 	netURL "net/url"
+	"time"
 
 	"github.com/getamis/sirius/log"
 	consulAPI "github.com/hashicorp/consul/api"
 )
 
+const (
+	// consulWaitTime is the maximum duration of a consul blocking query.
+	consulWaitTime        = 5 * time.Minute
+	defaultConsulZoneMeta = "zone"
+)
+
+type ConsulConfig struct {
+	// Tags filters the service instances with all given tags.
+	Tags []string
+	// Datacenter is the datacenter to query. Set to empty means the datacenter of the agent.
+	Datacenter string
+	// Token is the ACL token for the queries.
+	Token string
+	// ZoneMeta is the key of node meta for the zone of endpoints. Set to empty means "zone".
+	ZoneMeta string
+}
+
 // ConsulDiscovery discovers the dynamic ethclient endpoints through consul server.
-// TODO: should watch the change of endpoints
+// Only the service instances passing all health checks are used.
 func ConsulDiscovery(rawURL, serviceID, serviceScheme string) Option {
+	return ConsulDiscoveryWithConfig(rawURL, serviceID, serviceScheme, nil)
+}
+
+// ConsulDiscoveryWithConfig discovers the dynamic ethclient endpoints through consul
+// server with the given tags, datacenter and ACL token.
+func ConsulDiscoveryWithConfig(rawURL, serviceID, serviceScheme string, config *ConsulConfig) Option {
 	return func(mc *Client) error {
-		client, err := createConsulClient(rawURL)
+		d, err := NewConsulDiscoverer(rawURL, serviceID, serviceScheme, config)
 		if err != nil {
 			return err
 		}
-		urls, err := getEthURLsFromConsul(client, serviceID, serviceScheme)
-		if err != nil {
-			return err
+		return WithDiscoverer(d)(mc)
+	}
+}
+
+// consulDiscoverer watches the consul service with blocking queries. Only the service
+// instances passing all health checks are discovered, and the consul service tags and
+// passing weight are used as endpoint metadata.
+type consulDiscoverer struct {
+	client    *consulAPI.Client
+	serviceID string
+	scheme    string
+	config    *ConsulConfig
+	// the last index of blocking queries
+	lastIndex uint64
+}
+
+// NewConsulDiscoverer creates a discoverer watching the consul service.
+func NewConsulDiscoverer(rawURL, serviceID, serviceScheme string, config *ConsulConfig) (Discoverer, error) {
+	client, err := createConsulClient(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &ConsulConfig{}
+	}
+	if config.ZoneMeta == "" {
+		config.ZoneMeta = defaultConsulZoneMeta
+	}
+	return &consulDiscoverer{
+		client:    client,
+		serviceID: serviceID,
+		scheme:    serviceScheme,
+		config:    config,
+	}, nil
+}
+
+func (d *consulDiscoverer) Name() string {
+	return "consul"
+}
+
+func (d *consulDiscoverer) Discover(ctx context.Context, ch chan<- Update) error {
+	// Force sync at first
+	if err := d.sync(ctx, ch); err != nil {
+		return err
+	}
+	for {
+		err := d.sync(ctx, ch)
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
 		}
-		log.Info("EthClients from consul", "urls", urls)
-		for _, url := range urls {
-			mc.ClientMap().Add(url, nil)
+		if err == nil {
+			continue
+		}
+
+		// Retry later, and reset the index in case the consul server is restarted. The
+		// index is reset to 1 rather than 0, since the query with index 0 never blocks.
+		d.lastIndex = 1
+		select {
+		case <-time.After(retryPeriod):
+		case <-ctx.Done():
+			return nil
 		}
-		return nil
 	}
 }
 
-func getEthURLsFromConsul(client *consulAPI.Client, serviceID, serviceScheme string) ([]string, error) {
-	list, _, err := client.Catalog().Service(serviceID, "", nil)
+// sync waits for the change of the service and sends the found endpoints.
+func (d *consulDiscoverer) sync(ctx context.Context, ch chan<- Update) error {
+	q := &consulAPI.QueryOptions{
+		Datacenter: d.config.Datacenter,
+		Token:      d.config.Token,
+		WaitIndex:  d.lastIndex,
+		WaitTime:   consulWaitTime,
+	}
+	list, meta, err := d.client.Health().ServiceMultipleTags(d.serviceID, d.config.Tags, true, q.WithContext(ctx))
 	if err != nil {
-		log.Error("Failed to get service from consul", "serviceID", serviceID, "err", err)
-		return nil, err
+		if ctx.Err() == nil {
+			log.Error("Failed to get service from consul", "serviceID", d.serviceID, "err", err)
+		}
+		return err
+	}
+	// The index is not changed when the blocking query is timed out
+	if d.lastIndex != 0 && meta.LastIndex == d.lastIndex {
+		return nil
+	}
+	// Reset the index if it goes backwards, and never use the index 0 which doesn't
+	// block, see https://www.consul.io/api/features/blocking.html
+	if meta.LastIndex < d.lastIndex || meta.LastIndex < 1 {
+		d.lastIndex = 1
+	} else {
+		d.lastIndex = meta.LastIndex
 	}
+	sendUpdate(ctx, ch, Update{
+		Full:      true,
+		Endpoints: getEthEndpointsFromConsul(list, d.scheme, d.config.ZoneMeta),
+	})
+	return nil
+}
 
-	ethURLs := make([]string, len(list))
-	for i, srv := range list {
-		addr := srv.ServiceAddress
+func getEthEndpointsFromConsul(list []*consulAPI.ServiceEntry, serviceScheme, zoneMeta string) []Endpoint {
+	endpoints := make([]Endpoint, len(list))
+	for i, entry := range list {
+		srv := entry.Service
+		addr := srv.Address
 		if addr == "" {
-			addr = srv.Address
+			addr = entry.Node.Address
+		}
+		endpoints[i] = Endpoint{
+			URL: fmt.Sprintf("%s://%s:%d", serviceScheme, addr, srv.Port),
+			Metadata: Metadata{
+				Weight: srv.Weights.Passing,
+				Tags:   srv.Tags,
+				Zone:   entry.Node.Meta[zoneMeta],
+				Labels: map[string]string{
+					"node": entry.Node.Node,
+				},
+			},
 		}
-		ethURLs[i] = fmt.Sprintf("%s://%s:%d", serviceScheme, addr, srv.ServicePort)
 	}
-	return ethURLs, nil
+	return endpoints
 }
 
 func createConsulClient(rawURL string) (*consulAPI.Client, error) {
@@ -0,0 +1,227 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	consulAPI "github.com/hashicorp/consul/api"
+)
+
+const (
+	testConsulService = "geth"
+	// testConsulWait is the duration of the blocking queries of the fake consul.
+	testConsulWait = 50 * time.Millisecond
+)
+
+// fakeConsul serves the health service endpoint of consul with blocking queries.
+type fakeConsul struct {
+	lock    sync.Mutex
+	index   uint64
+	entries []*consulAPI.ServiceEntry
+	// changed is closed when the service is changed
+	changed chan struct{}
+	// queries are the queries received
+	queries []url.Values
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{changed: make(chan struct{})}
+}
+
+// set changes the service instances and the index, which wakes up the blocking queries.
+func (c *fakeConsul) set(index uint64, entries ...*consulAPI.ServiceEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.index = index
+	c.entries = entries
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// received returns the values of the query parameter received.
+func (c *fakeConsul) received(key string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var values []string
+	for _, q := range c.queries {
+		values = append(values, q.Get(key))
+	}
+	return values
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/"+testConsulService {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	index, _ := strconv.ParseUint(q.Get("index"), 10, 64)
+
+	c.lock.Lock()
+	c.queries = append(c.queries, q)
+	// Block until the service is changed or timed out
+	if index != 0 && index >= c.index {
+		changed := c.changed
+		c.lock.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(testConsulWait):
+		case <-r.Context().Done():
+			return
+		}
+		c.lock.Lock()
+	}
+	out := []*consulAPI.ServiceEntry{}
+	for _, e := range c.entries {
+		if q.Get(consulAPI.HealthPassing) != "" && e.Checks.AggregatedStatus() != consulAPI.HealthPassing {
+			continue
+		}
+		if !(Metadata{Tags: e.Service.Tags}).HasTags(q["tag"]) {
+			continue
+		}
+		out = append(out, e)
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	c.lock.Unlock()
+
+	json.NewEncoder(w).Encode(out)
+}
+
+func consulEntry(node, addr, status string, tags ...string) *consulAPI.ServiceEntry {
+	return &consulAPI.ServiceEntry{
+		Node: &consulAPI.Node{
+			Node:    node,
+			Address: addr,
+			Meta:    map[string]string{"zone": "zone-" + node},
+		},
+		Service: &consulAPI.AgentService{
+			ID:      testConsulService + "-" + node,
+			Service: testConsulService,
+			Tags:    tags,
+			Port:    8545,
+			Weights: consulAPI.AgentWeights{Passing: 2, Warning: 1},
+		},
+		Checks: consulAPI.HealthChecks{
+			{Node: node, CheckID: "serfHealth", Status: consulAPI.HealthPassing},
+			{Node: node, CheckID: "service:" + testConsulService, Status: status},
+		},
+	}
+}
+
+func TestConsulDiscoverer(t *testing.T) {
+	consul := newFakeConsul()
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	n1 := consulEntry("n1", "10.0.0.1", consulAPI.HealthPassing, "mainnet", TagArchive)
+	n2 := consulEntry("n2", "10.0.0.2", consulAPI.HealthCritical, "mainnet")
+	n3 := consulEntry("n3", "10.0.0.3", consulAPI.HealthPassing, "testnet")
+	consul.set(10, n1, n2, n3)
+
+	d, err := NewConsulDiscoverer(server.URL, testConsulService, "http", &ConsulConfig{Tags: []string{"mainnet"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan Update)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- d.Discover(ctx, ch)
+	}()
+	receive := func(urls ...string) Update {
+		select {
+		case u := <-ch:
+			var got []string
+			for _, ep := range u.Endpoints {
+				got = append(got, ep.URL)
+			}
+			if !u.Full || !reflect.DeepEqual(got, urls) {
+				t.Fatalf("got full %v and endpoints %v, want true and %v", u.Full, got, urls)
+			}
+			return u
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no update of %v received", urls)
+		}
+		return Update{}
+	}
+
+	// Only the passing instances with the tags are found
+	u := receive("http://10.0.0.1:8545")
+	want := Metadata{
+		Weight: 2,
+		Tags:   []string{"mainnet", TagArchive},
+		Zone:   "zone-n1",
+		Labels: map[string]string{"node": "n1"},
+	}
+	if !reflect.DeepEqual(u.Endpoints[0].Metadata, want) {
+		t.Fatalf("got metadata %+v, want %+v", u.Endpoints[0].Metadata, want)
+	}
+	if passing := consul.received(consulAPI.HealthPassing); passing[0] != "1" {
+		t.Fatalf("got passing %v, want %v", passing[0], "1")
+	}
+
+	// The service is changed while the query is blocking
+	n2 = consulEntry("n2", "10.0.0.2", consulAPI.HealthPassing, "mainnet")
+	consul.set(11, n2, n3)
+	receive("http://10.0.0.2:8545")
+
+	// The index goes backwards after consul is restarted, and it's reset to 1. The
+	// query with index 1 returns at once, so the service is sent again.
+	consul.set(3, n1)
+	receive("http://10.0.0.1:8545")
+	receive("http://10.0.0.1:8545")
+	// The timed out queries are repeated with the same index
+	var indexes []string
+	for _, index := range consul.received("index") {
+		if len(indexes) == 0 || indexes[len(indexes)-1] != index {
+			indexes = append(indexes, index)
+		}
+	}
+	if want := []string{"", "10", "11", "1"}; len(indexes) < len(want) || !reflect.DeepEqual(indexes[:len(want)], want) {
+		t.Fatalf("got indexes %v, want %v", indexes, want)
+	}
+
+	// The timed out queries are not sent
+	select {
+	case u := <-ch:
+		t.Fatalf("got unexpected update %+v", u)
+	case <-time.After(5 * testConsulWait):
+	}
+
+	consul.set(4, n1, n2)
+	receive("http://10.0.0.1:8545", "http://10.0.0.2:8545")
+	consul.set(5)
+	receive()
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+}
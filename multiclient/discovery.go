@@ -0,0 +1,222 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"context"
+	"sync"
+
+	"github.com/getamis/sirius/log"
+)
+
+// Update represents a change of the discovered endpoints.
+type Update struct {
+	// Full is true if Endpoints is the full set of discovered endpoints, and the
+	// endpoints not in the set are removed.
+	Full bool
+	// Endpoints are the added or updated endpoints, or the full set if Full is true.
+	Endpoints []Endpoint
+	// Removed are the urls of removed endpoints. It's ignored if Full is true.
+	Removed []string
+}
+
+// Discoverer discovers the eth client endpoints.
+type Discoverer interface {
+	// Name returns the name of the discoverer for logging.
+	Name() string
+	// Discover sends the changes of endpoints to ch until ctx is done. It must send
+	// an update once the initial discovery is done, even if nothing is found, or return
+	// an error if the initial discovery fails. After that, it should retry on errors by
+	// itself and return only when ctx is done.
+	Discover(ctx context.Context, ch chan<- Update) error
+}
+
+// sendUpdate sends the update to ch. It returns false if ctx is done.
+func sendUpdate(ctx context.Context, ch chan<- Update, u Update) bool {
+	select {
+	case ch <- u:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// reconciler applies the updates from discoverers to the client map. The endpoints
+// found by multiple discoverers are removed only if all of them remove the endpoints,
+// and the eth clients added to the map by others are never removed.
+type reconciler struct {
+	lock sync.Mutex
+	// the endpoints found by each discoverer
+	sets []map[string]Metadata
+	// the urls of the eth clients added by the reconciler
+	owned        map[string]bool
+	rpcClientMap *Map
+}
+
+func newReconciler(rpcClientMap *Map) *reconciler {
+	return &reconciler{
+		owned:        make(map[string]bool),
+		rpcClientMap: rpcClientMap,
+	}
+}
+
+// start runs the discoverers until ctx is done, and waits for their initial discovery
+// until readyCtx is done.
+func (r *reconciler) start(ctx, readyCtx context.Context, discoverers []Discoverer, wg *sync.WaitGroup) error {
+	r.lock.Lock()
+	base := len(r.sets)
+	for range discoverers {
+		r.sets = append(r.sets, make(map[string]Metadata))
+	}
+	r.lock.Unlock()
+
+	readyCh := make(chan error, len(discoverers))
+	for i, d := range discoverers {
+		wg.Add(1)
+		go func(idx int, d Discoverer) {
+			defer wg.Done()
+			r.run(ctx, idx, d, readyCh)
+		}(base+i, d)
+	}
+	for range discoverers {
+		select {
+		case err := <-readyCh:
+			if err != nil {
+				return err
+			}
+		case <-readyCtx.Done():
+			return readyCtx.Err()
+		}
+	}
+	return nil
+}
+
+// run applies the updates of the discoverer until it returns. The result of the initial
+// discovery is sent to readyCh.
+func (r *reconciler) run(ctx context.Context, idx int, d Discoverer, readyCh chan<- error) {
+	ch := make(chan Update)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- d.Discover(ctx, ch)
+	}()
+
+	ready := false
+	for {
+		select {
+		case u := <-ch:
+			r.apply(idx, d.Name(), u)
+			if !ready {
+				ready = true
+				readyCh <- nil
+			}
+		case err := <-errCh:
+			if !ready {
+				if err == nil {
+					err = ctx.Err()
+				}
+				log.Error("Failed to discover eth clients", "discoverer", d.Name(), "err", err)
+				readyCh <- err
+			} else if err != nil {
+				log.Error("Eth client discoverer stopped", "discoverer", d.Name(), "err", err)
+			}
+			return
+		}
+	}
+}
+
+// apply updates the endpoint set of the discoverer, and adds, updates or deletes the
+// eth clients accordingly.
+func (r *reconciler) apply(idx int, name string, u Update) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	olds := r.sets[idx]
+	news := make(map[string]Metadata, len(olds))
+	if !u.Full {
+		for url, md := range olds {
+			news[url] = md
+		}
+		for _, url := range u.Removed {
+			delete(news, url)
+		}
+	}
+	for _, e := range u.Endpoints {
+		news[e.URL] = e.Metadata
+	}
+
+	// the metadata before the update of the changed endpoints
+	befores := make(map[string]*Metadata, len(olds)+len(news))
+	for url := range olds {
+		befores[url] = r.lookup(url)
+	}
+	for url := range news {
+		befores[url] = r.lookup(url)
+	}
+	r.sets[idx] = news
+
+	for url, before := range befores {
+		after := r.lookup(url)
+		switch {
+		case after != nil && before == nil:
+			log.Info("EthClient discovered", "discoverer", name, "url", url)
+			if r.rpcClientMap.add(url, nil, *after) {
+				r.owned[url] = true
+			}
+		case after != nil:
+			r.rpcClientMap.SetMetadata(url, *after)
+		case before != nil && r.owned[url]:
+			log.Info("EthClient removed", "discoverer", name, "url", url)
+			delete(r.owned, url)
+			r.rpcClientMap.Delete(url)
+		case before != nil:
+			log.Info("EthClient not added by discoverers is kept", "discoverer", name, "url", url)
+		}
+	}
+}
+
+// lookup returns the metadata of the endpoint found by the first discoverer, or nil if
+// the endpoint is not found.
+func (r *reconciler) lookup(url string) *Metadata {
+	for _, set := range r.sets {
+		if md, ok := set[url]; ok {
+			return &md
+		}
+	}
+	return nil
+}
+
+// staticDiscoverer discovers a static list of endpoints.
+type staticDiscoverer struct {
+	endpoints []Endpoint
+}
+
+// NewStaticDiscoverer creates a discoverer of the given endpoints.
+func NewStaticDiscoverer(endpoints []Endpoint) Discoverer {
+	return &staticDiscoverer{
+		endpoints: endpoints,
+	}
+}
+
+func (d *staticDiscoverer) Name() string {
+	return "static"
+}
+
+func (d *staticDiscoverer) Discover(ctx context.Context, ch chan<- Update) error {
+	sendUpdate(ctx, ch, Update{Full: true, Endpoints: d.endpoints})
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,241 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDiscoverer sends the given updates, or fails the initial discovery with err.
+type fakeDiscoverer struct {
+	updates chan Update
+	err     error
+}
+
+func newFakeDiscoverer() *fakeDiscoverer {
+	return &fakeDiscoverer{updates: make(chan Update)}
+}
+
+func (d *fakeDiscoverer) Name() string {
+	return "fake"
+}
+
+func (d *fakeDiscoverer) Discover(ctx context.Context, ch chan<- Update) error {
+	if d.err != nil {
+		return d.err
+	}
+	for {
+		select {
+		case u := <-d.updates:
+			if !sendUpdate(ctx, ch, u) {
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// tiers returns the tiers of the eth clients in the map, which tell the metadata apart.
+func tiers(m *Map) map[string]int {
+	ts := make(map[string]int)
+	for _, url := range m.Keys() {
+		md, _ := m.Metadata(url)
+		ts[url] = md.Tier
+	}
+	return ts
+}
+
+func endpoints(urls ...string) []Endpoint {
+	var eps []Endpoint
+	for _, url := range urls {
+		eps = append(eps, Endpoint{URL: url})
+	}
+	return eps
+}
+
+func TestReconcilerApply(t *testing.T) {
+	type step struct {
+		idx int
+		u   Update
+	}
+	tests := []struct {
+		name string
+		// added are the eth clients added to the map by others
+		added []string
+		steps []step
+		want  map[string]int
+	}{
+		{
+			"full",
+			nil,
+			[]step{
+				{0, Update{Full: true, Endpoints: endpoints("a", "b")}},
+				{0, Update{Full: true, Endpoints: []Endpoint{{URL: "b", Metadata: Metadata{Tier: 1}}, {URL: "c"}}}},
+			},
+			map[string]int{"b": 1, "c": 0},
+		},
+		{
+			"incremental",
+			nil,
+			[]step{
+				{0, Update{Full: true, Endpoints: endpoints("a", "b")}},
+				{0, Update{Endpoints: endpoints("c")}},
+				{0, Update{Endpoints: []Endpoint{{URL: "b", Metadata: Metadata{Tier: 1}}}, Removed: []string{"a"}}},
+				{0, Update{Removed: []string{"unknown"}}},
+			},
+			map[string]int{"b": 1, "c": 0},
+		},
+		{
+			"shared",
+			nil,
+			[]step{
+				{0, Update{Full: true, Endpoints: endpoints("a")}},
+				{1, Update{Full: true, Endpoints: []Endpoint{{URL: "a", Metadata: Metadata{Tier: 1}}, {URL: "b"}}}},
+				// a is still found by the second discoverer
+				{0, Update{Full: true}},
+			},
+			map[string]int{"a": 1, "b": 0},
+		},
+		{
+			"removed by all",
+			nil,
+			[]step{
+				{0, Update{Full: true, Endpoints: endpoints("a")}},
+				{1, Update{Full: true, Endpoints: endpoints("a", "b")}},
+				{1, Update{Removed: []string{"a"}}},
+				{0, Update{Removed: []string{"a"}}},
+			},
+			map[string]int{"b": 0},
+		},
+		{
+			"precedence",
+			nil,
+			[]step{
+				{1, Update{Full: true, Endpoints: []Endpoint{{URL: "a", Metadata: Metadata{Tier: 1}}}}},
+				// the metadata of the first discoverer is used
+				{0, Update{Full: true, Endpoints: []Endpoint{{URL: "a", Metadata: Metadata{Tier: 2}}}}},
+				{1, Update{Endpoints: []Endpoint{{URL: "a", Metadata: Metadata{Tier: 3}}}}},
+			},
+			map[string]int{"a": 2},
+		},
+		{
+			"fallback",
+			nil,
+			[]step{
+				{0, Update{Full: true, Endpoints: []Endpoint{{URL: "a", Metadata: Metadata{Tier: 2}}}}},
+				{1, Update{Full: true, Endpoints: []Endpoint{{URL: "a", Metadata: Metadata{Tier: 1}}}}},
+				{0, Update{Removed: []string{"a"}}},
+			},
+			map[string]int{"a": 1},
+		},
+		{
+			"added by others",
+			[]string{"a"},
+			[]step{
+				{0, Update{Full: true, Endpoints: []Endpoint{{URL: "a", Metadata: Metadata{Tier: 1}}, {URL: "b"}}}},
+				{0, Update{Full: true}},
+			},
+			map[string]int{"a": 1},
+		},
+	}
+	for _, test := range tests {
+		m := NewMap(nil)
+		for _, url := range test.added {
+			m.Add(url, nil)
+		}
+		r := newReconciler(m)
+		r.sets = []map[string]Metadata{{}, {}}
+		for _, s := range test.steps {
+			r.apply(s.idx, "fake", s.u)
+		}
+		if got := tiers(m); !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%s: got clients %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReconcilerStart(t *testing.T) {
+	m := NewMap(nil)
+	r := newReconciler(m)
+	d1, d2 := newFakeDiscoverer(), newFakeDiscoverer()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- r.start(ctx, ctx, []Discoverer{d1, d2}, &wg)
+	}()
+	d1.updates <- Update{Full: true, Endpoints: endpoints("a")}
+	select {
+	case err := <-errCh:
+		t.Fatalf("started before the initial discovery of all discoverers, err %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	d2.updates <- Update{Full: true, Endpoints: endpoints("b")}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tiers(m), map[string]int{"a": 0, "b": 0}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got clients %v, want %v", got, want)
+	}
+
+	// the updates after the initial discovery are applied. An update is applied once
+	// the next one is received by the reconciler, so send two empty updates to wait.
+	d2.updates <- Update{Removed: []string{"b"}}
+	d2.updates <- Update{}
+	d2.updates <- Update{}
+	if got, want := tiers(m), map[string]int{"a": 0}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got clients %v, want %v", got, want)
+	}
+}
+
+func TestReconcilerStartError(t *testing.T) {
+	errDiscover := errors.New("discovery failed")
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	r := newReconciler(NewMap(nil))
+	err := r.start(ctx, ctx, []Discoverer{newFakeDiscoverer(), &fakeDiscoverer{err: errDiscover}}, &wg)
+	if err != errDiscover {
+		t.Fatalf("got error %v, want %v", err, errDiscover)
+	}
+}
+
+func TestNewWaitsForDiscovery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// the discoverer never sends the initial update
+	start := time.Now()
+	_, err := New(ctx, WithDiscoverer(newFakeDiscoverer()))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("returned after %v, want the ctx timeout", elapsed)
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getamis/sirius/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSRefreshInterval = 30 * time.Second
+	// minDNSRefreshInterval bounds the refresh rate of the records with zero or tiny TTLs.
+	minDNSRefreshInterval = time.Second
+	dnsQueryTimeout       = 3 * time.Second
+	dnsUDPSize            = 4096
+	resolvConfPath        = "/etc/resolv.conf"
+)
+
+var errNoDNSRecords = errors.New("no DNS records found")
+
+type DNSConfig struct {
+	// Service and Proto are the service and protocol of SRV records, i.e. the SRV record
+	// of _Service._Proto.name is resolved. Set Service to empty means resolving the A and
+	// AAAA records of name.
+	Service string
+	Proto   string
+	// Port is the port of endpoints resolved from A and AAAA records.
+	Port int
+	// RefreshInterval is the interval to resolve the records again after failures. The
+	// resolved records are refreshed when the minimum TTL of them expires. Set to 0
+	// means 30 seconds.
+	RefreshInterval time.Duration
+	// Servers are the addresses of the name servers, e.g. "10.96.0.10:53". Set to nil
+	// means the name servers in /etc/resolv.conf.
+	Servers []string
+}
+
+// DNSDiscovery discovers the dynamic ethclient endpoints through DNS.
+func DNSDiscovery(name, scheme string, config DNSConfig) Option {
+	return func(mc *Client) error {
+		d, err := NewDNSDiscoverer(name, scheme, config)
+		if err != nil {
+			return err
+		}
+		return WithDiscoverer(d)(mc)
+	}
+}
+
+// dnsResolver resolves the DNS records and resolves them again when their TTLs expire.
+// The SRV records are resolved if config.Service is given, and the priority and weight
+// of SRV records are used as the tier and weight of endpoints. Otherwise, the A and AAAA
+// records are resolved with config.Port.
+type dnsResolver struct {
+	name   string
+	scheme string
+	config DNSConfig
+	client *dnsClient
+}
+
+// NewDNSDiscoverer creates a discoverer resolving the DNS records of name.
+func NewDNSDiscoverer(name, scheme string, config DNSConfig) (Discoverer, error) {
+	if config.Service == "" && config.Port == 0 {
+		return nil, ErrInvalidDNSConfig
+	}
+	if config.RefreshInterval == 0 {
+		config.RefreshInterval = defaultDNSRefreshInterval
+	}
+	client := newDNSClient(resolvConfPath)
+	if len(config.Servers) > 0 {
+		client.servers = nameServers(config.Servers)
+	}
+	return &dnsResolver{
+		name:   name,
+		scheme: scheme,
+		config: config,
+		client: client,
+	}, nil
+}
+
+func (r *dnsResolver) Name() string {
+	return "dns"
+}
+
+func (r *dnsResolver) Discover(ctx context.Context, ch chan<- Update) error {
+	// Force sync at first
+	refresh, err := r.sync(ctx, ch)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(refresh)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			// Keep the known endpoints if failed to resolve, the error is logged in sync
+			if refresh, err = r.sync(ctx, ch); err != nil {
+				refresh = r.config.RefreshInterval
+			}
+			timer.Reset(refresh)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// sync resolves the records and sends the found endpoints. It returns when to resolve
+// the records again, i.e. the minimum TTL of the records.
+func (r *dnsResolver) sync(ctx context.Context, ch chan<- Update) (time.Duration, error) {
+	resolveCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	var endpoints []Endpoint
+	var ttl uint32
+	var err error
+	if r.config.Service != "" {
+		endpoints, ttl, err = r.lookupSRV(resolveCtx)
+	} else {
+		endpoints, ttl, err = r.lookupIP(resolveCtx)
+	}
+	if err != nil {
+		log.Warn("Failed to resolve eth client endpoints", "name", r.name, "service", r.config.Service, "err", err)
+		return 0, err
+	}
+	refresh := time.Duration(ttl) * time.Second
+	if refresh < minDNSRefreshInterval {
+		refresh = minDNSRefreshInterval
+	}
+	log.Debug("Eth client endpoints resolved", "name", r.name, "service", r.config.Service, "count", len(endpoints), "refresh", refresh)
+	sendUpdate(ctx, ch, Update{Full: true, Endpoints: endpoints})
+	return refresh, nil
+}
+
+func (r *dnsResolver) lookupSRV(ctx context.Context) ([]Endpoint, uint32, error) {
+	name := fmt.Sprintf("_%s._%s.%s", r.config.Service, r.config.Proto, r.name)
+	answers, err := r.client.query(ctx, name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	var endpoints []Endpoint
+	for _, answer := range answers {
+		srv, ok := answer.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+		host := strings.TrimSuffix(srv.Target.String(), ".")
+		endpoints = append(endpoints, Endpoint{
+			URL: fmt.Sprintf("%s://%s", r.scheme, net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))),
+			Metadata: Metadata{
+				Tier:   int(srv.Priority),
+				Weight: int(srv.Weight),
+			},
+		})
+	}
+	if len(endpoints) == 0 {
+		return nil, 0, errNoDNSRecords
+	}
+	return endpoints, minTTL(answers), nil
+}
+
+func (r *dnsResolver) lookupIP(ctx context.Context) ([]Endpoint, uint32, error) {
+	var answers []dnsmessage.Resource
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		as, err := r.client.query(ctx, r.name, qtype)
+		if err != nil {
+			if lastErr == nil || lastErr == errNoDNSRecords {
+				lastErr = err
+			}
+			continue
+		}
+		answers = append(answers, as...)
+	}
+
+	var endpoints []Endpoint
+	for _, answer := range answers {
+		var ip net.IP
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue
+		}
+		endpoints = append(endpoints, Endpoint{
+			URL: fmt.Sprintf("%s://%s", r.scheme, net.JoinHostPort(ip.String(), strconv.Itoa(r.config.Port))),
+		})
+	}
+	if len(endpoints) == 0 {
+		if lastErr == nil {
+			lastErr = errNoDNSRecords
+		}
+		return nil, 0, lastErr
+	}
+	return endpoints, minTTL(answers), nil
+}
+
+// minTTL returns the minimum TTL of the answers, including the CNAME records leading
+// to the answers.
+func minTTL(answers []dnsmessage.Resource) uint32 {
+	ttl := uint32(math.MaxUint32)
+	for _, answer := range answers {
+		if answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+	}
+	return ttl
+}
+
+// dnsClient is a stub resolver querying the recursive name servers directly, because
+// the standard resolver doesn't expose the TTLs of records.
+type dnsClient struct {
+	servers []string
+	search  []string
+}
+
+// newDNSClient creates a DNS client with the name servers and search domains in the
+// given resolv.conf. The local name server is used if there is none.
+func newDNSClient(path string) *dnsClient {
+	c := &dnsClient{}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Debug("Failed to read resolv.conf, use the local name server", "path", path, "err", err)
+		c.servers = nameServers([]string{"127.0.0.1"})
+		return c
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			servers = append(servers, fields[1])
+		case "domain", "search":
+			c.search = fields[1:]
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1"}
+	}
+	c.servers = nameServers(servers)
+	return c
+}
+
+// nameServers adds the default port to the name server addresses without ports.
+func nameServers(addrs []string) []string {
+	servers := make([]string, len(addrs))
+	for i, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		servers[i] = addr
+	}
+	return servers
+}
+
+// names returns the fully qualified names to query in order. A name without the
+// trailing dot is tried as is at first, and then with the search domains.
+func (c *dnsClient) names(name string) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+	names := []string{name + "."}
+	for _, domain := range c.search {
+		names = append(names, name+"."+strings.TrimSuffix(domain, ".")+".")
+	}
+	return names
+}
+
+// query resolves the records of the given type. The name servers are tried in order
+// until one of them answers.
+func (c *dnsClient) query(ctx context.Context, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	lastErr := errNoDNSRecords
+	for _, fqdn := range c.names(name) {
+		n, err := dnsmessage.NewName(fqdn)
+		if err != nil {
+			return nil, err
+		}
+		q := dnsmessage.Question{Name: n, Type: qtype, Class: dnsmessage.ClassINET}
+		for _, server := range c.servers {
+			answers, err := c.exchange(ctx, server, q)
+			if err == errNoDNSRecords {
+				// The name server answered, try the next name
+				break
+			}
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			return answers, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// exchange sends the question to the name server over UDP, and again over TCP if the
+// response is truncated.
+func (c *dnsClient) exchange(ctx context.Context, server string, q dnsmessage.Question) ([]dnsmessage.Resource, error) {
+	id := uint16(rand.Uint32())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	req, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	var h dnsmessage.Header
+	for _, network := range []string{"udp", "tcp"} {
+		resp, err := dnsRoundTrip(ctx, network, server, req)
+		if err != nil {
+			return nil, err
+		}
+		if h, err = p.Start(resp); err != nil {
+			return nil, err
+		}
+		if !h.Truncated {
+			break
+		}
+	}
+	if h.ID != id || !h.Response {
+		return nil, fmt.Errorf("invalid DNS response from %s", server)
+	}
+	// The response must echo the question, otherwise it's a response to another query.
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	if len(questions) != 1 || !sameQuestion(questions[0], q) {
+		return nil, fmt.Errorf("mismatched DNS response from %s", server)
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, errNoDNSRecords
+	default:
+		return nil, fmt.Errorf("DNS query failed on %s with rcode %d", server, h.RCode)
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) == 0 {
+		return nil, errNoDNSRecords
+	}
+	return answers, nil
+}
+
+// sameQuestion reports whether the questions are the same. The names are compared
+// case-insensitively.
+func sameQuestion(a, b dnsmessage.Question) bool {
+	return a.Type == b.Type && a.Class == b.Class && strings.EqualFold(a.Name.String(), b.Name.String())
+}
+
+func dnsRoundTrip(ctx context.Context, network, server string, req []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, dnsUDPSize)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		return resp[:n], nil
+	}
+
+	// The messages over TCP are prefixed with the two-byte length
+	msg := make([]byte, 2+len(req))
+	binary.BigEndian.PutUint16(msg, uint16(len(req)))
+	copy(msg[2:], req)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
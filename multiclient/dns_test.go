@@ -0,0 +1,259 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDNS answers the questions of the given names and types over UDP until the
+// returned function is called.
+func serveDNS(t *testing.T, records map[dnsmessage.Type][]func(b *dnsmessage.Builder) error) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			h.Response = true
+			if len(records[q.Type]) == 0 {
+				h.RCode = dnsmessage.RCodeNameError
+			}
+			b := dnsmessage.NewBuilder(nil, h)
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			for _, add := range records[q.Type] {
+				if err := add(&b); err != nil {
+					t.Error(err)
+				}
+			}
+			resp, err := b.Finish()
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func mustNewName(t *testing.T, name string) dnsmessage.Name {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func resourceHeader(t *testing.T, name string, ttl uint32) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{
+		Name:  mustNewName(t, name),
+		Class: dnsmessage.ClassINET,
+		TTL:   ttl,
+	}
+}
+
+func TestDNSResolverSRV(t *testing.T) {
+	name := "_ethrpc._tcp.eth.example.com."
+	addr, stop := serveDNS(t, map[dnsmessage.Type][]func(b *dnsmessage.Builder) error{
+		dnsmessage.TypeSRV: {
+			func(b *dnsmessage.Builder) error {
+				return b.SRVResource(resourceHeader(t, name, 60), dnsmessage.SRVResource{
+					Priority: 0, Weight: 10, Port: 8546, Target: mustNewName(t, "node1.example.com."),
+				})
+			},
+			func(b *dnsmessage.Builder) error {
+				return b.SRVResource(resourceHeader(t, name, 20), dnsmessage.SRVResource{
+					Priority: 1, Weight: 5, Port: 8547, Target: mustNewName(t, "node2.example.com."),
+				})
+			},
+		},
+	})
+	defer stop()
+
+	d, err := NewDNSDiscoverer("eth.example.com", "ws", DNSConfig{Service: "ethrpc", Proto: "tcp", Servers: []string{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan Update, 1)
+	refresh, err := d.(*dnsResolver).sync(context.Background(), ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refresh != 20*time.Second {
+		t.Errorf("refresh after %v, want the minimum TTL 20s", refresh)
+	}
+	want := []Endpoint{
+		{URL: "ws://node1.example.com:8546", Metadata: Metadata{Tier: 0, Weight: 10}},
+		{URL: "ws://node2.example.com:8547", Metadata: Metadata{Tier: 1, Weight: 5}},
+	}
+	if u := <-ch; !u.Full || !reflect.DeepEqual(u.Endpoints, want) {
+		t.Errorf("got update %+v, want endpoints %+v", u, want)
+	}
+}
+
+func TestDNSResolverIP(t *testing.T) {
+	name := "eth.example.com."
+	addr, stop := serveDNS(t, map[dnsmessage.Type][]func(b *dnsmessage.Builder) error{
+		dnsmessage.TypeA: {
+			func(b *dnsmessage.Builder) error {
+				return b.AResource(resourceHeader(t, name, 0), dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}})
+			},
+		},
+	})
+	defer stop()
+
+	d, err := NewDNSDiscoverer("eth.example.com", "http", DNSConfig{Port: 8545, Servers: []string{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan Update, 1)
+	refresh, err := d.(*dnsResolver).sync(context.Background(), ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refresh != minDNSRefreshInterval {
+		t.Errorf("refresh after %v, want %v for zero TTL", refresh, minDNSRefreshInterval)
+	}
+	want := []Endpoint{{URL: "http://10.0.0.1:8545"}}
+	if u := <-ch; !reflect.DeepEqual(u.Endpoints, want) {
+		t.Errorf("got endpoints %+v, want %+v", u.Endpoints, want)
+	}
+}
+
+func TestDNSClientQuestion(t *testing.T) {
+	name := "eth.example.com."
+	tests := []struct {
+		name      string
+		questions func(q dnsmessage.Question) []dnsmessage.Question
+		ok        bool
+	}{
+		{"same", func(q dnsmessage.Question) []dnsmessage.Question {
+			return []dnsmessage.Question{q}
+		}, true},
+		{"case", func(q dnsmessage.Question) []dnsmessage.Question {
+			q.Name = mustNewName(t, "ETH.Example.com.")
+			return []dnsmessage.Question{q}
+		}, true},
+		{"name", func(q dnsmessage.Question) []dnsmessage.Question {
+			q.Name = mustNewName(t, "evil.example.com.")
+			return []dnsmessage.Question{q}
+		}, false},
+		{"type", func(q dnsmessage.Question) []dnsmessage.Question {
+			q.Type = dnsmessage.TypeAAAA
+			return []dnsmessage.Question{q}
+		}, false},
+		{"class", func(q dnsmessage.Question) []dnsmessage.Question {
+			q.Class = dnsmessage.ClassCHAOS
+			return []dnsmessage.Question{q}
+		}, false},
+		{"none", func(q dnsmessage.Question) []dnsmessage.Question {
+			return nil
+		}, false},
+		{"more", func(q dnsmessage.Question) []dnsmessage.Question {
+			return []dnsmessage.Question{q, q}
+		}, false},
+	}
+	for _, test := range tests {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(questions func(q dnsmessage.Question) []dnsmessage.Question) {
+			buf := make([]byte, 512)
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				return
+			}
+			q, err := p.Question()
+			if err != nil {
+				return
+			}
+			h.Response = true
+			b := dnsmessage.NewBuilder(nil, h)
+			b.StartQuestions()
+			for _, q := range questions(q) {
+				b.Question(q)
+			}
+			b.StartAnswers()
+			b.AResource(resourceHeader(t, name, 60), dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}})
+			resp, _ := b.Finish()
+			conn.WriteTo(resp, addr)
+		}(test.questions)
+
+		c := &dnsClient{servers: []string{conn.LocalAddr().String()}}
+		answers, err := c.query(context.Background(), name, dnsmessage.TypeA)
+		conn.Close()
+		if ok := err == nil; ok != test.ok {
+			t.Fatalf("%s: got error %v, want ok %v", test.name, err, test.ok)
+		}
+		if test.ok && len(answers) != 1 {
+			t.Fatalf("%s: got %d answers, want 1", test.name, len(answers))
+		}
+	}
+}
+
+func TestNewDNSClient(t *testing.T) {
+	f, err := ioutil.TempFile("", "resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\nnameserver 10.96.0.10\nnameserver fd00::10\nsearch default.svc.cluster.local cluster.local\noptions ndots:5\n")
+	f.Close()
+
+	c := newDNSClient(f.Name())
+	if want := []string{"10.96.0.10:53", "[fd00::10]:53"}; !reflect.DeepEqual(c.servers, want) {
+		t.Errorf("got servers %v, want %v", c.servers, want)
+	}
+	want := []string{"eth.", "eth.default.svc.cluster.local.", "eth.cluster.local."}
+	if names := c.names("eth"); !reflect.DeepEqual(names, want) {
+		t.Errorf("got names %v, want %v", names, want)
+	}
+	if names := c.names("eth.example.com."); !reflect.DeepEqual(names, []string{"eth.example.com."}) {
+		t.Errorf("got names %v for a fully qualified name", names)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/getamis/sirius/log"
+)
+
+const (
+	defaultDrainTimeout = 30 * time.Second
+	drainCheckPeriod    = 100 * time.Millisecond
+)
+
+// closedCh is a closed channel for the removed clients.
+var closedCh = make(chan struct{})
+
+func init() {
+	close(closedCh)
+}
+
+// SetDrainTimeout sets the maximum duration to wait for the in-flight requests of the
+// removed eth clients. Set to 0 means closing the removed eth clients immediately.
+func (m *Map) SetDrainTimeout(timeout time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.drainTimeout = timeout
+}
+
+// Draining returns a channel which is closed when the rpc client is removed, so the
+// long-lived subscriptions can move to other clients before it's closed.
+func (m *Map) Draining(rc *rpc.Client) <-chan struct{} {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if c := m.find(rc); c != nil {
+		return c.drainCh
+	}
+	return closedCh
+}
+
+// find returns the client of the rpc client, including the draining clients. The caller
+// must hold the lock.
+func (m *Map) find(rc *rpc.Client) *client {
+	for _, v := range m.clientMap {
+		if v.Client == rc {
+			return v
+		}
+	}
+	for v := range m.drainingClients {
+		if v.Client == rc {
+			return v
+		}
+	}
+	return nil
+}
+
+// drain waits for the in-flight requests of the removed client and closes it.
+func (m *Map) drain(key string, c *client, timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainCheckPeriod)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&c.limiter.inFlight) > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			log.Warn("Eth client drain timed out", "id", c.Id, "url", key, "inFlight", atomic.LoadInt64(&c.limiter.inFlight))
+			m.closeDrained(c)
+			return
+		}
+	}
+	log.Trace("Eth client drained", "id", c.Id, "url", key)
+	m.closeDrained(c)
+}
+
+func (m *Map) closeDrained(c *client) {
+	m.lock.Lock()
+	_, ok := m.drainingClients[c]
+	delete(m.drainingClients, c)
+	m.lock.Unlock()
+
+	// It's closed by closeDraining already
+	if !ok {
+		return
+	}
+	c.Client.Close()
+}
+
+// closeDraining closes all draining clients immediately.
+func (m *Map) closeDraining() {
+	m.lock.Lock()
+	draining := m.drainingClients
+	m.drainingClients = make(map[*client]string)
+	m.lock.Unlock()
+
+	for c := range draining {
+		c.Client.Close()
+	}
+}
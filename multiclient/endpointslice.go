@@ -0,0 +1,204 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	clientset "k8s.io/client-go/kubernetes"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// endpointSliceAPI is the API path of EndpointSlices.
+	endpointSliceAPI = "/apis/discovery.k8s.io/v1"
+	// serviceNameLabel is the label of EndpointSlices for their service name.
+	serviceNameLabel = "kubernetes.io/service-name"
+)
+
+// endpointSlice is the EndpointSlice of discovery.k8s.io/v1. Only the fields used by
+// the discovery are defined, because the vendored k8s client doesn't provide the API.
+type endpointSlice struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	AddressType string          `json:"addressType"`
+	Endpoints   []sliceEndpoint `json:"endpoints"`
+	Ports       []slicePort     `json:"ports"`
+}
+
+type sliceEndpoint struct {
+	Addresses  []string `json:"addresses"`
+	Conditions struct {
+		// Ready is nil if the readiness is unknown, which should be considered as ready.
+		Ready *bool `json:"ready,omitempty"`
+	} `json:"conditions"`
+	TargetRef *v1.ObjectReference `json:"targetRef,omitempty"`
+	NodeName  *string             `json:"nodeName,omitempty"`
+	Zone      *string             `json:"zone,omitempty"`
+}
+
+type slicePort struct {
+	Name *string `json:"name,omitempty"`
+	// Port is nil if all ports are served.
+	Port *int32 `json:"port,omitempty"`
+}
+
+func (s *endpointSlice) DeepCopyObject() runtime.Object {
+	out := &endpointSlice{}
+	deepCopyJSON(s, out)
+	return out
+}
+
+type endpointSliceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []endpointSlice `json:"items"`
+}
+
+func (l *endpointSliceList) DeepCopyObject() runtime.Object {
+	out := &endpointSliceList{}
+	deepCopyJSON(l, out)
+	return out
+}
+
+// deepCopyJSON copies in to out through JSON, which keeps all fields of the types.
+func deepCopyJSON(in, out interface{}) {
+	raw, err := json.Marshal(in)
+	if err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		panic(err)
+	}
+}
+
+// sliceEndpoints returns the ethclient endpoints of the EndpointSlice. The zone of the
+// endpoint is used if it's given, otherwise it's looked up from the node.
+func (d *k8sEndpointsDiscoverer) sliceEndpoints(s *endpointSlice) []Endpoint {
+	endpoints := make([]Endpoint, 0)
+	for _, e := range s.Endpoints {
+		if e.Conditions.Ready != nil && !*e.Conditions.Ready && !d.config.IncludeNotReady {
+			continue
+		}
+		for _, addr := range e.Addresses {
+			for _, port := range s.Ports {
+				if port.Port == nil {
+					continue
+				}
+				if d.config.PortName != "" && (port.Name == nil || *port.Name != d.config.PortName) {
+					continue
+				}
+				endpoints = append(endpoints, Endpoint{
+					URL:      fmt.Sprintf("%s://%s", d.scheme, net.JoinHostPort(addr, strconv.Itoa(int(*port.Port)))),
+					Metadata: d.metadata(e.TargetRef, e.NodeName, e.Zone),
+				})
+			}
+		}
+	}
+	return endpoints
+}
+
+// endpointSliceSelector returns the label selector of the EndpointSlices. The name is
+// matched by the service name label.
+func endpointSliceSelector(config K8sDiscoveryConfig) string {
+	selector := config.LabelSelector
+	if config.Name != "" {
+		if selector != "" {
+			selector += ","
+		}
+		selector += serviceNameLabel + "=" + config.Name
+	}
+	return selector
+}
+
+// createEndpointSliceListWatch lists and watches the EndpointSlices in JSON through the
+// REST client of the core API.
+func createEndpointSliceListWatch(kubeClient clientset.Interface, ns string, config K8sDiscoveryConfig) cache.ListWatch {
+	request := func(opts metav1.ListOptions) *rest.Request {
+		opts.LabelSelector = endpointSliceSelector(config)
+		return kubeClient.CoreV1().RESTClient().Get().
+			AbsPath(endpointSliceAPI).
+			Namespace(ns).
+			Resource("endpointslices").
+			VersionedParams(&opts, k8sscheme.ParameterCodec).
+			SetHeader("Accept", "application/json")
+	}
+	return cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			raw, err := request(opts).DoRaw()
+			if err != nil {
+				return nil, err
+			}
+			list := &endpointSliceList{}
+			if err := json.Unmarshal(raw, list); err != nil {
+				return nil, err
+			}
+			return list, nil
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			opts.Watch = true
+			body, err := request(opts).Stream()
+			if err != nil {
+				return nil, err
+			}
+			return watch.NewStreamWatcher(&sliceDecoder{
+				body: body,
+				dec:  json.NewDecoder(body),
+			}), nil
+		},
+	}
+}
+
+// sliceDecoder decodes the watch events of EndpointSlices in JSON.
+type sliceDecoder struct {
+	body io.ReadCloser
+	dec  *json.Decoder
+}
+
+func (d *sliceDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	var event struct {
+		Type   watch.EventType `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := d.dec.Decode(&event); err != nil {
+		return "", nil, err
+	}
+	var obj runtime.Object = &endpointSlice{}
+	if event.Type == watch.Error {
+		obj = &metav1.Status{}
+	}
+	if err := json.Unmarshal(event.Object, obj); err != nil {
+		return "", nil, err
+	}
+	return event.Type, obj, nil
+}
+
+func (d *sliceDecoder) Close() {
+	d.body.Close()
+}
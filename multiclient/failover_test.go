@@ -0,0 +1,176 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+
+	"github.com/getamis/hypereth/testutil"
+)
+
+func startTestNode(t *testing.T, chain *testutil.Chain) *testutil.Node {
+	node, err := testutil.NewNode(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func TestFailover(t *testing.T) {
+	chain := testutil.NewChain(testutil.ChainConfig{})
+	chain.AddBlocks(3)
+	want := chain.Head().NumberU64()
+
+	for _, scheme := range []string{"http", "ws"} {
+		t.Run(scheme, func(t *testing.T) {
+			n1, n2 := startTestNode(t, chain), startTestNode(t, chain)
+			defer n1.Close()
+			defer n2.Close()
+			url := func(n *testutil.Node) string {
+				if scheme == "ws" {
+					return n.WSURL()
+				}
+				return n.HTTPURL()
+			}
+
+			ctx := context.Background()
+			mc, err := New(ctx, EthURLs([]string{url(n1), url(n2)}), WithRetryConfig(RetryConfig{
+				Timeout: time.Second,
+				Delay:   time.Millisecond,
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mc.Close()
+			blockNumber := func() (uint64, error) {
+				var n hexutil.Uint64
+				err := mc.CallContext(ctx, &n, "eth_blockNumber")
+				return uint64(n), err
+			}
+
+			// The errors of a node are retried on the other
+			n1.SetFault("eth_blockNumber", testutil.Fault{Err: errors.New("boom")})
+			for i := 0; i < 10; i++ {
+				if n, err := blockNumber(); err != nil || n != want {
+					t.Fatalf("got block number %d, err %v with a failing node, want %d", n, err, want)
+				}
+			}
+			n1.ClearFaults()
+
+			// The requests fail over to the running node
+			n2.Stop()
+			for i := 0; i < 10; i++ {
+				if n, err := blockNumber(); err != nil || n != want {
+					t.Fatalf("got block number %d, err %v with a stopped node, want %d", n, err, want)
+				}
+			}
+
+			n1.Stop()
+			if _, err := blockNumber(); err == nil {
+				t.Fatal("no error with all nodes stopped")
+			}
+
+			// The restarted node serves the requests again
+			if err := n2.Start(); err != nil {
+				t.Fatal(err)
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				n, err := blockNumber()
+				if err == nil && n == want {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("got block number %d, err %v after restart, want %d", n, err, want)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestSubscribeNewHeadFailover(t *testing.T) {
+	chain := testutil.NewChain(testutil.ChainConfig{})
+	n1, n2 := startTestNode(t, chain), startTestNode(t, chain)
+	defer n1.Close()
+	defer n2.Close()
+
+	ctx := context.Background()
+	mc, err := New(ctx, EthURLs([]string{n1.WSURL(), n2.WSURL()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+
+	ch := make(chan *Header, 16)
+	sub, err := mc.SubscribeNewHead(ctx, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	// Mine until the heads are received from both nodes, since the subscriptions are
+	// established in background
+	sources := make(map[string]bool)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sources) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got heads from %v, want both nodes", sources)
+		}
+		chain.AddBlock()
+		select {
+		case h := <-ch:
+			sources[mc.rpcClientMap.key(h.Client)] = true
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	n1.Stop()
+	for len(ch) > 0 {
+		<-ch
+	}
+	for _, block := range chain.AddBlocks(2) {
+		h := receiveHeader(t, ch)
+		for h.Number.Cmp(block.Number()) < 0 {
+			h = receiveHeader(t, ch)
+		}
+		if h.Hash() != block.Hash() {
+			t.Fatalf("got head %d, want %d", h.Number, block.Number())
+		}
+		if key := mc.rpcClientMap.key(h.Client); key != n2.WSURL() {
+			t.Fatalf("got head from %s, want %s", key, n2.WSURL())
+		}
+	}
+}
+
+func receiveHeader(t *testing.T, ch <-chan *Header) *Header {
+	select {
+	case h := <-ch:
+		return h
+	case <-time.After(5 * time.Second):
+		t.Fatal("no head received")
+		return nil
+	}
+}
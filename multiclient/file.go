@@ -0,0 +1,181 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/getamis/sirius/log"
+	yaml "gopkg.in/yaml.v2"
+
+	hethclient "github.com/getamis/hypereth/ethclient"
+)
+
+// fileReloadDelay is the delay to reload the file after changes, so a burst of events
+// triggers only one reload.
+const fileReloadDelay = 100 * time.Millisecond
+
+// configMapDataDir is the symlink swapped by k8s when the files of a ConfigMap mount
+// are updated.
+const configMapDataDir = "..data"
+
+// FileDiscovery discovers the ethclient endpoints from a YAML or JSON file, and reloads
+// the file on every change until the client is closed.
+func FileDiscovery(path string) Option {
+	return WithDiscoverer(NewFileDiscoverer(path))
+}
+
+// NewFileDiscoverer creates a discoverer loading the endpoints file. The file contains
+// a list of endpoints, each is either a url or an object with metadata, e.g.
+//
+//	endpoints:
+//	- ws://127.0.0.1:8546
+//	- url: wss://mainnet.infura.io/ws
+//	  tier: 1
+//	  weight: 2
+//	  tags: [archive]
+//	  zone: us-east-1a
+//	- url: https://gateway.internal:8545
+//	  dial:
+//	    jwtSecretFile: /etc/jwt/secret
+//	    caFile: /etc/ssl/gateway-ca.pem
+//
+// The parent directory is watched instead of the file, so the file can be replaced
+// atomically, e.g. by a k8s ConfigMap mount.
+func NewFileDiscoverer(path string) Discoverer {
+	return &fileLoader{
+		path: path,
+	}
+}
+
+type fileEndpoints struct {
+	Endpoints []fileEndpoint `yaml:"endpoints"`
+}
+
+type fileEndpoint struct {
+	URL    string                 `yaml:"url"`
+	Tier   int                    `yaml:"tier"`
+	Weight int                    `yaml:"weight"`
+	Tags   []string               `yaml:"tags"`
+	Zone   string                 `yaml:"zone"`
+	Labels map[string]string      `yaml:"labels"`
+	Dial   *hethclient.DialConfig `yaml:"dial"`
+}
+
+// UnmarshalYAML accepts either a url or an object with metadata.
+func (e *fileEndpoint) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&e.URL); err == nil {
+		return nil
+	}
+	type plain fileEndpoint
+	return unmarshal((*plain)(e))
+}
+
+// fileLoader loads the endpoints file on every change.
+type fileLoader struct {
+	path string
+}
+
+func (f *fileLoader) Name() string {
+	return "file"
+}
+
+func (f *fileLoader) Discover(ctx context.Context, ch chan<- Update) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Error("Failed to create file watcher", "err", err)
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(f.path)); err != nil {
+		log.Error("Failed to watch endpoints file", "path", f.path, "err", err)
+		return err
+	}
+	// Force sync at first
+	if err := f.sync(ctx, ch); err != nil {
+		return err
+	}
+
+	var reloadCh <-chan time.Time
+	for {
+		select {
+		case event := <-watcher.Events:
+			if !f.watches(event.Name) {
+				continue
+			}
+			log.Trace("Endpoints file changed", "path", f.path, "event", event)
+			if reloadCh == nil {
+				reloadCh = time.After(fileReloadDelay)
+			}
+		case err := <-watcher.Errors:
+			log.Warn("Failed to watch endpoints file", "path", f.path, "err", err)
+		case <-reloadCh:
+			reloadCh = nil
+			// Keep the known endpoints if failed to load, the error is logged in sync
+			f.sync(ctx, ch)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// watches returns true if the changes of name may change the endpoints file, i.e. name
+// is the file itself or the data symlink of a ConfigMap mount.
+func (f *fileLoader) watches(name string) bool {
+	name = filepath.Clean(name)
+	return name == filepath.Clean(f.path) ||
+		name == filepath.Join(filepath.Dir(f.path), configMapDataDir)
+}
+
+// sync loads the file and sends the found endpoints.
+func (f *fileLoader) sync(ctx context.Context, ch chan<- Update) error {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		log.Warn("Failed to read endpoints file", "path", f.path, "err", err)
+		return err
+	}
+	var file fileEndpoints
+	// YAML is a superset of JSON
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		log.Warn("Failed to parse endpoints file", "path", f.path, "err", err)
+		return err
+	}
+
+	endpoints := make([]Endpoint, 0, len(file.Endpoints))
+	for _, e := range file.Endpoints {
+		if e.URL == "" {
+			continue
+		}
+		endpoints = append(endpoints, Endpoint{
+			URL: e.URL,
+			Metadata: Metadata{
+				Tier:   e.Tier,
+				Weight: e.Weight,
+				Tags:   e.Tags,
+				Zone:   e.Zone,
+				Labels: e.Labels,
+				Dial:   e.Dial,
+			},
+		})
+	}
+	sendUpdate(ctx, ch, Update{Full: true, Endpoints: endpoints})
+	return nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import "testing"
+
+func TestFileLoaderWatches(t *testing.T) {
+	f := &fileLoader{path: "/etc/hypereth/endpoints.yaml"}
+	tests := []struct {
+		name    string
+		watched bool
+	}{
+		{"/etc/hypereth/endpoints.yaml", true},
+		{"/etc/hypereth/./endpoints.yaml", true},
+		{"/etc/hypereth/..data", true},
+		{"/etc/hypereth/..data_tmp", false},
+		{"/etc/hypereth/..2019_03_01_10_00_00.123456789", false},
+		{"/etc/hypereth/other.yaml", false},
+		{"/etc/hypereth/endpoints.yaml.swp", false},
+	}
+	for _, test := range tests {
+		if watched := f.watches(test.name); watched != test.watched {
+			t.Errorf("%s: got watched %v, want %v", test.name, watched, test.watched)
+		}
+	}
+}
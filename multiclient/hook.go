@@ -0,0 +1,93 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	hethclient "github.com/getamis/hypereth/ethclient"
+)
+
+// Hook is invoked before and after each JSON-RPC call. Each request is a logical call
+// with attempt 0, and the attempts on the eth clients are its children.
+type Hook = hethclient.Hook
+
+// CallInfo describes a JSON-RPC call passed to the hooks.
+type CallInfo = hethclient.CallInfo
+
+// withHooks wraps the RetryFunc to invoke the hooks for each attempt of the call.
+func (mc *Client) withHooks(method string, paramsSize int, attempts *int, fn RetryFunc) RetryFunc {
+	return func(ctx context.Context, rc *rpc.Client) (bool, error) {
+		*attempts++
+		info := &CallInfo{
+			Method:     method,
+			ParamsSize: paramsSize,
+			Endpoint:   hethclient.Endpoint(mc.rpcClientMap.key(rc)),
+			Attempt:    *attempts,
+		}
+		var retry bool
+		err := mc.hooks.Call(ctx, info, func(ctx context.Context) error {
+			var err error
+			retry, err = fn(ctx, rc)
+			return err
+		})
+		return retry, err
+	}
+}
+
+// paramsSize returns the size of the JSON encoded params if there are hooks.
+func (mc *Client) paramsSize(params []interface{}) int {
+	if len(mc.hooks) == 0 {
+		return 0
+	}
+	return hethclient.ParamsSize(params...)
+}
+
+// txParamsSize returns the size of the JSON encoded params of eth_sendRawTransaction if
+// there are hooks.
+func (mc *Client) txParamsSize(tx *types.Transaction) int {
+	if len(mc.hooks) == 0 {
+		return 0
+	}
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		return 0
+	}
+	return hethclient.ParamsSize(hexutil.Bytes(data))
+}
+
+func toBlockNumArg(number *big.Int) string {
+	if number == nil {
+		return "latest"
+	}
+	return hexutil.EncodeBig(number)
+}
+
+// batchParams returns the params of the batch requests.
+func batchParams(b []rpc.BatchElem) []interface{} {
+	params := make([]interface{}, len(b))
+	for i, elem := range b {
+		params[i] = elem.Args
+	}
+	return params
+}
@@ -17,6 +17,7 @@
 package multiclient
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
@@ -41,28 +42,189 @@ type KubeConfig struct {
 	APIServer string
 }
 
+// zoneLabels are the node labels of the availability zone, the stable one goes first.
+var zoneLabels = []string{
+	"topology.kubernetes.io/zone",
+	"failure-domain.beta.kubernetes.io/zone",
+}
+
+// K8sDiscoveryConfig represents how to discover the ethclient endpoints from the k8s
+// endpoints objects or EndpointSlices.
+type K8sDiscoveryConfig struct {
+	// Name is the name of the endpoints object, or the service name of EndpointSlices.
+	// Either Name or LabelSelector is required.
+	Name string
+	// LabelSelector selects the endpoints objects or EndpointSlices by labels, e.g. "app=geth".
+	LabelSelector string
+	// PortName selects the port by name, e.g. "ws". Set to empty means all ports.
+	PortName string
+	// IncludeNotReady includes the addresses which are not ready.
+	IncludeNotReady bool
+	// EndpointSlices discovers the endpoints from the EndpointSlices of discovery.k8s.io/v1
+	// instead of the endpoints objects, which requires k8s 1.21 or later.
+	EndpointSlices bool
+}
+
 // K8sEndpointsDiscovery discovers the dynamic ethclient endpoints in k8s cluster.
 // There are two ways to access k8s cluster:
 // 1. `kubeconfig` is nil means will build in-cluster config with service account token assigned to k8s pod.
 // 2. `kubeconfig` is given means access k8s cluster with given apiserver address and KUBE-CONFIG file.
 func K8sEndpointsDiscovery(namespace, name, scheme string, kubeconfig *KubeConfig) Option {
+	return K8sDiscovery(namespace, scheme, K8sDiscoveryConfig{Name: name}, kubeconfig)
+}
+
+// K8sDiscovery discovers the dynamic ethclient endpoints in k8s cluster by the endpoints
+// name or label selector. See K8sEndpointsDiscovery for the kubeconfig.
+func K8sDiscovery(namespace, scheme string, config K8sDiscoveryConfig, kubeconfig *KubeConfig) Option {
 	return func(mc *Client) error {
-		kubeClient, err := createKubeClient(kubeconfig)
+		d, err := NewK8sDiscoverer(namespace, scheme, config, kubeconfig)
 		if err != nil {
 			return err
 		}
-		lw := createEndpointsListWatch(kubeClient, namespace, name)
-		store := newEndpointStore(mc.ClientMap(), scheme)
-		// Force sync at first
-		err = syncWith(&lw, store)
-		if err != nil {
-			log.Error("Failed to sync the latest endpoints", "err", err)
-			return err
+		return WithDiscoverer(d)(mc)
+	}
+}
+
+// k8sEndpointsDiscoverer watches the k8s endpoints or EndpointSlices with a reflector.
+// The pod name, node name and the zone of the node are carried in the endpoint metadata.
+type k8sEndpointsDiscoverer struct {
+	kubeClient clientset.Interface
+	namespace  string
+	scheme     string
+	config     K8sDiscoveryConfig
+
+	// the zone of nodes, it's accessed by the reflector only
+	nodeZones map[string]string
+}
+
+// NewK8sEndpointsDiscoverer creates a discoverer watching the k8s endpoints by name. See
+// K8sEndpointsDiscovery for the kubeconfig.
+func NewK8sEndpointsDiscoverer(namespace, name, scheme string, kubeconfig *KubeConfig) (Discoverer, error) {
+	return NewK8sDiscoverer(namespace, scheme, K8sDiscoveryConfig{Name: name}, kubeconfig)
+}
+
+// NewK8sDiscoverer creates a discoverer watching the k8s endpoints or EndpointSlices by
+// the name or label selector. See K8sEndpointsDiscovery for the kubeconfig.
+func NewK8sDiscoverer(namespace, scheme string, config K8sDiscoveryConfig, kubeconfig *KubeConfig) (Discoverer, error) {
+	if config.Name == "" && config.LabelSelector == "" {
+		return nil, ErrInvalidK8sConfig
+	}
+	kubeClient, err := createKubeClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return &k8sEndpointsDiscoverer{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		scheme:     scheme,
+		config:     config,
+		nodeZones:  make(map[string]string),
+	}, nil
+}
+
+func (d *k8sEndpointsDiscoverer) Name() string {
+	return "k8s"
+}
+
+func (d *k8sEndpointsDiscoverer) Discover(ctx context.Context, ch chan<- Update) error {
+	lw := createEndpointsListWatch(d.kubeClient, d.namespace, d.config)
+	var expectedType runtime.Object = &v1.Endpoints{}
+	if d.config.EndpointSlices {
+		lw = createEndpointSliceListWatch(d.kubeClient, d.namespace, d.config)
+		expectedType = &endpointSlice{}
+	}
+	store := newEndpointStore(ctx, ch, d.convert)
+	// Force sync at first
+	err := syncWith(&lw, store)
+	if err != nil {
+		log.Error("Failed to sync the latest endpoints", "err", err)
+		return err
+	}
+	// Notify the initial sync is done even if no endpoint is found
+	store.mutex.RLock()
+	store.notify()
+	store.mutex.RUnlock()
+
+	reflector := cache.NewReflector(&lw, expectedType, store, 0)
+	reflector.Run(ctx.Done())
+	return nil
+}
+
+// convert returns the ethclient endpoints of the k8s endpoints object or EndpointSlice.
+func (d *k8sEndpointsDiscoverer) convert(obj interface{}) []Endpoint {
+	switch o := obj.(type) {
+	case *v1.Endpoints:
+		return d.endpoints(o)
+	case *endpointSlice:
+		return d.sliceEndpoints(o)
+	}
+	return nil
+}
+
+// endpoints returns the ethclient endpoints of the k8s endpoints object.
+func (d *k8sEndpointsDiscoverer) endpoints(e *v1.Endpoints) []Endpoint {
+	endpoints := make([]Endpoint, 0)
+	for _, s := range e.Subsets {
+		addrs := s.Addresses
+		if d.config.IncludeNotReady {
+			addrs = append(append([]v1.EndpointAddress{}, addrs...), s.NotReadyAddresses...)
 		}
-		reflector := cache.NewReflector(&lw, &v1.Endpoints{}, store, 0)
-		go reflector.Run(mc.Context().Done())
-		return nil
+		for _, addr := range addrs {
+			for _, port := range s.Ports {
+				if d.config.PortName != "" && port.Name != d.config.PortName {
+					continue
+				}
+				endpoints = append(endpoints, Endpoint{
+					URL:      fmt.Sprintf("%s://%s:%d", d.scheme, addr.IP, port.Port),
+					Metadata: d.metadata(addr.TargetRef, addr.NodeName, nil),
+				})
+			}
+		}
+	}
+	return endpoints
+}
+
+// metadata returns the metadata of the address. The zone of the node is looked up if
+// the zone is not given.
+func (d *k8sEndpointsDiscoverer) metadata(targetRef *v1.ObjectReference, nodeName, zone *string) Metadata {
+	md := Metadata{
+		Labels: make(map[string]string),
+	}
+	if targetRef != nil && targetRef.Kind == "Pod" {
+		md.Labels["pod"] = targetRef.Name
+	}
+	if nodeName != nil {
+		md.Labels["node"] = *nodeName
 	}
+	switch {
+	case zone != nil:
+		md.Zone = *zone
+	case nodeName != nil:
+		md.Zone = d.nodeZone(*nodeName)
+	}
+	return md
+}
+
+// nodeZone returns the zone of the node. The zone is empty if it's unknown.
+func (d *k8sEndpointsDiscoverer) nodeZone(name string) string {
+	if zone, ok := d.nodeZones[name]; ok {
+		return zone
+	}
+	node, err := d.kubeClient.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+	if err != nil {
+		// Don't cache the failure, e.g. not permitted to get nodes, retry next time
+		log.Debug("Failed to get k8s node", "node", name, "err", err)
+		return ""
+	}
+	zone := ""
+	for _, l := range zoneLabels {
+		if z, ok := node.Labels[l]; ok {
+			zone = z
+			break
+		}
+	}
+	d.nodeZones[name] = zone
+	return zone
 }
 
 func createKubeClient(kubeconfig *KubeConfig) (clientset.Interface, error) {
@@ -101,16 +263,21 @@ func createKubeClient(kubeconfig *KubeConfig) (clientset.Interface, error) {
 	return kubeClient, nil
 }
 
-func createEndpointsListWatch(kubeClient clientset.Interface, ns, name string) cache.ListWatch {
+func createEndpointsListWatch(kubeClient clientset.Interface, ns string, config K8sDiscoveryConfig) cache.ListWatch {
+	selectors := func(opts *metav1.ListOptions) {
+		// list and watch with specific name or labels
+		if config.Name != "" {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", config.Name).String()
+		}
+		opts.LabelSelector = config.LabelSelector
+	}
 	return cache.ListWatch{
 		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
-			// list with specific name
-			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+			selectors(&opts)
 			return kubeClient.CoreV1().Endpoints(ns).List(opts)
 		},
 		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
-			// watch with specific name
-			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+			selectors(&opts)
 			return kubeClient.CoreV1().Endpoints(ns).Watch(opts)
 		},
 	}
@@ -146,27 +313,44 @@ func syncWith(lw cache.ListerWatcher, store cache.Store) error {
 }
 
 // endpointStore implements the k8s.io/kubernetes/client-go/tools/cache.Store
-// interface. Instead of storing entire Kubernetes objects, it stores urls of ethclients
-// generated based on those objects.
+// interface. Instead of storing entire Kubernetes objects, it stores ethclient endpoints
+// generated based on those objects, and sends all endpoints to the update channel on
+// every change.
 type endpointStore struct {
 	// Protects metrics
 	mutex           sync.RWMutex
 	resourceVersion string
-	scheme          string
-	endpoints       map[types.UID][]string
+	convert         func(interface{}) []Endpoint
+	endpoints       map[types.UID][]Endpoint
 	endpointsVer    map[types.UID]string
-	rpcClientMap    *Map
+	ctx             context.Context
+	ch              chan<- Update
 }
 
-func newEndpointStore(rpcClientMap *Map, scheme string) *endpointStore {
+func newEndpointStore(ctx context.Context, ch chan<- Update, convert func(interface{}) []Endpoint) *endpointStore {
 	return &endpointStore{
-		scheme:       scheme,
-		endpoints:    map[types.UID][]string{},
+		convert:      convert,
+		endpoints:    map[types.UID][]Endpoint{},
 		endpointsVer: map[types.UID]string{},
-		rpcClientMap: rpcClientMap,
+		ctx:          ctx,
+		ch:           ch,
 	}
 }
 
+// list returns the endpoints of all k8s endpoints objects. The caller must hold the lock.
+func (s *endpointStore) list() []Endpoint {
+	all := []Endpoint{}
+	for _, endpoints := range s.endpoints {
+		all = append(all, endpoints...)
+	}
+	return all
+}
+
+// notify sends all endpoints. The caller must hold the lock.
+func (s *endpointStore) notify() {
+	sendUpdate(s.ctx, s.ch, Update{Full: true, Endpoints: s.list()})
+}
+
 // Implementing k8s.io/kubernetes/client-go/tools/cache.Store interface
 
 func (s *endpointStore) Add(obj interface{}) error {
@@ -175,18 +359,14 @@ func (s *endpointStore) Add(obj interface{}) error {
 		return err
 	}
 
-	endpoint := obj.(*v1.Endpoints)
-	urls := getEthURLsFromK8sEndpoint(endpoint, s.scheme)
+	endpoints := s.convert(obj)
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	for _, url := range urls {
-		s.rpcClientMap.Add(url, nil)
-	}
-
-	s.endpoints[o.GetUID()] = urls
+	s.endpoints[o.GetUID()] = endpoints
 	s.endpointsVer[o.GetUID()] = o.GetResourceVersion()
+	s.notify()
 
 	return nil
 }
@@ -196,28 +376,14 @@ func (s *endpointStore) Update(obj interface{}) error {
 	if err != nil {
 		return err
 	}
-	endpoint := obj.(*v1.Endpoints)
-	news := getEthURLsFromK8sEndpoint(endpoint, s.scheme)
+	news := s.convert(obj)
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	// Add new urls
-	for _, url := range news {
-		if c := s.rpcClientMap.Get(url); c == nil {
-			s.rpcClientMap.Add(url, nil)
-		}
-	}
-
-	// Remove old urls
-	olds := s.endpoints[o.GetUID()]
-	removed := findRemoved(olds, news)
-	for _, url := range removed {
-		s.rpcClientMap.Delete(url)
-	}
-
 	s.endpoints[o.GetUID()] = news
 	s.endpointsVer[o.GetUID()] = o.GetResourceVersion()
+	s.notify()
 
 	return nil
 }
@@ -228,19 +394,17 @@ func (s *endpointStore) Delete(obj interface{}) error {
 		return err
 	}
 
+	s.deleteUID(o.GetUID())
+	return nil
+}
+
+func (s *endpointStore) deleteUID(uid types.UID) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	urls := s.endpoints[o.GetUID()]
-
-	for _, url := range urls {
-		s.rpcClientMap.Delete(url)
-	}
-
-	delete(s.endpoints, o.GetUID())
-	delete(s.endpointsVer, o.GetUID())
-
-	return nil
+	delete(s.endpoints, uid)
+	delete(s.endpointsVer, uid)
+	s.notify()
 }
 
 func (s *endpointStore) List() []interface{} {
@@ -269,7 +433,7 @@ func (s *endpointStore) Replace(list []interface{}, resourceVersion string) erro
 
 	adds := []interface{}{}
 	updates := []interface{}{}
-	deletes := []interface{}{}
+	deletes := []types.UID{}
 
 	s.mutex.Lock()
 	items := make(map[types.UID]interface{})
@@ -293,8 +457,8 @@ func (s *endpointStore) Replace(list []interface{}, resourceVersion string) erro
 	}
 	// get deleted objects
 	for uid := range s.endpointsVer {
-		if obj, ok := items[uid]; !ok {
-			deletes = append(deletes, obj)
+		if _, ok := items[uid]; !ok {
+			deletes = append(deletes, uid)
 		}
 	}
 	s.mutex.Unlock()
@@ -313,11 +477,8 @@ func (s *endpointStore) Replace(list []interface{}, resourceVersion string) erro
 		}
 	}
 
-	for _, obj := range deletes {
-		err := s.Delete(obj)
-		if err != nil {
-			return err
-		}
+	for _, uid := range deletes {
+		s.deleteUID(uid)
 	}
 
 	s.mutex.Lock()
@@ -335,34 +496,3 @@ func (s *endpointStore) checkResourceVersion(rv string) bool {
 	defer s.mutex.RUnlock()
 	return s.resourceVersion == rv
 }
-
-func getEthURLsFromK8sEndpoint(e *v1.Endpoints, scheme string) []string {
-	ethURLs := make([]string, 0)
-	for _, s := range e.Subsets {
-		for _, addr := range s.Addresses {
-			for _, port := range s.Ports {
-				ethURLs = append(ethURLs, fmt.Sprintf("%s://%s:%d", scheme, addr.IP, port.Port))
-			}
-		}
-	}
-	return ethURLs
-}
-
-// findRemoved returns the string array represents the elements in olds array and removed
-// in news array.
-func findRemoved(olds, news []string) []string {
-	removed := []string{}
-	for _, o := range olds {
-		find := false
-		for _, n := range news {
-			if o == n {
-				find = true
-				break
-			}
-		}
-		if !find {
-			removed = append(removed, o)
-		}
-	}
-	return removed
-}
@@ -0,0 +1,485 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const testK8sNamespace = "eth"
+
+// fakeAPIServer serves the endpoints, EndpointSlices and nodes of the k8s API in JSON.
+type fakeAPIServer struct {
+	lock sync.Mutex
+	// objects are the endpoints objects and EndpointSlices keyed by resource and name
+	objects  map[string]map[string]metav1.Object
+	nodes    map[string]*v1.Node
+	nodeGets int
+	watchers map[chan watchEvent]string
+}
+
+// watchEvent is the watch event of a resource.
+type watchEvent struct {
+	Type   watch.EventType `json:"type"`
+	Object metav1.Object   `json:"object"`
+}
+
+func newFakeAPIServer() *fakeAPIServer {
+	return &fakeAPIServer{
+		objects: map[string]map[string]metav1.Object{
+			"endpoints":      {},
+			"endpointslices": {},
+		},
+		nodes:    make(map[string]*v1.Node),
+		watchers: make(map[chan watchEvent]string),
+	}
+}
+
+// set adds or updates the object of the resource, or deletes it if deleted is true.
+func (s *fakeAPIServer) set(resource string, obj metav1.Object, deleted bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	eventType := watch.Added
+	if _, ok := s.objects[resource][obj.GetName()]; ok {
+		eventType = watch.Modified
+	}
+	if deleted {
+		eventType = watch.Deleted
+		delete(s.objects[resource], obj.GetName())
+	} else {
+		s.objects[resource][obj.GetName()] = obj
+	}
+	for ch, r := range s.watchers {
+		if r == resource {
+			ch <- watchEvent{Type: eventType, Object: obj}
+		}
+	}
+}
+
+func (s *fakeAPIServer) nodeGetCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.nodeGets
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.URL.Path == "/version":
+		json.NewEncoder(w).Encode(map[string]string{"major": "1", "minor": "21", "gitVersion": "v1.21.0"})
+	case strings.HasPrefix(r.URL.Path, "/api/v1/nodes/"):
+		s.serveNode(w, strings.TrimPrefix(r.URL.Path, "/api/v1/nodes/"))
+	case r.URL.Path == "/api/v1/namespaces/"+testK8sNamespace+"/endpoints":
+		s.serveList(w, r, "endpoints", metav1.TypeMeta{Kind: "EndpointsList", APIVersion: "v1"})
+	case r.URL.Path == endpointSliceAPI+"/namespaces/"+testK8sNamespace+"/endpointslices":
+		s.serveList(w, r, "endpointslices", metav1.TypeMeta{Kind: "EndpointSliceList", APIVersion: "discovery.k8s.io/v1"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *fakeAPIServer) serveNode(w http.ResponseWriter, name string) {
+	s.lock.Lock()
+	s.nodeGets++
+	node, ok := s.nodes[name]
+	s.lock.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusFailure,
+			Reason:   metav1.StatusReasonNotFound,
+			Code:     http.StatusNotFound,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(node)
+}
+
+// serveList lists or watches the objects matching the field and label selectors.
+func (s *fakeAPIServer) serveList(w http.ResponseWriter, r *http.Request, resource string, listType metav1.TypeMeta) {
+	q := r.URL.Query()
+	selector, err := labels.Parse(q.Get("labelSelector"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimPrefix(q.Get("fieldSelector"), "metadata.name=")
+	match := func(obj metav1.Object) bool {
+		return (name == "" || obj.GetName() == name) && selector.Matches(labels.Set(obj.GetLabels()))
+	}
+
+	if q.Get("watch") != "true" {
+		s.lock.Lock()
+		items := []metav1.Object{}
+		for _, obj := range s.objects[resource] {
+			if match(obj) {
+				items = append(items, obj)
+			}
+		}
+		s.lock.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"kind":       listType.Kind,
+			"apiVersion": listType.APIVersion,
+			"metadata":   map[string]string{"resourceVersion": "1"},
+			"items":      items,
+		})
+		return
+	}
+
+	ch := make(chan watchEvent, 10)
+	s.lock.Lock()
+	s.watchers[ch] = resource
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.watchers, ch)
+		s.lock.Unlock()
+	}()
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-ch:
+			if !match(e.Object) {
+				continue
+			}
+			enc.Encode(e)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func podRef(name string) *v1.ObjectReference {
+	return &v1.ObjectReference{Kind: "Pod", Name: name}
+}
+
+func testEndpoints(name string, lbls map[string]string, ready, notReady []v1.EndpointAddress, ports ...v1.EndpointPort) *v1.Endpoints {
+	return &v1.Endpoints{
+		TypeMeta: metav1.TypeMeta{Kind: "Endpoints", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testK8sNamespace,
+			UID:       types.UID("endpoints-" + name),
+			Labels:    lbls,
+		},
+		Subsets: []v1.EndpointSubset{{Addresses: ready, NotReadyAddresses: notReady, Ports: ports}},
+	}
+}
+
+func testEndpointSlice(name, service string, lbls map[string]string, endpoints []sliceEndpoint, ports ...slicePort) *endpointSlice {
+	ls := map[string]string{serviceNameLabel: service}
+	for k, v := range lbls {
+		ls[k] = v
+	}
+	return &endpointSlice{
+		TypeMeta: metav1.TypeMeta{Kind: "EndpointSlice", APIVersion: "discovery.k8s.io/v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testK8sNamespace,
+			UID:       types.UID("endpointslice-" + name),
+			Labels:    ls,
+		},
+		AddressType: "IPv4",
+		Endpoints:   endpoints,
+		Ports:       ports,
+	}
+}
+
+func sliceEndpointOf(addr string, ready *bool, pod, node string, zone *string) sliceEndpoint {
+	e := sliceEndpoint{
+		Addresses: []string{addr},
+		TargetRef: podRef(pod),
+		NodeName:  stringPtr(node),
+		Zone:      zone,
+	}
+	e.Conditions.Ready = ready
+	return e
+}
+
+// startFakeAPIServer starts a fake k8s API server with the endpoints of geth and
+// parity services, both of them have a not ready address.
+func startFakeAPIServer(t *testing.T) (*fakeAPIServer, *httptest.Server) {
+	s := newFakeAPIServer()
+	s.nodes["n1"] = &v1.Node{
+		TypeMeta:   metav1.TypeMeta{Kind: "Node", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "n1", Labels: map[string]string{"topology.kubernetes.io/zone": "zone-a"}},
+	}
+	s.nodes["n2"] = &v1.Node{
+		TypeMeta:   metav1.TypeMeta{Kind: "Node", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "n2", Labels: map[string]string{"failure-domain.beta.kubernetes.io/zone": "zone-b"}},
+	}
+	ports := []v1.EndpointPort{{Name: "ws", Port: 8546}, {Name: "http", Port: 8545}}
+	s.set("endpoints", testEndpoints("geth", map[string]string{"app": "geth"},
+		[]v1.EndpointAddress{{IP: "10.0.0.1", NodeName: stringPtr("n1"), TargetRef: podRef("geth-0")}},
+		[]v1.EndpointAddress{{IP: "10.0.0.2", NodeName: stringPtr("n2"), TargetRef: podRef("geth-1")}},
+		ports...), false)
+	s.set("endpoints", testEndpoints("parity", map[string]string{"app": "parity"},
+		[]v1.EndpointAddress{{IP: "10.0.1.1", NodeName: stringPtr("n3"), TargetRef: podRef("parity-0")}},
+		nil,
+		ports...), false)
+
+	slicePorts := []slicePort{{Name: stringPtr("ws"), Port: int32Ptr(8546)}, {Name: stringPtr("http"), Port: int32Ptr(8545)}}
+	s.set("endpointslices", testEndpointSlice("geth-abc", "geth", map[string]string{"app": "geth"}, []sliceEndpoint{
+		sliceEndpointOf("10.0.0.1", boolPtr(true), "geth-0", "n1", stringPtr("zone-c")),
+		sliceEndpointOf("10.0.0.2", boolPtr(false), "geth-1", "n2", nil),
+	}, slicePorts...), false)
+	s.set("endpointslices", testEndpointSlice("parity-xyz", "parity", map[string]string{"app": "parity"}, []sliceEndpoint{
+		sliceEndpointOf("fd00::1", nil, "parity-0", "n3", nil),
+	}, slicePorts...), false)
+
+	return s, httptest.NewServer(s)
+}
+
+// endpointStrings formats the endpoints with url, zone, pod and node in order.
+func endpointStrings(endpoints []Endpoint) []string {
+	ss := []string{}
+	for _, e := range endpoints {
+		ss = append(ss, strings.Join([]string{e.URL, e.Zone, e.Labels["pod"], e.Labels["node"]}, " "))
+	}
+	sort.Strings(ss)
+	return ss
+}
+
+// waitK8sEndpoints waits for the full update of the wanted endpoints, the updates of
+// the objects synced one by one are skipped.
+func waitK8sEndpoints(t *testing.T, ch <-chan Update, want []string) {
+	var got []string
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case u := <-ch:
+			if !u.Full {
+				t.Fatalf("got update %+v, want full update", u)
+			}
+			got = endpointStrings(u.Endpoints)
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("got endpoints %q, want %q", got, want)
+		}
+	}
+}
+
+func TestK8sDiscoverer(t *testing.T) {
+	_, server := startFakeAPIServer(t)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		config K8sDiscoveryConfig
+		want   []string
+	}{
+		{
+			"endpoints by name",
+			K8sDiscoveryConfig{Name: "geth"},
+			[]string{
+				"ws://10.0.0.1:8545 zone-a geth-0 n1",
+				"ws://10.0.0.1:8546 zone-a geth-0 n1",
+			},
+		},
+		{
+			"endpoints by selector",
+			K8sDiscoveryConfig{LabelSelector: "app in (geth,parity)", PortName: "ws"},
+			[]string{
+				"ws://10.0.0.1:8546 zone-a geth-0 n1",
+				"ws://10.0.1.1:8546  parity-0 n3",
+			},
+		},
+		{
+			"endpoints not ready",
+			K8sDiscoveryConfig{Name: "geth", LabelSelector: "app=geth", PortName: "http", IncludeNotReady: true},
+			[]string{
+				"ws://10.0.0.1:8545 zone-a geth-0 n1",
+				"ws://10.0.0.2:8545 zone-b geth-1 n2",
+			},
+		},
+		{
+			"endpoints not found",
+			K8sDiscoveryConfig{Name: "geth", LabelSelector: "app=parity"},
+			[]string{},
+		},
+		{
+			"slices by name",
+			K8sDiscoveryConfig{Name: "geth", PortName: "ws", EndpointSlices: true},
+			[]string{
+				"ws://10.0.0.1:8546 zone-c geth-0 n1",
+			},
+		},
+		{
+			"slices by selector",
+			K8sDiscoveryConfig{LabelSelector: "app", PortName: "http", EndpointSlices: true},
+			[]string{
+				"ws://10.0.0.1:8545 zone-c geth-0 n1",
+				"ws://[fd00::1]:8545  parity-0 n3",
+			},
+		},
+		{
+			"slices not ready",
+			K8sDiscoveryConfig{Name: "geth", PortName: "ws", IncludeNotReady: true, EndpointSlices: true},
+			[]string{
+				"ws://10.0.0.1:8546 zone-c geth-0 n1",
+				"ws://10.0.0.2:8546 zone-b geth-1 n2",
+			},
+		},
+		{
+			"slices of unknown port",
+			K8sDiscoveryConfig{Name: "geth", PortName: "rpc", EndpointSlices: true},
+			[]string{},
+		},
+	}
+	for _, test := range tests {
+		d, err := NewK8sDiscoverer(testK8sNamespace, "ws", test.config, &KubeConfig{APIServer: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := make(chan Update, 10)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- d.Discover(ctx, ch)
+		}()
+		t.Log(test.name)
+		waitK8sEndpoints(t, ch, test.want)
+		cancel()
+		if err := <-errCh; err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestK8sDiscovererWatch(t *testing.T) {
+	for _, slices := range []bool{false, true} {
+		s, server := startFakeAPIServer(t)
+		config := K8sDiscoveryConfig{LabelSelector: "app=geth", PortName: "ws", IncludeNotReady: true, EndpointSlices: slices}
+		// The typed watch of endpoints decodes the protobuf set by createKubeClient, and the
+		// fake API server speaks JSON only.
+		kubeClient, err := clientset.NewForConfig(&rest.Config{Host: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &k8sEndpointsDiscoverer{
+			kubeClient: kubeClient,
+			namespace:  testK8sNamespace,
+			scheme:     "ws",
+			config:     config,
+			nodeZones:  make(map[string]string),
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := make(chan Update, 10)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- d.Discover(ctx, ch)
+		}()
+
+		t.Logf("slices %v", slices)
+		want := []string{
+			"ws://10.0.0.2:8546 zone-b geth-1 n2",
+		}
+		if slices {
+			want = append([]string{"ws://10.0.0.1:8546 zone-c geth-0 n1"}, want...)
+		} else {
+			want = append([]string{"ws://10.0.0.1:8546 zone-a geth-0 n1"}, want...)
+		}
+		waitK8sEndpoints(t, ch, want)
+
+		// wait for the watch, the changes before it are not sent
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			s.lock.Lock()
+			watching := len(s.watchers)
+			s.lock.Unlock()
+			if watching > 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("slices %v: no watch received", slices)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// the second address is moved to node n1, and its zone is looked up once
+		gets := s.nodeGetCount()
+		if slices {
+			s.set("endpointslices", testEndpointSlice("geth-abc", "geth", map[string]string{"app": "geth"}, []sliceEndpoint{
+				sliceEndpointOf("10.0.0.3", nil, "geth-2", "n2", nil),
+			}, slicePort{Name: stringPtr("ws"), Port: int32Ptr(8546)}), false)
+		} else {
+			s.set("endpoints", testEndpoints("geth", map[string]string{"app": "geth"},
+				[]v1.EndpointAddress{{IP: "10.0.0.3", NodeName: stringPtr("n2"), TargetRef: podRef("geth-2")}},
+				nil,
+				v1.EndpointPort{Name: "ws", Port: 8546}), false)
+		}
+		want = []string{"ws://10.0.0.3:8546 zone-b geth-2 n2"}
+		waitK8sEndpoints(t, ch, want)
+		if n := s.nodeGetCount(); n != gets {
+			t.Fatalf("slices %v: got %d node lookups, want the cached zone", slices, n-gets)
+		}
+
+		// the other services are not watched
+		if slices {
+			s.set("endpointslices", testEndpointSlice("parity-xyz", "parity", map[string]string{"app": "parity"}, nil), true)
+			s.set("endpointslices", testEndpointSlice("geth-abc", "geth", map[string]string{"app": "geth"}, nil), true)
+		} else {
+			s.set("endpoints", testEndpoints("parity", map[string]string{"app": "parity"}, nil, nil), true)
+			s.set("endpoints", testEndpoints("geth", map[string]string{"app": "geth"}, nil, nil), true)
+		}
+		waitK8sEndpoints(t, ch, []string{})
+
+		cancel()
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"math"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit represents the request limits of an eth client.
+type RateLimit struct {
+	// Rate is the number of requests per second. Set to 0 means unlimited.
+	Rate float64
+	// Burst is the maximum number of requests at once. Set to 0 means the ceiling of Rate.
+	Burst int
+	// MaxInFlight is the maximum number of concurrent requests. Set to 0 means unlimited.
+	MaxInFlight int
+}
+
+// limiter limits the requests to an eth client with a token bucket and an in-flight cap.
+// It never blocks, a throttled eth client is skipped by callers.
+type limiter struct {
+	inFlight int64
+
+	lock sync.RWMutex
+	// rate is nil if the request rate is unlimited
+	rate        *rate.Limiter
+	maxInFlight int64
+}
+
+func newLimiter(rl RateLimit) *limiter {
+	l := &limiter{}
+	l.set(rl)
+	return l
+}
+
+// set replaces the limits and keeps the current in-flight requests.
+func (l *limiter) set(rl RateLimit) {
+	var r *rate.Limiter
+	if rl.Rate > 0 {
+		burst := rl.Burst
+		if burst <= 0 {
+			burst = int(math.Ceil(rl.Rate))
+		}
+		r = rate.NewLimiter(rate.Limit(rl.Rate), burst)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rate = r
+	l.maxInFlight = int64(rl.MaxInFlight)
+}
+
+// throttled reports whether a request would be rejected now without consuming any token.
+func (l *limiter) throttled() bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	if l.maxInFlight > 0 && atomic.LoadInt64(&l.inFlight) >= l.maxInFlight {
+		return true
+	}
+	if l.rate != nil {
+		now := time.Now()
+		r := l.rate.ReserveN(now, 1)
+		defer r.CancelAt(now)
+		return !r.OK() || r.DelayFrom(now) > 0
+	}
+	return false
+}
+
+// acquire takes a token and an in-flight slot. It returns false if the eth client is
+// throttled. The caller must call release after the request is done if it returns true.
+func (l *limiter) acquire() bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	if n := atomic.AddInt64(&l.inFlight, 1); l.maxInFlight > 0 && n > l.maxInFlight {
+		atomic.AddInt64(&l.inFlight, -1)
+		return false
+	}
+	if l.rate != nil && !l.rate.Allow() {
+		atomic.AddInt64(&l.inFlight, -1)
+		return false
+	}
+	return true
+}
+
+func (l *limiter) release() {
+	atomic.AddInt64(&l.inFlight, -1)
+}
+
+// rateLimitFor finds the rate limit for the given url. The exact url is matched first,
+// and then the patterns in the syntax of path.Match. If several patterns match, the most
+// specific one, i.e. the one with the most non-wildcard characters, is used, and the
+// ties are broken by the lexical order of the patterns.
+func rateLimitFor(limits map[string]RateLimit, url string) (RateLimit, bool) {
+	if l, ok := limits[url]; ok {
+		return l, true
+	}
+	best, found := "", false
+	for pattern := range limits {
+		if ok, _ := path.Match(pattern, url); !ok {
+			continue
+		}
+		if !found || moreSpecific(pattern, best) {
+			best, found = pattern, true
+		}
+	}
+	if !found {
+		return RateLimit{}, false
+	}
+	return limits[best], true
+}
+
+// moreSpecific reports whether the pattern a is more specific than b.
+func moreSpecific(a, b string) bool {
+	la, lb := literalLen(a), literalLen(b)
+	if la != lb {
+		return la > lb
+	}
+	return a < b
+}
+
+// literalLen returns the number of non-wildcard characters in the pattern.
+func literalLen(pattern string) int {
+	return len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+}
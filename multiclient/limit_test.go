@@ -0,0 +1,49 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import "testing"
+
+func TestRateLimitFor(t *testing.T) {
+	limits := map[string]RateLimit{
+		"https://*":                       {Rate: 1},
+		"https://*.infura.io/v3/*":        {Rate: 2},
+		"https://mainnet.infura.io/v3/*":  {Rate: 3},
+		"https://mainnet.infura.io/v3/ab": {Rate: 4},
+		"https://?ainnet.infura.io/v3/*":  {Rate: 5},
+	}
+	tests := []struct {
+		url   string
+		rate  float64
+		found bool
+	}{
+		{"https://mainnet.infura.io/v3/ab", 4, true},
+		{"https://mainnet.infura.io/v3/cd", 3, true},
+		{"https://ropsten.infura.io/v3/cd", 2, true},
+		{"https://example.com", 1, true},
+		{"http://example.com", 0, false},
+	}
+	for _, test := range tests {
+		// the map order is random, so repeat to catch the nondeterminism
+		for i := 0; i < 20; i++ {
+			l, found := rateLimitFor(limits, test.url)
+			if found != test.found || l.Rate != test.rate {
+				t.Fatalf("%s: got rate %v and found %v, want %v and %v", test.url, l.Rate, found, test.rate, test.found)
+			}
+		}
+	}
+}
@@ -17,7 +17,9 @@
 package multiclient
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/getamis/sirius/log"
@@ -30,13 +32,24 @@ type Map struct {
 	idMap       map[uint64]string
 	idCounter   uint64
 	newClientCh chan<- string
+	// the rate limits of eth clients keyed by url or url pattern
+	rateLimits map[string]RateLimit
+	// the removed clients which are waiting for the in-flight requests
+	drainingClients map[*client]string
+	drainTimeout    time.Duration
 
 	lock sync.RWMutex
 }
 
 type client struct {
 	*rpc.Client
-	Id uint64
+	Id        uint64
+	limiter   *limiter
+	metadata  Metadata
+	retention Retention
+	// drainCh is closed when the client starts draining
+	drainCh chan struct{}
+	stats   *stats
 }
 
 func NewMap(newClientCh chan<- string) *Map {
@@ -45,9 +58,15 @@ func NewMap(newClientCh chan<- string) *Map {
 		idMap:       make(map[uint64]string),
 		idCounter:   0,
 		newClientCh: newClientCh,
+		rateLimits:  make(map[string]RateLimit),
+
+		drainingClients: make(map[*client]string),
+		drainTimeout:    defaultDrainTimeout,
 	}
 }
 
+// Delete removes the eth client. New requests are not routed to the eth client anymore,
+// and it's closed after the in-flight requests are done or the drain timeout.
 func (m *Map) Delete(key string) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
@@ -56,22 +75,57 @@ func (m *Map) Delete(key string) {
 	if !ok {
 		return
 	}
-	if c.Client != nil {
-		c.Client.Close()
-	}
+	m.remove(key, c)
+}
+
+// remove removes the eth client and drains its rpc client. The caller must hold the lock.
+func (m *Map) remove(key string, c *client) {
 	delete(m.idMap, c.Id)
 	delete(m.clientMap, key)
+	close(c.drainCh)
 	log.Trace("Eth client removed", "id", c.Id, "url", key)
+
+	if c.Client != nil {
+		m.drainingClients[c] = key
+		go m.drain(key, c, m.drainTimeout)
+	}
 }
 
 func (m *Map) Add(key string, value *rpc.Client) {
+	m.AddWithMetadata(key, value, Metadata{})
+}
+
+// AddWithMetadata adds the eth client with the endpoint metadata. If the eth client
+// exists, only its metadata is updated unless a different rpc client is given, which
+// replaces the old one, and the old one is closed after its in-flight requests.
+func (m *Map) AddWithMetadata(key string, value *rpc.Client, md Metadata) {
+	m.add(key, value, md)
+}
+
+// add adds or updates the eth client as AddWithMetadata does. It reports whether a new
+// eth client is added.
+func (m *Map) add(key string, value *rpc.Client, md Metadata) bool {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
+	if c, ok := m.clientMap[key]; ok {
+		if value == nil || value == c.Client {
+			c.metadata = md
+			log.Trace("Eth client metadata updated", "id", c.Id, "url", key, "tier", md.Tier, "weight", md.Weight, "tags", md.Tags)
+			return false
+		}
+		m.remove(key, c)
+	}
+
 	m.idCounter++
+	rl, _ := rateLimitFor(m.rateLimits, key)
 	m.clientMap[key] = &client{
-		Id:     m.idCounter,
-		Client: value,
+		Id:       m.idCounter,
+		Client:   value,
+		limiter:  newLimiter(rl),
+		metadata: md,
+		drainCh:  make(chan struct{}),
+		stats:    &stats{},
 	}
 	m.idMap[m.idCounter] = key
 
@@ -82,17 +136,21 @@ func (m *Map) Add(key string, value *rpc.Client) {
 		}
 	}
 	log.Trace("Eth client added", "id", m.idCounter, "url", key)
+	return true
 }
 
+// Replace replaces the rpc client of the eth client. It returns 0 if the eth client has
+// been removed.
 func (m *Map) Replace(key string, value *rpc.Client) uint64 {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	if _, ok := m.clientMap[key]; ok {
-		m.clientMap[key].Client = value
+	c, ok := m.clientMap[key]
+	if !ok {
+		return 0
 	}
-
-	return m.clientMap[key].Id
+	c.Client = value
+	return c.Id
 }
 
 func (m *Map) Get(key string) *rpc.Client {
@@ -142,6 +200,34 @@ func (m *Map) List() []*rpc.Client {
 	return l
 }
 
+// Available returns the clients which are not throttled by their rate limits in the
+// preferred order.
+func (m *Map) Available() []*rpc.Client {
+	clients, _ := m.selectClients(query{})
+	return clients
+}
+
+// selectClients returns the clients which have all required tags and are not throttled
+// in the preferred order. The clients failing the recent requests and the clients known
+// to have pruned the requested state are moved to the end. It also returns the number of clients with the required tags.
+func (m *Map) selectClients(q query) ([]*rpc.Client, int) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	matched := 0
+	cs := []*candidate{}
+	for _, v := range m.clientMap {
+		if v.Client == nil || !v.metadata.HasTags(q.tags) {
+			continue
+		}
+		matched++
+		if !v.limiter.throttled() {
+			cs = append(cs, newCandidate(v.Client, v.metadata, v.retention, v.stats.failing(), q))
+		}
+	}
+	return sortCandidates(cs), matched
+}
+
 // Map returns a deep copy of client map
 func (m *Map) Map() map[string]*rpc.Client {
 	m.lock.RLock()
@@ -194,3 +280,166 @@ func (m *Map) NilClients() []string {
 	}
 	return urls
 }
+
+// Metadata returns the endpoint metadata of the eth client.
+func (m *Map) Metadata(key string) (Metadata, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	c, ok := m.clientMap[key]
+	if !ok {
+		return Metadata{}, false
+	}
+	return c.metadata, true
+}
+
+// SetMetadata updates the endpoint metadata of an existing eth client. It returns false
+// if the eth client is not found.
+func (m *Map) SetMetadata(key string, md Metadata) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	c, ok := m.clientMap[key]
+	if !ok {
+		return false
+	}
+	c.metadata = md
+	log.Trace("Eth client metadata updated", "id", c.Id, "url", key, "tier", md.Tier, "weight", md.Weight, "tags", md.Tags)
+	return true
+}
+
+// Retention returns the learned state retention of the eth client.
+func (m *Map) Retention(key string) (Retention, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	c, ok := m.clientMap[key]
+	if !ok {
+		return Retention{}, false
+	}
+	return c.retention, true
+}
+
+// setRetention sets the probed state retention of the eth client. The archive eth
+// client is tagged as archive.
+func (m *Map) setRetention(key string, r Retention) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	c, ok := m.clientMap[key]
+	if !ok {
+		return
+	}
+	c.retention = r
+	hasTag := c.metadata.HasTags([]string{TagArchive})
+	if r.Archive && !hasTag {
+		c.metadata.Tags = append(append([]string{}, c.metadata.Tags...), TagArchive)
+	} else if !r.Archive && hasTag {
+		log.Warn("Eth client is tagged as archive but its state is pruned", "id", c.Id, "url", key, "missing", r.Missing)
+	}
+}
+
+// learnRetention records whether the rpc client serves the state at the given depth.
+func (m *Map) learnRetention(rc *rpc.Client, depth uint64, served bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, v := range m.clientMap {
+		if v.Client != rc {
+			continue
+		}
+		if served {
+			v.retention.served(depth)
+		} else {
+			v.retention.missing(depth)
+		}
+		return
+	}
+}
+
+// SetRateLimits sets the rate limits keyed by url or url pattern in the syntax of
+// path.Match, e.g. "https://*.infura.io/v3/*". The limits are applied to both current
+// and future eth clients, and the eth clients matching none of them become unlimited.
+func (m *Map) SetRateLimits(limits map[string]RateLimit) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.rateLimits = make(map[string]RateLimit, len(limits))
+	for k, v := range limits {
+		m.rateLimits[k] = v
+	}
+	for k, v := range m.clientMap {
+		rl, _ := rateLimitFor(m.rateLimits, k)
+		v.limiter.set(rl)
+	}
+}
+
+// SetRateLimit updates the rate limit of an existing eth client at runtime. It returns
+// false if the eth client is not found.
+func (m *Map) SetRateLimit(key string, rl RateLimit) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	c, ok := m.clientMap[key]
+	if !ok {
+		return false
+	}
+	c.limiter.set(rl)
+	log.Trace("Eth client rate limit updated", "id", c.Id, "url", key, "rate", rl.Rate, "burst", rl.Burst, "maxInFlight", rl.MaxInFlight)
+	return true
+}
+
+// acquire acquires a request slot of the given rpc client. It returns false if the
+// client is throttled, otherwise the caller must call the returned release function
+// after the request is done.
+func (m *Map) acquire(rc *rpc.Client) (func(), bool) {
+	m.lock.RLock()
+	var l *limiter
+	if c := m.find(rc); c != nil {
+		l = c.limiter
+	}
+	m.lock.RUnlock()
+
+	// The client has been removed, let the request fail by itself.
+	if l == nil {
+		return func() {}, true
+	}
+	if !l.acquire() {
+		return nil, false
+	}
+	return l.release, true
+}
+
+// key returns the url of the rpc client, including the draining ones.
+func (m *Map) key(rc *rpc.Client) string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for k, v := range m.clientMap {
+		if v.Client == rc {
+			return k
+		}
+	}
+	for v, k := range m.drainingClients {
+		if v.Client == rc {
+			return k
+		}
+	}
+	return ""
+}
+
+// limited wraps the RetryFunc to skip the throttled rpc clients.
+func (m *Map) limited(fn RetryFunc) RetryFunc {
+	return func(ctx context.Context, rc *rpc.Client) (bool, error) {
+		release, ok := m.acquire(rc)
+		if !ok {
+			return true, ErrThrottled
+		}
+		defer release()
+
+		start := time.Now()
+		retry, err := fn(ctx, rc)
+		m.observe(rc, time.Since(start), err)
+		return retry, err
+	}
+}
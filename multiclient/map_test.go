@@ -0,0 +1,118 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+func TestMapAddExisting(t *testing.T) {
+	m := NewMap(nil)
+	m.SetDrainTimeout(0)
+	key := "ws://127.0.0.1:8546"
+
+	old := rpc.DialInProc(rpc.NewServer())
+	m.AddWithMetadata(key, old, Metadata{Tier: 1})
+	id := m.clientMap[key].Id
+
+	// Re-adding the same endpoint only updates the metadata
+	m.AddWithMetadata(key, nil, Metadata{Tier: 2})
+	if c := m.clientMap[key]; c.Id != id || c.Client != old || c.metadata.Tier != 2 {
+		t.Fatalf("got client id %d, tier %d, want id %d and tier 2 with the old rpc client", c.Id, c.metadata.Tier, id)
+	}
+	if len(m.idMap) != 1 {
+		t.Fatalf("got %d ids, want 1", len(m.idMap))
+	}
+
+	// A different rpc client replaces the old one, which is drained
+	drainCh := m.Draining(old)
+	m.AddWithMetadata(key, rpc.DialInProc(rpc.NewServer()), Metadata{Tier: 3})
+	if k, _ := m.GetById(id); k != "" {
+		t.Fatalf("old id %d still maps to %s", id, k)
+	}
+	if len(m.idMap) != 1 || m.Len() != 1 {
+		t.Fatalf("got %d ids and %d clients, want 1 and 1", len(m.idMap), m.Len())
+	}
+	select {
+	case <-drainCh:
+	default:
+		t.Fatal("old rpc client is not draining")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		m.lock.RLock()
+		n := len(m.drainingClients)
+		m.lock.RUnlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("old rpc client is not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMapDrain(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		release bool
+	}{
+		{"released", time.Minute, true},
+		{"timed out", 500 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMap(nil)
+			m.SetDrainTimeout(tt.timeout)
+			key := "ws://127.0.0.1:8546"
+			rc := rpc.DialInProc(rpc.NewServer())
+			m.Add(key, rc)
+
+			release, ok := m.acquire(rc)
+			if !ok {
+				t.Fatal("failed to acquire the rpc client")
+			}
+			m.Delete(key)
+			select {
+			case <-m.Draining(rc):
+			default:
+				t.Fatal("rpc client is not draining")
+			}
+			// The in-flight request keeps the rpc client open
+			time.Sleep(2 * drainCheckPeriod)
+			if err := rc.Call(nil, "rpc_modules"); err == rpc.ErrClientQuit {
+				t.Fatal("rpc client is closed with an in-flight request")
+			}
+			if tt.release {
+				release()
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for rc.Call(nil, "rpc_modules") != rpc.ErrClientQuit {
+				if time.Now().After(deadline) {
+					t.Fatal("rpc client is not closed")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
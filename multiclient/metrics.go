@@ -0,0 +1,149 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"context"
+	"net"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/getamis/sirius/metrics"
+
+	hethclient "github.com/getamis/hypereth/ethclient"
+)
+
+const (
+	metricsSubsystem = "multiclient"
+	// unknownMethod is the method label of the requests for the methods not found, to
+	// bound the cardinality of the method label.
+	unknownMethod = "unknown"
+	// methodNotFoundCode is the JSON-RPC error code of the methods not found.
+	methodNotFoundCode = -32601
+)
+
+// The error classes of the failed requests.
+const (
+	errorClassTimeout      = "timeout"
+	errorClassCanceled     = "canceled"
+	errorClassNotFound     = "not_found"
+	errorClassMissingState = "missing_state"
+	errorClassRPC          = "rpc"
+	errorClassTransport    = "transport"
+)
+
+// clientMetrics records the requests to the eth clients. The endpoint label is the
+// scheme and host of the url, so the credentials in the url are not exposed.
+type clientMetrics struct {
+	requests               metrics.CounterVec
+	errors                 metrics.CounterVec
+	latency                metrics.HistogramVec
+	retries                metrics.CounterVec
+	dialFailures           metrics.CounterVec
+	subscriptionReconnects metrics.CounterVec
+}
+
+func newClientMetrics(registry metrics.Registry) *clientMetrics {
+	opt := metrics.Subsystem(metricsSubsystem)
+	return &clientMetrics{
+		requests:               registry.NewCounterVec("requests_total", []string{"endpoint", "method"}, opt),
+		errors:                 registry.NewCounterVec("errors_total", []string{"endpoint", "method", "class"}, opt),
+		latency:                registry.NewHistogramVec("request_duration_seconds", []string{"endpoint", "method"}, opt),
+		retries:                registry.NewCounterVec("retries_total", []string{"method"}, opt),
+		dialFailures:           registry.NewCounterVec("dial_failures_total", []string{"endpoint"}, opt),
+		subscriptionReconnects: registry.NewCounterVec("subscription_reconnects_total", []string{"endpoint"}, opt),
+	}
+}
+
+// observe records a request to the eth client.
+func (m *clientMetrics) observe(key, method string, latency time.Duration, err error) {
+	endpoint := hethclient.Endpoint(key)
+	method = methodLabel(method, err)
+	if c, err := m.requests.GetMetricWithLabelValues(endpoint, method); err == nil {
+		c.Inc()
+	}
+	if h, err := m.latency.GetMetricWithLabelValues(endpoint, method); err == nil {
+		h.Observe(latency.Seconds())
+	}
+	if err == nil {
+		return
+	}
+	if c, err := m.errors.GetMetricWithLabelValues(endpoint, method, errorClass(err)); err == nil {
+		c.Inc()
+	}
+}
+
+// observeRetries records the retries of a request.
+func (m *clientMetrics) observeRetries(method string, retries int, err error) {
+	if c, err := m.retries.GetMetricWithLabelValues(methodLabel(method, err)); err == nil {
+		c.Add(float64(retries))
+	}
+}
+
+// observeDialFailure records a failed dial to the eth client.
+func (m *clientMetrics) observeDialFailure(key string) {
+	if c, err := m.dialFailures.GetMetricWithLabelValues(hethclient.Endpoint(key)); err == nil {
+		c.Inc()
+	}
+}
+
+// observeReconnect records a resubscription of new head to the eth client.
+func (m *clientMetrics) observeReconnect(key string) {
+	if c, err := m.subscriptionReconnects.GetMetricWithLabelValues(hethclient.Endpoint(key)); err == nil {
+		c.Inc()
+	}
+}
+
+// instrument wraps the RetryFunc to record the requests of the method.
+func (m *clientMetrics) instrument(method string, rm *Map, fn RetryFunc) RetryFunc {
+	return func(ctx context.Context, rc *rpc.Client) (bool, error) {
+		start := time.Now()
+		retry, err := fn(ctx, rc)
+		m.observe(rm.key(rc), method, time.Since(start), err)
+		return retry, err
+	}
+}
+
+// errorClass classifies the error of a failed request.
+func errorClass(err error) string {
+	switch {
+	case err == context.DeadlineExceeded:
+		return errorClassTimeout
+	case err == context.Canceled:
+		return errorClassCanceled
+	case err == ethereum.NotFound:
+		return errorClassNotFound
+	case isMissingStateError(err):
+		return errorClassMissingState
+	}
+	if _, ok := err.(rpc.Error); ok {
+		return errorClassRPC
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return errorClassTimeout
+	}
+	return errorClassTransport
+}
+
+// methodLabel returns the method, or unknownMethod if the method is not found.
+func methodLabel(method string, err error) string {
+	if e, ok := err.(rpc.Error); ok && e.ErrorCode() == methodNotFoundCode {
+		return unknownMethod
+	}
+	return method
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	ethereum "github.com/ethereum/go-ethereum"
+)
+
+// methodNotFoundError is the error returned by an eth client for an unknown method.
+type methodNotFoundError struct{}
+
+func (methodNotFoundError) Error() string {
+	return "the method foo_bar does not exist/is not available"
+}
+func (methodNotFoundError) ErrorCode() int { return methodNotFoundCode }
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{context.DeadlineExceeded, errorClassTimeout},
+		{context.Canceled, errorClassCanceled},
+		{ethereum.NotFound, errorClassNotFound},
+		{errors.New("missing trie node 0123 (path )"), errorClassMissingState},
+		{rpcError("execution reverted"), errorClassRPC},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{IsTimeout: true}}, errorClassTimeout},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, errorClassTransport},
+	}
+	for _, tt := range tests {
+		if got := errorClass(tt.err); got != tt.want {
+			t.Errorf("got class %s of %v, want %s", got, tt.err, tt.want)
+		}
+	}
+}
+
+func TestMethodLabel(t *testing.T) {
+	if got := methodLabel("foo_bar", methodNotFoundError{}); got != unknownMethod {
+		t.Errorf("got method label %s, want %s", got, unknownMethod)
+	}
+	if got := methodLabel("eth_call", rpcError("execution reverted")); got != "eth_call" {
+		t.Errorf("got method label %s, want eth_call", got)
+	}
+}
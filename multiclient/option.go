@@ -20,6 +20,9 @@ import (
 	"time"
 
 	"github.com/getamis/sirius/log"
+	"github.com/getamis/sirius/metrics"
+
+	hethclient "github.com/getamis/hypereth/ethclient"
 )
 
 // Option represents a Client option
@@ -29,9 +32,33 @@ type Option func(*Client) error
 func EthURLs(urls []string) Option {
 	return func(mc *Client) error {
 		log.Info("EthClients from static list", "urls", urls)
-		for _, url := range urls {
-			mc.ClientMap().Add(url, nil)
+		endpoints := make([]Endpoint, len(urls))
+		for i, url := range urls {
+			endpoints[i] = Endpoint{URL: url}
+		}
+		mc.discoverers = append(mc.discoverers, NewStaticDiscoverer(endpoints))
+		return nil
+	}
+}
+
+// Endpoints represents static ethclient endpoints with metadata, e.g. tiers, weights
+// and tags.
+func Endpoints(endpoints []Endpoint) Option {
+	return func(mc *Client) error {
+		for _, e := range endpoints {
+			log.Info("EthClient from static list", "url", e.URL, "tier", e.Tier, "weight", e.Weight, "tags", e.Tags)
 		}
+		mc.discoverers = append(mc.discoverers, NewStaticDiscoverer(endpoints))
+		return nil
+	}
+}
+
+// WithDiscoverer discovers the ethclient endpoints with the given discoverer. The
+// endpoints from all discoverers are merged, and the eth clients are added or deleted
+// as the endpoints change until the client is closed.
+func WithDiscoverer(d Discoverer) Option {
+	return func(mc *Client) error {
+		mc.discoverers = append(mc.discoverers, d)
 		return nil
 	}
 }
@@ -67,3 +94,100 @@ func WithRetryConfig(retry RetryConfig) Option {
 		return nil
 	}
 }
+
+// WithRateLimits configures the rate limits of eth clients keyed by url or url pattern
+// in the syntax of path.Match, e.g. "https://*.infura.io/v3/*". A throttled eth client
+// is skipped rather than waited. If several patterns match an url, the most specific one
+// is used. The limits can be updated at runtime through Map.SetRateLimits and
+// Map.SetRateLimit.
+func WithRateLimits(limits map[string]RateLimit) Option {
+	return func(mc *Client) error {
+		log.Info("Use given rate limits", "limits", limits)
+		mc.ClientMap().SetRateLimits(limits)
+		return nil
+	}
+}
+
+// WithMethodTags routes the JSON-RPC methods to the eth clients with the given tags.
+// The methods are keyed by name or name pattern in the syntax of path.Match, e.g.
+// {"debug_*": {"trace"}}. If several patterns match, only the most specific one is used.
+func WithMethodTags(routes map[string][]string) Option {
+	return func(mc *Client) error {
+		log.Info("Use given method routes", "routes", routes)
+		mc.methodTags = routes
+		return nil
+	}
+}
+
+// WithHistoricalTags routes the requests which query the state at an explicit block
+// number to the eth clients with the given tags, e.g. "archive".
+func WithHistoricalTags(tags ...string) Option {
+	return func(mc *Client) error {
+		log.Info("Use given historical state tags", "tags", tags)
+		mc.historicalTags = tags
+		return nil
+	}
+}
+
+// WithArchiveRouting routes the historical state queries according to the state
+// retention of eth clients. The retention window of each eth client is probed once it's
+// dialed, and learned from the pruned state errors afterwards. The eth clients serving
+// the state since the first block are tagged as archive.
+func WithArchiveRouting() Option {
+	return func(mc *Client) error {
+		log.Info("Use archive-aware routing")
+		mc.archiveRouting = true
+		return nil
+	}
+}
+
+// WithZone prefers the eth clients in the given zone, and falls back to other zones only
+// when the eth clients in the zone are unavailable, throttled or failed. It overrides the
+// zone in the environment variable MULTICLIENT_ZONE. The zone of eth clients is given
+// by the endpoint metadata, e.g. the zone of nodes in k8s.
+func WithZone(zone string) Option {
+	return func(mc *Client) error {
+		log.Info("Prefer eth clients in the zone", "zone", zone)
+		mc.zone = zone
+		return nil
+	}
+}
+
+// WithDrainTimeout configures the maximum duration to wait for the in-flight requests of
+// the removed eth clients before closing them. Set to 0 means closing them immediately.
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(mc *Client) error {
+		log.Info("Use given drain timeout", "timeout", timeout)
+		mc.ClientMap().SetDrainTimeout(timeout)
+		return nil
+	}
+}
+
+// WithMetrics records the requests, errors, latencies and retries of each eth client,
+// the dial failures and the subscription reconnects in the metrics registry.
+func WithMetrics(registry metrics.Registry) Option {
+	return func(mc *Client) error {
+		mc.metrics = newClientMetrics(registry)
+		return nil
+	}
+}
+
+// WithDialConfig dials the HTTP eth clients with the authentication and transport
+// options, e.g. headers, JWT tokens and TLS certificates, unless the endpoint metadata
+// has its own dial config. The websocket eth clients are dialed with its basic auth
+// only, and the other eth clients ignore it.
+func WithDialConfig(config *hethclient.DialConfig) Option {
+	return func(mc *Client) error {
+		mc.dialConfig = config
+		return nil
+	}
+}
+
+// WithHooks invokes the hooks before and after each request and each attempt of the
+// request on the eth clients, e.g. to trace the requests with the retries as children.
+func WithHooks(hooks ...Hook) Option {
+	return func(mc *Client) error {
+		mc.hooks = append(mc.hooks, hooks...)
+		return nil
+	}
+}
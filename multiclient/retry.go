@@ -58,6 +58,10 @@ func Retry(ctx context.Context, retryLimit int, retryTimeout, retryDelay time.Du
 		if attempt == retryLimit {
 			return err
 		}
+		// The throttled client is skipped without delay
+		if err == ErrThrottled {
+			continue
+		}
 
 		timer.Reset(retryDelay)
 		select {
@@ -67,3 +71,22 @@ func Retry(ctx context.Context, retryLimit int, retryTimeout, retryDelay time.Du
 		}
 	}
 }
+
+// retry retries the request of the method on the eth clients. The throttled eth clients
+// are skipped, the request and its attempts are passed to the hooks, and the attempts
+// and retries are recorded in metrics.
+func (mc *Client) retry(ctx context.Context, method string, params []interface{}, clients []*rpc.Client, fn RetryFunc) error {
+	attempts := 0
+	info := &CallInfo{
+		Method:     method,
+		ParamsSize: mc.paramsSize(params),
+	}
+	fn = mc.withHooks(method, info.ParamsSize, &attempts, mc.metrics.instrument(method, mc.rpcClientMap, fn))
+	err := mc.hooks.Call(ctx, info, func(ctx context.Context) error {
+		return mc.requestRetryFunc(ctx, clients, mc.rpcClientMap.limited(fn))
+	})
+	if attempts > 1 {
+		mc.metrics.observeRetries(method, attempts-1, err)
+	}
+	return err
+}
@@ -0,0 +1,219 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"math"
+	"math/big"
+	"math/rand"
+	"path"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/rpc"
+
+	hethclient "github.com/getamis/hypereth/ethclient"
+)
+
+const (
+	// TagArchive represents the endpoint serves the historical state.
+	TagArchive = "archive"
+	// TagTrace represents the endpoint serves the debug and trace APIs.
+	TagTrace = "trace"
+	// TagWS represents the endpoint supports subscriptions.
+	TagWS = "ws"
+)
+
+// Metadata represents the properties of an eth client endpoint.
+type Metadata struct {
+	// Tier is the priority tier of the endpoint. The endpoints in the lowest tier are
+	// preferred, and the endpoints in the next tier are used only when the lower tiers
+	// are exhausted.
+	Tier int `json:"tier"`
+	// Weight is the relative probability to be selected among the endpoints in the same
+	// tier. Set to 0 means 1.
+	Weight int `json:"weight"`
+	// Tags are the capabilities of the endpoint, e.g. "archive", "trace" and "ws".
+	Tags []string `json:"tags,omitempty"`
+	// Zone is the availability zone of the endpoint.
+	Zone string `json:"zone,omitempty"`
+	// Labels are the other properties of the endpoint, e.g. the pod and node name in k8s.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Dial is the authentication and transport options to dial the endpoint. Set to nil
+	// means the default options of the client. The changes take effect on the next dial.
+	// Only the file discovery sets it, the other discoverers always use the default.
+	Dial *hethclient.DialConfig `json:"-"`
+}
+
+// HasTags reports whether the endpoint has all given tags.
+func (md Metadata) HasTags(tags []string) bool {
+	for _, t := range tags {
+		found := false
+		for _, mt := range md.Tags {
+			if t == mt {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (md Metadata) weight() int {
+	if md.Weight <= 0 {
+		return 1
+	}
+	return md.Weight
+}
+
+// Endpoint represents an eth client endpoint with metadata.
+type Endpoint struct {
+	URL string
+	Metadata
+}
+
+// query represents the requirements of a request to select eth clients.
+type query struct {
+	// tags are the tags required by the request
+	tags []string
+	// depth is the state depth of the request, 0 means the latest state
+	depth uint64
+	// zone is the preferred zone, empty means no preference
+	zone string
+}
+
+type candidate struct {
+	client *rpc.Client
+	// pruned is true if the client is known to have pruned the requested state
+	pruned bool
+	// failing is true if the client failed the recent requests
+	failing bool
+	tier    int
+	// remote is true if the client is not in the preferred zone
+	remote bool
+	// key is the weighted random key, the candidate with larger key is preferred.
+	key float64
+}
+
+// sortCandidates sorts the candidates by tier, prefers the candidates in the preferred
+// zone in the same tier, and shuffles the rest by weight. The failing candidates are
+// moved after the working ones regardless of tier and zone, and the pruned candidates
+// are always the last resort.
+func sortCandidates(cs []*candidate) []*rpc.Client {
+	sort.SliceStable(cs, func(i, j int) bool {
+		if cs[i].pruned != cs[j].pruned {
+			return !cs[i].pruned
+		}
+		if cs[i].failing != cs[j].failing {
+			return !cs[i].failing
+		}
+		if cs[i].tier != cs[j].tier {
+			return cs[i].tier < cs[j].tier
+		}
+		if cs[i].remote != cs[j].remote {
+			return !cs[i].remote
+		}
+		return cs[i].key > cs[j].key
+	})
+	clients := make([]*rpc.Client, len(cs))
+	for i, c := range cs {
+		clients[i] = c.client
+	}
+	return clients
+}
+
+// newCandidate creates a candidate with the weighted random key u^(1/w), which
+// makes the order a weighted random permutation.
+func newCandidate(c *rpc.Client, md Metadata, r Retention, failing bool, q query) *candidate {
+	return &candidate{
+		client:  c,
+		pruned:  !r.canServe(q.depth),
+		failing: failing,
+		tier:    md.Tier,
+		remote:  q.zone != "" && md.Zone != q.zone,
+		key:     math.Pow(rand.Float64(), 1/float64(md.weight())),
+	}
+}
+
+// requiredTags returns the tags required by the eth clients to serve the request.
+// blockNumber is the block number of the state the request queries, nil means the
+// latest or pending state. The method tags are matched as rateLimitFor does.
+func (mc *Client) requiredTags(method string, blockNumber *big.Int) []string {
+	var tags []string
+	if blockNumber != nil {
+		tags = append(tags, mc.historicalTags...)
+	}
+	return append(tags, methodTagsFor(mc.methodTags, method)...)
+}
+
+// methodTagsFor finds the tags of the given method. The exact method is matched first,
+// and then the most specific pattern in the syntax of path.Match.
+func methodTagsFor(routes map[string][]string, method string) []string {
+	if ts, ok := routes[method]; ok {
+		return ts
+	}
+	best, found := "", false
+	for pattern := range routes {
+		if ok, _ := path.Match(pattern, method); !ok {
+			continue
+		}
+		if !found || moreSpecific(pattern, best) {
+			best, found = pattern, true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return routes[best]
+}
+
+// batchTags returns the union of the tags required by the batch requests.
+func (mc *Client) batchTags(b []rpc.BatchElem) []string {
+	var tags []string
+	for _, elem := range b {
+		tags = append(tags, mc.requiredTags(elem.Method, nil)...)
+	}
+	return tags
+}
+
+// availableClients returns the eth clients which are able to serve the request in the
+// preferred order.
+func (mc *Client) availableClients(method string, blockNumber *big.Int) ([]*rpc.Client, error) {
+	return mc.selectClients(query{
+		tags:  mc.requiredTags(method, blockNumber),
+		depth: mc.stateDepth(blockNumber),
+		zone:  mc.zone,
+	})
+}
+
+// selectClients returns the eth clients which have all required tags and are not
+// throttled in the preferred order.
+func (mc *Client) selectClients(q query) ([]*rpc.Client, error) {
+	clients, matched := mc.rpcClientMap.selectClients(q)
+	if len(clients) > 0 {
+		return clients, nil
+	}
+	if len(mc.rpcClientMap.List()) == 0 {
+		return nil, ErrNoEthClient
+	}
+	if matched == 0 {
+		return nil, ErrNoTaggedClient
+	}
+	return nil, ErrThrottled
+}
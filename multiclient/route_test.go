@@ -0,0 +1,131 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// rpcError is an error returned by an eth client.
+type rpcError string
+
+func (e rpcError) Error() string  { return string(e) }
+func (e rpcError) ErrorCode() int { return -32000 }
+
+func TestSortCandidatesDemotesFailing(t *testing.T) {
+	local, remote, backup := &rpc.Client{}, &rpc.Client{}, &rpc.Client{}
+	q := query{zone: "a"}
+	cs := []*candidate{
+		newCandidate(backup, Metadata{Tier: 1, Zone: "a"}, Retention{}, false, q),
+		newCandidate(local, Metadata{Zone: "a"}, Retention{}, true, q),
+		newCandidate(remote, Metadata{Zone: "b"}, Retention{}, false, q),
+	}
+	clients := sortCandidates(cs)
+	if clients[0] != remote || clients[1] != backup || clients[2] != local {
+		t.Fatal("the failing local candidate is not demoted after the working ones")
+	}
+}
+
+func TestSortCandidatesPrefersZone(t *testing.T) {
+	local, remote, backup := &rpc.Client{}, &rpc.Client{}, &rpc.Client{}
+	q := query{zone: "a"}
+	cs := []*candidate{
+		newCandidate(backup, Metadata{Tier: 1, Zone: "a"}, Retention{}, false, q),
+		newCandidate(remote, Metadata{Zone: "b", Weight: 100}, Retention{}, false, q),
+		newCandidate(local, Metadata{Zone: "a"}, Retention{}, false, q),
+	}
+	clients := sortCandidates(cs)
+	if clients[0] != local || clients[1] != remote || clients[2] != backup {
+		t.Fatal("the local candidate is not preferred in the same tier")
+	}
+
+	// No zone is preferred without the zone of the client
+	cs = []*candidate{
+		newCandidate(backup, Metadata{Tier: 1, Zone: "a"}, Retention{}, false, query{}),
+		newCandidate(local, Metadata{Zone: "a"}, Retention{}, false, query{}),
+	}
+	if clients := sortCandidates(cs); clients[0] != local || clients[1] != backup {
+		t.Fatal("the candidates are not sorted by tier")
+	}
+}
+
+func TestStatsFailing(t *testing.T) {
+	s := &stats{}
+	s.observe(time.Millisecond, errors.New("connection refused"))
+	if !s.failing() {
+		t.Fatal("not failing after a transport error")
+	}
+	// The eth client works if it returns rpc errors
+	s.observe(time.Millisecond, rpcError("execution reverted"))
+	if s.failing() {
+		t.Fatal("failing after an rpc error")
+	}
+	s.observe(time.Millisecond, errors.New("connection refused"))
+	s.lastFailureAt = time.Now().Add(-failurePenalty)
+	if s.failing() {
+		t.Fatal("failing after the failure penalty")
+	}
+	s.observe(time.Millisecond, errors.New("connection refused"))
+	s.observe(time.Millisecond, nil)
+	if s.failing() {
+		t.Fatal("failing after a successful request")
+	}
+}
+
+func TestRequiredTags(t *testing.T) {
+	mc := &Client{
+		methodTags: map[string][]string{
+			"debug_*":           {"debug"},
+			"debug_trace*":      {"trace"},
+			"debug_traceBlock*": {"trace", "block"},
+			"debug_traceCall":   {"call"},
+			"eth_getLogs":       {"logs"},
+			"?th_getLogs":       {"other"},
+			"trace_[a-z]*":      {"parity"},
+		},
+		historicalTags: []string{TagArchive},
+	}
+	tests := []struct {
+		method      string
+		blockNumber *big.Int
+		tags        []string
+	}{
+		{"debug_traceCall", nil, []string{"call"}},
+		{"debug_traceBlockByNumber", nil, []string{"trace", "block"}},
+		{"debug_traceTransaction", nil, []string{"trace"}},
+		{"debug_getBadBlocks", nil, []string{"debug"}},
+		{"eth_getLogs", nil, []string{"logs"}},
+		{"trace_filter", nil, []string{"parity"}},
+		{"eth_getBalance", nil, nil},
+		{"eth_getBalance", big.NewInt(1), []string{TagArchive}},
+		{"debug_traceCall", big.NewInt(1), []string{TagArchive, "call"}},
+	}
+	for _, test := range tests {
+		// the map order is random, so repeat to catch the nondeterminism
+		for i := 0; i < 20; i++ {
+			if tags := mc.requiredTags(test.method, test.blockNumber); !reflect.DeepEqual(tags, test.tags) {
+				t.Fatalf("%s: got tags %v, want %v", test.method, tags, test.tags)
+			}
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package multiclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/getamis/sirius/log"
+
+	hethclient "github.com/getamis/hypereth/ethclient"
+)
+
+const (
+	// latencySamples is the number of recent requests to compute the latency percentiles.
+	latencySamples = 256
+	// failurePenalty is the period to demote an eth client after its last failure.
+	failurePenalty = 30 * time.Second
+)
+
+// Status represents the state of a multiclient.
+type Status struct {
+	// Head is the highest block number known by the eth clients.
+	Head      uint64           `json:"head"`
+	Endpoints []EndpointStatus `json:"endpoints"`
+}
+
+// EndpointStatus represents the state of an eth client.
+type EndpointStatus struct {
+	// URL is the scheme and host of the endpoint. The path, query and user info are
+	// stripped because they may carry API keys or credentials.
+	URL string `json:"url"`
+	ID  uint64 `json:"id"`
+	// Dialed is true if the eth client has been dialed, and Failing is true if it failed
+	// the recent requests by timeouts or transport errors.
+	Dialed    bool      `json:"dialed"`
+	Failing   bool      `json:"failing"`
+	Draining  bool      `json:"draining"`
+	Metadata  Metadata  `json:"metadata"`
+	Retention Retention `json:"retention"`
+	// Head is the latest block number received from the eth client.
+	Head     uint64 `json:"head"`
+	InFlight int64  `json:"inFlight"`
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+	// LastError is the error of the last failed request.
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorAt   *time.Time `json:"lastErrorAt,omitempty"`
+	LastSuccessAt *time.Time `json:"lastSuccessAt,omitempty"`
+	// LatencyP50 and LatencyP99 are the latency percentiles of recent requests.
+	LatencyP50 time.Duration `json:"latencyP50"`
+	LatencyP99 time.Duration `json:"latencyP99"`
+	// DialAttempts is the number of dials, and LastDialError is the error of the last
+	// dial if it failed.
+	DialAttempts  int    `json:"dialAttempts"`
+	LastDialError string `json:"lastDialError,omitempty"`
+}
+
+// stats records the requests to an eth client.
+type stats struct {
+	lock          sync.Mutex
+	head          uint64
+	requests      uint64
+	errors        uint64
+	lastErr       error
+	lastErrAt     time.Time
+	lastSuccessAt time.Time
+	// failures is the number of consecutive requests failed by timeouts or transport
+	// errors, and lastFailureAt is the time of the last one.
+	failures      int
+	lastFailureAt time.Time
+	// latencies is a ring buffer of recent latencies
+	latencies    [latencySamples]time.Duration
+	next         int
+	count        int
+	dialAttempts int
+	lastDialErr  error
+}
+
+func (s *stats) observe(latency time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.requests++
+	if err != nil {
+		s.errors++
+		s.lastErr = err
+		s.lastErrAt = time.Now()
+	} else {
+		s.lastSuccessAt = time.Now()
+	}
+	// The rpc errors are returned by a working eth client, e.g. execution reverted
+	if class := errorClass(err); err != nil && (class == errorClassTimeout || class == errorClassTransport) {
+		s.failures++
+		s.lastFailureAt = time.Now()
+	} else if err == nil || class == errorClassRPC {
+		s.failures = 0
+	}
+	s.latencies[s.next] = latency
+	s.next = (s.next + 1) % latencySamples
+	if s.count < latencySamples {
+		s.count++
+	}
+}
+
+// failing reports whether the eth client failed the recent requests, i.e. the last
+// request failed by a timeout or transport error within the failure penalty.
+func (s *stats) failing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.failingLocked()
+}
+
+// failingLocked is failing with the lock held.
+func (s *stats) failingLocked() bool {
+	return s.failures > 0 && time.Since(s.lastFailureAt) < failurePenalty
+}
+
+func (s *stats) observeHead(number uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if number > s.head {
+		s.head = number
+	}
+}
+
+func (s *stats) observeDial(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.dialAttempts++
+	s.lastDialErr = err
+}
+
+// fill fills the endpoint status with the stats. The url in errors is redacted.
+func (s *stats) fill(status *EndpointStatus, url string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	redact := strings.NewReplacer(url, hethclient.Endpoint(url))
+	status.Head = s.head
+	status.Requests = s.requests
+	status.Errors = s.errors
+	status.Failing = s.failingLocked()
+	if s.lastErr != nil {
+		at := s.lastErrAt
+		status.LastError = redact.Replace(s.lastErr.Error())
+		status.LastErrorAt = &at
+	}
+	if !s.lastSuccessAt.IsZero() {
+		at := s.lastSuccessAt
+		status.LastSuccessAt = &at
+	}
+	if s.count > 0 {
+		latencies := make([]time.Duration, s.count)
+		copy(latencies, s.latencies[:s.count])
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		status.LatencyP50 = latencies[(s.count-1)*50/100]
+		status.LatencyP99 = latencies[(s.count-1)*99/100]
+	}
+	status.DialAttempts = s.dialAttempts
+	if s.lastDialErr != nil {
+		status.LastDialError = redact.Replace(s.lastDialErr.Error())
+	}
+}
+
+func (c *client) status(url string, draining bool) EndpointStatus {
+	s := EndpointStatus{
+		URL:       hethclient.Endpoint(url),
+		ID:        c.Id,
+		Dialed:    c.Client != nil,
+		Draining:  draining,
+		Metadata:  c.metadata,
+		Retention: c.retention,
+		InFlight:  atomic.LoadInt64(&c.limiter.inFlight),
+	}
+	c.stats.fill(&s, url)
+	return s
+}
+
+// Status returns the state of all eth clients, including the draining ones.
+func (m *Map) Status() []EndpointStatus {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	status := make([]EndpointStatus, 0, len(m.clientMap)+len(m.drainingClients))
+	for url, c := range m.clientMap {
+		status = append(status, c.status(url, false))
+	}
+	for c, url := range m.drainingClients {
+		status = append(status, c.status(url, true))
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].ID < status[j].ID })
+	return status
+}
+
+// observe records the result of a request to the rpc client.
+func (m *Map) observe(rc *rpc.Client, latency time.Duration, err error) {
+	m.lock.RLock()
+	c := m.find(rc)
+	m.lock.RUnlock()
+
+	if c != nil {
+		c.stats.observe(latency, err)
+	}
+}
+
+// observeHead records the latest block number received from the rpc client.
+func (m *Map) observeHead(rc *rpc.Client, number uint64) {
+	m.lock.RLock()
+	c := m.find(rc)
+	m.lock.RUnlock()
+
+	if c != nil {
+		c.stats.observeHead(number)
+	}
+}
+
+// observeDial records the result of dialing the eth client.
+func (m *Map) observeDial(key string, err error) {
+	m.lock.RLock()
+	c, ok := m.clientMap[key]
+	m.lock.RUnlock()
+
+	if ok {
+		c.stats.observeDial(err)
+	}
+}
+
+// Status returns the snapshot of the state of all eth clients.
+func (mc *Client) Status() Status {
+	s := Status{
+		Head:      mc.headNumber(),
+		Endpoints: mc.rpcClientMap.Status(),
+	}
+	for _, e := range s.Endpoints {
+		if e.Head > s.Head {
+			s.Head = e.Head
+		}
+	}
+	return s
+}
+
+// StatusHandler returns a http handler serving the status in JSON.
+func (mc *Client) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(mc.Status()); err != nil {
+			log.Debug("Failed to write status", "err", err)
+		}
+	})
+}
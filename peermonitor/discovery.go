@@ -0,0 +1,208 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package peermonitor
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/getamis/sirius/log"
+)
+
+// defaultDiscoveryLookups is the default number of random lookups in each fetch.
+const defaultDiscoveryLookups = 3
+
+var (
+	// ErrNoBootnodes is returned if no bootnode is given for the network without
+	// default bootnodes, e.g. the private networks.
+	ErrNoBootnodes = errors.New("no bootnodes")
+
+	bootnodesMap = map[string][]string{
+		ChainNetworkMainnet: params.MainnetBootnodes,
+		ChainNetworkRopsten: params.TestnetBootnodes,
+		ChainNetworkRinkeby: params.RinkebyBootnodes,
+	}
+)
+
+// DiscoveryConfig represents the config of the discovery source.
+type DiscoveryConfig struct {
+	// Bootnodes are the enode URLs to bootstrap the discovery. Set to empty means the
+	// bootnodes of the network in go-ethereum.
+	Bootnodes []string
+	// ListenAddr is the UDP address to listen for the discovery packets. Set to empty
+	// means a random port.
+	ListenAddr string
+	// PrivateKey is the node key of the crawler. Set to nil means a random key.
+	PrivateKey *ecdsa.PrivateKey
+	// Lookups is the number of random lookups in each fetch. Set to 0 means 3 lookups.
+	Lookups int
+	// Verify reports whether the discovered node is a valid candidate. Set to nil means
+	// the nodes are dialed to verify they are reachable.
+	Verify func(*enode.Node) bool
+}
+
+// discoverySource finds the nodes by the discovery v4 protocol. The discovery v4 of
+// go-ethereum 1.8 carries no ENR, so the nodes cannot be filtered by network or fork
+// ID until they are verified. See dnsSource for the nodes with ENRs.
+type discoverySource struct {
+	config    DiscoveryConfig
+	bootnodes []*enode.Node
+
+	lock  sync.Mutex
+	table *discover.Table
+	db    *enode.DB
+}
+
+// NewDiscoverySource returns the source crawling the nodes of the network by the
+// discovery v4 protocol from the bootnodes. The UDP listener is started on the first
+// fetch and stopped on Close.
+func NewDiscoverySource(network string, config DiscoveryConfig) (NodeSource, error) {
+	urls := config.Bootnodes
+	if len(urls) == 0 {
+		urls = bootnodesMap[network]
+	}
+	if len(urls) == 0 {
+		return nil, ErrNoBootnodes
+	}
+	bootnodes := make([]*enode.Node, 0, len(urls))
+	for _, url := range urls {
+		n, err := enode.ParseV4(url)
+		if err != nil {
+			return nil, err
+		}
+		bootnodes = append(bootnodes, n)
+	}
+	if config.Lookups <= 0 {
+		config.Lookups = defaultDiscoveryLookups
+	}
+	if config.Verify == nil {
+		config.Verify = func(n *enode.Node) bool {
+			return dialNode(n) == nil
+		}
+	}
+	return &discoverySource{
+		config:    config,
+		bootnodes: bootnodes,
+	}, nil
+}
+
+func (s *discoverySource) Name() string {
+	return "discovery"
+}
+
+func (s *discoverySource) Nodes(filter map[string]bool, max int) ([]*enode.Node, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.table == nil {
+		if err := s.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	seen := make(map[enode.ID]bool)
+	candidates := make([]*enode.Node, 0)
+	for i := 0; i < s.config.Lookups; i++ {
+		for _, n := range s.table.LookupRandom() {
+			// skip the nodes not accepting TCP connections, e.g. the bootnodes
+			if seen[n.ID()] || filter[n.ID().String()] || n.TCP() == 0 {
+				continue
+			}
+			seen[n.ID()] = true
+			candidates = append(candidates, n)
+		}
+	}
+	log.Trace("Discovered nodes", "nodeCount", len(candidates))
+
+	nodeCh := make(chan *enode.Node, len(candidates))
+	for _, n := range candidates {
+		go func(n *enode.Node) {
+			if !s.config.Verify(n) {
+				nodeCh <- nil
+				return
+			}
+			nodeCh <- n
+		}(n)
+	}
+	enodes := make([]*enode.Node, 0)
+	for i := 0; i < len(candidates); i++ {
+		n := <-nodeCh
+		if n != nil && len(enodes) < max {
+			enodes = append(enodes, n)
+		}
+	}
+	return enodes, nil
+}
+
+func (s *discoverySource) start() error {
+	key := s.config.PrivateKey
+	if key == nil {
+		var err error
+		key, err = crypto.GenerateKey()
+		if err != nil {
+			return err
+		}
+	}
+	addr, err := net.ResolveUDPAddr("udp", s.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	// an empty path means the in-memory database
+	db, err := enode.OpenDB("")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	ln := enode.NewLocalNode(db, key)
+	ln.SetFallbackIP(net.IPv4(127, 0, 0, 1))
+	ln.SetFallbackUDP(conn.LocalAddr().(*net.UDPAddr).Port)
+	table, err := discover.ListenUDP(conn, ln, discover.Config{
+		PrivateKey: key,
+		Bootnodes:  s.bootnodes,
+	})
+	if err != nil {
+		db.Close()
+		conn.Close()
+		return err
+	}
+	log.Info("Discovery started", "self", ln.Node().String(), "bootnodes", len(s.bootnodes))
+	s.table, s.db = table, db
+	return nil
+}
+
+// Close stops the UDP listener.
+func (s *discoverySource) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.table != nil {
+		s.table.Close()
+		s.db.Close()
+		s.table, s.db = nil, nil
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package peermonitor
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/getamis/sirius/log"
+)
+
+const (
+	// dnsTimeout is the timeout to sync the trees in each fetch.
+	dnsTimeout = 30 * time.Second
+	// dnsMaxEntries is the max number of entries walked in each tree.
+	dnsMaxEntries = 10000
+	// dnsSigLength is the length of the root signatures in [R || S || V] format.
+	dnsSigLength = 65
+
+	rootPrefix   = "enrtree-root:v1"
+	branchPrefix = "enrtree-branch:"
+	linkPrefix   = "enrtree://"
+	enrPrefix    = "enr:"
+)
+
+var (
+	// ErrNoDNSTrees is returned if no tree is given for the network without the default
+	// DNS discovery lists, e.g. the private networks.
+	ErrNoDNSTrees = errors.New("no dns discovery trees")
+
+	errInvalidSig   = errors.New("invalid signature")
+	errHashMismatch = errors.New("hash mismatch")
+	errTooManyNodes = errors.New("too many entries")
+
+	// dnsTreesMap are the DNS discovery lists of the networks maintained by the
+	// go-ethereum team.
+	dnsTreesMap = map[string][]string{
+		ChainNetworkMainnet: {"enrtree://AKA3AM6LPBYEUDMVNU3BSVQJ5AD45Y7YPOHJLEF6W26QOE4VTUDPE@all.mainnet.ethdisco.net"},
+		ChainNetworkRopsten: {"enrtree://AKA3AM6LPBYEUDMVNU3BSVQJ5AD45Y7YPOHJLEF6W26QOE4VTUDPE@all.ropsten.ethdisco.net"},
+		ChainNetworkRinkeby: {"enrtree://AKA3AM6LPBYEUDMVNU3BSVQJ5AD45Y7YPOHJLEF6W26QOE4VTUDPE@all.rinkeby.ethdisco.net"},
+	}
+
+	b32format = base32.StdEncoding.WithPadding(base32.NoPadding)
+	b64format = base64.RawURLEncoding
+)
+
+// TXTResolver resolves the TXT records, e.g. net.Resolver.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DNSConfig represents the config of the DNS discovery source.
+type DNSConfig struct {
+	// Trees are the enrtree URLs of the DNS discovery lists, i.e.
+	// enrtree://<base32 public key>@<domain>. Set to empty means the lists of the
+	// network maintained by the go-ethereum team.
+	Trees []string
+	// Resolver resolves the TXT records of the trees. Set to nil means the default
+	// resolver.
+	Resolver TXTResolver
+	// Verify reports whether the listed node is a valid candidate. Set to nil means the
+	// nodes are dialed to verify they are reachable.
+	Verify func(*enode.Node) bool
+}
+
+// dnsTree is a DNS discovery list signed by the public key.
+type dnsTree struct {
+	domain string
+	pubkey *ecdsa.PublicKey
+}
+
+// dnsRoot is the root entry of a tree.
+type dnsRoot struct {
+	eroot string
+	lroot string
+	seq   uint
+	sig   []byte
+}
+
+// dnsSource finds the nodes in the DNS discovery lists of EIP-1459. The nodes are listed
+// in the signed node records, so they are filtered by the fork IDs in their "eth"
+// entries when verified by the handshakes.
+type dnsSource struct {
+	config DNSConfig
+	trees  []*dnsTree
+
+	lock sync.Mutex
+	// entries are the resolved entries keyed by the full names, which never change
+	// since the names are the hashes of the entries
+	entries map[string]string
+}
+
+// NewDNSSource returns the source of the nodes in the DNS discovery lists (EIP-1459).
+// The trees are synced on each fetch, and the linked trees are followed.
+func NewDNSSource(network string, config DNSConfig) (NodeSource, error) {
+	urls := config.Trees
+	if len(urls) == 0 {
+		urls = dnsTreesMap[network]
+	}
+	if len(urls) == 0 {
+		return nil, ErrNoDNSTrees
+	}
+	trees := make([]*dnsTree, 0, len(urls))
+	for _, url := range urls {
+		t, err := parseDNSTree(url)
+		if err != nil {
+			return nil, err
+		}
+		trees = append(trees, t)
+	}
+	if config.Resolver == nil {
+		config.Resolver = net.DefaultResolver
+	}
+	if config.Verify == nil {
+		config.Verify = func(n *enode.Node) bool {
+			return dialNode(n) == nil
+		}
+	}
+	return &dnsSource{
+		config:  config,
+		trees:   trees,
+		entries: make(map[string]string),
+	}, nil
+}
+
+func (s *dnsSource) Name() string {
+	return "dns"
+}
+
+func (s *dnsSource) Nodes(filter map[string]bool, max int) ([]*enode.Node, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	nodes, err := s.sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Trace("Synced DNS discovery trees", "nodeCount", len(nodes))
+
+	candidates := make([]*enode.Node, 0)
+	for _, n := range nodes {
+		if filter[n.ID().String()] || n.TCP() == 0 {
+			continue
+		}
+		candidates = append(candidates, n)
+	}
+	// verify the random candidates in batches until enough nodes are found, since the
+	// public lists have thousands of nodes
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	enodes := make([]*enode.Node, 0)
+	for len(candidates) > 0 && len(enodes) < max {
+		batch := candidates
+		if len(batch) > 2*max {
+			batch = batch[:2*max]
+		}
+		candidates = candidates[len(batch):]
+
+		nodeCh := make(chan *enode.Node, len(batch))
+		for _, n := range batch {
+			go func(n *enode.Node) {
+				if !s.config.Verify(n) {
+					nodeCh <- nil
+					return
+				}
+				nodeCh <- n
+			}(n)
+		}
+		for i := 0; i < len(batch); i++ {
+			n := <-nodeCh
+			if n != nil && len(enodes) < max {
+				enodes = append(enodes, n)
+			}
+		}
+	}
+	return enodes, nil
+}
+
+// sync returns the nodes in the trees and the linked trees.
+func (s *dnsSource) sync(ctx context.Context) ([]*enode.Node, error) {
+	seen := make(map[string]bool)
+	queue := append([]*dnsTree{}, s.trees...)
+	var nodes []*enode.Node
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		if seen[t.domain] {
+			continue
+		}
+		seen[t.domain] = true
+
+		root, err := s.resolveRoot(ctx, t)
+		if err != nil {
+			log.Warn("Failed to resolve DNS discovery tree", "domain", t.domain, "err", err)
+			continue
+		}
+		treeNodes, _, err := s.walk(ctx, t, root.eroot, false)
+		if err != nil {
+			log.Warn("Failed to sync DNS discovery tree", "domain", t.domain, "err", err)
+		}
+		nodes = append(nodes, treeNodes...)
+		_, links, err := s.walk(ctx, t, root.lroot, true)
+		if err != nil {
+			log.Warn("Failed to sync DNS discovery links", "domain", t.domain, "err", err)
+		}
+		queue = append(queue, links...)
+	}
+	if len(seen) > 0 && len(nodes) == 0 {
+		return nil, fmt.Errorf("no node found in %d trees", len(seen))
+	}
+	return nodes, nil
+}
+
+// walk returns the nodes, or the linked trees if links is true, under the hash in the
+// tree.
+func (s *dnsSource) walk(ctx context.Context, t *dnsTree, hash string, links bool) ([]*enode.Node, []*dnsTree, error) {
+	var nodes []*enode.Node
+	var trees []*dnsTree
+	hashes := []string{hash}
+	for count := 0; len(hashes) > 0; count++ {
+		if count >= dnsMaxEntries {
+			return nodes, trees, errTooManyNodes
+		}
+		hash, hashes = hashes[0], hashes[1:]
+		txt, err := s.resolveEntry(ctx, t, hash)
+		if err != nil {
+			return nodes, trees, err
+		}
+		switch {
+		case strings.HasPrefix(txt, branchPrefix):
+			children, err := parseBranch(txt)
+			if err != nil {
+				return nodes, trees, err
+			}
+			hashes = append(hashes, children...)
+		case strings.HasPrefix(txt, enrPrefix) && !links:
+			n, err := parseENR(txt)
+			if err != nil {
+				log.Debug("Failed to parse node record", "domain", t.domain, "err", err)
+				continue
+			}
+			nodes = append(nodes, n)
+		case strings.HasPrefix(txt, linkPrefix) && links:
+			link, err := parseDNSTree(txt)
+			if err != nil {
+				log.Debug("Failed to parse tree link", "domain", t.domain, "err", err)
+				continue
+			}
+			trees = append(trees, link)
+		default:
+			return nodes, trees, fmt.Errorf("unexpected entry %q at %s.%s", txt, hash, t.domain)
+		}
+	}
+	return nodes, trees, nil
+}
+
+// resolveRoot resolves and verifies the root entry of the tree. The root is resolved on
+// each sync, since it changes when the tree is updated.
+func (s *dnsSource) resolveRoot(ctx context.Context, t *dnsTree) (*dnsRoot, error) {
+	txts, err := s.config.Resolver.LookupTXT(ctx, t.domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, rootPrefix) {
+			continue
+		}
+		root, err := parseRoot(txt)
+		if err != nil {
+			return nil, err
+		}
+		if !root.verify(t.pubkey) {
+			return nil, errInvalidSig
+		}
+		return root, nil
+	}
+	return nil, fmt.Errorf("no root entry at %s", t.domain)
+}
+
+// resolveEntry resolves the entry of the hash in the tree, and verifies the entry matches
+// the hash.
+func (s *dnsSource) resolveEntry(ctx context.Context, t *dnsTree, hash string) (string, error) {
+	name := hash + "." + t.domain
+	if txt, ok := s.entries[name]; ok {
+		return txt, nil
+	}
+	want, err := b32format.DecodeString(hash)
+	if err != nil || len(want) < 12 {
+		return "", fmt.Errorf("invalid hash %q", hash)
+	}
+	txts, err := s.config.Resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	for _, txt := range txts {
+		if bytes.HasPrefix(crypto.Keccak256([]byte(txt)), want) {
+			s.entries[name] = txt
+			return txt, nil
+		}
+	}
+	return "", errHashMismatch
+}
+
+// parseDNSTree parses the enrtree URL.
+func parseDNSTree(url string) (*dnsTree, error) {
+	parts := strings.SplitN(strings.TrimPrefix(url, linkPrefix), "@", 2)
+	if !strings.HasPrefix(url, linkPrefix) || len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid enrtree url %q", url)
+	}
+	key, err := b32format.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in %q: %v", url, err)
+	}
+	pubkey, err := crypto.DecompressPubkey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in %q: %v", url, err)
+	}
+	return &dnsTree{domain: parts[1], pubkey: pubkey}, nil
+}
+
+// parseRoot parses the root entry, i.e.
+// enrtree-root:v1 e=<enr root> l=<link root> seq=<sequence number> sig=<signature>.
+func parseRoot(txt string) (*dnsRoot, error) {
+	var root dnsRoot
+	var sig string
+	if _, err := fmt.Sscanf(txt, rootPrefix+" e=%s l=%s seq=%d sig=%s", &root.eroot, &root.lroot, &root.seq, &sig); err != nil {
+		return nil, fmt.Errorf("invalid root entry %q: %v", txt, err)
+	}
+	var err error
+	root.sig, err = b64format.DecodeString(sig)
+	if err != nil || len(root.sig) != dnsSigLength {
+		return nil, errInvalidSig
+	}
+	return &root, nil
+}
+
+// signedText returns the text of the root entry without the signature.
+func (r *dnsRoot) signedText() string {
+	return fmt.Sprintf(rootPrefix+" e=%s l=%s seq=%d", r.eroot, r.lroot, r.seq)
+}
+
+func (r *dnsRoot) verify(pubkey *ecdsa.PublicKey) bool {
+	hash := crypto.Keccak256([]byte(r.signedText()))
+	return crypto.VerifySignature(crypto.CompressPubkey(pubkey), hash, r.sig[:len(r.sig)-1])
+}
+
+// parseBranch returns the child hashes of the branch entry.
+func parseBranch(txt string) ([]string, error) {
+	hashes := strings.Split(strings.TrimPrefix(txt, branchPrefix), ",")
+	if len(hashes) == 1 && hashes[0] == "" {
+		return nil, nil
+	}
+	for _, h := range hashes {
+		if _, err := b32format.DecodeString(h); err != nil {
+			return nil, fmt.Errorf("invalid branch entry %q", txt)
+		}
+	}
+	return hashes, nil
+}
+
+// parseENR decodes the node record in the entry, and verifies its signature.
+func parseENR(txt string) (*enode.Node, error) {
+	data, err := b64format.DecodeString(strings.TrimPrefix(txt, enrPrefix))
+	if err != nil {
+		return nil, err
+	}
+	var r enr.Record
+	if err := rlp.DecodeBytes(data, &r); err != nil {
+		return nil, err
+	}
+	return enode.New(enode.ValidSchemes, &r)
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package peermonitor
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// mapResolver resolves the TXT records in the map.
+type mapResolver map[string]string
+
+func (r mapResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	txt, ok := r[name]
+	if !ok {
+		return nil, fmt.Errorf("no such host %s", name)
+	}
+	return []string{txt}, nil
+}
+
+// testTree builds the signed tree of the nodes and links in the resolver.
+type testTree struct {
+	domain   string
+	key      *ecdsa.PrivateKey
+	resolver mapResolver
+}
+
+func newTestTree(t *testing.T, domain string, resolver mapResolver) *testTree {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testTree{domain: domain, key: key, resolver: resolver}
+}
+
+func (tr *testTree) url() string {
+	return linkPrefix + b32format.EncodeToString(crypto.CompressPubkey(&tr.key.PublicKey)) + "@" + tr.domain
+}
+
+// add adds the entry and returns its hash.
+func (tr *testTree) add(txt string) string {
+	hash := b32format.EncodeToString(crypto.Keccak256([]byte(txt))[:16])
+	tr.resolver[hash+"."+tr.domain] = txt
+	return hash
+}
+
+// build adds the nodes in two branches, the links, and the signed root.
+func (tr *testTree) build(t *testing.T, nodes []*enode.Node, links []*testTree) {
+	var hashes []string
+	for _, n := range nodes {
+		data, err := rlp.EncodeToBytes(n.Record())
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, tr.add(enrPrefix+b64format.EncodeToString(data)))
+	}
+	half := len(hashes) / 2
+	eroot := tr.add(branchPrefix + strings.Join([]string{
+		tr.add(branchPrefix + strings.Join(hashes[:half], ",")),
+		tr.add(branchPrefix + strings.Join(hashes[half:], ",")),
+	}, ","))
+	var linkHashes []string
+	for _, l := range links {
+		linkHashes = append(linkHashes, tr.add(l.url()))
+	}
+	lroot := tr.add(branchPrefix + strings.Join(linkHashes, ","))
+
+	root := &dnsRoot{eroot: eroot, lroot: lroot, seq: 1}
+	sig, err := crypto.Sign(crypto.Keccak256([]byte(root.signedText())), tr.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.resolver[tr.domain] = root.signedText() + " sig=" + b64format.EncodeToString(sig)
+}
+
+func newTestENRs(t *testing.T, n int) []*enode.Node {
+	nodes := make([]*enode.Node, n)
+	for i := range nodes {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = newTestENR(t, key, nil)
+	}
+	return nodes
+}
+
+func TestDNSSource(t *testing.T) {
+	resolver := make(mapResolver)
+	tree := newTestTree(t, "nodes.example.org", resolver)
+	linked := newTestTree(t, "linked.example.org", resolver)
+	nodes := newTestENRs(t, 4)
+	linkedNodes := newTestENRs(t, 2)
+	tree.build(t, nodes, []*testTree{linked})
+	linked.build(t, linkedNodes, nil)
+
+	s, err := NewDNSSource("private", DNSConfig{
+		Trees:    []string{tree.url()},
+		Resolver: resolver,
+		Verify:   func(*enode.Node) bool { return true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The nodes in the tree and the linked tree are found, except the filtered ones
+	filter := map[string]bool{nodes[0].ID().String(): true}
+	found, err := s.Nodes(filter, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[enode.ID]bool)
+	for _, n := range append(nodes[1:], linkedNodes...) {
+		want[n.ID()] = true
+	}
+	if len(found) != len(want) {
+		t.Fatalf("got %d nodes, want %d", len(found), len(want))
+	}
+	for _, n := range found {
+		if !want[n.ID()] {
+			t.Fatalf("got unexpected node %s", n)
+		}
+	}
+
+	// At most max nodes are returned
+	if found, err := s.Nodes(nil, 2); err != nil || len(found) != 2 {
+		t.Fatalf("got %d nodes, %v, want 2", len(found), err)
+	}
+}
+
+func TestDNSSourceInvalidTree(t *testing.T) {
+	resolver := make(mapResolver)
+	tree := newTestTree(t, "nodes.example.org", resolver)
+	tree.build(t, newTestENRs(t, 2), nil)
+	other := newTestTree(t, "nodes.example.org", make(mapResolver))
+
+	// The root signed by another key is rejected
+	s, err := NewDNSSource("private", DNSConfig{Trees: []string{other.url()}, Resolver: resolver})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Nodes(nil, 10); err == nil {
+		t.Fatal("got no error of an invalid signature")
+	}
+
+	// The entry not matching its hash is rejected
+	for name, txt := range resolver {
+		if strings.HasPrefix(txt, enrPrefix) {
+			resolver[name] = enrPrefix + "tampered"
+		}
+	}
+	s, err = NewDNSSource("private", DNSConfig{Trees: []string{tree.url()}, Resolver: resolver})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Nodes(nil, 10); err == nil {
+		t.Fatal("got no error of tampered entries")
+	}
+}
+
+func TestNewDNSSource(t *testing.T) {
+	if _, err := NewDNSSource(ChainNetworkMainnet, DNSConfig{}); err != nil {
+		t.Fatalf("got %v of the default trees, want nil", err)
+	}
+	if _, err := NewDNSSource("private", DNSConfig{}); err != ErrNoDNSTrees {
+		t.Fatalf("got %v, want %v", err, ErrNoDNSTrees)
+	}
+	for _, url := range []string{"enrtree://nodes.example.org", "enrtree://AAAA@nodes.example.org", "enode://abc@nodes.example.org"} {
+		if _, err := NewDNSSource("private", DNSConfig{Trees: []string{url}}); err == nil {
+			t.Fatalf("got no error of %q", url)
+		}
+	}
+}
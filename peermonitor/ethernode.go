@@ -66,6 +66,18 @@ func (n *ethernode) URL() string {
 	return fmt.Sprintf("enode://%s@%s:%d", n.ID, n.Host, n.Port)
 }
 
+// NewEthernodesSource returns the source of the geth and parity nodes listed in
+// ethernodes for the network. The nodes are dialed to verify they are reachable.
+func NewEthernodesSource(network string) NodeSource {
+	return &funcSource{
+		name: "ethernodes",
+		fn:   GetEthNodesFetcher(network),
+	}
+}
+
+// GetEthNodesFetcher returns the function fetching the nodes of the network.
+//
+// Deprecated: use NewEthernodesSource instead.
 func GetEthNodesFetcher(network string) fetchFn {
 	return func(filter map[string]bool, max int) []*enode.Node {
 		return fetchFromEthNodes(filter, max, network)
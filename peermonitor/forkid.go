@@ -0,0 +1,184 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package peermonitor
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+var (
+	// ErrRemoteStale is returned if the candidate is on a subset of the forks of the
+	// ethereum endpoint, but is not aware of the next fork.
+	ErrRemoteStale = errors.New("remote needs update")
+	// ErrLocalIncompatibleOrStale is returned if the candidate is on another chain, or
+	// the ethereum endpoint is not aware of a fork passed by the candidate.
+	ErrLocalIncompatibleOrStale = errors.New("local incompatible or needs update")
+)
+
+// ForkID is the fork identifier of EIP-2124, i.e. the CRC32 checksum of the genesis hash
+// and the passed fork blocks, and the next fork block or 0 if no fork is scheduled.
+type ForkID struct {
+	Hash [4]byte
+	Next uint64
+}
+
+// NewForkID returns the fork ID of the chain at the head block.
+func NewForkID(config *params.ChainConfig, genesis common.Hash, head uint64) ForkID {
+	hash := crc32.ChecksumIEEE(genesis[:])
+	var next uint64
+	for _, fork := range gatherForks(config) {
+		if fork > head {
+			next = fork
+			break
+		}
+		hash = checksumUpdate(hash, fork)
+	}
+	return ForkID{Hash: checksumToBytes(hash), Next: next}
+}
+
+// ethEntry is the "eth" entry in the node records, and the fields after the fork ID are
+// ignored for the future versions.
+type ethEntry struct {
+	ForkID ForkID
+	Rest   []rlp.RawValue `rlp:"tail"`
+}
+
+func (e ethEntry) ENRKey() string {
+	return "eth"
+}
+
+// nodeForkID returns the fork ID in the node record, or false if the record has no "eth"
+// entry, e.g. the nodes found by the discovery v4.
+func nodeForkID(n *enode.Node) (ForkID, bool) {
+	var entry ethEntry
+	if err := n.Load(&entry); err != nil {
+		return ForkID{}, false
+	}
+	return entry.ForkID, true
+}
+
+// forkFilter validates the fork IDs of the candidates by the rules of EIP-2124 against
+// the chain of the ethereum endpoint.
+type forkFilter struct {
+	head uint64
+	// forks are the fork blocks followed by the never passed math.MaxUint64, and sums
+	// are the checksums before each of the forks
+	forks []uint64
+	sums  [][4]byte
+}
+
+func newForkFilter(config *params.ChainConfig, genesis common.Hash, head uint64) *forkFilter {
+	forks := gatherForks(config)
+	sums := make([][4]byte, len(forks)+1)
+	hash := crc32.ChecksumIEEE(genesis[:])
+	sums[0] = checksumToBytes(hash)
+	for i, fork := range forks {
+		hash = checksumUpdate(hash, fork)
+		sums[i+1] = checksumToBytes(hash)
+	}
+	return &forkFilter{
+		head:  head,
+		forks: append(forks, math.MaxUint64),
+		sums:  sums,
+	}
+}
+
+// validate returns nil if the fork ID is compatible with the local chain.
+func (f *forkFilter) validate(id ForkID) error {
+	for i, fork := range f.forks {
+		if f.head >= fork {
+			continue
+		}
+		// The remote is on the same fork, and must not announce a passed fork
+		if f.sums[i] == id.Hash {
+			if id.Next > 0 && f.head >= id.Next {
+				return ErrLocalIncompatibleOrStale
+			}
+			return nil
+		}
+		// The remote is on a past fork, and must be aware of the following one
+		for j := 0; j < i; j++ {
+			if f.sums[j] == id.Hash {
+				if f.forks[j] != id.Next {
+					return ErrRemoteStale
+				}
+				return nil
+			}
+		}
+		// The remote is on a future fork, i.e. the local chain is syncing
+		for j := i + 1; j < len(f.sums); j++ {
+			if f.sums[j] == id.Hash {
+				return nil
+			}
+		}
+		return ErrLocalIncompatibleOrStale
+	}
+	// unreachable since the last fork is never passed
+	return nil
+}
+
+// gatherForks returns the sorted fork blocks in the chain config, i.e. the *big.Int
+// fields named *Block. The duplicated blocks and the forks at genesis are skipped.
+func gatherForks(config *params.ChainConfig) []uint64 {
+	var forks []uint64
+	if config == nil {
+		return forks
+	}
+	bigType := reflect.TypeOf(new(big.Int))
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !strings.HasSuffix(field.Name, "Block") || field.Type != bigType {
+			continue
+		}
+		if b := v.Field(i).Interface().(*big.Int); b != nil && b.Sign() > 0 {
+			forks = append(forks, b.Uint64())
+		}
+	}
+	sort.Slice(forks, func(i, j int) bool { return forks[i] < forks[j] })
+	for i := 1; i < len(forks); i++ {
+		if forks[i] == forks[i-1] {
+			forks = append(forks[:i], forks[i+1:]...)
+			i--
+		}
+	}
+	return forks
+}
+
+func checksumUpdate(hash uint32, fork uint64) uint32 {
+	var blob [8]byte
+	binary.BigEndian.PutUint64(blob[:], fork)
+	return crc32.Update(hash, crc32.IEEETable, blob[:])
+}
+
+func checksumToBytes(hash uint32) [4]byte {
+	var blob [4]byte
+	binary.BigEndian.PutUint32(blob[:], hash)
+	return blob
+}
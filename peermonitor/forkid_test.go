@@ -0,0 +1,125 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package peermonitor
+
+import (
+	"crypto/ecdsa"
+	"net"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func TestNewForkID(t *testing.T) {
+	tests := []struct {
+		head uint64
+		want ForkID
+	}{
+		{0, ForkID{Hash: [4]byte{0xfc, 0x64, 0xec, 0x04}, Next: 1150000}},
+		{1149999, ForkID{Hash: [4]byte{0xfc, 0x64, 0xec, 0x04}, Next: 1150000}},
+		{1150000, ForkID{Hash: [4]byte{0x97, 0xc2, 0xc3, 0x4c}, Next: 1920000}},
+		{1920000, ForkID{Hash: [4]byte{0x91, 0xd1, 0xf9, 0x48}, Next: 2463000}},
+		{2463000, ForkID{Hash: [4]byte{0x7a, 0x64, 0xda, 0x13}, Next: 2675000}},
+		{2675000, ForkID{Hash: [4]byte{0x3e, 0xdd, 0x5b, 0x10}, Next: 4370000}},
+		{4370000, ForkID{Hash: [4]byte{0xa0, 0x0b, 0xc3, 0x24}, Next: 0}},
+	}
+	for _, test := range tests {
+		if id := NewForkID(params.MainnetChainConfig, params.MainnetGenesisHash, test.head); id != test.want {
+			t.Fatalf("got fork id %x at %d, want %x", id, test.head, test.want)
+		}
+	}
+}
+
+func TestForkFilter(t *testing.T) {
+	tests := []struct {
+		head uint64
+		id   ForkID
+		err  error
+	}{
+		// The same fork without or with an unpassed next fork
+		{4370000, ForkID{Hash: [4]byte{0xa0, 0x0b, 0xc3, 0x24}, Next: 0}, nil},
+		{4370000, ForkID{Hash: [4]byte{0xa0, 0x0b, 0xc3, 0x24}, Next: 7280000}, nil},
+		// The same fork with a passed next fork
+		{4370000, ForkID{Hash: [4]byte{0xa0, 0x0b, 0xc3, 0x24}, Next: 4370000}, ErrLocalIncompatibleOrStale},
+		// The remote is syncing, and is aware of the next fork or not
+		{4370000, ForkID{Hash: [4]byte{0x3e, 0xdd, 0x5b, 0x10}, Next: 4370000}, nil},
+		{4370000, ForkID{Hash: [4]byte{0x3e, 0xdd, 0x5b, 0x10}, Next: 0}, ErrRemoteStale},
+		// The local is syncing
+		{2675000, ForkID{Hash: [4]byte{0xa0, 0x0b, 0xc3, 0x24}, Next: 0}, nil},
+		// Another chain
+		{4370000, ForkID{Hash: [4]byte{0xaf, 0xec, 0x6b, 0x27}, Next: 0}, ErrLocalIncompatibleOrStale},
+	}
+	for _, test := range tests {
+		f := newForkFilter(params.MainnetChainConfig, params.MainnetGenesisHash, test.head)
+		if err := f.validate(test.id); err != test.err {
+			t.Fatalf("got %v of fork id %x at %d, want %v", err, test.id, test.head, test.err)
+		}
+	}
+}
+
+func TestNodeForkID(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := NewForkID(params.MainnetChainConfig, params.MainnetGenesisHash, 4370000)
+	n := newTestENR(t, key, &want)
+	if id, ok := nodeForkID(n); !ok || id != want {
+		t.Fatalf("got fork id %x, %v, want %x", id, ok, want)
+	}
+	if _, ok := nodeForkID(newTestENR(t, key, nil)); ok {
+		t.Fatal("got fork id of the record without eth entry")
+	}
+}
+
+// newTestENR returns the node with the signed record, which has the fork ID if given.
+func newTestENR(t *testing.T, key *ecdsa.PrivateKey, id *ForkID) *enode.Node {
+	var r enr.Record
+	r.Set(enr.IP(net.IPv4(127, 0, 0, 1)))
+	r.Set(enr.TCP(30303))
+	r.Set(enr.UDP(30303))
+	if id != nil {
+		r.Set(ethEntry{ForkID: *id})
+	}
+	if err := enode.SignV4(&r, key); err != nil {
+		t.Fatal(err)
+	}
+	n, err := enode.New(enode.ValidSchemes, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestVerifyForkID(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &handshakeVerifier{
+		forks:   newForkFilter(params.MainnetChainConfig, params.MainnetGenesisHash, 4370000),
+		pending: make(map[enode.ID]chan error),
+	}
+	// The node on another chain is dropped before dialed
+	id := NewForkID(params.TestnetChainConfig, params.TestnetGenesisHash, 0)
+	if err := v.verify(newTestENR(t, key, &id)); err != ErrLocalIncompatibleOrStale {
+		t.Fatalf("got %v, want %v", err, ErrLocalIncompatibleOrStale)
+	}
+}
@@ -35,6 +35,18 @@ var (
 	}
 )
 
+// NewGistSource returns the source of the peer list maintained in gist for the network.
+// The nodes are dialed to verify they are reachable.
+func NewGistSource(network string) NodeSource {
+	return &funcSource{
+		name: "gist",
+		fn:   GetGistFetcher(network),
+	}
+}
+
+// GetGistFetcher returns the function fetching the nodes of the network.
+//
+// Deprecated: use NewGistSource instead.
 func GetGistFetcher(network string) fetchFn {
 	return func(filter map[string]bool, max int) []*enode.Node {
 		return fetchFromGist(filter, max, network)
@@ -0,0 +1,306 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package peermonitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/getamis/sirius/log"
+)
+
+const (
+	// maxVerifyingPeers is the max number of candidates in handshake at the same time.
+	maxVerifyingPeers = 256
+	// statusMsg is the message code of the eth status message
+	statusMsg = 0x00
+	// dialedConn is the connection flag of the dynamically dialed peers in p2p.Server,
+	// i.e. the unexported dynDialedConn of the vendored go-ethereum 1.8.21. Check it when
+	// go-ethereum is upgraded.
+	dialedConn = 1
+)
+
+var (
+	handshakeTimeout = 5 * time.Second
+
+	// ErrUnsupportedProtocol is returned if the ethereum endpoint runs neither the eth nor
+	// the istanbul protocol.
+	ErrUnsupportedProtocol = errors.New("unsupported protocol")
+	// ErrNetworkMismatch is returned if the candidate is on another network.
+	ErrNetworkMismatch = errors.New("network mismatch")
+	// ErrGenesisMismatch is returned if the candidate has another genesis block.
+	ErrGenesisMismatch = errors.New("genesis mismatch")
+
+	// handshakeProtocols are the supported protocols in the order of preference. The
+	// eth/64 status with the fork ID is not supported in go-ethereum 1.8, so the fork IDs
+	// are verified only if they are in the node records.
+	handshakeProtocols = []p2p.Protocol{
+		{Name: "istanbul", Version: 64, Length: 22},
+		{Name: "eth", Version: 63, Length: 17},
+	}
+)
+
+// statusData is the status message of the eth protocol.
+type statusData struct {
+	ProtocolVersion uint32
+	NetworkID       uint64
+	TD              *big.Int
+	CurrentBlock    common.Hash
+	GenesisBlock    common.Hash
+}
+
+// protocolInfo is the protocol metadata in admin_nodeInfo and admin_peers.
+type protocolInfo struct {
+	Network    uint64      `json:"network"`
+	Difficulty *big.Int    `json:"difficulty"`
+	Genesis    common.Hash `json:"genesis"`
+	Head       common.Hash `json:"head"`
+	// Config is the chain config to verify the fork IDs, which is unknown if nil
+	Config *params.ChainConfig `json:"config"`
+}
+
+// handshakeVerifier verifies the candidates by the devp2p and eth status handshakes.
+// The candidates must be on the same network and have the same genesis block as the
+// ethereum endpoint. The candidates with the fork IDs in their node records must also
+// be compatible with the chain of the ethereum endpoint, and are dropped before dialed.
+type handshakeVerifier struct {
+	server *p2p.Server
+
+	lock    sync.Mutex
+	status  statusData
+	forks   *forkFilter
+	pending map[enode.ID]chan error
+}
+
+// newHandshakeVerifier creates the verifier of the protocol of the ethereum endpoint in
+// its admin_nodeInfo at the head block.
+func newHandshakeVerifier(protocols map[string]json.RawMessage, head uint64) (*handshakeVerifier, error) {
+	proto, _, err := parseProtocolInfo(protocols)
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	v := &handshakeVerifier{
+		pending: make(map[enode.ID]chan error),
+	}
+	if err := v.setStatus(protocols, head); err != nil {
+		return nil, err
+	}
+	proto.Run = v.run
+	v.server = &p2p.Server{
+		Config: p2p.Config{
+			PrivateKey:  key,
+			MaxPeers:    maxVerifyingPeers,
+			Name:        "peer-monitor",
+			NoDiscovery: true,
+			NoDial:      true,
+			Protocols:   []p2p.Protocol{proto},
+		},
+	}
+	if err := v.server.Start(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// parseProtocolInfo returns the first supported protocol in the protocols of
+// admin_nodeInfo or admin_peers, and its metadata.
+func parseProtocolInfo(protocols map[string]json.RawMessage) (p2p.Protocol, *protocolInfo, error) {
+	for _, proto := range handshakeProtocols {
+		data, ok := protocols[proto.Name]
+		if !ok {
+			continue
+		}
+		info := &protocolInfo{}
+		if err := json.Unmarshal(data, info); err != nil {
+			return proto, nil, err
+		}
+		if info.Difficulty == nil {
+			info.Difficulty = new(big.Int)
+		}
+		return proto, info, nil
+	}
+	return p2p.Protocol{}, nil, ErrUnsupportedProtocol
+}
+
+// setStatus updates the status sent to the candidates, and the fork filter at the head
+// block.
+func (v *handshakeVerifier) setStatus(protocols map[string]json.RawMessage, head uint64) error {
+	proto, info, err := parseProtocolInfo(protocols)
+	if err != nil {
+		return err
+	}
+	var forks *forkFilter
+	if info.Config != nil {
+		forks = newForkFilter(info.Config, info.Genesis, head)
+	}
+	v.lock.Lock()
+	v.forks = forks
+	v.status = statusData{
+		ProtocolVersion: uint32(proto.Version),
+		NetworkID:       info.Network,
+		TD:              info.Difficulty,
+		CurrentBlock:    info.Head,
+		GenesisBlock:    info.Genesis,
+	}
+	v.lock.Unlock()
+	return nil
+}
+
+// filter returns the verified nodes.
+func (v *handshakeVerifier) filter(nodes []*enode.Node) []*enode.Node {
+	nodeCh := make(chan *enode.Node, len(nodes))
+	for _, n := range nodes {
+		go func(n *enode.Node) {
+			if err := v.verify(n); err != nil {
+				log.Debug("Failed to verify node", "node", n.String(), "err", err)
+				nodeCh <- nil
+				return
+			}
+			nodeCh <- n
+		}(n)
+	}
+	verified := make([]*enode.Node, 0)
+	for i := 0; i < len(nodes); i++ {
+		if n := <-nodeCh; n != nil {
+			verified = append(verified, n)
+		}
+	}
+	return verified
+}
+
+// verify checks the fork ID of the node if known, then dials the node and completes the
+// handshakes.
+func (v *handshakeVerifier) verify(n *enode.Node) error {
+	errCh := make(chan error, 1)
+	v.lock.Lock()
+	if id, ok := nodeForkID(n); ok && v.forks != nil {
+		if err := v.forks.validate(id); err != nil {
+			v.lock.Unlock()
+			return err
+		}
+	}
+	if _, ok := v.pending[n.ID()]; ok {
+		v.lock.Unlock()
+		return fmt.Errorf("already verifying %s", n.ID())
+	}
+	v.pending[n.ID()] = errCh
+	v.lock.Unlock()
+	defer func() {
+		v.lock.Lock()
+		delete(v.pending, n.ID())
+		v.lock.Unlock()
+	}()
+
+	conn, err := dialer.Dial(n)
+	if err != nil {
+		return err
+	}
+	// the connection is closed by the server if failed
+	if err := v.server.SetupConn(conn, dialedConn, n); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(2 * handshakeTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-errCh:
+		return err
+	case <-timer.C:
+		v.server.RemovePeer(n)
+		return p2p.DiscReadTimeout
+	}
+}
+
+// run is the protocol handler which disconnects the peer after the status handshake.
+func (v *handshakeVerifier) run(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+	err := v.handshake(rw)
+	v.lock.Lock()
+	if errCh, ok := v.pending[p.ID()]; ok {
+		errCh <- err
+	}
+	v.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return p2p.DiscQuitting
+}
+
+func (v *handshakeVerifier) handshake(rw p2p.MsgReadWriter) error {
+	v.lock.Lock()
+	status := v.status
+	v.lock.Unlock()
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- p2p.Send(rw, statusMsg, &status)
+	}()
+	go func() {
+		errCh <- readStatus(rw, &status)
+	}()
+	timer := time.NewTimer(handshakeTimeout)
+	defer timer.Stop()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				return err
+			}
+		case <-timer.C:
+			return p2p.DiscReadTimeout
+		}
+	}
+	return nil
+}
+
+func readStatus(rw p2p.MsgReadWriter, ours *statusData) error {
+	msg, err := rw.ReadMsg()
+	if err != nil {
+		return err
+	}
+	defer msg.Discard()
+	if msg.Code != statusMsg {
+		return fmt.Errorf("unexpected message code %d", msg.Code)
+	}
+	var status statusData
+	if err := msg.Decode(&status); err != nil {
+		return err
+	}
+	if status.NetworkID != ours.NetworkID {
+		return ErrNetworkMismatch
+	}
+	if status.GenesisBlock != ours.GenesisBlock {
+		return ErrGenesisMismatch
+	}
+	return nil
+}
+
+func (v *handshakeVerifier) close() {
+	v.server.Stop()
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package peermonitor
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+
+	"github.com/getamis/hypereth/testutil"
+)
+
+// startTestPeer starts a devp2p server running the eth protocol, which sends the status
+// after hold is closed, or never sends the status if silent.
+func startTestPeer(t *testing.T, status statusData, hold <-chan struct{}, silent bool) (*p2p.Server, *enode.Node) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &p2p.Server{
+		Config: p2p.Config{
+			PrivateKey:  key,
+			MaxPeers:    10,
+			Name:        "test-peer",
+			ListenAddr:  "127.0.0.1:0",
+			NoDiscovery: true,
+			NoDial:      true,
+			Protocols: []p2p.Protocol{{
+				Name:    "eth",
+				Version: 63,
+				Length:  17,
+				Run: func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+					if hold != nil {
+						<-hold
+					}
+					if !silent {
+						if err := p2p.Send(rw, statusMsg, &status); err != nil {
+							return err
+						}
+					}
+					for {
+						msg, err := rw.ReadMsg()
+						if err != nil {
+							return err
+						}
+						msg.Discard()
+					}
+				},
+			}},
+		},
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	addr := server.ListenAddr
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		server.Stop()
+		t.Fatal(err)
+	}
+	tcpPort, err := net.LookupPort("tcp", port)
+	if err != nil {
+		server.Stop()
+		t.Fatal(err)
+	}
+	return server, enode.NewV4(&key.PublicKey, net.IPv4(127, 0, 0, 1), tcpPort, 0)
+}
+
+// newTestVerifier creates the verifier of the fake node in its admin_nodeInfo.
+func newTestVerifier(t *testing.T, node *testutil.Node) *handshakeVerifier {
+	protocols := make(map[string]json.RawMessage)
+	for name, info := range node.NodeInfo().Protocols {
+		data, err := json.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		protocols[name] = data
+	}
+	v, err := newHandshakeVerifier(protocols, node.Chain().Head().NumberU64())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestHandshakeVerify(t *testing.T) {
+	timeout := handshakeTimeout
+	handshakeTimeout = 200 * time.Millisecond
+	defer func() {
+		handshakeTimeout = timeout
+	}()
+
+	chain := testutil.NewChain(testutil.ChainConfig{NetworkID: 5})
+	chain.AddBlocks(2)
+	node := startTestNode(t, chain)
+	defer node.Close()
+	v := newTestVerifier(t, node)
+	defer v.close()
+
+	matched := statusData{
+		ProtocolVersion: 63,
+		NetworkID:       5,
+		TD:              chain.Head().Number(),
+		CurrentBlock:    chain.Head().Hash(),
+		GenesisBlock:    chain.Genesis().Hash(),
+	}
+	otherNetwork := matched
+	otherNetwork.NetworkID = 1
+	otherGenesis := matched
+	otherGenesis.GenesisBlock = common.HexToHash("0x01")
+
+	tests := []struct {
+		name    string
+		status  statusData
+		silent  bool
+		wantErr error
+	}{
+		{"matched", matched, false, nil},
+		{"network mismatch", otherNetwork, false, ErrNetworkMismatch},
+		{"genesis mismatch", otherGenesis, false, ErrGenesisMismatch},
+		{"timeout", matched, true, p2p.DiscReadTimeout},
+	}
+	nodes := []*enode.Node{}
+	for _, test := range tests {
+		server, n := startTestPeer(t, test.status, nil, test.silent)
+		defer server.Stop()
+		nodes = append(nodes, n)
+
+		if err := v.verify(n); err != test.wantErr {
+			t.Fatalf("%s: got error %v, want %v", test.name, err, test.wantErr)
+		}
+	}
+
+	// Only the matched peer is kept
+	verified := v.filter(nodes)
+	if len(verified) != 1 || verified[0].ID() != nodes[0].ID() {
+		t.Fatalf("got verified nodes %v, want %v", verified, nodes[:1])
+	}
+
+	// The unreachable node is dropped
+	server, unreachable := startTestPeer(t, matched, nil, false)
+	server.Stop()
+	if err := v.verify(unreachable); err == nil {
+		t.Fatal("got no error on the unreachable node")
+	}
+}
+
+// TestDialedConn pins dialedConn to the dynamically dialed flag of the vendored
+// go-ethereum, i.e. the peers set up with it are neither inbound, static nor trusted.
+func TestDialedConn(t *testing.T) {
+	chain := testutil.NewChain(testutil.ChainConfig{})
+	node := startTestNode(t, chain)
+	defer node.Close()
+	v := newTestVerifier(t, node)
+	defer v.close()
+
+	hold := make(chan struct{})
+	status := statusData{
+		ProtocolVersion: 63,
+		NetworkID:       chain.NetworkID(),
+		TD:              chain.Head().Number(),
+		CurrentBlock:    chain.Head().Hash(),
+		GenesisBlock:    chain.Genesis().Hash(),
+	}
+	server, n := startTestPeer(t, status, hold, false)
+	defer server.Stop()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- v.verify(n)
+	}()
+
+	// The peer is kept in the handshake until hold is closed
+	deadline := time.Now().Add(5 * time.Second)
+	var peers []*p2p.PeerInfo
+	for len(peers) == 0 {
+		if time.Now().After(deadline) {
+			close(hold)
+			t.Fatal("no peer is set up")
+		}
+		time.Sleep(10 * time.Millisecond)
+		peers = v.server.PeersInfo()
+	}
+	close(hold)
+	p := peers[0]
+	if p.ID != n.ID().String() {
+		t.Fatalf("got peer %s, want %s", p.ID, n.ID())
+	}
+	if p.Network.Inbound || p.Network.Static || p.Network.Trusted {
+		t.Fatalf("got inbound %v, static %v, trusted %v, want a dynamically dialed peer", p.Network.Inbound, p.Network.Static, p.Network.Trusted)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
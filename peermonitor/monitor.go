@@ -18,7 +18,9 @@ package peermonitor
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"io"
 	"net"
 	"time"
 
@@ -38,27 +40,60 @@ var (
 	dialer = p2p.TCPDialer{Dialer: &net.Dialer{Timeout: dialTimeout}}
 )
 
-type fetchFn func(filter map[string]bool, max int) []*enode.Node
-
 type PeerMonitor struct {
-	ethURL       string
+	ethURL string
+	// ethClient is dialed on the first run and reconnects after the restarts of the
+	// ethereum endpoint
+	ethClient    *ethclient.Client
 	minPeerCount int
 	maxPeerCount int
-	fetcher      []fetchFn
-	quit         chan struct{}
+	sources      []NodeSource
+	// verifyHandshake verifies the candidates by the handshakes, and verifier is created
+	// on the first run
+	verifyHandshake bool
+	verifier        *handshakeVerifier
+	// score is the policy to prune the peers, firstSeen is the time the peers were first
+	// seen, and banned is the time the peers were pruned
+	score     ScoreConfig
+	firstSeen map[string]time.Time
+	banned    map[string]time.Time
+	quit      chan struct{}
 }
 
+// NewPeerMonitor creates the peer monitor of the ethereum endpoint, which fetches the
+// candidate nodes from the gist and ethernodes of the network. The candidates are not
+// verified by the handshakes as before, use New to verify them.
 func NewPeerMonitor(ethURL string, minPeerCount, maxPeerCount int, network string) *PeerMonitor {
-	return &PeerMonitor{
-		ethURL:       ethURL,
-		minPeerCount: minPeerCount,
-		maxPeerCount: maxPeerCount,
-		quit:         make(chan struct{}),
-		fetcher: []fetchFn{
-			GetGistFetcher(network),
-			GetEthNodesFetcher(network),
-		},
+	// Never fails since VerifyHandshake returns no error
+	m, _ := New(ethURL, minPeerCount, maxPeerCount, network, VerifyHandshake(false))
+	return m
+}
+
+// New creates the peer monitor of the ethereum endpoint with the options. The candidate
+// nodes are fetched from the gist and ethernodes of the network unless the sources are
+// given by the options.
+func New(ethURL string, minPeerCount, maxPeerCount int, network string, opts ...Option) (*PeerMonitor, error) {
+	m := &PeerMonitor{
+		ethURL:          ethURL,
+		minPeerCount:    minPeerCount,
+		maxPeerCount:    maxPeerCount,
+		verifyHandshake: true,
+		firstSeen:       make(map[string]time.Time),
+		banned:          make(map[string]time.Time),
+		quit:            make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(m); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.sources) == 0 {
+		m.sources = []NodeSource{
+			NewGistSource(network),
+			NewEthernodesSource(network),
+		}
 	}
+	return m, nil
 }
 
 func (m *PeerMonitor) Run(monitorDuration time.Duration) error {
@@ -77,6 +112,7 @@ func (m *PeerMonitor) Run(monitorDuration time.Duration) error {
 			}
 			timer.Reset(duration)
 		case <-m.quit:
+			m.Close()
 			return nil
 		}
 	}
@@ -87,28 +123,72 @@ func (m *PeerMonitor) Stop() {
 }
 
 func (m *PeerMonitor) RunOnce() error {
-	dialCtx, dialCancel := context.WithTimeout(context.Background(), ctxTimeout)
-	defer dialCancel()
-	ethClient, err := ethclient.DialContext(dialCtx, m.ethURL)
-	if err != nil {
-		return err
+	if m.ethClient == nil {
+		dialCtx, dialCancel := context.WithTimeout(context.Background(), ctxTimeout)
+		defer dialCancel()
+		ethClient, err := ethclient.DialContext(dialCtx, m.ethURL)
+		if err != nil {
+			return err
+		}
+		m.ethClient = ethClient.WithReconnect(ethclient.ReconnectConfig{})
 	}
-	defer ethClient.Close()
+	ethClient := m.ethClient
 
 	peersCtx, peersCancel := context.WithTimeout(context.Background(), ctxTimeout)
 	defer peersCancel()
-	peers, err := ethClient.AdminPeers(peersCtx)
+	var peers []*peerInfo
+	err := ethClient.CallContext(peersCtx, &peers, "admin_peers")
 	if err != nil {
 		return err
 	}
-
 	log.Info("Current peers", "count", len(peers))
-	if len(peers) > m.minPeerCount {
+
+	var protocols map[string]json.RawMessage
+	if m.verifyHandshake || m.score.Threshold > 0 {
+		protocols, err = m.nodeProtocols()
+		if err != nil {
+			return err
+		}
+	}
+
+	pruned := false
+	if m.score.Threshold > 0 {
+		remaining, err := m.prunePeers(peers, protocols)
+		if err != nil {
+			return err
+		}
+		pruned = len(remaining) < len(peers)
+		peers = remaining
+	}
+
+	if len(peers) > m.minPeerCount && !pruned {
 		log.Info("No need to discover nodes", "minPeerCount", m.minPeerCount)
 		return nil
 	}
 
-	nodes := m.fetchNodes(peers, m.maxPeerCount)
+	if len(peers) >= m.maxPeerCount {
+		log.Info("No room for new peers", "maxPeerCount", m.maxPeerCount)
+		return nil
+	}
+
+	if m.verifyHandshake {
+		if err := m.updateVerifier(protocols); err != nil {
+			return err
+		}
+	}
+
+	exists := make(map[string]bool)
+	for _, p := range peers {
+		exists[p.ID] = true
+	}
+	for id, t := range m.banned {
+		if time.Since(t) > pruneBanDuration {
+			delete(m.banned, id)
+			continue
+		}
+		exists[id] = true
+	}
+	nodes := m.fetchNodes(exists, m.maxPeerCount-len(peers))
 	if len(nodes) == 0 {
 		log.Error("empty node list")
 		return errors.New("empty node list")
@@ -126,30 +206,85 @@ func (m *PeerMonitor) RunOnce() error {
 	return nil
 }
 
-func (m *PeerMonitor) fetchNodes(curPeers []*p2p.PeerInfo, maxPeerCount int) []string {
-	exists := make(map[string]bool)
-	for _, p := range curPeers {
-		exists[p.ID] = true
-	}
-
-	dist := maxPeerCount - len(curPeers)
+// fetchNodes fetches at most want nodes not in exists from the sources.
+func (m *PeerMonitor) fetchNodes(exists map[string]bool, want int) []string {
 	enodes := []string{}
-
-	addNodes := func(candidates []*enode.Node) {
+	for _, s := range m.sources {
+		dist := want - len(enodes)
+		if dist <= 0 {
+			break
+		}
+		candidates, err := s.Nodes(exists, dist)
+		if err != nil {
+			log.Error("Failed to fetch nodes", "source", s.Name(), "err", err)
+			continue
+		}
+		if m.verifier != nil {
+			candidates = m.verifier.filter(candidates)
+		}
+		if len(candidates) > dist {
+			candidates = candidates[:dist]
+		}
 		for _, c := range candidates {
 			exists[c.ID().String()] = true
 			enodes = append(enodes, c.String())
 		}
+		log.Trace("Fetched nodes", "source", s.Name(), "nodeCount", len(candidates))
 	}
+	return enodes
+}
 
-	for _, f := range m.fetcher {
-		addNodes(f(exists, dist))
-		dist = dist - len(enodes)
-		if dist <= 0 {
-			break
+// nodeProtocols returns the protocol metadata in admin_nodeInfo.
+func (m *PeerMonitor) nodeProtocols() (map[string]json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	defer cancel()
+	var info struct {
+		Protocols map[string]json.RawMessage `json:"protocols"`
+	}
+	if err := m.ethClient.CallContext(ctx, &info, "admin_nodeInfo"); err != nil {
+		return nil, err
+	}
+	return info.Protocols, nil
+}
+
+// updateVerifier updates the status of the ethereum endpoint to verify the candidates.
+func (m *PeerMonitor) updateVerifier(protocols map[string]json.RawMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	defer cancel()
+	head, err := m.ethClient.BlockNumber(ctx)
+	if err != nil {
+		return err
+	}
+	if m.verifier != nil {
+		return m.verifier.setStatus(protocols, head.Uint64())
+	}
+	verifier, err := newHandshakeVerifier(protocols, head.Uint64())
+	if err != nil {
+		return err
+	}
+	m.verifier = verifier
+	return nil
+}
+
+// Close releases the ethereum client, the verifier and the sources holding resources,
+// e.g. the discovery listener. Run closes the monitor when stopped, and the callers of
+// RunOnce should close it after the runs.
+func (m *PeerMonitor) Close() {
+	if m.ethClient != nil {
+		m.ethClient.Close()
+		m.ethClient = nil
+	}
+	if m.verifier != nil {
+		m.verifier.close()
+		m.verifier = nil
+	}
+	for _, s := range m.sources {
+		if c, ok := s.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Warn("Failed to close node source", "source", s.Name(), "err", err)
+			}
 		}
 	}
-	return enodes
 }
 
 func dialNode(node *enode.Node) error {
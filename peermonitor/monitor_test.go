@@ -0,0 +1,118 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package peermonitor
+
+import (
+	"testing"
+
+	"github.com/getamis/hypereth/testutil"
+)
+
+func startTestNode(t *testing.T, chain *testutil.Chain) *testutil.Node {
+	node, err := testutil.NewNode(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func TestRunOnce(t *testing.T) {
+	chain := testutil.NewChain(testutil.ChainConfig{})
+	node := startTestNode(t, chain)
+	defer node.Close()
+
+	var candidates []*testutil.Node
+	urls := []string{}
+	for i := 0; i < 3; i++ {
+		n := startTestNode(t, chain)
+		defer n.Close()
+		candidates = append(candidates, n)
+		urls = append(urls, n.Enode().String())
+	}
+	existing := startTestNode(t, chain)
+	defer existing.Close()
+	node.AddPeer(existing.Enode())
+
+	m, err := New(node.HTTPURL(), 2, 3, "mainnet", StaticNodes(append([]string{existing.Enode().String()}, urls...)), VerifyHandshake(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// The peers are added up to the max peer count, and the existing peer is skipped
+	if err := m.RunOnce(); err != nil {
+		t.Fatal(err)
+	}
+	peers := node.Peers()
+	if len(peers) != 3 {
+		t.Fatalf("got %d peers, want 3", len(peers))
+	}
+	seen := make(map[string]bool)
+	for _, p := range peers {
+		if seen[p.ID] {
+			t.Fatalf("peer %s is added twice", p.ID)
+		}
+		seen[p.ID] = true
+	}
+
+	// No peer is added if there are enough peers
+	node.RemovePeer(existing.Enode().ID())
+	m.minPeerCount = 1
+	if err := m.RunOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if peers := node.Peers(); len(peers) != 2 {
+		t.Fatalf("got %d peers, want 2", len(peers))
+	}
+
+	// The candidates are fetched again if the peers are dropped
+	for _, n := range candidates {
+		node.RemovePeer(n.Enode().ID())
+	}
+	if err := m.RunOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if peers := node.Peers(); len(peers) != 3 {
+		t.Fatalf("got %d peers, want 3", len(peers))
+	}
+
+	// The client is released on Close, and dialed again by the next run
+	m.Close()
+	if m.ethClient != nil {
+		t.Fatal("got the eth client after closed")
+	}
+	if err := m.RunOnce(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewPeerMonitor(t *testing.T) {
+	// The legacy constructor keeps the handshake verification off
+	if m := NewPeerMonitor("http://127.0.0.1:8545", 1, 2, "mainnet"); m.verifyHandshake {
+		t.Fatal("got handshake verification enabled by NewPeerMonitor")
+	}
+	m, err := New("http://127.0.0.1:8545", 1, 2, "mainnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.verifyHandshake {
+		t.Fatal("got handshake verification disabled by New")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package peermonitor
+
+import "errors"
+
+// Option represents a PeerMonitor option
+type Option func(*PeerMonitor) error
+
+// WithSources fetches the candidate nodes from the given sources in order. The default
+// sources, i.e. the gist and ethernodes scrapers, are used only if no source is given.
+func WithSources(sources ...NodeSource) Option {
+	return func(m *PeerMonitor) error {
+		m.sources = append(m.sources, sources...)
+		return nil
+	}
+}
+
+// StaticNodes fetches the candidate nodes from the static list of enode URLs.
+func StaticNodes(urls []string) Option {
+	return func(m *PeerMonitor) error {
+		s, err := NewStaticSource(urls)
+		if err != nil {
+			return err
+		}
+		m.sources = append(m.sources, s)
+		return nil
+	}
+}
+
+// VerifyHandshake enables or disables the verification of the candidates by the devp2p
+// and eth status handshakes, which is enabled by default. The candidates must be on the
+// same network and have the same genesis block as the ethereum endpoint.
+func VerifyHandshake(enabled bool) Option {
+	return func(m *PeerMonitor) error {
+		m.verifyHandshake = enabled
+		return nil
+	}
+}
+
+// WithScoreConfig scores the peers and prunes the worst ones by the config. The zero
+// fields are set to the ones in DefaultScoreConfig.
+func WithScoreConfig(config ScoreConfig) Option {
+	return func(m *PeerMonitor) error {
+		if config.Threshold < 0 || config.MaxPrune < 0 || config.GracePeriod < 0 {
+			return errors.New("invalid score config")
+		}
+		if config.MaxPrune == 0 {
+			config.MaxPrune = DefaultScoreConfig.MaxPrune
+		}
+		if config.GracePeriod == 0 {
+			config.GracePeriod = DefaultScoreConfig.GracePeriod
+		}
+		if config.MaxBlockLag == 0 {
+			config.MaxBlockLag = DefaultScoreConfig.MaxBlockLag
+		}
+		if config.LagPenalty == 0 {
+			config.LagPenalty = DefaultScoreConfig.LagPenalty
+		}
+		if config.InboundPenalty == 0 {
+			config.InboundPenalty = DefaultScoreConfig.InboundPenalty
+		}
+		m.score = config
+		return nil
+	}
+}
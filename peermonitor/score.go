@@ -0,0 +1,225 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package peermonitor
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/getamis/sirius/log"
+)
+
+const (
+	maxScore           = 100
+	defaultMaxBlockLag = 64
+	// pruneBanDuration is the duration not to add the pruned peers back.
+	pruneBanDuration = time.Hour
+)
+
+// ScoreConfig represents the policy to score and prune the peers. Each peer starts
+// with the score 100 and gets the penalties. The peers scored below the threshold are
+// pruned by admin_removePeer, and replaced by the candidates from the node sources.
+// The trusted and static peers are never pruned.
+//
+// The admin_peers of go-ethereum 1.8 reports neither the latency nor the connection
+// time, so the peers are not scored by latency, and the connection age is the time
+// since the peer monitor first saw the peer.
+type ScoreConfig struct {
+	// Threshold is the score to prune the peers below. Set to 0 means no pruning.
+	Threshold float64
+	// MaxPrune is the max number of peers pruned in each run. Set to 0 means 1.
+	MaxPrune int
+	// GracePeriod is the connection age before the peers could be pruned, so the new
+	// peers have time to sync. Set to 0 means 10 minutes.
+	GracePeriod time.Duration
+	// MaxBlockLag is the head lag in blocks to get the full LagPenalty, and the penalty
+	// is proportional below. Set to 0 means 64 blocks.
+	MaxBlockLag uint64
+	// LagPenalty is the penalty of the peers lagging MaxBlockLag blocks, or having a
+	// head unknown to the ethereum endpoint with less total difficulty. Set to 0 means
+	// 60.
+	LagPenalty float64
+	// InboundPenalty is the penalty of the inbound peers. Set to 0 means 10.
+	InboundPenalty float64
+	// ClientPenalties are the penalties by the prefixes of the peer names, e.g. Parity.
+	// The longest matching prefix is applied.
+	ClientPenalties map[string]float64
+}
+
+// DefaultScoreConfig is the default policy without pruning.
+var DefaultScoreConfig = ScoreConfig{
+	MaxPrune:       1,
+	GracePeriod:    10 * time.Minute,
+	MaxBlockLag:    defaultMaxBlockLag,
+	LagPenalty:     60,
+	InboundPenalty: 10,
+}
+
+// peerInfo is the peer in admin_peers with the raw protocol metadata, since the total
+// difficulties overflow float64.
+type peerInfo struct {
+	p2p.PeerInfo
+	Protocols map[string]json.RawMessage `json:"protocols"`
+}
+
+// peerScore is the score of a peer with the reasons of the penalties.
+type peerScore struct {
+	peer    *peerInfo
+	score   float64
+	reasons []string
+}
+
+// localHead is the head of the ethereum endpoint.
+type localHead struct {
+	number     uint64
+	difficulty *big.Int
+}
+
+// scorePeer scores the peer. It returns nil if the peer is still in handshake.
+func (m *PeerMonitor) scorePeer(ctx context.Context, p *peerInfo, local *localHead) (*peerScore, error) {
+	_, info, err := parseProtocolInfo(p.Protocols)
+	if err != nil {
+		// the protocol metadata is a string during the handshake
+		return nil, nil
+	}
+	s := &peerScore{
+		peer:  p,
+		score: maxScore,
+	}
+
+	var lag uint64
+	header, err := m.ethClient.HeaderByHash(ctx, info.Head)
+	switch {
+	case err == ethereum.NotFound:
+		// the peer is ahead, or on a fork unknown to the ethereum endpoint
+		if info.Difficulty.Cmp(local.difficulty) < 0 {
+			lag = m.score.MaxBlockLag
+		}
+	case err != nil:
+		return nil, err
+	case header.Number.Uint64() < local.number:
+		lag = local.number - header.Number.Uint64()
+	}
+	if lag > m.score.MaxBlockLag {
+		lag = m.score.MaxBlockLag
+	}
+	if lag > 0 {
+		s.score -= m.score.LagPenalty * float64(lag) / float64(m.score.MaxBlockLag)
+		s.reasons = append(s.reasons, "lag")
+	}
+	if p.Network.Inbound && m.score.InboundPenalty != 0 {
+		s.score -= m.score.InboundPenalty
+		s.reasons = append(s.reasons, "inbound")
+	}
+	if penalty, ok := clientPenalty(m.score.ClientPenalties, p.Name); ok {
+		s.score -= penalty
+		s.reasons = append(s.reasons, "client")
+	}
+	return s, nil
+}
+
+// clientPenalty returns the penalty of the longest prefix matching the peer name.
+func clientPenalty(penalties map[string]float64, name string) (float64, bool) {
+	var penalty float64
+	longest := -1
+	for prefix, p := range penalties {
+		if strings.HasPrefix(name, prefix) && len(prefix) > longest {
+			penalty, longest = p, len(prefix)
+		}
+	}
+	return penalty, longest >= 0
+}
+
+// prunePeers removes the worst peers scored below the threshold, and returns the
+// remaining peers.
+func (m *PeerMonitor) prunePeers(peers []*peerInfo, protocols map[string]json.RawMessage) ([]*peerInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	defer cancel()
+
+	_, info, err := parseProtocolInfo(protocols)
+	if err != nil {
+		return nil, err
+	}
+	header, err := m.ethClient.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	local := &localHead{
+		number:     header.Number.Uint64(),
+		difficulty: info.Difficulty,
+	}
+
+	// track the connection age of the peers
+	now := time.Now()
+	firstSeen := make(map[string]time.Time, len(peers))
+	for _, p := range peers {
+		t, ok := m.firstSeen[p.ID]
+		if !ok {
+			t = now
+		}
+		firstSeen[p.ID] = t
+	}
+	m.firstSeen = firstSeen
+
+	scores := make([]*peerScore, 0)
+	for _, p := range peers {
+		if p.Network.Trusted || p.Network.Static || now.Sub(firstSeen[p.ID]) < m.score.GracePeriod {
+			continue
+		}
+		s, err := m.scorePeer(ctx, p, local)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil {
+			continue
+		}
+		log.Trace("Scored peer", "id", p.ID, "name", p.Name, "score", s.score, "reasons", s.reasons)
+		if s.score < m.score.Threshold {
+			scores = append(scores, s)
+		}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		return scores[i].score < scores[j].score
+	})
+	if len(scores) > m.score.MaxPrune {
+		scores = scores[:m.score.MaxPrune]
+	}
+
+	pruned := make(map[string]bool)
+	for _, s := range scores {
+		if err := m.ethClient.RemovePeer(ctx, s.peer.Enode); err != nil {
+			log.Error("Failed to remove peer", "id", s.peer.ID, "err", err)
+			continue
+		}
+		log.Info("Pruned peer", "id", s.peer.ID, "name", s.peer.Name, "score", s.score, "reasons", s.reasons)
+		pruned[s.peer.ID] = true
+		m.banned[s.peer.ID] = now
+	}
+	remaining := make([]*peerInfo, 0, len(peers))
+	for _, p := range peers {
+		if !pruned[p.ID] {
+			remaining = append(remaining, p)
+		}
+	}
+	return remaining, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package peermonitor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithScoreConfig(t *testing.T) {
+	m := &PeerMonitor{}
+	if err := WithScoreConfig(ScoreConfig{Threshold: 50})(m); err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultScoreConfig
+	want.Threshold = 50
+	if m.score.Threshold != want.Threshold || m.score.MaxPrune != want.MaxPrune || m.score.GracePeriod != want.GracePeriod ||
+		m.score.MaxBlockLag != want.MaxBlockLag || m.score.LagPenalty != want.LagPenalty || m.score.InboundPenalty != want.InboundPenalty {
+		t.Fatalf("got score config %+v, want %+v", m.score, want)
+	}
+
+	// The given fields are kept
+	config := ScoreConfig{
+		Threshold:      80,
+		MaxPrune:       3,
+		GracePeriod:    time.Minute,
+		MaxBlockLag:    16,
+		LagPenalty:     30,
+		InboundPenalty: 5,
+	}
+	if err := WithScoreConfig(config)(m); err != nil {
+		t.Fatal(err)
+	}
+	if m.score.Threshold != config.Threshold || m.score.MaxPrune != config.MaxPrune || m.score.GracePeriod != config.GracePeriod ||
+		m.score.MaxBlockLag != config.MaxBlockLag || m.score.LagPenalty != config.LagPenalty || m.score.InboundPenalty != config.InboundPenalty {
+		t.Fatalf("got score config %+v, want %+v", m.score, config)
+	}
+
+	if err := WithScoreConfig(ScoreConfig{Threshold: -1})(m); err == nil {
+		t.Fatal("got no error of a negative threshold")
+	}
+}
+
+func TestClientPenalty(t *testing.T) {
+	penalties := map[string]float64{
+		"Geth":                    5,
+		"Parity":                  20,
+		"Parity-Ethereum":         10,
+		"Parity-Ethereum/v2.2.11": 1,
+	}
+	tests := []struct {
+		name    string
+		penalty float64
+		ok      bool
+	}{
+		{"Geth/v1.8.21-stable/linux-amd64/go1.11.4", 5, true},
+		{"Parity/v1.11.11-stable/x86_64-linux-gnu/rustc1.29.0", 20, true},
+		{"Parity-Ethereum/v2.1.10-stable/x86_64-linux-gnu/rustc1.29.0", 10, true},
+		{"Parity-Ethereum/v2.2.11-stable/x86_64-linux-gnu/rustc1.31.1", 1, true},
+		{"besu/v1.0.0/linux-x86_64/oracle_openjdk-java-11", 0, false},
+	}
+	// repeat since the map iteration order is random
+	for i := 0; i < 10; i++ {
+		for _, test := range tests {
+			if penalty, ok := clientPenalty(penalties, test.name); penalty != test.penalty || ok != test.ok {
+				t.Fatalf("got penalty %v, %v of %s, want %v, %v", penalty, ok, test.name, test.penalty, test.ok)
+			}
+		}
+	}
+}
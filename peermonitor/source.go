@@ -0,0 +1,198 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package peermonitor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/getamis/sirius/log"
+)
+
+// httpSourceTimeout is the timeout to fetch the enode list from an HTTP endpoint.
+const httpSourceTimeout = 10 * time.Second
+
+// NodeSource provides the candidate nodes to add as peers of the ethereum endpoint. The
+// sources implementing io.Closer are closed when the peer monitor stops.
+type NodeSource interface {
+	// Name returns the name of the source in logs.
+	Name() string
+	// Nodes returns at most max nodes whose IDs are not in the filter.
+	Nodes(filter map[string]bool, max int) ([]*enode.Node, error)
+}
+
+type fetchFn func(filter map[string]bool, max int) []*enode.Node
+
+// funcSource adapts the scrapers which verify the reachability of the nodes themselves.
+type funcSource struct {
+	name string
+	fn   fetchFn
+}
+
+func (s *funcSource) Name() string {
+	return s.name
+}
+
+func (s *funcSource) Nodes(filter map[string]bool, max int) ([]*enode.Node, error) {
+	return s.fn(filter, max), nil
+}
+
+type staticSource struct {
+	nodes []*enode.Node
+}
+
+// NewStaticSource returns the source of a static list of enode URLs.
+func NewStaticSource(urls []string) (NodeSource, error) {
+	nodes := make([]*enode.Node, 0, len(urls))
+	for _, url := range urls {
+		n, err := enode.ParseV4(url)
+		if err != nil {
+			return nil, fmt.Errorf("invalid enode %q: %v", url, err)
+		}
+		nodes = append(nodes, n)
+	}
+	return &staticSource{nodes: nodes}, nil
+}
+
+func (s *staticSource) Name() string {
+	return "static"
+}
+
+func (s *staticSource) Nodes(filter map[string]bool, max int) ([]*enode.Node, error) {
+	return selectNodes(s.nodes, filter, max), nil
+}
+
+type fileSource struct {
+	path string
+}
+
+// NewFileSource returns the source of a local file, which is either a JSON array of
+// enode URLs, e.g. the static-nodes.json of geth, or a text file with one enode URL
+// per line. The file is read on each fetch, so it can be updated while running.
+func NewFileSource(path string) NodeSource {
+	return &fileSource{path: path}
+}
+
+func (s *fileSource) Name() string {
+	return "file:" + s.path
+}
+
+func (s *fileSource) Nodes(filter map[string]bool, max int) ([]*enode.Node, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := parseNodeList(data)
+	if err != nil {
+		return nil, err
+	}
+	return selectNodes(nodes, filter, max), nil
+}
+
+type httpSource struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPSource returns the source of an HTTP endpoint responding the enode list in the
+// same formats as NewFileSource.
+func NewHTTPSource(url string) NodeSource {
+	return &httpSource{
+		url:    url,
+		client: &http.Client{Timeout: httpSourceTimeout},
+	}
+}
+
+func (s *httpSource) Name() string {
+	return s.url
+}
+
+func (s *httpSource) Nodes(filter map[string]bool, max int) ([]*enode.Node, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := parseNodeList(data)
+	if err != nil {
+		return nil, err
+	}
+	return selectNodes(nodes, filter, max), nil
+}
+
+// parseNodeList parses a JSON array of enode URLs, or the enode URLs line by line. Blank
+// lines and lines starting with '#' are skipped, and the invalid enodes are logged and
+// skipped.
+func parseNodeList(data []byte) ([]*enode.Node, error) {
+	var urls []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &urls); err != nil {
+			return nil, err
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			urls = append(urls, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	nodes := make([]*enode.Node, 0, len(urls))
+	for _, url := range urls {
+		n, err := enode.ParseV4(url)
+		if err != nil {
+			log.Warn("Failed to parse enode url", "url", url, "err", err)
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// selectNodes returns at most max nodes not in the filter.
+func selectNodes(nodes []*enode.Node, filter map[string]bool, max int) []*enode.Node {
+	selected := make([]*enode.Node, 0)
+	for _, n := range nodes {
+		if len(selected) >= max {
+			break
+		}
+		if !filter[n.ID().String()] {
+			selected = append(selected, n)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package peermonitor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+func newTestEnodes(t *testing.T, n int) []string {
+	urls := make([]string, n)
+	for i := range urls {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls[i] = enode.NewV4(&key.PublicKey, net.IPv4(127, 0, 0, 1), 30303+i, 30303+i).String()
+	}
+	return urls
+}
+
+func checkNodes(t *testing.T, got []*enode.Node, want []string) {
+	if len(got) != len(want) {
+		t.Fatalf("got %d nodes, want %d", len(got), len(want))
+	}
+	for i, n := range got {
+		if n.String() != want[i] {
+			t.Fatalf("got node %d %s, want %s", i, n, want[i])
+		}
+	}
+}
+
+func TestParseNodeList(t *testing.T) {
+	urls := newTestEnodes(t, 2)
+	jsonList, err := json.Marshal(append([]string{"enode://invalid"}, urls...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"json", string(jsonList), urls},
+		{"lines", "# nodes\n\n" + urls[0] + "\n  " + urls[1] + "  \nenode://invalid\n", urls},
+		{"empty", "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nodes, err := parseNodeList([]byte(test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkNodes(t, nodes, test.want)
+		})
+	}
+
+	if _, err := parseNodeList([]byte("[" + urls[0])); err == nil {
+		t.Fatal("got no error of an invalid json list")
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peermonitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nodes.txt")
+
+	s := NewFileSource(path)
+	if _, err := s.Nodes(nil, 10); err == nil {
+		t.Fatal("got no error of a missing file")
+	}
+
+	urls := newTestEnodes(t, 3)
+	if err := ioutil.WriteFile(path, []byte(strings.Join(urls, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := s.Nodes(nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNodes(t, nodes, urls)
+
+	// The filtered nodes are skipped and at most max nodes are returned
+	first, err := enode.ParseV4(urls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err = s.Nodes(map[string]bool{first.ID().String(): true}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNodes(t, nodes, urls[1:2])
+
+	// The file is read again on each fetch
+	if err := ioutil.WriteFile(path, []byte(urls[2]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err = s.Nodes(nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNodes(t, nodes, urls[2:])
+}
+
+func TestHTTPSource(t *testing.T) {
+	urls := newTestEnodes(t, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/nodes" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(urls)
+	}))
+	defer server.Close()
+
+	nodes, err := NewHTTPSource(server.URL+"/nodes").Nodes(nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNodes(t, nodes, urls)
+
+	if _, err := NewHTTPSource(server.URL+"/missing").Nodes(nil, 10); err == nil {
+		t.Fatal("got no error of a not found response")
+	}
+}
@@ -0,0 +1,802 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	// defaultGasPrice is the gas price returned by eth_gasPrice, 1 gwei.
+	defaultGasPrice = 1000000000
+	// txGas is the gas returned by eth_estimateGas.
+	txGas = 21000
+)
+
+// EthAPI is the eth namespace of the fake node.
+type EthAPI struct {
+	n *Node
+}
+
+// BlockNumber returns the number of the head block.
+func (api *EthAPI) BlockNumber(ctx context.Context) (hexutil.Uint64, error) {
+	if err := api.n.fault(ctx, "eth_blockNumber"); err != nil {
+		return 0, err
+	}
+	c := api.n.chain
+	lag := api.n.Lag()
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return hexutil.Uint64(c.headAt(lag).NumberU64()), nil
+}
+
+// ChainId returns the chain ID to sign the transactions.
+func (api *EthAPI) ChainId(ctx context.Context) (*hexutil.Big, error) {
+	if err := api.n.fault(ctx, "eth_chainId"); err != nil {
+		return nil, err
+	}
+	return (*hexutil.Big)(api.n.chain.ChainID()), nil
+}
+
+// Syncing returns false since the fake node is always synced.
+func (api *EthAPI) Syncing(ctx context.Context) (interface{}, error) {
+	if err := api.n.fault(ctx, "eth_syncing"); err != nil {
+		return nil, err
+	}
+	return false, nil
+}
+
+// GasPrice returns the gas price of 1 gwei.
+func (api *EthAPI) GasPrice(ctx context.Context) (*hexutil.Big, error) {
+	if err := api.n.fault(ctx, "eth_gasPrice"); err != nil {
+		return nil, err
+	}
+	return (*hexutil.Big)(big.NewInt(defaultGasPrice)), nil
+}
+
+// GetBlockByNumber returns the block of the number, or nil if not found.
+func (api *EthAPI) GetBlockByNumber(ctx context.Context, number rpc.BlockNumber, full bool) (map[string]interface{}, error) {
+	if err := api.n.fault(ctx, "eth_getBlockByNumber"); err != nil {
+		return nil, err
+	}
+	c := api.n.chain
+	lag := api.n.Lag()
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	block := c.blockByNumber(number, lag)
+	if block == nil {
+		return nil, nil
+	}
+	return marshalBlock(block, full)
+}
+
+// GetBlockByHash returns the block of the hash, or nil if not found.
+func (api *EthAPI) GetBlockByHash(ctx context.Context, hash common.Hash, full bool) (map[string]interface{}, error) {
+	if err := api.n.fault(ctx, "eth_getBlockByHash"); err != nil {
+		return nil, err
+	}
+	c := api.n.chain
+	lag := api.n.Lag()
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	block := c.blockByHash(hash, lag)
+	if block == nil {
+		return nil, nil
+	}
+	return marshalBlock(block, full)
+}
+
+// GetBlockTransactionCountByNumber returns the number of transactions in the block.
+func (api *EthAPI) GetBlockTransactionCountByNumber(ctx context.Context, number rpc.BlockNumber) (*hexutil.Uint, error) {
+	if err := api.n.fault(ctx, "eth_getBlockTransactionCountByNumber"); err != nil {
+		return nil, err
+	}
+	c := api.n.chain
+	lag := api.n.Lag()
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	block := c.blockByNumber(number, lag)
+	if block == nil {
+		return nil, nil
+	}
+	count := hexutil.Uint(len(block.Transactions()))
+	return &count, nil
+}
+
+// GetBlockTransactionCountByHash returns the number of transactions in the block.
+func (api *EthAPI) GetBlockTransactionCountByHash(ctx context.Context, hash common.Hash) (*hexutil.Uint, error) {
+	if err := api.n.fault(ctx, "eth_getBlockTransactionCountByHash"); err != nil {
+		return nil, err
+	}
+	c := api.n.chain
+	lag := api.n.Lag()
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	block := c.blockByHash(hash, lag)
+	if block == nil {
+		return nil, nil
+	}
+	count := hexutil.Uint(len(block.Transactions()))
+	return &count, nil
+}
+
+// GetUncleByBlockHashAndIndex returns nil since the fake chain has no uncles.
+func (api *EthAPI) GetUncleByBlockHashAndIndex(ctx context.Context, hash common.Hash, index hexutil.Uint) (map[string]interface{}, error) {
+	if err := api.n.fault(ctx, "eth_getUncleByBlockHashAndIndex"); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// GetTransactionByHash returns the mined or pending transaction, or nil if not found.
+func (api *EthAPI) GetTransactionByHash(ctx context.Context, hash common.Hash) (map[string]interface{}, error) {
+	if err := api.n.fault(ctx, "eth_getTransactionByHash"); err != nil {
+		return nil, err
+	}
+	c := api.n.chain
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if lookup, ok := c.txs[hash]; ok {
+		return marshalTransaction(lookup.block.Transactions()[lookup.index], lookup.block, lookup.index)
+	}
+	for _, tx := range c.pending {
+		if tx.Hash() == hash {
+			return marshalTransaction(tx, nil, 0)
+		}
+	}
+	return nil, nil
+}
+
+// GetTransactionByBlockHashAndIndex returns the transaction in the block, or nil if not
+// found.
+func (api *EthAPI) GetTransactionByBlockHashAndIndex(ctx context.Context, hash common.Hash, index hexutil.Uint) (map[string]interface{}, error) {
+	if err := api.n.fault(ctx, "eth_getTransactionByBlockHashAndIndex"); err != nil {
+		return nil, err
+	}
+	c := api.n.chain
+	lag := api.n.Lag()
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	block := c.blockByHash(hash, lag)
+	if block == nil || int(index) >= len(block.Transactions()) {
+		return nil, nil
+	}
+	return marshalTransaction(block.Transactions()[index], block, int(index))
+}
+
+// GetTransactionReceipt returns the receipt of the mined transaction, or nil if not
+// found.
+func (api *EthAPI) GetTransactionReceipt(ctx context.Context, hash common.Hash) (map[string]interface{}, error) {
+	if err := api.n.fault(ctx, "eth_getTransactionReceipt"); err != nil {
+		return nil, err
+	}
+	c := api.n.chain
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	lookup, ok := c.txs[hash]
+	if !ok {
+		return nil, nil
+	}
+	receipt := c.receipts[lookup.block.Hash()][lookup.index]
+	fields, err := marshalMap(receipt)
+	if err != nil {
+		return nil, err
+	}
+	tx := lookup.block.Transactions()[lookup.index]
+	from, _ := c.sender(tx)
+	fields["blockHash"] = lookup.block.Hash()
+	fields["blockNumber"] = (*hexutil.Big)(lookup.block.Number())
+	fields["transactionIndex"] = hexutil.Uint64(lookup.index)
+	fields["from"] = from
+	fields["to"] = tx.To()
+	return fields, nil
+}
+
+// GetBalance returns the balance of the account.
+func (api *EthAPI) GetBalance(ctx context.Context, addr common.Address, number rpc.BlockNumber) (*hexutil.Big, error) {
+	if err := api.n.fault(ctx, "eth_getBalance"); err != nil {
+		return nil, err
+	}
+	var balance *big.Int
+	err := api.n.chain.withState(addr, number, api.n.Lag(), func(a *account) {
+		balance = new(big.Int).Set(a.balance)
+	})
+	return (*hexutil.Big)(balance), err
+}
+
+// GetTransactionCount returns the nonce of the account. The pending nonce includes the
+// pending transactions.
+func (api *EthAPI) GetTransactionCount(ctx context.Context, addr common.Address, number rpc.BlockNumber) (*hexutil.Uint64, error) {
+	if err := api.n.fault(ctx, "eth_getTransactionCount"); err != nil {
+		return nil, err
+	}
+	c := api.n.chain
+	var nonce uint64
+	err := c.withState(addr, number, api.n.Lag(), func(a *account) {
+		nonce = a.nonce
+		if number != rpc.PendingBlockNumber {
+			return
+		}
+		for _, tx := range c.pending {
+			if from, _ := c.sender(tx); from == addr && tx.Nonce() >= nonce {
+				nonce = tx.Nonce() + 1
+			}
+		}
+	})
+	return (*hexutil.Uint64)(&nonce), err
+}
+
+// GetCode returns the code of the account.
+func (api *EthAPI) GetCode(ctx context.Context, addr common.Address, number rpc.BlockNumber) (hexutil.Bytes, error) {
+	if err := api.n.fault(ctx, "eth_getCode"); err != nil {
+		return nil, err
+	}
+	var code []byte
+	err := api.n.chain.withState(addr, number, api.n.Lag(), func(a *account) {
+		code = common.CopyBytes(a.code)
+	})
+	return code, err
+}
+
+// GetStorageAt returns the storage slot of the account.
+func (api *EthAPI) GetStorageAt(ctx context.Context, addr common.Address, key string, number rpc.BlockNumber) (hexutil.Bytes, error) {
+	if err := api.n.fault(ctx, "eth_getStorageAt"); err != nil {
+		return nil, err
+	}
+	var value common.Hash
+	err := api.n.chain.withState(addr, number, api.n.Lag(), func(a *account) {
+		value = a.storage[common.HexToHash(key)]
+	})
+	return value[:], err
+}
+
+// CallArgs is the arguments of eth_call and eth_estimateGas. The other fields are
+// ignored.
+type CallArgs struct {
+	To *common.Address `json:"to"`
+}
+
+// Call returns the result set by Chain.SetCallResult for the contract.
+func (api *EthAPI) Call(ctx context.Context, args CallArgs, number rpc.BlockNumber) (hexutil.Bytes, error) {
+	if err := api.n.fault(ctx, "eth_call"); err != nil {
+		return nil, err
+	}
+	var result []byte
+	if args.To == nil {
+		return result, nil
+	}
+	c := api.n.chain
+	err := c.withState(*args.To, number, api.n.Lag(), func(*account) {
+		result = common.CopyBytes(c.calls[*args.To])
+	})
+	return result, err
+}
+
+// EstimateGas returns the gas of a plain transfer.
+func (api *EthAPI) EstimateGas(ctx context.Context, args CallArgs) (hexutil.Uint64, error) {
+	if err := api.n.fault(ctx, "eth_estimateGas"); err != nil {
+		return 0, err
+	}
+	return txGas, nil
+}
+
+// SendRawTransaction adds the signed transaction to the pending transactions.
+func (api *EthAPI) SendRawTransaction(ctx context.Context, encodedTx hexutil.Bytes) (common.Hash, error) {
+	if err := api.n.fault(ctx, "eth_sendRawTransaction"); err != nil {
+		return common.Hash{}, err
+	}
+	tx := new(types.Transaction)
+	if err := rlp.DecodeBytes(encodedTx, tx); err != nil {
+		return common.Hash{}, err
+	}
+	if err := api.n.chain.SendTransaction(tx); err != nil {
+		return common.Hash{}, err
+	}
+	return tx.Hash(), nil
+}
+
+// GetLogs returns the logs of the canonical blocks matching the filter criteria.
+func (api *EthAPI) GetLogs(ctx context.Context, crit FilterCriteria) ([]*types.Log, error) {
+	if err := api.n.fault(ctx, "eth_getLogs"); err != nil {
+		return nil, err
+	}
+	c := api.n.chain
+	lag := api.n.Lag()
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var blocks []*types.Block
+	if crit.BlockHash != nil {
+		if block := c.blockByHash(*crit.BlockHash, lag); block != nil {
+			blocks = append(blocks, block)
+		}
+	} else {
+		from, to := c.headAt(lag), c.headAt(lag)
+		if crit.FromBlock != nil {
+			from = c.blockByNumber(*crit.FromBlock, lag)
+		}
+		if crit.ToBlock != nil {
+			if to = c.blockByNumber(*crit.ToBlock, lag); to == nil {
+				to = c.headAt(lag)
+			}
+		}
+		if from != nil {
+			for n := from.NumberU64(); n <= to.NumberU64(); n++ {
+				blocks = append(blocks, c.blocks[n])
+			}
+		}
+	}
+	logs := []*types.Log{}
+	for _, block := range blocks {
+		for _, l := range c.logs[block.Hash()] {
+			if crit.match(l) {
+				logs = append(logs, l)
+			}
+		}
+	}
+	return logs, nil
+}
+
+// NewHeads sends the new heads to the subscription. A node lagging behind sends the
+// stale heads.
+func (api *EthAPI) NewHeads(ctx context.Context) (*rpc.Subscription, error) {
+	if err := api.n.fault(ctx, "eth_subscribe"); err != nil {
+		return nil, err
+	}
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+	sub := notifier.CreateSubscription()
+	ch := make(chan *types.Header, 16)
+	headSub := api.n.chain.SubscribeNewHead(ch)
+	go func() {
+		defer headSub.Unsubscribe()
+		var last common.Hash
+		for {
+			select {
+			case head := <-ch:
+				if lag := api.n.Lag(); lag > 0 {
+					c := api.n.chain
+					c.lock.RLock()
+					head = c.headAt(lag).Header()
+					c.lock.RUnlock()
+				}
+				if head.Hash() != last {
+					last = head.Hash()
+					notifier.Notify(sub.ID, head)
+				}
+			case <-sub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// Logs sends the new and removed logs matching the filter criteria to the subscription.
+func (api *EthAPI) Logs(ctx context.Context, crit FilterCriteria) (*rpc.Subscription, error) {
+	if err := api.n.fault(ctx, "eth_subscribe"); err != nil {
+		return nil, err
+	}
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+	sub := notifier.CreateSubscription()
+	ch := make(chan []*types.Log, 16)
+	logsSub := api.n.chain.SubscribeLogs(ch)
+	go func() {
+		defer logsSub.Unsubscribe()
+		for {
+			select {
+			case logs := <-ch:
+				for _, l := range logs {
+					if crit.match(l) {
+						notifier.Notify(sub.ID, l)
+					}
+				}
+			case <-sub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// FilterCriteria is the arguments of eth_getLogs and the logs subscription.
+type FilterCriteria struct {
+	BlockHash *common.Hash
+	FromBlock *rpc.BlockNumber
+	ToBlock   *rpc.BlockNumber
+	Addresses []common.Address
+	Topics    [][]common.Hash
+}
+
+// UnmarshalJSON accepts both a single value and a list for the address and topics.
+func (crit *FilterCriteria) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		BlockHash *common.Hash      `json:"blockHash"`
+		FromBlock *rpc.BlockNumber  `json:"fromBlock"`
+		ToBlock   *rpc.BlockNumber  `json:"toBlock"`
+		Addresses json.RawMessage   `json:"address"`
+		Topics    []json.RawMessage `json:"topics"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	crit.BlockHash, crit.FromBlock, crit.ToBlock = raw.BlockHash, raw.FromBlock, raw.ToBlock
+	if err := unmarshalList(raw.Addresses, &crit.Addresses); err != nil {
+		return fmt.Errorf("invalid address: %v", err)
+	}
+	crit.Topics = make([][]common.Hash, len(raw.Topics))
+	for i, t := range raw.Topics {
+		if err := unmarshalList(t, &crit.Topics[i]); err != nil {
+			return fmt.Errorf("invalid topic %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// unmarshalList decodes null, a single value or a list into the list of addresses or
+// hashes.
+func unmarshalList(data json.RawMessage, list interface{}) error {
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+	if data[0] == '[' {
+		return json.Unmarshal(data, list)
+	}
+	switch l := list.(type) {
+	case *[]common.Address:
+		var addr common.Address
+		if err := json.Unmarshal(data, &addr); err != nil {
+			return err
+		}
+		*l = []common.Address{addr}
+	case *[]common.Hash:
+		var hash common.Hash
+		if err := json.Unmarshal(data, &hash); err != nil {
+			return err
+		}
+		*l = []common.Hash{hash}
+	}
+	return nil
+}
+
+// match reports whether the log matches the addresses and topics.
+func (crit FilterCriteria) match(l *types.Log) bool {
+	if len(crit.Addresses) > 0 && !containsAddress(crit.Addresses, l.Address) {
+		return false
+	}
+	if len(crit.Topics) > len(l.Topics) {
+		return false
+	}
+	for i, topics := range crit.Topics {
+		if len(topics) > 0 && !containsHash(topics, l.Topics[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsAddress(addrs []common.Address, addr common.Address) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func containsHash(hashes []common.Hash, hash common.Hash) bool {
+	for _, h := range hashes {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// NetAPI is the net namespace of the fake node.
+type NetAPI struct {
+	n *Node
+}
+
+// Version returns the network ID.
+func (api *NetAPI) Version(ctx context.Context) (string, error) {
+	if err := api.n.fault(ctx, "net_version"); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d", api.n.chain.NetworkID()), nil
+}
+
+// PeerCount returns the number of peers.
+func (api *NetAPI) PeerCount(ctx context.Context) (hexutil.Uint, error) {
+	if err := api.n.fault(ctx, "net_peerCount"); err != nil {
+		return 0, err
+	}
+	return hexutil.Uint(len(api.n.Peers())), nil
+}
+
+// Listening returns true since the fake node is always listening.
+func (api *NetAPI) Listening(ctx context.Context) (bool, error) {
+	if err := api.n.fault(ctx, "net_listening"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// AdminAPI is the admin namespace of the fake node.
+type AdminAPI struct {
+	n *Node
+}
+
+// Peers returns the peers of the node.
+func (api *AdminAPI) Peers(ctx context.Context) ([]*p2p.PeerInfo, error) {
+	if err := api.n.fault(ctx, "admin_peers"); err != nil {
+		return nil, err
+	}
+	return api.n.Peers(), nil
+}
+
+// AddPeer connects to the enode URL immediately.
+func (api *AdminAPI) AddPeer(ctx context.Context, url string) (bool, error) {
+	if err := api.n.fault(ctx, "admin_addPeer"); err != nil {
+		return false, err
+	}
+	node, err := enode.ParseV4(url)
+	if err != nil {
+		return false, fmt.Errorf("invalid enode: %v", err)
+	}
+	api.n.AddPeer(node)
+	return true, nil
+}
+
+// RemovePeer disconnects from the enode URL immediately.
+func (api *AdminAPI) RemovePeer(ctx context.Context, url string) (bool, error) {
+	if err := api.n.fault(ctx, "admin_removePeer"); err != nil {
+		return false, err
+	}
+	node, err := enode.ParseV4(url)
+	if err != nil {
+		return false, fmt.Errorf("invalid enode: %v", err)
+	}
+	api.n.RemovePeer(node.ID())
+	return true, nil
+}
+
+// NodeInfo returns the node information with the eth protocol status.
+func (api *AdminAPI) NodeInfo(ctx context.Context) (*p2p.NodeInfo, error) {
+	if err := api.n.fault(ctx, "admin_nodeInfo"); err != nil {
+		return nil, err
+	}
+	return api.n.NodeInfo(), nil
+}
+
+// TxPoolAPI is the txpool namespace of the fake node.
+type TxPoolAPI struct {
+	n *Node
+}
+
+// Status returns the number of pending transactions. The fake node has no queued
+// transactions.
+func (api *TxPoolAPI) Status(ctx context.Context) (map[string]hexutil.Uint, error) {
+	if err := api.n.fault(ctx, "txpool_status"); err != nil {
+		return nil, err
+	}
+	return map[string]hexutil.Uint{
+		"pending": hexutil.Uint(len(api.n.chain.Pending())),
+		"queued":  0,
+	}, nil
+}
+
+// DebugAPI is the debug namespace of the fake node.
+type DebugAPI struct {
+	n *Node
+}
+
+// Metrics returns the metrics set by Node.SetMetrics.
+func (api *DebugAPI) Metrics(ctx context.Context, raw bool) (map[string]interface{}, error) {
+	if err := api.n.fault(ctx, "debug_metrics"); err != nil {
+		return nil, err
+	}
+	return api.n.Metrics(), nil
+}
+
+// ExecutionResult is the result of debug_traceTransaction.
+type ExecutionResult struct {
+	Gas         uint64        `json:"gas"`
+	Failed      bool          `json:"failed"`
+	ReturnValue string        `json:"returnValue"`
+	StructLogs  []interface{} `json:"structLogs"`
+}
+
+// TraceTransaction returns an empty trace of the mined transaction.
+func (api *DebugAPI) TraceTransaction(ctx context.Context, hash common.Hash, config *map[string]interface{}) (*ExecutionResult, error) {
+	if err := api.n.fault(ctx, "debug_traceTransaction"); err != nil {
+		return nil, err
+	}
+	c := api.n.chain
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	lookup, ok := c.txs[hash]
+	if !ok {
+		return nil, fmt.Errorf("transaction %x not found", hash)
+	}
+	return &ExecutionResult{
+		Gas:        c.receipts[lookup.block.Hash()][lookup.index].GasUsed,
+		StructLogs: []interface{}{},
+	}, nil
+}
+
+// IstanbulAPI is the istanbul namespace of the fake node.
+type IstanbulAPI struct {
+	n *Node
+}
+
+// GetValidators returns the validators set by Chain.SetValidators.
+func (api *IstanbulAPI) GetValidators(ctx context.Context, number *rpc.BlockNumber) ([]common.Address, error) {
+	if err := api.n.fault(ctx, "istanbul_getValidators"); err != nil {
+		return nil, err
+	}
+	c := api.n.chain
+	lag := api.n.Lag()
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if number != nil && c.blockByNumber(*number, lag) == nil {
+		return nil, fmt.Errorf("unknown block %d", *number)
+	}
+	return append([]common.Address{}, c.validators...), nil
+}
+
+// Propose records the proposal to add or remove the validator.
+func (api *IstanbulAPI) Propose(ctx context.Context, addr common.Address, auth bool) error {
+	if err := api.n.fault(ctx, "istanbul_propose"); err != nil {
+		return err
+	}
+	api.n.propose(addr, auth)
+	return nil
+}
+
+// MinerAPI is the miner namespace of the fake node.
+type MinerAPI struct {
+	n *Node
+}
+
+// Start starts mining. The blocks are still mined by Chain.AddBlock.
+func (api *MinerAPI) Start(ctx context.Context, threads *int) error {
+	if err := api.n.fault(ctx, "miner_start"); err != nil {
+		return err
+	}
+	api.n.setMining(true)
+	return nil
+}
+
+// Stop stops mining.
+func (api *MinerAPI) Stop(ctx context.Context) (bool, error) {
+	if err := api.n.fault(ctx, "miner_stop"); err != nil {
+		return false, err
+	}
+	api.n.setMining(false)
+	return true, nil
+}
+
+// withState runs fn with the account at the block of the number.
+func (c *Chain) withState(addr common.Address, number rpc.BlockNumber, lag uint64, fn func(*account)) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	block := c.blockByNumber(number, lag)
+	if block == nil {
+		return fmt.Errorf("unknown block %d", number)
+	}
+	a, err := c.state(addr, block)
+	if err != nil {
+		return err
+	}
+	fn(a)
+	return nil
+}
+
+// marshalMap converts the value to the JSON fields.
+func marshalMap(v interface{}) (map[string]interface{}, error) {
+	enc, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(enc, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// marshalBlock converts the block to the JSON fields of eth_getBlockByNumber.
+func marshalBlock(block *types.Block, full bool) (map[string]interface{}, error) {
+	fields, err := marshalMap(block.Header())
+	if err != nil {
+		return nil, err
+	}
+	fields["size"] = hexutil.Uint64(block.Size())
+	fields["totalDifficulty"] = (*hexutil.Big)(new(big.Int).Add(block.Number(), big.NewInt(1)))
+	fields["uncles"] = []common.Hash{}
+
+	txs := make([]interface{}, len(block.Transactions()))
+	for i, tx := range block.Transactions() {
+		if !full {
+			txs[i] = tx.Hash()
+			continue
+		}
+		if txs[i], err = marshalTransaction(tx, block, i); err != nil {
+			return nil, err
+		}
+	}
+	fields["transactions"] = txs
+	return fields, nil
+}
+
+// marshalTransaction converts the transaction to the JSON fields of
+// eth_getTransactionByHash. The block is nil for the pending transaction.
+func marshalTransaction(tx *types.Transaction, block *types.Block, index int) (map[string]interface{}, error) {
+	fields, err := marshalMap(tx)
+	if err != nil {
+		return nil, err
+	}
+	var from common.Address
+	if tx.Protected() {
+		from, _ = types.Sender(types.NewEIP155Signer(tx.ChainId()), tx)
+	} else {
+		from, _ = types.Sender(types.HomesteadSigner{}, tx)
+	}
+	fields["from"] = from
+	// geth 1.8 returns the zero hash as the block hash of pending transactions
+	fields["blockHash"] = common.Hash{}
+	fields["blockNumber"] = nil
+	fields["transactionIndex"] = nil
+	if block != nil {
+		fields["blockHash"] = block.Hash()
+		fields["blockNumber"] = (*hexutil.Big)(block.Number())
+		fields["transactionIndex"] = hexutil.Uint64(index)
+	}
+	return fields, nil
+}
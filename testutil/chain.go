@@ -0,0 +1,516 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package testutil
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	defaultNetworkID = 1
+	defaultGasLimit  = 8000000
+)
+
+var (
+	// ErrNonceTooLow is returned if the nonce of a transaction is lower than the one
+	// present in the state.
+	ErrNonceTooLow = errors.New("nonce too low")
+	// ErrKnownTransaction is returned if the transaction is already pending or mined.
+	ErrKnownTransaction = errors.New("known transaction")
+)
+
+// ChainConfig is the options of a fake chain.
+type ChainConfig struct {
+	// NetworkID is the network ID returned by net_version. Set to 0 means 1.
+	NetworkID uint64
+	// ChainID is the chain ID to recover the senders of EIP155 transactions. Set to
+	// nil means the network ID.
+	ChainID *big.Int
+	// Validators are the validators returned by istanbul_getValidators.
+	Validators []common.Address
+	// Alloc is the balances of the accounts in the genesis state.
+	Alloc map[common.Address]*big.Int
+}
+
+// account is an account in the state. The state is not versioned, all blocks share
+// the latest state.
+type account struct {
+	balance *big.Int
+	nonce   uint64
+	code    []byte
+	storage map[common.Hash]common.Hash
+}
+
+// txLookup is the location of a mined transaction.
+type txLookup struct {
+	block *types.Block
+	index int
+}
+
+// Chain is a scriptable chain served by fake nodes. The blocks are mined on demand by
+// AddBlock, and the reorgs are made by Reorg. A chain can be shared by multiple nodes
+// to simulate the endpoints of the same network.
+type Chain struct {
+	networkID uint64
+	chainID   *big.Int
+	signer    types.Signer
+
+	// blocks are the canonical blocks indexed by number
+	blocks   []*types.Block
+	byHash   map[common.Hash]*types.Block
+	receipts map[common.Hash]types.Receipts
+	// logs are the logs of the blocks, including the logs not emitted by transactions
+	logs    map[common.Hash][]*types.Log
+	txs     map[common.Hash]txLookup
+	pending []*types.Transaction
+	// forks is the number of reorgs to make the forked blocks different
+	forks uint64
+
+	accounts   map[common.Address]*account
+	calls      map[common.Address][]byte
+	validators []common.Address
+	// retention is the number of recent blocks whose state is served, 0 means all
+	retention uint64
+
+	headFeed event.Feed
+	logsFeed event.Feed
+	lock     sync.RWMutex
+}
+
+// NewChain creates a chain with the genesis block.
+func NewChain(config ChainConfig) *Chain {
+	networkID := config.NetworkID
+	if networkID == 0 {
+		networkID = defaultNetworkID
+	}
+	chainID := config.ChainID
+	if chainID == nil {
+		chainID = new(big.Int).SetUint64(networkID)
+	}
+	c := &Chain{
+		networkID:  networkID,
+		chainID:    chainID,
+		signer:     types.NewEIP155Signer(chainID),
+		byHash:     make(map[common.Hash]*types.Block),
+		receipts:   make(map[common.Hash]types.Receipts),
+		logs:       make(map[common.Hash][]*types.Log),
+		txs:        make(map[common.Hash]txLookup),
+		accounts:   make(map[common.Address]*account),
+		calls:      make(map[common.Address][]byte),
+		validators: config.Validators,
+	}
+	for addr, balance := range config.Alloc {
+		c.account(addr).balance = new(big.Int).Set(balance)
+	}
+	genesis := types.NewBlock(&types.Header{
+		Number:     big.NewInt(0),
+		Difficulty: big.NewInt(1),
+		GasLimit:   defaultGasLimit,
+		Time:       big.NewInt(time.Now().Unix()),
+	}, nil, nil, nil)
+	c.insert(genesis, nil, nil)
+	return c
+}
+
+// NetworkID returns the network ID of the chain.
+func (c *Chain) NetworkID() uint64 {
+	return c.networkID
+}
+
+// ChainID returns the chain ID of the chain.
+func (c *Chain) ChainID() *big.Int {
+	return new(big.Int).Set(c.chainID)
+}
+
+// Genesis returns the genesis block.
+func (c *Chain) Genesis() *types.Block {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.blocks[0]
+}
+
+// Head returns the head block.
+func (c *Chain) Head() *types.Block {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.head()
+}
+
+func (c *Chain) head() *types.Block {
+	return c.blocks[len(c.blocks)-1]
+}
+
+// BlockByNumber returns the canonical block of the number, or nil if not found.
+func (c *Chain) BlockByNumber(number uint64) *types.Block {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if number >= uint64(len(c.blocks)) {
+		return nil
+	}
+	return c.blocks[number]
+}
+
+// BlockByHash returns the block of the hash, including the blocks removed by reorgs,
+// or nil if not found.
+func (c *Chain) BlockByHash(hash common.Hash) *types.Block {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.byHash[hash]
+}
+
+// AddBlock mines a block with the pending transactions and the given logs on the head.
+// The logs are filled with the block number and hash.
+func (c *Chain) AddBlock(logs ...types.Log) *types.Block {
+	c.lock.Lock()
+	block, blockLogs := c.mine(logs)
+	c.lock.Unlock()
+
+	c.notify(block, blockLogs)
+	return block
+}
+
+// AddBlocks mines n empty blocks on the head.
+func (c *Chain) AddBlocks(n int) []*types.Block {
+	blocks := make([]*types.Block, n)
+	for i := range blocks {
+		blocks[i] = c.AddBlock()
+	}
+	return blocks
+}
+
+// Reorg removes the recent depth blocks and mines n blocks on the new head. The
+// transactions of the removed blocks are pending again, and the removed logs are sent
+// to the log subscriptions with the Removed flag.
+func (c *Chain) Reorg(depth, n int) ([]*types.Block, error) {
+	c.lock.Lock()
+	if depth >= len(c.blocks) {
+		c.lock.Unlock()
+		return nil, fmt.Errorf("reorg depth %d exceeds chain length %d", depth, len(c.blocks))
+	}
+	var removed []*types.Log
+	var txs []*types.Transaction
+	for _, b := range c.blocks[len(c.blocks)-depth:] {
+		for _, l := range c.logs[b.Hash()] {
+			cpy := *l
+			cpy.Removed = true
+			removed = append(removed, &cpy)
+		}
+		for _, tx := range b.Transactions() {
+			delete(c.txs, tx.Hash())
+			c.undo(tx)
+			txs = append(txs, tx)
+		}
+	}
+	c.blocks = c.blocks[:len(c.blocks)-depth]
+	c.pending = append(txs, c.pending...)
+	c.forks++
+	c.lock.Unlock()
+
+	if len(removed) > 0 {
+		c.logsFeed.Send(removed)
+	}
+	blocks := make([]*types.Block, n)
+	for i := range blocks {
+		blocks[i] = c.AddBlock()
+	}
+	return blocks, nil
+}
+
+// SendTransaction adds the signed transaction to the pending transactions, which are
+// mined in the next block.
+func (c *Chain) SendTransaction(tx *types.Transaction) error {
+	from, err := c.sender(tx)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.txs[tx.Hash()]; ok {
+		return ErrKnownTransaction
+	}
+	for _, p := range c.pending {
+		if p.Hash() == tx.Hash() {
+			return ErrKnownTransaction
+		}
+	}
+	if tx.Nonce() < c.account(from).nonce {
+		return ErrNonceTooLow
+	}
+	c.pending = append(c.pending, tx)
+	return nil
+}
+
+// Pending returns the pending transactions.
+func (c *Chain) Pending() []*types.Transaction {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return append([]*types.Transaction{}, c.pending...)
+}
+
+// SetBalance sets the balance of the account.
+func (c *Chain) SetBalance(addr common.Address, balance *big.Int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.account(addr).balance = new(big.Int).Set(balance)
+}
+
+// SetCode sets the code of the account.
+func (c *Chain) SetCode(addr common.Address, code []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.account(addr).code = common.CopyBytes(code)
+}
+
+// SetStorage sets the storage slot of the account.
+func (c *Chain) SetStorage(addr common.Address, key, value common.Hash) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.account(addr).storage[key] = value
+}
+
+// SetCallResult sets the result of eth_call to the contract. The result is the same
+// for all inputs.
+func (c *Chain) SetCallResult(addr common.Address, result []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.calls[addr] = common.CopyBytes(result)
+}
+
+// SetValidators sets the validators returned by istanbul_getValidators.
+func (c *Chain) SetValidators(validators []common.Address) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.validators = append([]common.Address{}, validators...)
+}
+
+// SetStateRetention sets the number of recent blocks whose state is served like a
+// pruned node. The state queries of older blocks fail with the missing trie node error.
+// Set to 0 means an archive node.
+func (c *Chain) SetStateRetention(blocks uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.retention = blocks
+}
+
+// SubscribeNewHead subscribes to the new heads.
+func (c *Chain) SubscribeNewHead(ch chan<- *types.Header) event.Subscription {
+	return c.headFeed.Subscribe(ch)
+}
+
+// SubscribeLogs subscribes to the logs of the new blocks and the removed logs.
+func (c *Chain) SubscribeLogs(ch chan<- []*types.Log) event.Subscription {
+	return c.logsFeed.Subscribe(ch)
+}
+
+// mine mines a block on the head. It must be called with the write lock.
+func (c *Chain) mine(extraLogs []types.Log) (*types.Block, []*types.Log) {
+	parent := c.head()
+	header := &types.Header{
+		ParentHash: parent.Hash(),
+		Number:     new(big.Int).Add(parent.Number(), big.NewInt(1)),
+		Difficulty: big.NewInt(1),
+		GasLimit:   defaultGasLimit,
+		Time:       new(big.Int).Add(parent.Time(), big.NewInt(1)),
+		// Make the blocks of different forks different
+		Extra: new(big.Int).SetUint64(c.forks).Bytes(),
+	}
+
+	var txs []*types.Transaction
+	var receipts types.Receipts
+	var gasUsed uint64
+	for _, tx := range c.pending {
+		if header.GasLimit-gasUsed < tx.Gas() {
+			break
+		}
+		if err := c.apply(tx); err != nil {
+			continue
+		}
+		gasUsed += tx.Gas()
+		txs = append(txs, tx)
+		receipts = append(receipts, &types.Receipt{
+			Status:            types.ReceiptStatusSuccessful,
+			CumulativeGasUsed: gasUsed,
+			TxHash:            tx.Hash(),
+			GasUsed:           tx.Gas(),
+			Logs:              []*types.Log{},
+		})
+	}
+	c.pending = c.pending[len(txs):]
+	header.GasUsed = gasUsed
+
+	var logs []*types.Log
+	for i := range extraLogs {
+		l := extraLogs[i]
+		logs = append(logs, &l)
+	}
+	block := types.NewBlock(header, txs, nil, nil)
+	h := block.Header()
+	if len(receipts) > 0 {
+		h.ReceiptHash = types.DeriveSha(receipts)
+	}
+	h.Bloom = types.BytesToBloom(types.LogsBloom(logs).Bytes())
+	block = block.WithSeal(h)
+	for i, l := range logs {
+		l.BlockNumber = block.NumberU64()
+		l.BlockHash = block.Hash()
+		l.Index = uint(i)
+	}
+	c.insert(block, receipts, logs)
+	return block, logs
+}
+
+// insert appends the block to the canonical chain. It must be called with the write
+// lock.
+func (c *Chain) insert(block *types.Block, receipts types.Receipts, logs []*types.Log) {
+	c.blocks = append(c.blocks, block)
+	c.byHash[block.Hash()] = block
+	c.receipts[block.Hash()] = receipts
+	c.logs[block.Hash()] = logs
+	for i, tx := range block.Transactions() {
+		c.txs[tx.Hash()] = txLookup{block: block, index: i}
+	}
+}
+
+func (c *Chain) notify(block *types.Block, logs []*types.Log) {
+	c.headFeed.Send(block.Header())
+	if len(logs) > 0 {
+		c.logsFeed.Send(logs)
+	}
+}
+
+// apply transfers the value of the transaction and increases the nonce of the sender.
+func (c *Chain) apply(tx *types.Transaction) error {
+	from, err := c.sender(tx)
+	if err != nil {
+		return err
+	}
+	sender := c.account(from)
+	if tx.Nonce() != sender.nonce {
+		return ErrNonceTooLow
+	}
+	sender.nonce++
+	sender.balance.Sub(sender.balance, tx.Value())
+	if tx.To() != nil {
+		to := c.account(*tx.To())
+		to.balance.Add(to.balance, tx.Value())
+	}
+	return nil
+}
+
+// undo reverts the transaction applied by apply.
+func (c *Chain) undo(tx *types.Transaction) {
+	from, err := c.sender(tx)
+	if err != nil {
+		return
+	}
+	sender := c.account(from)
+	sender.nonce--
+	sender.balance.Add(sender.balance, tx.Value())
+	if tx.To() != nil {
+		to := c.account(*tx.To())
+		to.balance.Sub(to.balance, tx.Value())
+	}
+}
+
+func (c *Chain) sender(tx *types.Transaction) (common.Address, error) {
+	if tx.Protected() {
+		return types.Sender(c.signer, tx)
+	}
+	return types.Sender(types.HomesteadSigner{}, tx)
+}
+
+// headAt returns the head seen by a node lagging the given number of blocks behind. It
+// must be called with the lock.
+func (c *Chain) headAt(lag uint64) *types.Block {
+	if lag >= uint64(len(c.blocks)) {
+		return c.blocks[0]
+	}
+	return c.blocks[uint64(len(c.blocks))-1-lag]
+}
+
+// blockByNumber resolves the block number of the JSON-RPC requests to a node lagging
+// behind. The pending block is the head. It must be called with the lock.
+func (c *Chain) blockByNumber(number rpc.BlockNumber, lag uint64) *types.Block {
+	head := c.headAt(lag)
+	if number < 0 {
+		return head
+	}
+	if uint64(number) > head.NumberU64() {
+		return nil
+	}
+	return c.blocks[number]
+}
+
+// blockByHash returns the block of the hash known by a node lagging behind. It must be
+// called with the lock.
+func (c *Chain) blockByHash(hash common.Hash, lag uint64) *types.Block {
+	block := c.byHash[hash]
+	if block == nil || block.NumberU64() > c.headAt(lag).NumberU64() {
+		return nil
+	}
+	return block
+}
+
+// state returns the account of the address at the block. It returns the missing trie
+// node error if the state of the block is pruned. It must be called with the lock.
+func (c *Chain) state(addr common.Address, block *types.Block) (*account, error) {
+	number := block.NumberU64()
+	if c.retention != 0 && number != 0 && number+c.retention <= c.head().NumberU64() {
+		return nil, fmt.Errorf("missing trie node %x (path )", block.Root())
+	}
+	a, ok := c.accounts[addr]
+	if !ok {
+		return &account{balance: new(big.Int)}, nil
+	}
+	return a, nil
+}
+
+// account returns the account of the address, and creates it if not found. It must be
+// called with the write lock.
+func (c *Chain) account(addr common.Address) *account {
+	a, ok := c.accounts[addr]
+	if !ok {
+		a = &account{
+			balance: new(big.Int),
+			storage: make(map[common.Hash]common.Hash),
+		}
+		c.accounts[addr] = a
+	}
+	return a
+}
@@ -0,0 +1,203 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package testutil
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// maxRequestSize is the maximum size of HTTP requests.
+	maxRequestSize = 5 * 1024 * 1024
+	// corruptResult replaces the results of the corrupt responses, which has the wrong
+	// type for most methods.
+	corruptResult = `"0xcorrupt"`
+	// notificationMethod is the method of the subscription notifications.
+	notificationMethod = "eth_subscription"
+)
+
+// jsonMessage is the fields of the JSON-RPC messages to corrupt.
+type jsonMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+}
+
+// codec corrupts the responses of the requests matching the Corrupt faults of the node.
+type codec struct {
+	n *Node
+	// corrupts are the IDs of the requests whose responses are corrupt
+	corrupts map[string]bool
+	lock     sync.Mutex
+}
+
+// newCodec creates a server codec of the connection with the given encode and decode
+// functions.
+func (n *Node) newCodec(rwc io.ReadWriteCloser, encode, decode func(v interface{}) error) rpc.ServerCodec {
+	c := &codec{
+		n:        n,
+		corrupts: make(map[string]bool),
+	}
+	return rpc.NewCodec(rwc, func(v interface{}) error {
+		msg, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return encode(json.RawMessage(c.corrupt(msg)))
+	}, func(v interface{}) error {
+		var msg json.RawMessage
+		if err := decode(&msg); err != nil {
+			return err
+		}
+		c.inspect(msg)
+		return json.Unmarshal(msg, v)
+	})
+}
+
+// inspect records the IDs of the requests to corrupt.
+func (c *codec) inspect(msg json.RawMessage) {
+	var reqs []jsonMessage
+	if len(msg) > 0 && msg[0] == '[' {
+		json.Unmarshal(msg, &reqs)
+	} else {
+		var req jsonMessage
+		json.Unmarshal(msg, &req)
+		reqs = append(reqs, req)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, req := range reqs {
+		if req.Method != "" && c.n.corrupt(req.Method) {
+			c.corrupts[string(req.ID)] = true
+		}
+	}
+}
+
+// corrupt replaces the results of the responses to corrupt and the notifications
+// matching the Corrupt faults of "eth_subscription".
+func (c *codec) corrupt(msg []byte) []byte {
+	var batch []map[string]json.RawMessage
+	if len(msg) > 0 && msg[0] == '[' {
+		if err := json.Unmarshal(msg, &batch); err != nil {
+			return msg
+		}
+	} else {
+		var single map[string]json.RawMessage
+		if err := json.Unmarshal(msg, &single); err != nil {
+			return msg
+		}
+		batch = append(batch, single)
+	}
+
+	changed := false
+	for _, m := range batch {
+		if c.corruptMessage(m) {
+			changed = true
+		}
+	}
+	if !changed {
+		return msg
+	}
+	var out []byte
+	if len(msg) > 0 && msg[0] == '[' {
+		out, _ = json.Marshal(batch)
+	} else {
+		out, _ = json.Marshal(batch[0])
+	}
+	return out
+}
+
+// corruptMessage replaces the result of the message if it's a response to corrupt or
+// a notification to corrupt.
+func (c *codec) corruptMessage(m map[string]json.RawMessage) bool {
+	if method, ok := m["method"]; ok {
+		if string(method) != `"`+notificationMethod+`"` || !c.n.corrupt(notificationMethod) {
+			return false
+		}
+		var params map[string]json.RawMessage
+		if err := json.Unmarshal(m["params"], &params); err != nil {
+			return false
+		}
+		params["result"] = json.RawMessage(corruptResult)
+		m["params"], _ = json.Marshal(params)
+		return true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	id := string(m["id"])
+	if !c.corrupts[id] {
+		return false
+	}
+	delete(c.corrupts, id)
+	if _, ok := m["result"]; !ok {
+		return false
+	}
+	m["result"] = json.RawMessage(corruptResult)
+	return true
+}
+
+// httpReadWriteNopCloser wraps an io.Reader and io.Writer with a NOP Close method.
+type httpReadWriteNopCloser struct {
+	io.Reader
+	io.Writer
+}
+
+// Close does nothing and returns always nil.
+func (t *httpReadWriteNopCloser) Close() error {
+	return nil
+}
+
+// serveHTTP serves a single JSON-RPC request or batch over HTTP.
+func (n *Node) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body := io.LimitReader(r.Body, maxRequestSize)
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	codec := n.newCodec(&httpReadWriteNopCloser{body, w}, json.NewEncoder(w).Encode, dec.Decode)
+	defer codec.Close()
+
+	w.Header().Set("content-type", "application/json")
+	n.server.ServeSingleRequest(r.Context(), codec, rpc.OptionMethodInvocation)
+}
+
+// websocketHandler serves the JSON-RPC requests and subscriptions over websocket from
+// any origin.
+func (n *Node) websocketHandler() http.Handler {
+	return websocket.Server{
+		Handler: func(conn *websocket.Conn) {
+			encode := func(v interface{}) error {
+				return websocket.JSON.Send(conn, v)
+			}
+			decode := func(v interface{}) error {
+				return websocket.JSON.Receive(conn, v)
+			}
+			n.server.ServeCodec(n.newCodec(conn, encode, decode), rpc.OptionMethodInvocation|rpc.OptionSubscriptions)
+		},
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package harness
+
+import (
+	"context"
+
+	"github.com/getamis/hypereth/multiclient"
+)
+
+// discoverer discovers the endpoints added and removed by the harness, like the churn of
+// k8s endpoints.
+type discoverer struct {
+	urls    []string
+	updates chan multiclient.Update
+}
+
+func newDiscoverer(urls []string) *discoverer {
+	return &discoverer{
+		urls:    urls,
+		updates: make(chan multiclient.Update, 16),
+	}
+}
+
+func (d *discoverer) Name() string {
+	return "harness"
+}
+
+func (d *discoverer) Discover(ctx context.Context, ch chan<- multiclient.Update) error {
+	u := multiclient.Update{Full: true}
+	for _, url := range d.urls {
+		u.Endpoints = append(u.Endpoints, multiclient.Endpoint{URL: url})
+	}
+	for {
+		select {
+		case ch <- u:
+		case <-ctx.Done():
+			return nil
+		}
+		select {
+		case u = <-d.updates:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (d *discoverer) add(url string) {
+	d.updates <- multiclient.Update{Endpoints: []multiclient.Endpoint{{URL: url}}}
+}
+
+func (d *discoverer) remove(url string) {
+	d.updates <- multiclient.Update{Removed: []string{url}}
+}
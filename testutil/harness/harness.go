@@ -0,0 +1,404 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package harness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/getamis/hypereth/multiclient"
+	"github.com/getamis/hypereth/testutil"
+)
+
+const (
+	defaultEndpoints = 3
+	defaultScheme    = "ws"
+	// leakTimeout is the maximum duration to wait for the goroutines to return after
+	// Close.
+	leakTimeout = 5 * time.Second
+	// watchTimeout is the maximum duration to wait for the head subscriptions of all
+	// endpoints, and watchMinePeriod is the period to mine blocks meanwhile.
+	watchTimeout    = 10 * time.Second
+	watchMinePeriod = 50 * time.Millisecond
+)
+
+// ErrInjected is the error returned by the failed requests.
+var ErrInjected = errors.New("injected failure")
+
+// Config is the options of a harness.
+type Config struct {
+	// Endpoints is the number of fake endpoints. Set to 0 means 3.
+	Endpoints int
+	// Scheme is the scheme of the endpoints, "ws" or "http". Set to empty means "ws".
+	Scheme string
+	// Chain is the options of the chain served by all endpoints.
+	Chain testutil.ChainConfig
+	// Options are the extra options of the multiclient, e.g. the retry config. The
+	// endpoints are discovered by the harness.
+	Options []multiclient.Option
+}
+
+// Harness runs fake endpoints of the same chain behind a multiclient, scripts their
+// failures and checks the invariants of the multiclient. The goroutine leak check
+// counts all goroutines, so the tests using harnesses must not run in parallel.
+type Harness struct {
+	Chain  *testutil.Chain
+	Nodes  []*testutil.Node
+	Client *multiclient.Client
+
+	scheme     string
+	discoverer *discoverer
+	heads      *headRecorder
+	// goroutines is the number of goroutines before the harness starts
+	goroutines int
+	closeOnce  sync.Once
+}
+
+// New starts the fake endpoints and the multiclient discovering them.
+func New(ctx context.Context, config Config) (*Harness, error) {
+	h := &Harness{
+		Chain:      testutil.NewChain(config.Chain),
+		scheme:     config.Scheme,
+		goroutines: runtime.NumGoroutine(),
+	}
+	if h.scheme == "" {
+		h.scheme = defaultScheme
+	}
+	endpoints := config.Endpoints
+	if endpoints == 0 {
+		endpoints = defaultEndpoints
+	}
+
+	var urls []string
+	for i := 0; i < endpoints; i++ {
+		n, err := h.newNode()
+		if err != nil {
+			h.closeNodes()
+			return nil, err
+		}
+		urls = append(urls, h.url(n))
+	}
+	h.discoverer = newDiscoverer(urls)
+
+	opts := append([]multiclient.Option{multiclient.WithDiscoverer(h.discoverer)}, config.Options...)
+	client, err := multiclient.New(ctx, opts...)
+	if err != nil {
+		h.closeNodes()
+		return nil, err
+	}
+	h.Client = client
+	return h, nil
+}
+
+// URL returns the url of the i-th endpoint.
+func (h *Harness) URL(i int) string {
+	return h.url(h.Nodes[i])
+}
+
+// Mine mines n blocks on the chain.
+func (h *Harness) Mine(n int) {
+	h.Chain.AddBlocks(n)
+}
+
+// Down stops the i-th endpoint. The connections are refused until Up.
+func (h *Harness) Down(i int) {
+	h.Nodes[i].Stop()
+}
+
+// Up restarts the i-th endpoint on the same port.
+func (h *Harness) Up(i int) error {
+	return h.Nodes[i].Start()
+}
+
+// Slow delays all responses of the i-th endpoint.
+func (h *Harness) Slow(i int, latency time.Duration) {
+	h.Nodes[i].SetFault("*", testutil.Fault{Latency: latency})
+}
+
+// Fail fails the next count requests of the methods matching the pattern on the i-th
+// endpoint with ErrInjected. Set count to 0 means until Heal.
+func (h *Harness) Fail(i int, pattern string, count int) {
+	h.Nodes[i].SetFault(pattern, testutil.Fault{Err: ErrInjected, Count: count})
+}
+
+// Corrupt corrupts the results of the next count responses of the methods matching the
+// pattern on the i-th endpoint. Set count to 0 means until Heal.
+func (h *Harness) Corrupt(i int, pattern string, count int) {
+	h.Nodes[i].SetFault(pattern, testutil.Fault{Corrupt: true, Count: count})
+}
+
+// Stale makes the i-th endpoint lag the given number of blocks behind the chain.
+func (h *Harness) Stale(i int, lag uint64) {
+	h.Nodes[i].SetLag(lag)
+}
+
+// DropSubscriptions closes the connections of the i-th endpoint, which drops its
+// subscriptions and in-flight requests.
+func (h *Harness) DropSubscriptions(i int) {
+	h.Nodes[i].DropConnections()
+}
+
+// Heal clears the faults and the lag of the i-th endpoint, and restarts it if it's down.
+func (h *Harness) Heal(i int) error {
+	h.Nodes[i].ClearFaults()
+	h.Nodes[i].SetLag(0)
+	return h.Nodes[i].Start()
+}
+
+// RemoveEndpoint removes the i-th endpoint from the discovered endpoints like a pod
+// removed from the k8s endpoints. The endpoint keeps running.
+func (h *Harness) RemoveEndpoint(i int) {
+	h.discoverer.remove(h.URL(i))
+}
+
+// AddEndpoint adds the i-th endpoint back to the discovered endpoints.
+func (h *Harness) AddEndpoint(i int) {
+	h.discoverer.add(h.URL(i))
+}
+
+// AddNode starts a new endpoint and adds it to the discovered endpoints like a new pod.
+// It returns the index of the endpoint.
+func (h *Harness) AddNode() (int, error) {
+	n, err := h.newNode()
+	if err != nil {
+		return 0, err
+	}
+	h.discoverer.add(h.url(n))
+	return len(h.Nodes) - 1, nil
+}
+
+// WatchHeads subscribes to the new heads of the multiclient to check the lost heads.
+// The subscriptions of the endpoints are established in background, so it mines blocks
+// until a head is received from every dialed endpoint. The heads mined before it returns
+// are not checked.
+func (h *Harness) WatchHeads(ctx context.Context) error {
+	if h.heads != nil {
+		return nil
+	}
+	r, err := newHeadRecorder(ctx, h.Client, h.Chain.Head().NumberU64())
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(watchMinePeriod)
+	defer ticker.Stop()
+	timeout := time.NewTimer(watchTimeout)
+	defer timeout.Stop()
+	for {
+		pending := r.pending(h.Client.ClientMap().Map())
+		if len(pending) == 0 {
+			r.from = h.Chain.Head().NumberU64()
+			h.heads = r
+			return nil
+		}
+		h.Chain.AddBlock()
+		select {
+		case <-ticker.C:
+		case <-timeout.C:
+			r.stop()
+			return fmt.Errorf("no head received from %v", pending)
+		case <-ctx.Done():
+			r.stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// CheckNoLostHeads waits until every canonical block mined since WatchHeads is received
+// from at least one endpoint. It returns the error of the lost heads after the timeout.
+func (h *Harness) CheckNoLostHeads(timeout time.Duration) error {
+	if h.heads == nil {
+		return errors.New("heads are not watched")
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		lost := h.lostHeads()
+		if len(lost) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("lost heads %v", lost)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// lostHeads returns the numbers of the canonical blocks not received.
+func (h *Harness) lostHeads() []uint64 {
+	var lost []uint64
+	head := h.Chain.Head().NumberU64()
+	for n := h.heads.from + 1; n <= head; n++ {
+		if !h.heads.received(h.Chain.BlockByNumber(n).Hash()) {
+			lost = append(lost, n)
+		}
+	}
+	return lost
+}
+
+// CheckSuccessWithin calls fn once and checks it succeeds within the budget, e.g. a
+// request retried by the multiclient on the failed endpoints.
+func (h *Harness) CheckSuccessWithin(ctx context.Context, budget time.Duration, fn func(ctx context.Context, client *multiclient.Client) error) error {
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+
+	start := time.Now()
+	err := fn(ctx, h.Client)
+	if elapsed := time.Since(start); elapsed > budget {
+		return fmt.Errorf("succeeded after %v, budget %v", elapsed, budget)
+	}
+	if err != nil {
+		return fmt.Errorf("failed within budget %v: %v", budget, err)
+	}
+	return nil
+}
+
+// Close closes the multiclient and the endpoints, and checks the goroutines started
+// since New have returned. It returns the error with the stacks of the leaked goroutines.
+func (h *Harness) Close() error {
+	h.closeOnce.Do(func() {
+		if h.heads != nil {
+			h.heads.stop()
+		}
+		h.Client.Close()
+		h.closeNodes()
+	})
+	return h.checkGoroutines()
+}
+
+func (h *Harness) checkGoroutines() error {
+	deadline := time.Now().Add(leakTimeout)
+	for {
+		// The idle connections of the rpc clients keep their goroutines
+		if t, ok := http.DefaultTransport.(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
+		n := runtime.NumGoroutine()
+		if n <= h.goroutines {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			return fmt.Errorf("%d goroutines leaked:\n%s", n-h.goroutines, buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (h *Harness) newNode() (*testutil.Node, error) {
+	n, err := testutil.NewNode(h.Chain)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.Start(); err != nil {
+		return nil, err
+	}
+	h.Nodes = append(h.Nodes, n)
+	return n, nil
+}
+
+func (h *Harness) url(n *testutil.Node) string {
+	if h.scheme == "http" {
+		return n.HTTPURL()
+	}
+	return n.WSURL()
+}
+
+func (h *Harness) closeNodes() {
+	for _, n := range h.Nodes {
+		n.Close()
+	}
+}
+
+// headRecorder records the hashes of the heads received by a multiclient subscription.
+type headRecorder struct {
+	// from is the head number when the subscriptions are established
+	from   uint64
+	hashes map[common.Hash]bool
+	// sources are the rpc clients the heads are received from
+	sources map[*rpc.Client]bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+	lock    sync.Mutex
+}
+
+func newHeadRecorder(ctx context.Context, client *multiclient.Client, from uint64) (*headRecorder, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	ch := make(chan *multiclient.Header)
+	sub, err := client.SubscribeNewHead(ctx, ch)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	r := &headRecorder{
+		from:    from,
+		hashes:  make(map[common.Hash]bool),
+		sources: make(map[*rpc.Client]bool),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case head := <-ch:
+				r.lock.Lock()
+				r.hashes[head.Hash()] = true
+				r.sources[head.Client] = true
+				r.lock.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return r, nil
+}
+
+func (r *headRecorder) received(hash common.Hash) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.hashes[hash]
+}
+
+// pending returns the urls of the rpc clients no head is received from.
+func (r *headRecorder) pending(clients map[string]*rpc.Client) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var urls []string
+	for url, c := range clients {
+		if !r.sources[c] {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+func (r *headRecorder) stop() {
+	r.cancel()
+	<-r.done
+}
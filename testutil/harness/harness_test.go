@@ -0,0 +1,149 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package harness
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getamis/hypereth/multiclient"
+)
+
+var retryConfig = multiclient.WithRetryConfig(multiclient.RetryConfig{
+	Timeout: time.Second,
+	Delay:   10 * time.Millisecond,
+})
+
+func newHarness(t *testing.T, scheme string) *Harness {
+	h, err := New(context.Background(), Config{
+		Scheme:  scheme,
+		Options: []multiclient.Option{retryConfig},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func closeHarness(t *testing.T, h *Harness) {
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoLostHeads(t *testing.T) {
+	for _, scheme := range []string{"ws", "http"} {
+		t.Run(scheme, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t, scheme)
+			defer closeHarness(t, h)
+
+			if err := h.WatchHeads(ctx); err != nil {
+				t.Fatal(err)
+			}
+			h.Mine(3)
+			if err := h.CheckNoLostHeads(10 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestNoLostHeadsWithFailures(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t, "ws")
+	defer closeHarness(t, h)
+
+	if err := h.WatchHeads(ctx); err != nil {
+		t.Fatal(err)
+	}
+	h.Down(0)
+	h.Stale(1, 3)
+	h.Corrupt(2, "eth_getBlockByNumber", 1)
+	h.Mine(5)
+	if err := h.CheckNoLostHeads(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t, "ws")
+	defer closeHarness(t, h)
+
+	// The requests are retried on the working endpoint
+	h.Down(0)
+	h.Fail(1, "eth_getBlockByNumber", 0)
+	for i := 0; i < 10; i++ {
+		err := h.CheckSuccessWithin(ctx, 5*time.Second, func(ctx context.Context, c *multiclient.Client) error {
+			_, err := c.HeaderByNumber(ctx, nil)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The requests fail if all endpoints fail
+	h.Fail(2, "eth_getBlockByNumber", 0)
+	err := h.CheckSuccessWithin(ctx, 5*time.Second, func(ctx context.Context, c *multiclient.Client) error {
+		_, err := c.HeaderByNumber(ctx, nil)
+		return err
+	})
+	if err == nil {
+		t.Fatal("no error with all endpoints failing")
+	}
+}
+
+func TestRetrydial(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t, "ws")
+	defer closeHarness(t, h)
+
+	// The endpoint fails to dial when it's discovered
+	h.RemoveEndpoint(0)
+	h.Down(0)
+	h.AddEndpoint(0)
+	if err := h.Up(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// It's dialed again in the next round, e.g. triggered by a new endpoint
+	if _, err := h.AddNode(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(15 * time.Second)
+	for h.Client.ClientMap().Get(h.URL(0)) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("endpoint is not dialed again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The heads of the redialed endpoint are received
+	if err := h.WatchHeads(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(h.Nodes); i++ {
+		h.Down(i)
+	}
+	h.Mine(3)
+	if err := h.CheckNoLostHeads(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
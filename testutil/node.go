@@ -0,0 +1,451 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package testutil
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	// nodeName is the client name of the fake node and its peers.
+	nodeName = "Geth/v1.8.21-stable/linux-amd64/go1.11"
+	// p2pPort is the advertised port of the fake node, nothing listens on it.
+	p2pPort = 30303
+)
+
+// ErrConnectionDropped is returned by the requests which drop the connections.
+var ErrConnectionDropped = errors.New("connection dropped")
+
+// Fault is the failure injected into the JSON-RPC methods of a node.
+type Fault struct {
+	// Latency delays the response.
+	Latency time.Duration
+	// Err is returned as the JSON-RPC error with code -32000. Set to nil means the
+	// request succeeds after the latency.
+	Err error
+	// Drop closes all HTTP and websocket connections of the node before responding.
+	Drop bool
+	// Corrupt replaces the result of the response with a value of the wrong type. The
+	// notifications of the subscriptions match "eth_subscription". The other fields are
+	// ignored if it's set.
+	Corrupt bool
+	// Count is the number of requests to fail. Set to 0 means until the fault is
+	// cleared.
+	Count int
+}
+
+type faultRule struct {
+	pattern string
+	fault   Fault
+}
+
+// Node is a fake Ethereum node serving the JSON-RPC APIs of a chain over HTTP and
+// websocket on the same port. The eth, net, admin, txpool, debug, istanbul and miner
+// namespaces are supported.
+type Node struct {
+	chain  *Chain
+	key    *ecdsa.PrivateKey
+	server *rpc.Server
+
+	// addr is the listening address, kept across restarts
+	addr       string
+	httpServer *http.Server
+	conns      map[net.Conn]struct{}
+
+	faults    []*faultRule
+	lag       uint64
+	peers     []*p2p.PeerInfo
+	metrics   map[string]interface{}
+	proposals map[common.Address]bool
+	mining    bool
+
+	lock sync.Mutex
+}
+
+// NewNode creates a node serving the chain. The node is not listening until Start.
+func NewNode(chain *Chain) (*Node, error) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		chain:     chain,
+		key:       key,
+		server:    rpc.NewServer(),
+		conns:     make(map[net.Conn]struct{}),
+		metrics:   make(map[string]interface{}),
+		proposals: make(map[common.Address]bool),
+	}
+	apis := map[string]interface{}{
+		"eth":      &EthAPI{n},
+		"net":      &NetAPI{n},
+		"admin":    &AdminAPI{n},
+		"txpool":   &TxPoolAPI{n},
+		"debug":    &DebugAPI{n},
+		"istanbul": &IstanbulAPI{n},
+		"miner":    &MinerAPI{n},
+	}
+	for namespace, api := range apis {
+		if err := n.server.RegisterName(namespace, api); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// Start listens on a random local port, or the previous port after Stop to simulate a
+// restart.
+func (n *Node) Start() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.httpServer != nil {
+		return nil
+	}
+	addr := n.addr
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	n.addr = listener.Addr().String()
+
+	ws := n.websocketHandler()
+	n.httpServer = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+				ws.ServeHTTP(w, r)
+				return
+			}
+			n.serveHTTP(w, r)
+		}),
+		ConnState: n.trackConn,
+	}
+	// The idle connections would be stale in the clients after restarts
+	n.httpServer.SetKeepAlivesEnabled(false)
+	go n.httpServer.Serve(listener)
+	return nil
+}
+
+// Stop closes the listener and all connections. The node can be started again.
+func (n *Node) Stop() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.httpServer == nil {
+		return
+	}
+	n.httpServer.Close()
+	n.httpServer = nil
+	n.dropConnections()
+}
+
+// Close stops the node and the JSON-RPC server, including the in-process clients.
+func (n *Node) Close() {
+	n.Stop()
+	n.server.Stop()
+}
+
+// HTTPURL returns the HTTP endpoint of the node.
+func (n *Node) HTTPURL() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return "http://" + n.addr
+}
+
+// WSURL returns the websocket endpoint of the node.
+func (n *Node) WSURL() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return "ws://" + n.addr
+}
+
+// Attach returns an in-process client of the node. The in-process clients are not
+// affected by Stop and the dropped connections.
+func (n *Node) Attach() *rpc.Client {
+	return rpc.DialInProc(n.server)
+}
+
+// Chain returns the chain served by the node.
+func (n *Node) Chain() *Chain {
+	return n.chain
+}
+
+// Enode returns the enode of the node.
+func (n *Node) Enode() *enode.Node {
+	return enode.NewV4(&n.key.PublicKey, net.IPv4(127, 0, 0, 1), p2pPort, p2pPort)
+}
+
+// SetFault injects the fault into the methods matching the pattern in the syntax of
+// path.Match, e.g. "eth_*". The subscriptions match "eth_subscribe". The latest fault
+// takes precedence over the previous ones.
+func (n *Node) SetFault(pattern string, f Fault) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.faults = append([]*faultRule{{pattern: pattern, fault: f}}, n.faults...)
+}
+
+// ClearFaults removes all faults.
+func (n *Node) ClearFaults() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.faults = nil
+}
+
+// Lag returns the number of blocks the node lags behind the chain.
+func (n *Node) Lag() uint64 {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.lag
+}
+
+// SetLag makes the node lag the given number of blocks behind the chain to serve the
+// stale heads. The blocks after the stale head are not found.
+func (n *Node) SetLag(blocks uint64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.lag = blocks
+}
+
+// DropConnections closes all HTTP and websocket connections of the node, which makes
+// the in-flight requests and the subscriptions fail.
+func (n *Node) DropConnections() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.dropConnections()
+}
+
+// Peers returns the peers of the node.
+func (n *Node) Peers() []*p2p.PeerInfo {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return append([]*p2p.PeerInfo{}, n.peers...)
+}
+
+// AddPeer adds the node as a peer. It's ignored if the node is already a peer.
+func (n *Node) AddPeer(node *enode.Node) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	id := node.ID().String()
+	for _, p := range n.peers {
+		if p.ID == id {
+			return
+		}
+	}
+	info := &p2p.PeerInfo{
+		Enode: node.String(),
+		ID:    id,
+		Name:  nodeName,
+		Caps:  []string{"eth/63"},
+		Protocols: map[string]interface{}{
+			"eth": map[string]interface{}{
+				"version":    63,
+				"difficulty": n.chain.Head().NumberU64() + 1,
+				"head":       n.chain.Head().Hash(),
+			},
+		},
+	}
+	info.Network.LocalAddress = fmt.Sprintf("127.0.0.1:%d", p2pPort)
+	info.Network.RemoteAddress = fmt.Sprintf("%v:%d", node.IP(), node.TCP())
+	n.peers = append(n.peers, info)
+}
+
+// RemovePeer removes the peer of the node ID.
+func (n *Node) RemovePeer(id enode.ID) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for i, p := range n.peers {
+		if p.ID == id.String() {
+			n.peers = append(n.peers[:i], n.peers[i+1:]...)
+			return
+		}
+	}
+}
+
+// NodeInfo returns the node information with the network ID, genesis and head of the
+// chain in the eth protocol.
+func (n *Node) NodeInfo() *p2p.NodeInfo {
+	node := n.Enode()
+	head := n.chain.Head()
+	info := &p2p.NodeInfo{
+		ID:         node.ID().String(),
+		Name:       nodeName,
+		Enode:      node.String(),
+		IP:         node.IP().String(),
+		ListenAddr: fmt.Sprintf("[::]:%d", p2pPort),
+		Protocols: map[string]interface{}{
+			"eth": map[string]interface{}{
+				"network":    n.chain.NetworkID(),
+				"difficulty": head.NumberU64() + 1,
+				"genesis":    n.chain.Genesis().Hash(),
+				"head":       head.Hash(),
+				"config":     map[string]interface{}{"chainId": n.chain.ChainID()},
+			},
+		},
+	}
+	info.Ports.Discovery = p2pPort
+	info.Ports.Listener = p2pPort
+	return info
+}
+
+// Metrics returns the metrics returned by debug_metrics.
+func (n *Node) Metrics() map[string]interface{} {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.metrics
+}
+
+// SetMetrics sets the metrics returned by debug_metrics.
+func (n *Node) SetMetrics(metrics map[string]interface{}) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.metrics = metrics
+}
+
+// Proposals returns the validator proposals made by istanbul_propose.
+func (n *Node) Proposals() map[common.Address]bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	proposals := make(map[common.Address]bool, len(n.proposals))
+	for addr, auth := range n.proposals {
+		proposals[addr] = auth
+	}
+	return proposals
+}
+
+// Mining reports whether the node is started mining by miner_start.
+func (n *Node) Mining() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.mining
+}
+
+func (n *Node) propose(addr common.Address, auth bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.proposals[addr] = auth
+}
+
+func (n *Node) setMining(mining bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.mining = mining
+}
+
+// fault applies the fault of the method.
+func (n *Node) fault(ctx context.Context, method string) error {
+	f, ok := n.match(method, false)
+	if !ok {
+		return nil
+	}
+	if f.Latency > 0 {
+		select {
+		case <-time.After(f.Latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if f.Drop {
+		n.DropConnections()
+		return ErrConnectionDropped
+	}
+	return f.Err
+}
+
+// corrupt reports whether the response of the method should be corrupt.
+func (n *Node) corrupt(method string) bool {
+	_, ok := n.match(method, true)
+	return ok
+}
+
+// match returns the latest fault of the method, and consumes its count.
+func (n *Node) match(method string, corrupt bool) (Fault, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for i, r := range n.faults {
+		if r.fault.Corrupt != corrupt {
+			continue
+		}
+		if ok, _ := path.Match(r.pattern, method); !ok {
+			continue
+		}
+		f := r.fault
+		if r.fault.Count > 0 {
+			r.fault.Count--
+			if r.fault.Count == 0 {
+				n.faults = append(n.faults[:i], n.faults[i+1:]...)
+			}
+		}
+		return f, true
+	}
+	return Fault{}, false
+}
+
+// trackConn tracks the connections to drop. The hijacked websocket connections are
+// kept until they are dropped.
+func (n *Node) trackConn(conn net.Conn, state http.ConnState) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	switch state {
+	case http.StateNew:
+		n.conns[conn] = struct{}{}
+	case http.StateClosed:
+		delete(n.conns, conn)
+	}
+}
+
+func (n *Node) dropConnections() {
+	for conn := range n.conns {
+		conn.Close()
+		delete(n.conns, conn)
+	}
+}
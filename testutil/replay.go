@@ -0,0 +1,236 @@
+// Copyright 2019 AMIS Technologies
+// This file is part of the hypereth library.
+//
+// The hypereth library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The hypereth library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the hypereth library. If not, see <http://www.gnu.org/licenses/>.
+
+package testutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/getamis/hypereth/ethclient"
+)
+
+// replayMessage is the fields of the JSON-RPC requests and responses to replay.
+type replayMessage struct {
+	Version string                   `json:"jsonrpc"`
+	ID      json.RawMessage          `json:"id,omitempty"`
+	Method  string                   `json:"method,omitempty"`
+	Params  json.RawMessage          `json:"params,omitempty"`
+	Result  json.RawMessage          `json:"result,omitempty"`
+	Error   *ethclient.RecordedError `json:"error,omitempty"`
+}
+
+// Replayer serves the calls recorded by ethclient.Recorder over HTTP deterministically.
+// The calls are matched by the method and params. The calls of the same method and
+// params are served in the recorded order, and the last one is repeated after all are
+// served. The calls recorded from multiple endpoints are served together, so filter
+// them by the endpoint to replay an endpoint only.
+type Replayer struct {
+	// calls are the recorded calls keyed by the method and params
+	calls map[string][]ethclient.RecordedCall
+	// served is the number of served calls keyed by the method and params
+	served    map[string]int
+	unmatched []string
+	latency   bool
+
+	addr       string
+	httpServer *http.Server
+	lock       sync.Mutex
+}
+
+// NewReplayer creates a replayer of the calls. The replayer is not listening until
+// Start.
+func NewReplayer(calls []ethclient.RecordedCall) *Replayer {
+	r := &Replayer{
+		calls:  make(map[string][]ethclient.RecordedCall),
+		served: make(map[string]int),
+	}
+	for _, c := range calls {
+		key := replayKey(c.Method, c.Params)
+		r.calls[key] = append(r.calls[key], c)
+	}
+	return r
+}
+
+// NewReplayerFromFile creates a replayer of the calls in the recording file.
+func NewReplayerFromFile(path string) (*Replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	calls, err := ethclient.ReadRecording(f)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayer(calls), nil
+}
+
+// SetLatency delays the responses by the recorded elapsed time if enabled. The calls
+// of a batch are delayed by the slowest one.
+func (r *Replayer) SetLatency(enabled bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.latency = enabled
+}
+
+// Unmatched returns the methods of the requests without recorded calls, which are
+// failed with the JSON-RPC error code -32000.
+func (r *Replayer) Unmatched() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]string{}, r.unmatched...)
+}
+
+// Start listens on a random local port.
+func (r *Replayer) Start() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.httpServer != nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	r.addr = listener.Addr().String()
+	r.httpServer = &http.Server{Handler: r}
+	go r.httpServer.Serve(listener)
+	return nil
+}
+
+// Close stops listening.
+func (r *Replayer) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.httpServer != nil {
+		r.httpServer.Close()
+		r.httpServer = nil
+	}
+}
+
+// URL returns the HTTP endpoint of the replayer.
+func (r *Replayer) URL() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return "http://" + r.addr
+}
+
+// ServeHTTP replays the recorded calls of a single or batch request. The request fails
+// with 502 Bad Gateway if any call failed in the transport when recorded.
+func (r *Replayer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body = bytes.TrimSpace(body)
+	batch := len(body) > 0 && body[0] == '['
+	var reqs []replayMessage
+	if batch {
+		err = json.Unmarshal(body, &reqs)
+	} else {
+		reqs = make([]replayMessage, 1)
+		err = json.Unmarshal(body, &reqs[0])
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resps := make([]replayMessage, len(reqs))
+	var delay time.Duration
+	for i, m := range reqs {
+		call, ok := r.next(m.Method, m.Params)
+		resps[i] = replayMessage{Version: "2.0", ID: m.ID}
+		switch {
+		case !ok:
+			resps[i].Error = &ethclient.RecordedError{
+				Code:    -32000,
+				Message: fmt.Sprintf("no recorded call of %s", m.Method),
+			}
+		case call.Error != nil && call.Error.Code == 0:
+			http.Error(w, call.Error.Message, http.StatusBadGateway)
+			return
+		case call.Error != nil:
+			resps[i].Error = call.Error
+		case call.Result == nil:
+			resps[i].Result = json.RawMessage("null")
+		default:
+			resps[i].Result = call.Result
+		}
+		if call.Elapsed > delay {
+			delay = call.Elapsed
+		}
+	}
+
+	r.lock.Lock()
+	latency := r.latency
+	r.lock.Unlock()
+	if latency {
+		time.Sleep(delay)
+	}
+
+	w.Header().Set("content-type", "application/json")
+	if batch {
+		json.NewEncoder(w).Encode(resps)
+	} else {
+		json.NewEncoder(w).Encode(resps[0])
+	}
+}
+
+// next returns the next recorded call of the method and params.
+func (r *Replayer) next(method string, params json.RawMessage) (ethclient.RecordedCall, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := replayKey(method, params)
+	calls := r.calls[key]
+	if len(calls) == 0 {
+		r.unmatched = append(r.unmatched, method)
+		return ethclient.RecordedCall{}, false
+	}
+	i := r.served[key]
+	if i >= len(calls) {
+		i = len(calls) - 1
+	}
+	r.served[key] = i + 1
+	return calls[i], true
+}
+
+// replayKey returns the key of the method and the compacted params.
+func replayKey(method string, params json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, params); err != nil || buf.String() == "null" {
+		buf.Reset()
+		buf.WriteString("[]")
+	}
+	return method + buf.String()
+}